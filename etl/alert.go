@@ -0,0 +1,129 @@
+package etl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+// Events that the alert webhook is notified of.
+const (
+	AlertDayFailed    = "day_failed"
+	AlertRunCompleted = "run_completed"
+)
+
+const (
+	defaultAlertWebhookTimeout = 10 * time.Second
+	alertWebhookAttempts       = 3
+	alertWebhookRetryDelay     = 2 * time.Second
+)
+
+// AlertPayload is the JSON body POSTed to the alert webhook.
+type AlertPayload struct {
+	// Either day_failed or run_completed.
+	Event string
+	// Day that failed and its feeds. Only set for day_failed.
+	Day     *metadata.Day `json:",omitempty"`
+	FeedIDs []string      `json:",omitempty"`
+	Error   string        `json:",omitempty"`
+	// Number of days that were run and that failed. Only set for run_completed.
+	NumDays    int
+	NumFailed  int
+	FailedDays []metadata.Day `json:",omitempty"`
+}
+
+// alerter posts alerts to the webhook in the config, if there is one.
+//
+// Alerts are sent in the background so that a slow webhook does not hold up the pipeline.
+// Each request has a timeout and is retried a few times; failures are only logged.
+type alerter struct {
+	url    string
+	client *http.Client
+	// Delay before the first retry; later retries wait proportionally longer.
+	retryDelay time.Duration
+	wg         sync.WaitGroup
+}
+
+func newAlerter(ec *config.Config) *alerter {
+	if ec.AlertWebhookUrl == "" {
+		return nil
+	}
+	timeout := defaultAlertWebhookTimeout
+	if ec.AlertWebhookTimeoutSeconds > 0 {
+		timeout = time.Duration(ec.AlertWebhookTimeoutSeconds) * time.Second
+	}
+	return &alerter{
+		url:        ec.AlertWebhookUrl,
+		client:     &http.Client{Timeout: timeout},
+		retryDelay: alertWebhookRetryDelay,
+	}
+}
+
+// send sends the alert in the background. A nil alerter sends nothing.
+func (a *alerter) send(ctx context.Context, payload AlertPayload) {
+	if a == nil {
+		return
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		if err := a.post(ctx, payload); err != nil {
+			log.Printf("Failed to send %s alert to the webhook: %s", payload.Event, err)
+		}
+	}()
+}
+
+// wait waits for all alerts to be sent.
+func (a *alerter) wait() {
+	if a == nil {
+		return
+	}
+	a.wg.Wait()
+}
+
+func (a *alerter) post(ctx context.Context, payload AlertPayload) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for attempt := 0; attempt < alertWebhookAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(a.retryDelay * time.Duration(attempt)):
+			}
+		}
+		lastErr = a.postOnce(ctx, b)
+		if lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+func (a *alerter) postOnce(ctx context.Context, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+	return nil
+}
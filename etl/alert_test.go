@@ -0,0 +1,118 @@
+package etl
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+func TestAlerter(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		statuses     []int
+		wantRequests int
+		wantErr      bool
+	}{
+		{"success", []int{200}, 1, false},
+		{"retried", []int{500, 503, 204}, 3, false},
+		{"all attempts fail", []int{500, 500, 500, 200}, alertWebhookAttempts, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var m sync.Mutex
+			var payloads []AlertPayload
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				m.Lock()
+				defer m.Unlock()
+				if got := r.Header.Get("Content-Type"); got != "application/json" {
+					t.Errorf("Content-Type = %q, want application/json", got)
+				}
+				var payload AlertPayload
+				if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+					t.Errorf("failed to decode alert: %s", err)
+				}
+				payloads = append(payloads, payload)
+				w.WriteHeader(tc.statuses[len(payloads)-1])
+			}))
+			defer server.Close()
+			a := newAlerter(&config.Config{AlertWebhookUrl: server.URL})
+			a.retryDelay = time.Millisecond
+
+			day := metadata.NewDay(2023, time.March, 1)
+			err := a.post(context.Background(), AlertPayload{
+				Event:   AlertDayFailed,
+				Day:     &day,
+				FeedIDs: []string{"nycsubway_L"},
+				Error:   "processing failed",
+			})
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("post() error = %v, want error: %t", err, tc.wantErr)
+			}
+			if len(payloads) != tc.wantRequests {
+				t.Fatalf("webhook received %d request(s), want %d", len(payloads), tc.wantRequests)
+			}
+			for _, payload := range payloads {
+				if payload.Event != AlertDayFailed || payload.Day == nil || *payload.Day != day {
+					t.Errorf("webhook received %+v", payload)
+				}
+			}
+		})
+	}
+}
+
+func TestNilAlerter(t *testing.T) {
+	a := newAlerter(&config.Config{})
+	if a != nil {
+		t.Fatalf("newAlerter() without a webhook URL = %+v, want nil", a)
+	}
+	// A nil alerter sends nothing.
+	a.send(context.Background(), AlertPayload{Event: AlertRunCompleted})
+	a.wait()
+}
+
+type recordingObserver struct {
+	finished []metadata.Day
+}
+
+func (o *recordingObserver) BacklogSize(int) {}
+
+func (o *recordingObserver) DayFinished(day metadata.Day, _ time.Duration, _ error) {
+	o.finished = append(o.finished, day)
+}
+
+func TestRunPendingDaysDryRun(t *testing.T) {
+	var m sync.Mutex
+	numRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		numRequests++
+	}))
+	defer server.Close()
+	pendingDays := []config.PendingDay{
+		{Day: metadata.NewDay(2023, time.March, 1), FeedIDs: []string{"nycsubway_L"}},
+		{Day: metadata.NewDay(2023, time.March, 2), FeedIDs: []string{"nycsubway_L"}},
+	}
+	var observer recordingObserver
+	// In dry-run mode no day is processed, so neither the config nor the storage client is used
+	// beyond the alert webhook.
+	err := runPendingDays(context.Background(), pendingDays, nil, 1, true, &observer,
+		&config.Config{AlertWebhookUrl: server.URL}, nil, nil)
+	if err != nil {
+		t.Errorf("runPendingDays() in dry-run mode = %s, want nil", err)
+	}
+	if len(observer.finished) != 0 {
+		t.Errorf("observer was notified of %v, want no days", observer.finished)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if numRequests != 0 {
+		t.Errorf("webhook received %d request(s) in dry-run mode, want 0", numRequests)
+	}
+}
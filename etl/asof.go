@@ -0,0 +1,83 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jamespfennell/gtfs"
+	"github.com/jamespfennell/gtfs/journal"
+	hconfig "github.com/jamespfennell/hoard/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+type AsOfOptions struct {
+	// Only feed messages created at or before this time are used.
+	Time time.Time
+	// If non-empty, a directory with one subdirectory of GTFS-RT files per feed to use as input
+	// instead of downloading the data from Hoard.
+	InputDir string
+	// Path on disk to write the tar.xz CSV archive to.
+	OutputPath string
+}
+
+// AsOf reconstructs the CSV export of the day as it would have been built at the as-of time,
+// using only the feed messages created by then, and writes it to disk.
+//
+// Nothing is written to object storage, the metadata is not updated and no journal dump is
+// written.
+func AsOf(ctx context.Context, day metadata.Day, feedIDs []string, opts AsOfOptions, ec *config.Config, hc *hconfig.Config, sc *storage.Client) error {
+	if opts.OutputPath == "" {
+		return fmt.Errorf("an output path is required")
+	}
+	if start := day.Start(ec.Timezone.AsLoc()); opts.Time.Before(start) {
+		return fmt.Errorf("as-of time %s is before the start of %s", opts.Time.Format(time.RFC3339), day)
+	}
+	ecCopy := *ec
+	ecCopy.JournalDumpDir = ""
+	ecCopy.UploadJournalDump = false
+	log.Printf("%s: reconstructing the day as of %s", day, opts.Time.Format(time.RFC3339))
+	return run(ctx, day, feedIDs, runOptions{
+		preliminary: true,
+		inputDir:    opts.InputDir,
+		noUpload:    true,
+		asOf:        opts.Time,
+		outputPath:  opts.OutputPath,
+	}, &ecCopy, hc, sc)
+}
+
+// ParseAsOfTime parses an as-of time for the day. The time is either a time of day (HH:MM or
+// HH:MM:SS) in the config's timezone, or a full RFC 3339 timestamp.
+func ParseAsOfTime(day metadata.Day, s string, ec *config.Config) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			continue
+		}
+		start := day.Start(ec.Timezone.AsLoc())
+		return time.Date(start.Year(), start.Month(), start.Day(), t.Hour(), t.Minute(), t.Second(), 0, start.Location()), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid as-of time %q: expected HH:MM, HH:MM:SS or an RFC 3339 timestamp", s)
+}
+
+// asOfSource is a GTFS-RT source that skips the feed messages of the wrapped source created
+// after the as-of time.
+type asOfSource struct {
+	source journal.GtfsrtSource
+	asOf   time.Time
+}
+
+func (s *asOfSource) Next() *gtfs.Realtime {
+	for {
+		feedMessage := s.source.Next()
+		if feedMessage == nil || !feedMessage.CreatedAt.After(s.asOf) {
+			return feedMessage
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	hconfig "github.com/jamespfennell/hoard/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+// Steps of a run that are timed by the benchmark command.
+const (
+	stepDownload = "download"
+	stepParse    = "parse"
+	stepMerge    = "merge"
+	stepExport   = "export"
+	stepUpload   = "upload"
+)
+
+// stepTimer records the time taken by each step of a run. A nil timer records nothing.
+type stepTimer struct {
+	steps   []BenchmarkStep
+	current string
+	started time.Time
+}
+
+// begin ends the current step, if any, and starts the named step.
+func (t *stepTimer) begin(name string) {
+	if t == nil {
+		return
+	}
+	t.end()
+	t.current = name
+	t.started = time.Now()
+}
+
+// end ends the current step, if any.
+func (t *stepTimer) end() {
+	if t == nil || t.current == "" {
+		return
+	}
+	t.steps = append(t.steps, BenchmarkStep{
+		Name:    t.current,
+		Seconds: time.Since(t.started).Seconds(),
+	})
+	t.current = ""
+}
+
+type BenchmarkOptions struct {
+	// If non-empty, a directory with one subdirectory of GTFS-RT files per feed to use as input
+	// instead of downloading the data from Hoard.
+	InputDir string
+	// Whether to skip uploading the archives and updating the metadata.
+	NoUpload bool
+	Output   OutputFormat
+}
+
+// Benchmark runs the ETL pipeline for the day and reports the time taken by each step.
+//
+// With NoUpload, nothing is written to object storage, including journal dumps.
+func Benchmark(ctx context.Context, day metadata.Day, opts BenchmarkOptions, ec *config.Config, hc *hconfig.Config, sc *storage.Client) error {
+	feedIDs := config.FeedIDsForDay(ec.ActiveFeeds(), day)
+	if len(feedIDs) == 0 {
+		return fmt.Errorf("no feeds are active on %s", day)
+	}
+	if opts.NoUpload {
+		ecCopy := *ec
+		ecCopy.UploadJournalDump = false
+		ec = &ecCopy
+	}
+	timer := &stepTimer{}
+	startedAt := time.Now()
+	if err := run(ctx, day, feedIDs, runOptions{
+		inputDir: opts.InputDir,
+		noUpload: opts.NoUpload,
+		timer:    timer,
+	}, ec, hc, sc); err != nil {
+		return err
+	}
+	report := BenchmarkReport{
+		Day:          day,
+		FeedIDs:      feedIDs,
+		Uploaded:     !opts.NoUpload,
+		Steps:        timer.steps,
+		TotalSeconds: time.Since(startedAt).Seconds(),
+	}
+	if opts.Output == OutputJson {
+		return writeJson(report)
+	}
+	fmt.Printf("%-10s %12s %7s\n", "step", "time", "share")
+	for _, step := range report.Steps {
+		fmt.Printf("%-10s %12s %6.1f%%\n", step.Name, formatSeconds(step.Seconds), 100*step.Seconds/report.TotalSeconds)
+	}
+	fmt.Printf("%-10s %12s\n", "total", formatSeconds(report.TotalSeconds))
+	return nil
+}
+
+func formatSeconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond).String()
+}
@@ -0,0 +1,75 @@
+package etl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/export"
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+	"github.com/jamespfennell/xz"
+)
+
+// uploadChangesCsv uploads an archive of the trips that changed relative to the version of the
+// day currently in the metadata, and returns it. If the day has not been processed before there
+// is nothing to compare against and nil is returned.
+func uploadChangesCsv(ctx context.Context, day metadata.Day, csvTarBytes []byte, tag string, exportOpts export.Options,
+	ec *config.Config, sc *storage.Client) (*metadata.ChangesArtifact, error) {
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	var previous *metadata.ProcessedDay
+	for i := range m.ProcessedDays {
+		if m.ProcessedDays[i].Day == day {
+			previous = &m.ProcessedDays[i]
+		}
+	}
+	if previous == nil {
+		log.Printf("%s: not creating changes archive as the day has not been processed before", day)
+		return nil, nil
+	}
+	previousBytes, err := sc.Read(ctx, previous.Csv.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read previous CSV archive: %w", err)
+	}
+	previousTarBytes, err := io.ReadAll(xz.NewReader(bytes.NewReader(previousBytes)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress previous CSV archive: %w", err)
+	}
+	changesTarBytes, changeStats, err := export.ExportChanges(previousTarBytes, csvTarBytes, fmt.Sprintf("%s%s_changes_", ec.RemotePrefix, day), exportOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export changed trips: %w", err)
+	}
+	log.Printf("%s: %d trips added, %d removed and %d changed since %s", day, changeStats.Added, changeStats.Removed, changeStats.Changed, previous.Created)
+	changesBytes, err := export.Compress(changesTarBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress changes export: %w", err)
+	}
+	if err := checkArchiveSize(ec, day, "changes_csv.tar.xz", changesBytes); err != nil {
+		return nil, err
+	}
+	changesSha256, err := calculateSha256(changesBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate SHA-256 hash of changes upload: %w", err)
+	}
+	target := archiveKey(ec, day, "changes_csv", changesSha256, tag, "tar.xz")
+	if err := sc.Write(ctx, changesBytes, target); err != nil {
+		return nil, fmt.Errorf("failed to copy changes csv bytes to object storage: %w", err)
+	}
+	return &metadata.ChangesArtifact{
+		Artifact: metadata.Artifact{
+			Size:     int64(len(changesBytes)),
+			Path:     target,
+			Checksum: changesSha256,
+		},
+		Since:   previous.Created,
+		Added:   changeStats.Added,
+		Removed: changeStats.Removed,
+		Changed: changeStats.Changed,
+	}, nil
+}
@@ -0,0 +1,56 @@
+package etl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+// findMessageGaps returns the periods of the service day longer than the threshold in which a
+// feed has no GTFS-RT messages.
+//
+// Message times are the modification times of the files downloaded from Hoard, which are the
+// times Hoard fetched them. The start and end of the day count as boundaries, so a feed whose
+// messages start late or stop early has a gap at the start or end of the day.
+func findMessageGaps(dir string, feedIDs []string, start, end time.Time, threshold time.Duration) ([]metadata.MessageGap, error) {
+	var gaps []metadata.MessageGap
+	for _, feedID := range feedIDs {
+		files, err := os.ReadDir(filepath.Join(dir, feedID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list messages of feed %s: %w", feedID, err)
+		}
+		times := []time.Time{start}
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), ".gtfsrt") {
+				continue
+			}
+			info, err := file.Info()
+			if err != nil {
+				return nil, err
+			}
+			if info.ModTime().Before(start) || end.Before(info.ModTime()) {
+				continue
+			}
+			times = append(times, info.ModTime())
+		}
+		times = append(times, end)
+		sort.Slice(times, func(i, j int) bool {
+			return times[i].Before(times[j])
+		})
+		for i := 1; i < len(times); i++ {
+			if times[i].Sub(times[i-1]) > threshold {
+				gaps = append(gaps, metadata.MessageGap{
+					FeedID: feedID,
+					Start:  times[i-1],
+					End:    times[i],
+				})
+			}
+		}
+	}
+	return gaps, nil
+}
@@ -1,8 +1,17 @@
 package config
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jamespfennell/subwaydata.nyc/metadata"
@@ -36,6 +45,755 @@ type Config struct {
 
 	// Path within object storage to the JSON metadata file.
 	MetadataPath string
+
+	// Maximum number of trips to hold in memory while processing a day.
+	// Beyond this trips are spilled to temporary files on disk. Zero means no limit.
+	// This doesn't bound the memory used by the export: the CSV files and the archive holding them
+	// are built in memory, so a day's export needs memory for its full uncompressed CSV output.
+	MaxInMemoryTrips int
+
+	// Whether to also upload an uncompressed tar archive of the CSV files for each day,
+	// for consumers whose tooling cannot decompress xz archives.
+	UploadUncompressedCsv bool
+
+	// Whether to also upload, when a day is reprocessed, a CSV archive of only the trips that were
+	// added, removed or changed relative to the previous version of the day, for consumers that
+	// apply incremental updates.
+	UploadChangesCsv bool
+
+	// Additional buckets that all objects are copied to. Uploads to mirrors happen
+	// concurrently with uploads to the primary bucket; failures are logged but do not
+	// fail the pipeline.
+	Mirrors []Mirror
+
+	// Maximum number of uploads to object storage that can be in progress at once,
+	// across the primary bucket and all mirrors. Zero means no limit.
+	MaxConcurrentUploads int
+
+	// Maximum number of times a failed request to object storage is retried. Only transient
+	// failures are retried: timeouts, connection errors, throttling and 5xx responses. Zero means
+	// DefaultMaxRetries and a negative value disables retries.
+	MaxRetries int
+
+	// Delay before the first retry of a request to object storage, in milliseconds. The delay
+	// doubles with each retry and is randomly extended by up to 100% to spread out retries. Zero
+	// means DefaultBaseBackoff.
+	BaseBackoffMillis int
+
+	// Path on disk to a static GTFS zip file. If set, schedule-based exports like
+	// the per-route on-time performance summary are included in the CSV archive.
+	StaticGtfsPath string
+
+	// Maximum number of seconds a train can be early and still count as on time.
+	// Zero means the default of 60 seconds.
+	OnTimeEarlySeconds int
+
+	// Maximum number of seconds a train can be late and still count as on time.
+	// Zero means the default of 300 seconds.
+	OnTimeLateSeconds int
+
+	// Days that are never processed, for example because of a total feed outage.
+	SkipDays []SkipDays
+
+	// Whether to drop stop times that are outside of the service day. Trips with
+	// no stop times left in the service day are dropped entirely.
+	ClipStopTimesToDay bool
+
+	// Whether to include a README.md data dictionary in the CSV archive.
+	IncludeDataDictionary bool
+
+	// Number of feeds to build journals for concurrently within a day. Either an integer,
+	// "auto" for the number of CPUs, or a multiple of the number of CPUs like "2x".
+	// Empty means 1. Can be overridden with the --parallel-feeds flag.
+	//
+	// This is independent of the number of days processed concurrently, so up to
+	// days × feeds journals are built at once.
+	ParseConcurrency string
+
+	// Maximum number of feeds within a day whose journals are being built or are waiting to be
+	// added to the trip store. Once this many journals are outstanding, building the next one
+	// waits until the oldest has been added, which bounds memory when parsing is faster than
+	// adding trips to the store. This also caps the effective ParseConcurrency. Zero means no
+	// limit.
+	JournalBufferSize int
+
+	// Maximum size in bytes of each archive written for a day. If an archive is larger, for
+	// example because a feed bug duplicated trips, the day fails before the archive is uploaded
+	// and is marked as needing review in the dead-letter list. Zero means DefaultMaxArchiveBytes
+	// and a negative value means no limit.
+	MaxArchiveBytes int64
+
+	// Whether to include a 1-based stop_sequence column in stop_times.csv.
+	IncludeStopSequence bool
+
+	// Whether to include a travel_seconds column in stop_times.csv, the time from each stop to the
+	// next stop of the trip.
+	IncludeTravelTime bool
+
+	// Export options that override the global defaults for the trips of specific feeds, keyed by feed ID.
+	FeedExportOptions map[string]FeedExportOptions
+
+	// Permission bits of the files in the archives, in octal; e.g. "0644". Empty means 0600.
+	ArchiveFileMode string
+
+	// Modification time of the files in the CSV archive and of the readme in the GTFS-RT archive.
+	// Either "zero" for the Unix epoch or "day" for the start of the service day. Empty means zero.
+	ArchiveModTime string
+
+	// Whether to split the processed days in the metadata into one file per year. The file at
+	// MetadataPath then lists the shards, and only shards whose contents change are rewritten.
+	ShardMetadata bool
+
+	// Path to a JSON file describing the expected CSV files and columns of the export.
+	// If set, a day fails if its export does not match.
+	ExportSchemaPath string
+
+	// Path to a JSON file listing the known track identifiers, and aliases that map other values
+	// in the feeds to them. If set, the track column is normalized and trips with unknown tracks
+	// are flagged in the export stats. If empty, tracks are exported as they appear in the feeds.
+	TrackReferencePath string
+
+	// Whether to include vehicle_assignments.csv, which lists every vehicle assigned to each trip
+	// over its life. trips.csv always contains the last vehicle.
+	IncludeVehicleAssignments bool
+
+	// How vehicle IDs appear in the CSV archives: empty to export them as they are in the feeds,
+	// "omit" to drop the vehicle_id column (this can't be combined with vehicle assignments), or
+	// "hash" to replace them with an HMAC-SHA256 of the ID keyed by VehicleIDSalt. Hashes are
+	// stable within a service day, and also across days if VehicleIDHashAcrossDays is set; they
+	// change if the salt changes. The GTFS-RT archives always contain the raw IDs.
+	VehicleIDs string
+
+	// Secret salt of vehicle ID hashes. Required if VehicleIDs is "hash".
+	VehicleIDSalt string
+
+	// Whether a vehicle's hash is the same on every day, rather than only within a day.
+	VehicleIDHashAcrossDays bool
+
+	// If set, only stop times whose local clock time is in this window are exported, and trips
+	// with no stop times left are dropped. Of the form HH:MM-HH:MM; e.g., "07:00-10:00". If the
+	// end is before the start the window wraps around midnight. Each stop time is judged on its
+	// own, so trips that span a boundary of the window, including overnight trips, keep only
+	// their stop times inside the window.
+	TimeOfDayWindow string
+
+	// Whether to drop stop times that were still predictions when the train disappeared from the
+	// feed or the day ended, keeping only actuals. Trips with no stop times left are dropped.
+	DropPredictions bool
+
+	// Whether to write metadata files with a conditional put on the ETag read, so that concurrent
+	// runs don't lose each other's updates. A run whose write conflicts reads the metadata again
+	// and retries. The object storage service must support If-Match and If-None-Match on PUT.
+	MetadataConditionalWrites bool
+
+	// Whether to include provenance.json in the CSV archive, recording the dataset version, the
+	// revision of the ETL, the feed IDs and the service day.
+	IncludeProvenance bool
+
+	// Identifier of the processing run recorded in provenance.json, along with the time processing
+	// started. Usually set with the --run-id flag. If empty, the provenance is deterministic.
+	ProvenanceRunID string
+
+	// Maximum number of requests per second made to Hoard's object storage, shared by all of the
+	// days processed concurrently. Retry-After headers in Hoard's responses pause all requests.
+	// When set, the data is read with the ETL's own object storage clients rather than Hoard's
+	// retrieval code. Zero means no limit.
+	HoardRequestsPerSecond float64
+
+	// Whether to include headways.csv, which lists the time between consecutive departures at
+	// each stop, for each route and direction.
+	IncludeHeadways bool
+
+	// Whether to include stop_throughput.csv, which counts the trips of each route at each stop in
+	// each local hour.
+	IncludeStopThroughput bool
+
+	// Whether to include combined.csv, a single denormalized file with one row per stop time and
+	// the columns of the stop time's trip repeated on each row. This is convenient for tools that
+	// can't join trips.csv and stop_times.csv, but duplicates the trip data and makes the archives
+	// much larger, so it is off by default.
+	IncludeCombinedCsv bool
+
+	// Whether to include service_delivery.csv, which compares the number of trips of each route in
+	// the static schedule to the number that operated. Requires StaticGtfsPath.
+	IncludeServiceDeliveryCsv bool
+
+	// Whether to include first_last.csv, which lists the first and last departure of the service
+	// day at each stop, for each route and direction. Departures after midnight are written as
+	// 24:00:00 or later, as in GTFS.
+	IncludeFirstLastCsv bool
+
+	// If set, the trips of each day are written to <RemotePrefix><day>_journal.gob in this local
+	// directory exactly as they are passed to the export, so the export can be rerun against them
+	// with etl export-journal.
+	JournalDumpDir string
+
+	// Whether to also upload an xz-compressed journal dump of each day to object storage, next to
+	// the day's archives.
+	UploadJournalDump bool
+
+	// Whether to merge stop times within a trip that have the same stop ID, a feed artifact,
+	// keeping the most recently observed times. Either way such trips are counted in the
+	// export statistics in the metadata.
+	MergeDuplicateStopIDs bool
+
+	// If positive, a day is marked as needing review in the metadata if any feed has no messages
+	// for longer than this many minutes during the service day, including at its start and end.
+	// The gaps are logged and recorded in the metadata. Preliminary days are not checked.
+	MaxMessageGapMinutes int
+
+	// Whether to also upload one CSV archive per feed for each day, containing only the trips of
+	// that feed. They are listed separately in the metadata.
+	PerFeedArchives bool
+
+	// Terminals of routes, keyed by route ID. Trips whose direction ID seems inconsistent with
+	// the terminal they end at are counted in the export statistics in the metadata.
+	RouteTerminals map[string]RouteTerminals
+
+	// Whether to drop trips with an inconsistent direction ID instead of only counting them.
+	DropInconsistentDirections bool
+
+	// Whether to drop trips that the GTFS-RT feeds mark as canceled. Otherwise they are exported
+	// with whatever stop times they have, and is_canceled is true.
+	DropCanceledTrips bool
+
+	// If non-empty, the CSV archives include a manifest.json of file hashes signed with this
+	// base64-encoded Ed25519 key, either the 32-byte seed or the 64-byte private key.
+	ManifestSigningKey string
+
+	// Reference to the public key that consumers should verify manifest signatures with, for
+	// example a URL. Recorded in the manifest.
+	ManifestKeyID string
+
+	// Stop IDs of non-revenue stops like yards. Trips that stop at them are counted in the export
+	// statistics in the metadata.
+	NonRevenueStopIDs []string
+
+	// Whether to drop the stop times at non-revenue stops instead of only counting them. Trips
+	// are only dropped if they have no other stop times.
+	DropNonRevenueStopTimes bool
+
+	// If non-empty, a URL that the backlog, periodic and rerun-failed commands POST a JSON
+	// payload to when a day fails and when a run completes. See etl.AlertPayload.
+	AlertWebhookUrl string
+
+	// Timeout of each request to the alert webhook. Zero means 10 seconds. Failed requests are
+	// retried twice, and alerts never fail or hold up the pipeline.
+	AlertWebhookTimeoutSeconds int
+
+	// Whether to add a .preliminary tag to the object keys of preliminary archives, and to delete
+	// the archives of a preliminary day once it is processed again.
+	TagPreliminaryKeys bool
+
+	// If positive, trips whose last observation is more than this many minutes before the end of
+	// the service day are dropped as stale, and counted in the export statistics in the metadata.
+	// For a day that is not yet complete, the age is measured from the time of the run instead.
+	// Can be overridden per feed.
+	MaxTripAgeMinutes int
+
+	// Alternative names for feeds, keyed by alias with the feed ID as the value. Aliases are
+	// accepted wherever the CLI takes a feed ID, and the first alias of each feed in alphabetical
+	// order is displayed on the website in place of the feed ID.
+	FeedAliases map[string]string
+
+	// IDs or aliases of the feeds that commands process when no feeds are given on the command
+	// line. If empty, all of the feeds are processed.
+	DefaultFeeds []string
+
+	// Name and email of the identity that objects written to storage are attributed to,
+	// independent of the bucket credentials. If either is set, every object is written with a
+	// Written-By metadata entry of the form "Name <email>".
+	WriterName  string
+	WriterEmail string
+}
+
+// DefaultMaxArchiveBytes is the maximum archive size if MaxArchiveBytes is zero. It is far larger
+// than the archives of the busiest days.
+const DefaultMaxArchiveBytes = 2_000_000_000
+
+// DefaultMaxRetries and DefaultBaseBackoff are the object storage retry settings used if
+// MaxRetries and BaseBackoffMillis are zero.
+const (
+	DefaultMaxRetries  = 5
+	DefaultBaseBackoff = 200 * time.Millisecond
+)
+
+// StorageRetries returns the maximum number of retries of each request to object storage and the
+// delay before the first retry.
+func (c *Config) StorageRetries() (maxRetries int, baseBackoff time.Duration) {
+	switch {
+	case c.MaxRetries < 0:
+		maxRetries = 0
+	case c.MaxRetries == 0:
+		maxRetries = DefaultMaxRetries
+	default:
+		maxRetries = c.MaxRetries
+	}
+	baseBackoff = DefaultBaseBackoff
+	if c.BaseBackoffMillis > 0 {
+		baseBackoff = time.Duration(c.BaseBackoffMillis) * time.Millisecond
+	}
+	return maxRetries, baseBackoff
+}
+
+// MaxArchiveSize returns the maximum size in bytes of each archive. ok is false if there is no limit.
+func (c *Config) MaxArchiveSize() (limit int64, ok bool) {
+	switch {
+	case c.MaxArchiveBytes < 0:
+		return 0, false
+	case c.MaxArchiveBytes == 0:
+		return DefaultMaxArchiveBytes, true
+	default:
+		return c.MaxArchiveBytes, true
+	}
+}
+
+// ActiveFeeds returns the feeds that are processed: the default feeds, or all of the feeds if no
+// default feeds are set. The feeds are in the order of the Feeds field.
+func (c *Config) ActiveFeeds() []Feed {
+	if len(c.DefaultFeeds) == 0 {
+		return c.Feeds
+	}
+	selected := map[string]bool{}
+	for _, feedID := range c.ResolveFeedIDs(c.DefaultFeeds) {
+		selected[feedID] = true
+	}
+	var feeds []Feed
+	for _, feed := range c.Feeds {
+		if selected[feed.Id] {
+			feeds = append(feeds, feed)
+		}
+	}
+	return feeds
+}
+
+// MissingFeeds returns the IDs of the active feeds that are not in availableFeedIDs, in the order
+// of the Feeds field. It is used to check that every feed that would be processed is collected.
+func (c *Config) MissingFeeds(availableFeedIDs []string) []string {
+	available := map[string]bool{}
+	for _, feedID := range availableFeedIDs {
+		available[feedID] = true
+	}
+	var missing []string
+	for _, feed := range c.ActiveFeeds() {
+		if !available[feed.Id] {
+			missing = append(missing, feed.Id)
+		}
+	}
+	return missing
+}
+
+// ResolveFeedSet returns the feed IDs that the IDs or aliases refer to, and fails if any of them
+// is not a feed or two of them refer to the same feed.
+func (c *Config) ResolveFeedSet(s []string) ([]string, error) {
+	feedIDs := map[string]bool{}
+	for _, feed := range c.Feeds {
+		feedIDs[feed.Id] = true
+	}
+	var result []string
+	seen := map[string]string{}
+	for _, name := range s {
+		feedID := c.ResolveFeedID(name)
+		if !feedIDs[feedID] {
+			return nil, fmt.Errorf("feed %q is not in the list of feeds", name)
+		}
+		if other, ok := seen[feedID]; ok {
+			return nil, fmt.Errorf("feeds %q and %q are the same feed", other, name)
+		}
+		seen[feedID] = name
+		result = append(result, feedID)
+	}
+	return result, nil
+}
+
+// ResolveFeedID returns the feed ID that the alias refers to. If s is not an alias it is
+// returned unchanged.
+func (c *Config) ResolveFeedID(s string) string {
+	if feedID, ok := c.FeedAliases[s]; ok {
+		return feedID
+	}
+	return s
+}
+
+// ResolveFeedIDs resolves each of the aliases using ResolveFeedID.
+func (c *Config) ResolveFeedIDs(s []string) []string {
+	var feedIDs []string
+	for _, v := range s {
+		feedIDs = append(feedIDs, c.ResolveFeedID(v))
+	}
+	return feedIDs
+}
+
+// FeedNames returns the name displayed for each feed that has an alias, keyed by feed ID.
+func (c *Config) FeedNames() map[string]string {
+	var aliases []string
+	for alias := range c.FeedAliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	names := map[string]string{}
+	for _, alias := range aliases {
+		feedID := c.FeedAliases[alias]
+		if _, ok := names[feedID]; !ok {
+			names[feedID] = alias
+		}
+	}
+	return names
+}
+
+// WriterIdentity returns the value of the Written-By metadata entry of objects written to
+// storage. ok is false if neither the writer name nor email is set.
+func (c *Config) WriterIdentity() (identity string, ok bool) {
+	switch {
+	case c.WriterName == "" && c.WriterEmail == "":
+		return "", false
+	case c.WriterEmail == "":
+		return c.WriterName, true
+	case c.WriterName == "":
+		return fmt.Sprintf("<%s>", c.WriterEmail), true
+	}
+	return fmt.Sprintf("%s <%s>", c.WriterName, c.WriterEmail), true
+}
+
+// ParseTimeOfDayWindow parses the TimeOfDayWindow field into the start and end of the window,
+// as durations since midnight. ok is false if the field is empty.
+func ParseTimeOfDayWindow(s string) (start, end time.Duration, ok bool, err error) {
+	if s == "" {
+		return 0, 0, false, nil
+	}
+	startS, endS, found := strings.Cut(s, "-")
+	if !found {
+		return 0, 0, false, fmt.Errorf("invalid time of day window %q (must be of the form HH:MM-HH:MM)", s)
+	}
+	parse := func(s string) (time.Duration, error) {
+		t, err := time.Parse("15:04", s)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+	}
+	if start, err = parse(startS); err != nil {
+		return 0, 0, false, fmt.Errorf("invalid start of time of day window %q: %w", s, err)
+	}
+	if end, err = parse(endS); err != nil {
+		return 0, 0, false, fmt.Errorf("invalid end of time of day window %q: %w", s, err)
+	}
+	if start == end {
+		return 0, 0, false, fmt.Errorf("time of day window %q is empty", s)
+	}
+	return start, end, true, nil
+}
+
+const (
+	VehicleIDsOmit = "omit"
+	VehicleIDsHash = "hash"
+)
+
+const (
+	ArchiveModTimeZero = "zero"
+	ArchiveModTimeDay  = "day"
+)
+
+// ParseArchiveFileMode parses the ArchiveFileMode field. Zero is returned if the field is empty.
+func ParseArchiveFileMode(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseInt(s, 8, 64)
+	if err != nil || mode <= 0 || mode > 0777 {
+		return 0, fmt.Errorf("invalid archive file mode %q (must be octal permission bits like 0644)", s)
+	}
+	return mode, nil
+}
+
+// ParseManifestSigningKey parses the ManifestSigningKey field. ok is false if the field is empty.
+func ParseManifestSigningKey(s string) (key ed25519.PrivateKey, ok bool, err error) {
+	if s == "" {
+		return nil, false, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid manifest signing key: %w", err)
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), true, nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(b), true, nil
+	default:
+		return nil, false, fmt.Errorf("invalid manifest signing key: got %d bytes, want %d or %d", len(b), ed25519.SeedSize, ed25519.PrivateKeySize)
+	}
+}
+
+// FeedExportOptions overrides the export options for the trips of a single feed.
+//
+// Only options that apply to individual trips can be overridden; options that change the
+// columns of the CSV files apply to the whole archive.
+type FeedExportOptions struct {
+	// Overrides ClipStopTimesToDay. If null the global value is used.
+	ClipStopTimesToDay *bool
+
+	// If non-empty, only trips with one of these route IDs are exported for the feed.
+	RouteIDs []string
+
+	// Overrides MaxTripAgeMinutes. If null the global value is used; zero disables the check.
+	MaxTripAgeMinutes *int
+}
+
+// RouteTerminals is the stop IDs of the terminals that a route's trips end at in each direction.
+type RouteTerminals struct {
+	Direction0StopIDs []string
+	Direction1StopIDs []string
+}
+
+// UnmarshalJSON rejects unknown options so that typos in the config are not silently ignored.
+func (o *FeedExportOptions) UnmarshalJSON(data []byte) error {
+	type raw FeedExportOptions
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode((*raw)(o)); err != nil {
+		return fmt.Errorf("invalid feed export options: %w", err)
+	}
+	return nil
+}
+
+// Parse parses an ETL config file and validates it.
+//
+// In addition to the checks of Validate, Parse checks that the fields needed to run the pipeline
+// are set: the feeds, the timezone and the object storage settings. The error lists every problem
+// found, each naming the field it is about.
+func Parse(b []byte) (*Config, error) {
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	if err := errors.Join(append(c.checkRequired(), c.Validate())...); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// checkRequired returns an error for each field needed to run the pipeline that isn't set. It also
+// loads the location of the timezone, returning an error if the timezone is unknown.
+func (c *Config) checkRequired() []error {
+	var errs []error
+	if len(c.Feeds) == 0 {
+		errs = append(errs, fmt.Errorf("Feeds: at least one feed is required"))
+	}
+	if c.Timezone.name == "" {
+		errs = append(errs, fmt.Errorf("Timezone: required, e.g. \"America/New_York\""))
+	} else if loc, err := time.LoadLocation(c.Timezone.name); err != nil {
+		errs = append(errs, fmt.Errorf("Timezone: invalid timezone %q: %w", c.Timezone.name, err))
+	} else {
+		c.Timezone.loc = loc
+	}
+	errs = append(errs, checkBucket("", c.BucketUrl, c.BucketAccessKey, c.BucketSecretKey, c.BucketName)...)
+	if c.MetadataPath == "" {
+		errs = append(errs, fmt.Errorf("MetadataPath: required"))
+	}
+	for i, m := range c.Mirrors {
+		errs = append(errs, checkBucket(fmt.Sprintf("Mirrors[%d].", i), m.BucketUrl, m.BucketAccessKey, m.BucketSecretKey, m.BucketName)...)
+	}
+	return errs
+}
+
+// checkBucket returns an error for each missing or invalid setting of a bucket. The prefix is
+// prepended to the field names in the errors.
+func checkBucket(prefix, bucketUrl, accessKey, secretKey, name string) []error {
+	var errs []error
+	if bucketUrl == "" {
+		errs = append(errs, fmt.Errorf("%sBucketUrl: required", prefix))
+	} else if _, err := url.Parse(bucketUrl); err != nil {
+		errs = append(errs, fmt.Errorf("%sBucketUrl: invalid URL %q: %w", prefix, bucketUrl, err))
+	}
+	for _, f := range []struct{ field, value string }{
+		{"BucketAccessKey", accessKey},
+		{"BucketSecretKey", secretKey},
+		{"BucketName", name},
+	} {
+		if f.value == "" {
+			errs = append(errs, fmt.Errorf("%s%s: required", prefix, f.field))
+		}
+	}
+	return errs
+}
+
+// Validate checks that the config is internally consistent. The error lists every problem found,
+// each naming the field it is about.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(field, format string, a ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, a...)))
+	}
+	feedIDs := map[string]bool{}
+	for i, feed := range c.Feeds {
+		if feed.Id == "" {
+			add(fmt.Sprintf("Feeds[%d].Id", i), "required")
+		} else if feedIDs[feed.Id] {
+			add(fmt.Sprintf("Feeds[%d].Id", i), "duplicate feed ID %q", feed.Id)
+		}
+		feedIDs[feed.Id] = true
+	}
+	for feedID := range c.FeedExportOptions {
+		if !feedIDs[feedID] {
+			add("FeedExportOptions", "export options provided for feed %q which is not in the list of feeds", feedID)
+		}
+	}
+	lowerAliases := map[string]string{}
+	for alias, feedID := range c.FeedAliases {
+		if alias == "" {
+			add("FeedAliases", "empty alias provided for feed %q", feedID)
+			continue
+		}
+		if !feedIDs[feedID] {
+			add("FeedAliases", "alias %q provided for feed %q which is not in the list of feeds", alias, feedID)
+		}
+		if feedIDs[alias] {
+			add("FeedAliases", "alias %q is the ID of a feed", alias)
+		}
+		if other, ok := lowerAliases[strings.ToLower(alias)]; ok {
+			add("FeedAliases", "aliases %q and %q differ only by case", other, alias)
+		}
+		lowerAliases[strings.ToLower(alias)] = alias
+	}
+	switch c.VehicleIDs {
+	case "":
+	case VehicleIDsOmit:
+		if c.IncludeVehicleAssignments {
+			add("VehicleIDs", "vehicle IDs can't be omitted when vehicle assignments are included")
+		}
+	case VehicleIDsHash:
+		if c.VehicleIDSalt == "" {
+			add("VehicleIDSalt", "hashing vehicle IDs requires a vehicle ID salt")
+		}
+	default:
+		add("VehicleIDs", "invalid vehicle IDs mode %q (must be empty, %s or %s)", c.VehicleIDs, VehicleIDsOmit, VehicleIDsHash)
+	}
+	if c.IncludeServiceDeliveryCsv && c.StaticGtfsPath == "" {
+		add("StaticGtfsPath", "service delivery export requires a static GTFS file")
+	}
+	if _, err := c.ResolveFeedSet(c.DefaultFeeds); err != nil {
+		add("DefaultFeeds", "%s", err)
+	}
+	if _, err := ParseArchiveFileMode(c.ArchiveFileMode); err != nil {
+		add("ArchiveFileMode", "%s", err)
+	}
+	if _, err := ParseConcurrency(c.ParseConcurrency); err != nil {
+		add("ParseConcurrency", "%s", err)
+	}
+	if _, _, err := ParseManifestSigningKey(c.ManifestSigningKey); err != nil {
+		add("ManifestSigningKey", "%s", err)
+	}
+	if _, _, _, err := ParseTimeOfDayWindow(c.TimeOfDayWindow); err != nil {
+		add("TimeOfDayWindow", "%s", err)
+	}
+	if c.AlertWebhookUrl != "" {
+		if u, err := url.Parse(c.AlertWebhookUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			add("AlertWebhookUrl", "invalid alert webhook URL %q (must be an http or https URL)", c.AlertWebhookUrl)
+		}
+	}
+	if c.MaxTripAgeMinutes < 0 {
+		add("MaxTripAgeMinutes", "invalid max trip age %d minutes (must be non-negative)", c.MaxTripAgeMinutes)
+	}
+	for feedID, feedOpts := range c.FeedExportOptions {
+		if feedOpts.MaxTripAgeMinutes != nil && *feedOpts.MaxTripAgeMinutes < 0 {
+			add(fmt.Sprintf("FeedExportOptions[%q].MaxTripAgeMinutes", feedID), "invalid max trip age %d minutes (must be non-negative)", *feedOpts.MaxTripAgeMinutes)
+		}
+	}
+	if c.JournalBufferSize < 0 {
+		add("JournalBufferSize", "invalid journal buffer size %d (must be non-negative)", c.JournalBufferSize)
+	}
+	if c.BaseBackoffMillis < 0 {
+		add("BaseBackoffMillis", "invalid base backoff %d milliseconds (must be non-negative)", c.BaseBackoffMillis)
+	}
+	if c.HoardRequestsPerSecond < 0 {
+		add("HoardRequestsPerSecond", "invalid Hoard requests per second %v (must be non-negative)", c.HoardRequestsPerSecond)
+	}
+	switch c.ArchiveModTime {
+	case "", ArchiveModTimeZero, ArchiveModTimeDay:
+	default:
+		add("ArchiveModTime", "invalid archive mod time %q (must be %s or %s)", c.ArchiveModTime, ArchiveModTimeZero, ArchiveModTimeDay)
+	}
+	if strings.ContainsAny(c.WriterName, "<>") || !isPrintableAscii(c.WriterName) {
+		add("WriterName", "invalid writer name %q (must be printable ASCII without angle brackets)", c.WriterName)
+	}
+	if c.WriterEmail != "" && (!strings.Contains(c.WriterEmail, "@") || strings.ContainsAny(c.WriterEmail, "<> ") || !isPrintableAscii(c.WriterEmail)) {
+		add("WriterEmail", "invalid writer email %q", c.WriterEmail)
+	}
+	return errors.Join(errs...)
+}
+
+// isPrintableAscii returns whether s can be sent in an HTTP header as is.
+func isPrintableAscii(s string) bool {
+	for _, r := range s {
+		if r < ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+const maxConcurrency = 256
+
+// ParseConcurrency resolves a concurrency value.
+//
+// The value is either an integer, "auto" for the number of CPUs, or a multiple of the
+// number of CPUs like "2x". The result is clamped to between 1 and 256.
+func ParseConcurrency(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	var n int
+	switch {
+	case s == "":
+		n = 1
+	case s == "auto":
+		n = runtime.NumCPU()
+	case strings.HasSuffix(s, "x"):
+		multiple, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+		if err != nil || multiple <= 0 {
+			return 0, fmt.Errorf("invalid concurrency %q: multiple of the number of CPUs must be a positive number", s)
+		}
+		n = int(multiple * float64(runtime.NumCPU()))
+	default:
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid concurrency %q: must be an integer, \"auto\", or a multiple of the number of CPUs like \"2x\"", s)
+		}
+	}
+	if n < 1 {
+		n = 1
+	}
+	if n > maxConcurrency {
+		n = maxConcurrency
+	}
+	return n, nil
+}
+
+// SkipDays describes a range of days that should never be processed.
+type SkipDays struct {
+	FirstDay metadata.Day
+	// Last day in the range, inclusive. If nil, the range contains only the first day.
+	LastDay *metadata.Day
+	// Reason the days are skipped. This is recorded in the metadata.
+	Reason string
+}
+
+// Contains returns whether the day is in the range.
+func (s SkipDays) Contains(day metadata.Day) bool {
+	lastDay := s.FirstDay
+	if s.LastDay != nil {
+		lastDay = *s.LastDay
+	}
+	return !day.Before(s.FirstDay) && !lastDay.Before(day)
+}
+
+// Mirror describes an additional bucket that data is copied to.
+type Mirror struct {
+	BucketUrl       string
+	BucketAccessKey string
+	BucketSecretKey string
+	BucketName      string
+	BucketPrefix    string
 }
 
 type Feed struct {
@@ -49,6 +807,8 @@ type Feed struct {
 type PendingDay struct {
 	Day     metadata.Day
 	FeedIDs []string
+	// Whether the day's data isn't complete yet, in which case it is processed as preliminary.
+	Preliminary bool
 }
 
 type Timezone struct {
@@ -60,23 +820,61 @@ func (t Timezone) AsLoc() *time.Location {
 	return t.loc
 }
 
+// UnmarshalJSON only stores the name of the timezone. The location is loaded by Parse, so that an
+// unknown timezone is reported along with the config's other problems.
 func (t *Timezone) UnmarshalJSON(data []byte) error {
-	if err := json.Unmarshal(data, &t.name); err != nil {
-		return err
-	}
-	var err error
-	t.loc, err = time.LoadLocation(t.name)
-	if err != nil {
-		return err
-	}
-	return nil
+	return json.Unmarshal(data, &t.name)
 }
 
 func (t Timezone) MarshalJSON() ([]byte, error) {
 	return json.Marshal(t.name)
 }
 
-func CalculatePendingDays(feeds []Feed, processedDays []metadata.ProcessedDay, lastDay metadata.Day, softwareVersion int) []PendingDay {
+// CompletionDelay is how long after the end of a day its data is expected to be complete in Hoard.
+// The pipeline reads data up to 4 hours after the end of the day, and Hoard uploads data in batches.
+const CompletionDelay = 5 * time.Hour
+
+// LastCompleteDay returns the most recent day in the location whose data is expected to be
+// complete in Hoard at the time now, given CompletionDelay.
+//
+// The current day is never complete, so processing it as final would publish truncated data.
+func LastCompleteDay(now time.Time, loc *time.Location) metadata.Day {
+	y, m, d := now.In(loc).Add(-CompletionDelay).Date()
+	return metadata.DayOf(time.Date(y, m, d-1, 12, 0, 0, 0, loc))
+}
+
+// IncompleteDays returns the days after the last complete day, up to and including the current
+// day, on which at least one feed is active and which are not skipped. The most recent day
+// is first.
+//
+// Days that already have final data, e.g. because they were processed before CompletionDelay was
+// raised, are not returned: processing them as preliminary would replace the final data.
+func IncompleteDays(feeds []Feed, processedDays []metadata.ProcessedDay, skipDays []SkipDays, now time.Time, loc *time.Location) []PendingDay {
+	finalDays := map[metadata.Day]bool{}
+	for _, processedDay := range processedDays {
+		if !processedDay.Preliminary {
+			finalDays[processedDay.Day] = true
+		}
+	}
+	today := metadata.DayOf(now.In(loc))
+	var result []PendingDay
+	for day := LastCompleteDay(now, loc).Next(); !today.Before(day); day = day.Next() {
+		if _, skipped := SkipReason(skipDays, day); skipped {
+			continue
+		}
+		if finalDays[day] {
+			continue
+		}
+		feedIDs := FeedIDsForDay(feeds, day)
+		if len(feedIDs) == 0 {
+			continue
+		}
+		result = append([]PendingDay{{Day: day, FeedIDs: feedIDs, Preliminary: true}}, result...)
+	}
+	return result
+}
+
+func CalculatePendingDays(feeds []Feed, processedDays []metadata.ProcessedDay, skipDays []SkipDays, lastDay metadata.Day, softwareVersion int) []PendingDay {
 	upperBound := lastDay.Next()
 
 	dayToRequiredFeeds := map[metadata.Day][]string{}
@@ -100,8 +898,15 @@ func CalculatePendingDays(feeds []Feed, processedDays []metadata.ProcessedDay, l
 	result := []PendingDay{}
 	for day, requiredFeeds := range dayToRequiredFeeds {
 		requiredFeeds := requiredFeeds
+		sort.Strings(requiredFeeds)
+		if _, skipped := SkipReason(skipDays, day); skipped {
+			continue
+		}
 		processedDay := dayToProcessedDay[day]
-		if processedDay.SoftwareVersion < softwareVersion || !contains(processedDay.Feeds, requiredFeeds) {
+		if processedDay.GtfsrtPruned {
+			continue
+		}
+		if processedDay.SoftwareVersion < softwareVersion || processedDay.Preliminary || !contains(processedDay.Feeds, requiredFeeds) {
 			result = append(result, PendingDay{
 				Day:     day,
 				FeedIDs: requiredFeeds,
@@ -113,6 +918,55 @@ func CalculatePendingDays(feeds []Feed, processedDays []metadata.ProcessedDay, l
 	return result
 }
 
+// SkipReason returns the reason the day is skipped, if it is skipped.
+func SkipReason(skipDays []SkipDays, day metadata.Day) (string, bool) {
+	for _, s := range skipDays {
+		if s.Contains(day) {
+			return s.Reason, true
+		}
+	}
+	return "", false
+}
+
+// SkippedDays returns all of the skipped days from the first day of any feed up to the last day.
+func SkippedDays(feeds []Feed, skipDays []SkipDays, lastDay metadata.Day) []metadata.SkippedDay {
+	var firstDay *metadata.Day
+	for i := range feeds {
+		if firstDay == nil || feeds[i].FirstDay.Before(*firstDay) {
+			firstDay = &feeds[i].FirstDay
+		}
+	}
+	var result []metadata.SkippedDay
+	if firstDay == nil {
+		return result
+	}
+	for day := *firstDay; !lastDay.Before(day); day = day.Next() {
+		if reason, skipped := SkipReason(skipDays, day); skipped {
+			result = append(result, metadata.SkippedDay{
+				Day:    day,
+				Reason: reason,
+			})
+		}
+	}
+	return result
+}
+
+// FeedIDsForDay returns the IDs of the feeds that are active on the provided day.
+func FeedIDsForDay(feeds []Feed, day metadata.Day) []string {
+	var feedIDs []string
+	for _, feed := range feeds {
+		if day.Before(feed.FirstDay) {
+			continue
+		}
+		if feed.LastDay != nil && feed.LastDay.Before(day) {
+			continue
+		}
+		feedIDs = append(feedIDs, feed.Id)
+	}
+	sort.Strings(feedIDs)
+	return feedIDs
+}
+
 // contains checks if every element of the subset is contained in the superset
 func contains(superset, subset []string) bool {
 	supersetS := map[string]bool{}
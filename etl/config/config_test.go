@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -28,6 +30,67 @@ func TestConfig(t *testing.T) {
 	}
 }
 
+func TestFeedExportOptions(t *testing.T) {
+	var c Config
+	if err := json.Unmarshal([]byte(sampleConfig), &c); err != nil {
+		t.Fatalf("failed to parse config: %s", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("sample config is invalid: %s", err)
+	}
+
+	c.FeedExportOptions["nycsubway_ACE"] = FeedExportOptions{}
+	if err := c.Validate(); err == nil {
+		t.Errorf("expected an error for export options referencing an unknown feed")
+	}
+
+	var o FeedExportOptions
+	if err := json.Unmarshal([]byte(`{"ClipStopTimes": true}`), &o); err == nil {
+		t.Errorf("expected an error for an unknown export option")
+	}
+}
+
+func TestFeedAliases(t *testing.T) {
+	c := Config{
+		Feeds: []Feed{{Id: "nycsubway_L"}, {Id: "nycsubway_ACE"}},
+		FeedAliases: map[string]string{
+			"L":    "nycsubway_L",
+			"Line": "nycsubway_L",
+			"ACE":  "nycsubway_ACE",
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("valid aliases rejected: %s", err)
+	}
+	gotIDs := c.ResolveFeedIDs([]string{"L", "nycsubway_ACE", "unknown"})
+	wantIDs := []string{"nycsubway_L", "nycsubway_ACE", "unknown"}
+	if !reflect.DeepEqual(gotIDs, wantIDs) {
+		t.Errorf("ResolveFeedIDs() = %v, want %v", gotIDs, wantIDs)
+	}
+	gotNames := c.FeedNames()
+	wantNames := map[string]string{"nycsubway_L": "L", "nycsubway_ACE": "ACE"}
+	if !reflect.DeepEqual(gotNames, wantNames) {
+		t.Errorf("FeedNames() = %v, want %v", gotNames, wantNames)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		aliases map[string]string
+	}{
+		{"unknown feed", map[string]string{"G": "nycsubway_G"}},
+		{"alias is a feed ID", map[string]string{"nycsubway_ACE": "nycsubway_L"}},
+		{"aliases differ by case", map[string]string{"L": "nycsubway_L", "l": "nycsubway_ACE"}},
+		{"empty alias", map[string]string{"": "nycsubway_L"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c.FeedAliases = tc.aliases
+			if err := c.Validate(); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
 func TestCalculatePendingDays(t *testing.T) {
 	jan2 := metadata.NewDay(2022, time.January, 2)
 	jan3 := metadata.NewDay(2022, time.January, 3)
@@ -40,6 +103,7 @@ func TestCalculatePendingDays(t *testing.T) {
 	testCases := []struct {
 		feeds         []Feed
 		processedDays []metadata.ProcessedDay
+		skipDays      []SkipDays
 		lastDay       metadata.Day
 		wantOut       []PendingDay
 	}{
@@ -168,6 +232,55 @@ func TestCalculatePendingDays(t *testing.T) {
 			lastDay:       jan2,
 			wantOut:       []PendingDay{},
 		},
+		{
+			feeds: []Feed{
+				{
+					Id:       feedID1,
+					FirstDay: jan4,
+					LastDay:  &jan5,
+				},
+			},
+			processedDays: []metadata.ProcessedDay{
+				{
+					Day:   jan4,
+					Feeds: []string{feedID1},
+				},
+				{
+					Day:         jan5,
+					Feeds:       []string{feedID1},
+					Preliminary: true,
+				},
+			},
+			lastDay: jan5,
+			wantOut: []PendingDay{
+				{
+					Day:     jan5,
+					FeedIDs: []string{feedID1},
+				},
+			},
+		},
+		{
+			feeds: []Feed{
+				{
+					Id:       feedID1,
+					FirstDay: jan4,
+					LastDay:  &jan5,
+				},
+			},
+			processedDays: []metadata.ProcessedDay{
+				{
+					Day:          jan4,
+					Feeds:        []string{feedID1},
+					GtfsrtPruned: true,
+				},
+				{
+					Day:   jan5,
+					Feeds: []string{feedID1},
+				},
+			},
+			lastDay: jan5,
+			wantOut: []PendingDay{},
+		},
 		{
 			feeds: []Feed{
 				{
@@ -199,14 +312,290 @@ func TestCalculatePendingDays(t *testing.T) {
 				},
 			},
 		},
+		{
+			feeds: []Feed{
+				{
+					Id:       feedID1,
+					FirstDay: jan2,
+					LastDay:  nil,
+				},
+			},
+			processedDays: []metadata.ProcessedDay{},
+			skipDays: []SkipDays{
+				{FirstDay: jan2},
+				{FirstDay: jan4, LastDay: &jan5, Reason: "outage"},
+			},
+			lastDay: jan5,
+			wantOut: []PendingDay{
+				{
+					Day:     jan3,
+					FeedIDs: []string{feedID1},
+				},
+			},
+		},
 	}
 
 	for i, testCase := range testCases {
 		t.Run(fmt.Sprintf("case_%d", i), func(t *testing.T) {
-			out := CalculatePendingDays(testCase.feeds, testCase.processedDays, testCase.lastDay, 0)
+			out := CalculatePendingDays(testCase.feeds, testCase.processedDays, testCase.skipDays, testCase.lastDay, 0)
 			if !reflect.DeepEqual(out, testCase.wantOut) {
 				t.Errorf("Expected != actual. Expected:\n%+v\nActual:\n%+v", testCase.wantOut, out)
 			}
 		})
 	}
 }
+
+func TestLastCompleteDay(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("failed to load location: %s", err)
+	}
+	for _, tc := range []struct {
+		now  time.Time
+		want metadata.Day
+	}{
+		{time.Date(2023, time.March, 15, 4, 59, 0, 0, loc), metadata.NewDay(2023, time.March, 13)},
+		{time.Date(2023, time.March, 15, 5, 0, 0, 0, loc), metadata.NewDay(2023, time.March, 14)},
+		{time.Date(2023, time.March, 15, 23, 0, 0, 0, loc), metadata.NewDay(2023, time.March, 14)},
+		// Clocks go forward at 2:00 on March 12, so March 12 is 23 hours long.
+		{time.Date(2023, time.March, 13, 5, 0, 0, 0, loc), metadata.NewDay(2023, time.March, 12)},
+	} {
+		if got := LastCompleteDay(tc.now, loc); got != tc.want {
+			t.Errorf("LastCompleteDay(%s) = %s, want %s", tc.now, got, tc.want)
+		}
+	}
+
+	feeds := []Feed{{Id: "nycsubway_L", FirstDay: metadata.NewDay(2023, time.January, 1)}}
+	now := time.Date(2023, time.March, 15, 4, 0, 0, 0, loc)
+	got := IncompleteDays(feeds, nil, nil, now, loc)
+	want := []PendingDay{
+		{Day: metadata.NewDay(2023, time.March, 15), FeedIDs: []string{"nycsubway_L"}, Preliminary: true},
+		{Day: metadata.NewDay(2023, time.March, 14), FeedIDs: []string{"nycsubway_L"}, Preliminary: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("IncompleteDays() = %v, want %v", got, want)
+	}
+
+	// Preliminary data is replaced, but final data isn't.
+	processedDays := []metadata.ProcessedDay{
+		{Day: metadata.NewDay(2023, time.March, 15), Feeds: []string{"nycsubway_L"}, Preliminary: true},
+		{Day: metadata.NewDay(2023, time.March, 14), Feeds: []string{"nycsubway_L"}},
+	}
+	got = IncompleteDays(feeds, processedDays, nil, now, loc)
+	want = want[:1]
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("IncompleteDays() with processed days = %v, want %v", got, want)
+	}
+}
+
+func TestFeedOrdering(t *testing.T) {
+	jan2 := metadata.NewDay(2022, time.January, 2)
+	jan3 := metadata.NewDay(2022, time.January, 3)
+	feeds := []Feed{
+		{Id: "nycsubway_L", FirstDay: jan2},
+		{Id: "nycsubway_ACE", FirstDay: jan2},
+		{Id: "nycsubway_G", FirstDay: jan2},
+	}
+	want := []string{"nycsubway_ACE", "nycsubway_G", "nycsubway_L"}
+	for i := 0; i < 10; i++ {
+		if got := FeedIDsForDay(feeds, jan3); !reflect.DeepEqual(got, want) {
+			t.Fatalf("FeedIDsForDay() = %v, want %v", got, want)
+		}
+		for _, pendingDay := range CalculatePendingDays(feeds, nil, nil, jan3, 0) {
+			if !reflect.DeepEqual(pendingDay.FeedIDs, want) {
+				t.Fatalf("CalculatePendingDays() feeds for %s = %v, want %v", pendingDay.Day, pendingDay.FeedIDs, want)
+			}
+		}
+	}
+}
+
+func TestParseConcurrency(t *testing.T) {
+	numCPU := runtime.NumCPU()
+	testCases := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"", 1, false},
+		{"4", 4, false},
+		{"0", 1, false},
+		{"100000", maxConcurrency, false},
+		{"auto", numCPU, false},
+		{"2x", min(2*numCPU, maxConcurrency), false},
+		{"0.5x", max(numCPU/2, 1), false},
+		{"-1x", 0, true},
+		{"many", 0, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := ParseConcurrency(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseConcurrency(%q) returned error %v, wantErr=%t", tc.in, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("ParseConcurrency(%q) = %d, want %d", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriterIdentity(t *testing.T) {
+	for _, tc := range []struct {
+		name, email  string
+		wantIdentity string
+		wantOk       bool
+	}{
+		{"", "", "", false},
+		{"subwaydata-bot", "", "subwaydata-bot", true},
+		{"", "bot@subwaydata.nyc", "<bot@subwaydata.nyc>", true},
+		{"subwaydata-bot", "bot@subwaydata.nyc", "subwaydata-bot <bot@subwaydata.nyc>", true},
+	} {
+		c := Config{WriterName: tc.name, WriterEmail: tc.email}
+		if err := c.Validate(); err != nil {
+			t.Errorf("valid writer %q %q rejected: %s", tc.name, tc.email, err)
+		}
+		identity, ok := c.WriterIdentity()
+		if identity != tc.wantIdentity || ok != tc.wantOk {
+			t.Errorf("WriterIdentity() = %q, %t, want %q, %t", identity, ok, tc.wantIdentity, tc.wantOk)
+		}
+	}
+
+	for _, c := range []Config{
+		{WriterName: "bot <bot@subwaydata.nyc>"},
+		{WriterName: "bot\n"},
+		{WriterEmail: "subwaydata.nyc"},
+		{WriterEmail: "bot @subwaydata.nyc"},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected an error for writer %q %q", c.WriterName, c.WriterEmail)
+		}
+	}
+}
+
+func TestDefaultFeeds(t *testing.T) {
+	c := Config{
+		Feeds:        []Feed{{Id: "nycsubway_ACE"}, {Id: "nycsubway_L"}, {Id: "nycsubway_G"}},
+		FeedAliases:  map[string]string{"L": "nycsubway_L"},
+		DefaultFeeds: []string{"L", "nycsubway_G"},
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("valid default feeds rejected: %s", err)
+	}
+	var got []string
+	for _, feed := range c.ActiveFeeds() {
+		got = append(got, feed.Id)
+	}
+	if want := []string{"nycsubway_L", "nycsubway_G"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ActiveFeeds() = %v, want %v", got, want)
+	}
+	c.DefaultFeeds = nil
+	if got := c.ActiveFeeds(); len(got) != 3 {
+		t.Errorf("ActiveFeeds() without default feeds = %v, want all feeds", got)
+	}
+
+	for _, defaultFeeds := range [][]string{
+		{"nycsubway_7"},
+		{"L", "nycsubway_L"},
+	} {
+		c.DefaultFeeds = defaultFeeds
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected an error for default feeds %v", defaultFeeds)
+		}
+	}
+}
+
+func TestVehicleIDs(t *testing.T) {
+	for _, c := range []Config{
+		{},
+		{VehicleIDs: VehicleIDsOmit},
+		{VehicleIDs: VehicleIDsHash, VehicleIDSalt: "salt"},
+		{VehicleIDs: VehicleIDsHash, VehicleIDSalt: "salt", IncludeVehicleAssignments: true},
+	} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("valid vehicle ID mode %q rejected: %s", c.VehicleIDs, err)
+		}
+	}
+	for _, c := range []Config{
+		{VehicleIDs: "drop"},
+		{VehicleIDs: VehicleIDsHash},
+		{VehicleIDs: VehicleIDsOmit, IncludeVehicleAssignments: true},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected an error for vehicle ID mode %q", c.VehicleIDs)
+		}
+	}
+}
+
+func TestMissingFeeds(t *testing.T) {
+	c := Config{
+		Feeds: []Feed{{Id: "nycsubway_ACE"}, {Id: "nycsubway_L"}, {Id: "nycsubway_G"}},
+	}
+	if got, want := c.MissingFeeds([]string{"nycsubway_L", "nycsubway_1"}), []string{"nycsubway_ACE", "nycsubway_G"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MissingFeeds() = %v, want %v", got, want)
+	}
+	c.DefaultFeeds = []string{"nycsubway_L"}
+	if got := c.MissingFeeds([]string{"nycsubway_L"}); got != nil {
+		t.Errorf("MissingFeeds() with default feeds = %v, want none", got)
+	}
+}
+
+func TestStorageRetries(t *testing.T) {
+	testCases := []struct {
+		maxRetries, baseBackoffMillis int
+		wantMaxRetries                int
+		wantBaseBackoff               time.Duration
+	}{
+		{0, 0, DefaultMaxRetries, DefaultBaseBackoff},
+		{2, 50, 2, 50 * time.Millisecond},
+		{-1, 0, 0, DefaultBaseBackoff},
+	}
+	for _, tc := range testCases {
+		c := Config{MaxRetries: tc.maxRetries, BaseBackoffMillis: tc.baseBackoffMillis}
+		gotMaxRetries, gotBaseBackoff := c.StorageRetries()
+		if gotMaxRetries != tc.wantMaxRetries || gotBaseBackoff != tc.wantBaseBackoff {
+			t.Errorf("StorageRetries() with MaxRetries=%d, BaseBackoffMillis=%d = (%d, %s), want (%d, %s)",
+				tc.maxRetries, tc.baseBackoffMillis, gotMaxRetries, gotBaseBackoff, tc.wantMaxRetries, tc.wantBaseBackoff)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	var raw map[string]any
+	if err := json.Unmarshal([]byte(sampleConfig), &raw); err != nil {
+		t.Fatalf("failed to parse config: %s", err)
+	}
+	raw["BucketAccessKey"] = "access"
+	raw["BucketSecretKey"] = "secret"
+	b, err := json.Marshal(raw)
+	if err != nil {
+		t.Fatalf("failed to encode config: %s", err)
+	}
+	if _, err := Parse(b); err != nil {
+		t.Errorf("sample config with credentials is invalid: %s", err)
+	}
+
+	_, err = Parse([]byte(`{"Mirrors": [{"BucketName": "mirror"}], "MaxTripAgeMinutes": -1}`))
+	if err == nil {
+		t.Fatalf("expected an error for an empty config")
+	}
+	for _, field := range []string{
+		"Feeds", "Timezone", "BucketUrl", "BucketAccessKey", "BucketSecretKey", "BucketName", "MetadataPath",
+		"Mirrors[0].BucketUrl", "MaxTripAgeMinutes",
+	} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("error %q doesn't name the %s field", err, field)
+		}
+	}
+	if strings.Contains(err.Error(), "Mirrors[0].BucketName") {
+		t.Errorf("error %q names the Mirrors[0].BucketName field, which is set", err)
+	}
+
+	// An unknown timezone is reported along with the other problems.
+	_, err = Parse([]byte(`{"Timezone": "America/Nowhere"}`))
+	if err == nil || !strings.Contains(err.Error(), "Timezone: invalid timezone") {
+		t.Errorf("Parse() with an unknown timezone returned %v, want an error naming the Timezone field", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "MetadataPath:") {
+		t.Errorf("error %q for an unknown timezone doesn't list the config's other problems", err)
+	}
+}
@@ -0,0 +1,165 @@
+package etl
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+type CoverageOptions struct {
+	// If set, the report is written to this path instead of stdout. The format is given by the
+	// extension, which must be .csv or .json.
+	ExportPath string
+	Output     OutputFormat
+}
+
+// Coverage reports, per feed per month, how many of the days the feed is active were processed.
+//
+// The report is derived entirely from the metadata; the feeds' active ranges come from the config.
+func Coverage(ctx context.Context, ec *config.Config, sc *storage.Client, opts CoverageOptions) error {
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	report := coverage(ec.Feeds, m, lastBacklogDay(ec))
+	if opts.ExportPath == "" {
+		if opts.Output == OutputJson {
+			return writeJson(report)
+		}
+		for _, row := range report.Rows {
+			fmt.Printf("%s %s: %d/%d day(s) present, %d missing, %d preliminary, %d skipped, %d trip(s)\n",
+				row.FeedID, row.Month, row.PresentDays, row.NumDays, row.MissingDays, row.PreliminaryDays, row.SkippedDays, row.Trips)
+		}
+		return nil
+	}
+	var b []byte
+	switch filepath.Ext(opts.ExportPath) {
+	case ".csv":
+		b, err = report.csv()
+	case ".json":
+		b, err = json.MarshalIndent(report, "", "  ")
+	default:
+		return fmt.Errorf("unknown coverage report format %q (the path must end in .csv or .json)", opts.ExportPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to build coverage report: %w", err)
+	}
+	if err := os.WriteFile(opts.ExportPath, b, 0644); err != nil {
+		return fmt.Errorf("failed to write coverage report: %w", err)
+	}
+	fmt.Printf("Wrote coverage of %d feed month(s) to %s\n", len(report.Rows), opts.ExportPath)
+	return nil
+}
+
+// coverage builds the coverage report for the days up to and including the last day.
+func coverage(feeds []config.Feed, m *metadata.Metadata, lastDay metadata.Day) CoverageReport {
+	dayToProcessedDay := map[metadata.Day]*metadata.ProcessedDay{}
+	for i := range m.ProcessedDays {
+		dayToProcessedDay[m.ProcessedDays[i].Day] = &m.ProcessedDays[i]
+	}
+	skipped := map[metadata.Day]bool{}
+	for _, skippedDay := range m.SkippedDays {
+		skipped[skippedDay.Day] = true
+	}
+	report := CoverageReport{
+		GeneratedAt: time.Now().UTC(),
+		LastDay:     lastDay,
+		Rows:        []CoverageRow{},
+	}
+	for _, feed := range sortedFeeds(feeds) {
+		upperBound := lastDay.Next()
+		if feed.LastDay != nil && feed.LastDay.Before(upperBound) {
+			upperBound = feed.LastDay.Next()
+		}
+		var row *CoverageRow
+		for day := feed.FirstDay; day.Before(upperBound); day = day.Next() {
+			if row == nil || row.Month != day.MonthString() {
+				report.Rows = append(report.Rows, CoverageRow{FeedID: feed.Id, Month: day.MonthString()})
+				row = &report.Rows[len(report.Rows)-1]
+			}
+			row.NumDays++
+			processedDay := dayToProcessedDay[day]
+			switch {
+			case processedDay != nil && containsString(processedDay.Feeds, feed.Id):
+				if processedDay.Preliminary {
+					row.PreliminaryDays++
+				} else {
+					row.PresentDays++
+				}
+				row.Trips += feedTrips(processedDay, feed.Id)
+			case skipped[day]:
+				row.SkippedDays++
+			default:
+				row.MissingDays++
+			}
+		}
+	}
+	return report
+}
+
+// feedTrips returns the number of trips of the feed in the CSV export of the day. Days exported
+// before the trips were counted per feed only have a total, which is used if the day has just the
+// one feed; otherwise the feed's trips are unknown and zero is returned.
+func feedTrips(processedDay *metadata.ProcessedDay, feedID string) int {
+	stats := processedDay.ExportStats
+	switch {
+	case stats == nil:
+		return 0
+	case stats.FeedTripsOut != nil:
+		return stats.FeedTripsOut[feedID]
+	case len(processedDay.Feeds) == 1:
+		return stats.TripsOut
+	default:
+		return 0
+	}
+}
+
+func sortedFeeds(feeds []config.Feed) []config.Feed {
+	sorted := append([]config.Feed(nil), feeds...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Id < sorted[j].Id
+	})
+	return sorted
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CoverageReport) csv() ([]byte, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	records := [][]string{{"feed_id", "month", "days", "present_days", "missing_days", "preliminary_days", "skipped_days", "trips"}}
+	for _, row := range r.Rows {
+		records = append(records, []string{
+			row.FeedID,
+			row.Month,
+			strconv.Itoa(row.NumDays),
+			strconv.Itoa(row.PresentDays),
+			strconv.Itoa(row.MissingDays),
+			strconv.Itoa(row.PreliminaryDays),
+			strconv.Itoa(row.SkippedDays),
+			strconv.Itoa(row.Trips),
+		})
+	}
+	if err := w.WriteAll(records); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
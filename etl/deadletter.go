@@ -0,0 +1,115 @@
+package etl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	hconfig "github.com/jamespfennell/hoard/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+type RerunFailedOptions struct {
+	Limit       *int
+	Concurrency int
+	DryRun      bool
+}
+
+// RerunFailed runs the pipeline again for the days in the dead-letter list in the metadata.
+//
+// Each day is run with the feeds it failed with. Days that succeed are removed from the list;
+// days that fail again stay on it with their attempt count incremented.
+func RerunFailed(ctx context.Context, ec *config.Config, hc *hconfig.Config, sc *storage.Client, opts RerunFailedOptions) error {
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to obtain metadata: %w", err)
+	}
+	if len(m.FailedDays) == 0 {
+		log.Println("No failed days to rerun")
+		return nil
+	}
+	var pendingDays []config.PendingDay
+	lastCompleteDay := lastBacklogDay(ec)
+	for _, failedDay := range m.FailedDays {
+		log.Printf("%s: failed %d time(s), most recently at %s: %s",
+			failedDay.Day, failedDay.Attempts, failedDay.LastAttempt.Format(time.RFC3339), failedDay.Error)
+		pendingDays = append(pendingDays, config.PendingDay{
+			Day:     failedDay.Day,
+			FeedIDs: failedDay.FeedIDs,
+			// Days that failed in a backlog run with --include-today may still be incomplete.
+			Preliminary: lastCompleteDay.Before(failedDay.Day),
+		})
+	}
+	log.Printf("%d failed day(s) to rerun", len(pendingDays))
+	return runPendingDays(ctx, pendingDays, opts.Limit, opts.Concurrency, opts.DryRun, nil, ec, hc, sc)
+}
+
+// failedDayError returns the error recorded for a failed day in the metadata, and whether the
+// failure needs review.
+//
+// The metadata is public, and most errors include object storage URLs, paths or the text of
+// responses, so only the messages of the errors that this package creates are recorded. Other
+// errors are recorded by class. The full error is logged when the day fails.
+func failedDayError(err error) (string, bool) {
+	var tooLarge *ArchiveTooLargeError
+	var regression *QualityRegressionError
+	switch {
+	case errors.As(err, &tooLarge):
+		return tooLarge.Error(), true
+	case errors.As(err, &regression):
+		return regression.Error(), true
+	case errors.Is(err, context.DeadlineExceeded):
+		return "processing the day timed out", false
+	case errors.Is(err, context.Canceled):
+		return "processing the day was canceled", false
+	default:
+		return "processing the day failed; see the logs of the run for the full error", false
+	}
+}
+
+// updateFailedDays records the outcome of running the days in the dead-letter list: days that
+// failed are added or have their attempt count incremented, and days that succeeded are removed.
+func updateFailedDays(ctx context.Context, attempted []config.PendingDay, failures map[metadata.Day]error, sc *storage.Client) error {
+	now := time.Now().UTC()
+	return sc.UpdateMetadata(ctx, func(m *metadata.Metadata) bool {
+		dayToFailedDay := map[metadata.Day]metadata.FailedDay{}
+		for _, failedDay := range m.FailedDays {
+			dayToFailedDay[failedDay.Day] = failedDay
+		}
+		changed := false
+		for _, pendingDay := range attempted {
+			err, failed := failures[pendingDay.Day]
+			failedDay, listed := dayToFailedDay[pendingDay.Day]
+			if !failed {
+				if listed {
+					delete(dayToFailedDay, pendingDay.Day)
+					changed = true
+				}
+				continue
+			}
+			failedDay.Day = pendingDay.Day
+			failedDay.FeedIDs = pendingDay.FeedIDs
+			failedDay.Error, failedDay.NeedsReview = failedDayError(err)
+			failedDay.Attempts++
+			failedDay.LastAttempt = now
+			dayToFailedDay[pendingDay.Day] = failedDay
+			changed = true
+		}
+		if !changed {
+			return false
+		}
+		m.FailedDays = nil
+		for _, failedDay := range dayToFailedDay {
+			m.FailedDays = append(m.FailedDays, failedDay)
+		}
+		sort.Slice(m.FailedDays, func(i, j int) bool {
+			return m.FailedDays[i].Day.Before(m.FailedDays[j].Day)
+		})
+		return true
+	})
+}
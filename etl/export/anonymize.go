@@ -0,0 +1,54 @@
+package export
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// VehicleIDAnonymizer replaces vehicle IDs in the export with salted hashes, so that a vehicle
+// can be followed through the data without its ID being exposed.
+//
+// The hash of a vehicle ID is the first 16 hex characters of its HMAC-SHA256 keyed by the salt.
+// Unless StableAcrossDays is set, the service day is hashed along with the ID, so the same
+// vehicle has the same hash on every trip of a day but a different hash on each day. Hashes are
+// only stable for as long as the salt is unchanged. Empty vehicle IDs are left empty.
+type VehicleIDAnonymizer struct {
+	Salt string
+	// Whether a vehicle has the same hash on every day.
+	StableAcrossDays bool
+}
+
+func (a *VehicleIDAnonymizer) anonymize(vehicleID string, dayStart time.Time) string {
+	if vehicleID == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(a.Salt))
+	if !a.StableAcrossDays {
+		mac.Write([]byte(dayStart.Format("2006-01-02")))
+		mac.Write([]byte{0})
+	}
+	mac.Write([]byte(vehicleID))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// vehicleID returns the vehicle ID as it appears in the export.
+func vehicleID(opts *Options, vehicleID string) string {
+	if opts.VehicleIDAnonymizer == nil {
+		return vehicleID
+	}
+	return opts.VehicleIDAnonymizer.anonymize(vehicleID, opts.DayStart)
+}
+
+// vehicleIDDescription returns the description of vehicle ID columns in the data dictionary.
+func vehicleIDDescription(opts *Options, description string) string {
+	switch {
+	case opts.VehicleIDAnonymizer == nil:
+		return description
+	case opts.VehicleIDAnonymizer.StableAcrossDays:
+		return description + " The ID is replaced with a salted hash that is the same for the vehicle on every day."
+	default:
+		return description + " The ID is replaced with a salted hash that is the same for the vehicle within the day, but differs between days."
+	}
+}
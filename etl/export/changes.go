@@ -0,0 +1,248 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Values of the change_type column of the changes archive.
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// ChangeStats records the number of trips of each change type in a changes archive.
+type ChangeStats struct {
+	Added   int
+	Removed int
+	Changed int
+}
+
+// ExportChanges returns a tar archive with the trips that differ between two uncompressed tar
+// archives created by the exporter: a previous version of a day and the current version.
+//
+// The trips.csv file of the archive has a change_type column followed by the columns of the
+// current version's trips.csv. It lists the added and changed trips in the current version's
+// order, with their current rows, and then the removed trips with their previous rows. The
+// stop_times.csv file has the current version's stop times of the added and changed trips.
+//
+// A trip has changed if its row in trips.csv or any of its rows in stop_times.csv differ. Rows
+// are compared by column name using the current version's columns; columns missing from the
+// previous version are treated as empty, so adding a column changes every trip with a value
+// in it.
+func ExportChanges(previous, current []byte, filePrefix string, opts Options) ([]byte, ChangeStats, error) {
+	var stats ChangeStats
+	p, err := readCsvTables(previous)
+	if err != nil {
+		return nil, stats, fmt.Errorf("failed to read previous archive: %w", err)
+	}
+	c, err := readCsvTables(current)
+	if err != nil {
+		return nil, stats, fmt.Errorf("failed to read current archive: %w", err)
+	}
+	var tripsCsv, stopTimesCsv bytes.Buffer
+	tw := csv.NewWriter(&tripsCsv)
+	sw := csv.NewWriter(&stopTimesCsv)
+	if err := tw.Write(append([]string{"change_type"}, c.trips.header...)); err != nil {
+		return nil, stats, err
+	}
+	if err := sw.Write(c.stopTimes.header); err != nil {
+		return nil, stats, err
+	}
+	tripIndices := p.trips.indices(c.trips.header)
+	stopTimeIndices := p.stopTimes.indices(c.stopTimes.header)
+	for _, tripUID := range c.trips.order {
+		changeType := ChangeChanged
+		if _, ok := p.trips.rows[tripUID]; !ok {
+			changeType = ChangeAdded
+			stats.Added++
+		} else if !rowsEqual(&p.trips, &c.trips, tripIndices, tripUID) ||
+			!rowsEqual(&p.stopTimes, &c.stopTimes, stopTimeIndices, tripUID) {
+			stats.Changed++
+		} else {
+			continue
+		}
+		if err := tw.Write(append([]string{changeType}, c.trips.rows[tripUID][0]...)); err != nil {
+			return nil, stats, err
+		}
+		for _, row := range c.stopTimes.rows[tripUID] {
+			if err := sw.Write(row); err != nil {
+				return nil, stats, err
+			}
+		}
+	}
+	for _, tripUID := range p.trips.order {
+		if _, ok := c.trips.rows[tripUID]; ok {
+			continue
+		}
+		stats.Removed++
+		row := project(p.trips.rows[tripUID][0], tripIndices)
+		if err := tw.Write(append([]string{ChangeRemoved}, row...)); err != nil {
+			return nil, stats, err
+		}
+	}
+	tw.Flush()
+	if err := tw.Error(); err != nil {
+		return nil, stats, err
+	}
+	sw.Flush()
+	if err := sw.Error(); err != nil {
+		return nil, stats, err
+	}
+
+	var out bytes.Buffer
+	tarWriter := tar.NewWriter(&out)
+	mode := opts.FileMode
+	if mode == 0 {
+		mode = DefaultFileMode
+	}
+	for _, f := range []file{
+		{"trips.csv", tripsCsv.Bytes()},
+		{"stop_times.csv", stopTimesCsv.Bytes()},
+	} {
+		hdr := &tar.Header{
+			Name:    filePrefix + f.Name,
+			Mode:    mode,
+			Size:    int64(len(f.Body)),
+			ModTime: opts.ModTime.Truncate(time.Second),
+		}
+		if err := tarWriter.WriteHeader(hdr); err != nil {
+			return nil, stats, err
+		}
+		if _, err := tarWriter.Write(f.Body); err != nil {
+			return nil, stats, err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, stats, err
+	}
+	return out.Bytes(), stats, nil
+}
+
+// csvTables is the rows of trips.csv and stop_times.csv in an archive.
+type csvTables struct {
+	trips     csvTable
+	stopTimes csvTable
+}
+
+// csvTable is the rows of a CSV file whose first column is trip_uid, grouped by trip UID.
+type csvTable struct {
+	header []string
+	// Trip UIDs in the order they first appear.
+	order []string
+	rows  map[string][][]string
+}
+
+func readCsvTables(b []byte) (*csvTables, error) {
+	var t csvTables
+	var tripsRead, stopTimesRead bool
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		switch {
+		case strings.HasSuffix(hdr.Name, "stop_times.csv"):
+			if err := t.stopTimes.read(tr); err != nil {
+				return nil, fmt.Errorf("failed to parse stop_times.csv: %w", err)
+			}
+			stopTimesRead = true
+		case strings.HasSuffix(hdr.Name, "trips.csv"):
+			if err := t.trips.read(tr); err != nil {
+				return nil, fmt.Errorf("failed to parse trips.csv: %w", err)
+			}
+			tripsRead = true
+		}
+	}
+	if !tripsRead || !stopTimesRead {
+		return nil, fmt.Errorf("archive does not contain trips.csv and stop_times.csv")
+	}
+	return &t, nil
+}
+
+func (t *csvTable) read(r io.Reader) error {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("no header row: %w", err)
+	}
+	if len(header) == 0 || header[0] != "trip_uid" {
+		return fmt.Errorf("first column is not trip_uid")
+	}
+	t.header = header
+	t.rows = map[string][][]string{}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		tripUID := row[0]
+		if _, ok := t.rows[tripUID]; !ok {
+			t.order = append(t.order, tripUID)
+		}
+		t.rows[tripUID] = append(t.rows[tripUID], row)
+	}
+}
+
+// indices returns the index of each of the columns in the table's header, or -1 if the table
+// doesn't have the column.
+func (t *csvTable) indices(columns []string) []int {
+	nameToIndex := map[string]int{}
+	for i, name := range t.header {
+		nameToIndex[name] = i
+	}
+	indices := make([]int, len(columns))
+	for i, name := range columns {
+		j, ok := nameToIndex[name]
+		if !ok {
+			j = -1
+		}
+		indices[i] = j
+	}
+	return indices
+}
+
+// project returns the values of the row at the indices, with empty values for indices of -1.
+func project(row []string, indices []int) []string {
+	projected := make([]string, len(indices))
+	for i, j := range indices {
+		if j >= 0 {
+			projected[i] = row[j]
+		}
+	}
+	return projected
+}
+
+// rowsEqual returns whether the trip's rows in the previous version of a table, projected onto
+// the current version's columns using the indices, are the same as its rows in the current version.
+func rowsEqual(previous, current *csvTable, indices []int, tripUID string) bool {
+	previousRows, currentRows := previous.rows[tripUID], current.rows[tripUID]
+	if len(previousRows) != len(currentRows) {
+		return false
+	}
+	for i := range previousRows {
+		for j, k := range indices {
+			var v string
+			if k >= 0 {
+				v = previousRows[i][k]
+			}
+			if v != currentRows[i][j] {
+				return false
+			}
+		}
+	}
+	return true
+}
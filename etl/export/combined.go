@@ -0,0 +1,94 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+// combinedExport writes combined.csv, a denormalized join of trips.csv and stop_times.csv for
+// tools that can't join two files.
+//
+// Each row is a stop time preceded by all of the columns of its trip, so the trip columns are
+// repeated on every stop time of the trip and the file is much larger than the other two
+// together. Trips with no stop times have a single row with empty stop time columns. The
+// trip_uid column of stop_times.csv is omitted, and stop time columns with the same name as a
+// trip column are prefixed with stop_time_.
+type combinedExport struct {
+	opts            *Options
+	tripColumns     []tripColumn
+	stopTimeColumns []stopTimeColumn
+	b               bytes.Buffer
+	w               *csv.Writer
+}
+
+func newCombinedExport(opts *Options) *combinedExport {
+	e := &combinedExport{
+		opts:        opts,
+		tripColumns: tripColumns(opts),
+	}
+	for _, c := range stopTimeColumns(opts) {
+		if c.Name == "trip_uid" {
+			continue
+		}
+		e.stopTimeColumns = append(e.stopTimeColumns, c)
+	}
+	e.w = csv.NewWriter(&e.b)
+	var header []string
+	for _, c := range e.columns() {
+		header = append(header, c.Name)
+	}
+	// Writes to a bytes.Buffer don't fail.
+	_ = e.w.Write(header)
+	return e
+}
+
+func (e *combinedExport) fileName() string {
+	return "combined.csv"
+}
+
+func (e *combinedExport) columns() []Column {
+	tripColumnNames := map[string]bool{}
+	var columns []Column
+	for _, c := range e.tripColumns {
+		tripColumnNames[c.Name] = true
+		c.Column.Description = "Column of trips.csv, repeated on every stop time of the trip. " + c.Column.Description
+		columns = append(columns, c.Column)
+	}
+	for _, c := range e.stopTimeColumns {
+		if tripColumnNames[c.Name] {
+			c.Column.Name = "stop_time_" + c.Name
+		}
+		c.Column.Description = "Column of stop_times.csv. Empty if the trip has no stop times. " + c.Column.Description
+		c.Column.Nullable = true
+		columns = append(columns, c.Column)
+	}
+	return columns
+}
+
+func (e *combinedExport) add(_ string, trips []journal.Trip) {
+	for i := range trips {
+		trip := &trips[i]
+		var tripRow []string
+		for _, c := range e.tripColumns {
+			tripRow = append(tripRow, c.value(e.opts, trip))
+		}
+		if len(trip.StopTimes) == 0 {
+			_ = e.w.Write(append(tripRow, make([]string, len(e.stopTimeColumns))...))
+			continue
+		}
+		for k := range trip.StopTimes {
+			row := append([]string{}, tripRow...)
+			for _, c := range e.stopTimeColumns {
+				row = append(row, c.value(e.opts, trip, k))
+			}
+			_ = e.w.Write(row)
+		}
+	}
+}
+
+func (e *combinedExport) csv() []byte {
+	e.w.Flush()
+	return e.b.Bytes()
+}
@@ -0,0 +1,320 @@
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jamespfennell/gtfs"
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+// tripColumn is a column of trips.csv.
+type tripColumn struct {
+	Column
+	value func(opts *Options, trip *journal.Trip) string
+}
+
+// stopTimeColumn is a column of stop_times.csv.
+type stopTimeColumn struct {
+	Column
+	value func(opts *Options, trip *journal.Trip, i int) string
+}
+
+// tripColumns returns the columns of trips.csv given the export options.
+func tripColumns(opts *Options) []tripColumn {
+	columns := []tripColumn{
+		{
+			Column{"trip_uid", "string", "", false, "Unique identifier for the trip, unique across all days."},
+			func(_ *Options, trip *journal.Trip) string { return trip.TripUID },
+		},
+		{
+			Column{"trip_id", "string", "", false, "Trip ID from the GTFS-RT feed."},
+			func(_ *Options, trip *journal.Trip) string { return trip.TripID },
+		},
+		{
+			Column{"route_id", "string", "", false, "Route ID from the GTFS-RT feed."},
+			func(_ *Options, trip *journal.Trip) string { return trip.RouteID },
+		},
+		{
+			Column{"direction_id", "integer", "", true, "Direction of the trip: 0 or 1."},
+			func(_ *Options, trip *journal.Trip) string { return formatDirectionID(trip.DirectionID) },
+		},
+		{
+			Column{"start_time", "integer", "unix seconds", false, "Start time of the trip."},
+			func(_ *Options, trip *journal.Trip) string { return formatUnix(trip.StartTime) },
+		},
+		{
+			Column{"vehicle_id", "string", "", false, vehicleIDDescription(opts, "ID of the vehicle assigned to the trip.")},
+			func(opts *Options, trip *journal.Trip) string { return vehicleID(opts, trip.VehicleID) },
+		},
+		{
+			Column{"last_observed", "integer", "unix seconds", false, "Time of the last feed message that contained the trip."},
+			func(_ *Options, trip *journal.Trip) string { return formatUnix(trip.LastObserved) },
+		},
+		{
+			Column{"marked_past", "integer", "unix seconds", true, "Time of the first feed message after the trip disappeared from the feed."},
+			func(_ *Options, trip *journal.Trip) string { return formatNullableUnix(trip.MarkedPast) },
+		},
+		{
+			Column{"num_updates", "integer", "", false, "Number of feed messages that contained the trip."},
+			func(_ *Options, trip *journal.Trip) string { return fmt.Sprintf("%d", trip.NumUpdates) },
+		},
+		{
+			Column{"num_schedule_changes", "integer", "", false, "Number of times new stops were added to the trip's schedule."},
+			func(_ *Options, trip *journal.Trip) string { return fmt.Sprintf("%d", trip.NumScheduleChanges) },
+		},
+		{
+			Column{"num_schedule_rewrites", "integer", "", false, "Number of times the trip's schedule was replaced entirely."},
+			func(_ *Options, trip *journal.Trip) string { return fmt.Sprintf("%d", trip.NumScheduleRewrites) },
+		},
+		{
+			Column{"reached_terminal", "boolean", "", true, "Whether the last stop of the trip is the last stop of the matching scheduled trip. Empty if there is no static schedule or no matching scheduled trip."},
+			func(opts *Options, trip *journal.Trip) string { return formatReachedTerminal(opts, trip) },
+		},
+		{
+			Column{"is_added", "boolean", "", true, "Whether the GTFS-RT feed marks the trip as added. False for trips that match a scheduled trip and aren't marked as added, and empty for other trips, including all unmarked trips if there is no static schedule."},
+			func(opts *Options, trip *journal.Trip) string { return formatIsAdded(opts, trip) },
+		},
+		{
+			Column{"is_canceled", "boolean", "", true, "Whether the GTFS-RT feed marks the trip as canceled. Canceled trips are exported with whatever stop times they have unless DropCanceledTrips is set. Empty if the schedule relationships of the trips weren't recorded."},
+			func(opts *Options, trip *journal.Trip) string { return formatIsCanceled(opts, trip) },
+		},
+		{
+			Column{"start_date", "string", "YYYYMMDD", true, "Service day the trip was assigned to, from the start_date field of the GTFS-RT feed, or the exported service day if the feed didn't give one. For trips that start after midnight this can be the day before the calendar date of their stop times. Empty only if the export has no service day."},
+			func(opts *Options, trip *journal.Trip) string { return formatStartDate(opts, trip) },
+		},
+	}
+	if !opts.OmitVehicleIDs {
+		return columns
+	}
+	var retained []tripColumn
+	for _, c := range columns {
+		if c.Name != "vehicle_id" {
+			retained = append(retained, c)
+		}
+	}
+	return retained
+}
+
+// stopTimeColumns returns the columns of stop_times.csv given the export options.
+func stopTimeColumns(opts *Options) []stopTimeColumn {
+	columns := []stopTimeColumn{
+		{
+			Column{"trip_uid", "string", "", false, "Trip the stop time belongs to; references trips.csv."},
+			func(_ *Options, trip *journal.Trip, _ int) string { return trip.TripUID },
+		},
+		{
+			Column{"stop_id", "string", "", false, "Stop ID from the GTFS static feed."},
+			func(_ *Options, trip *journal.Trip, i int) string { return trip.StopTimes[i].StopID },
+		},
+	}
+	if opts.IncludeStopSequence {
+		columns = append(columns, stopTimeColumn{
+			Column{"stop_sequence", "integer", "", false, "Position of the stop time within the trip, starting at 1."},
+			func(_ *Options, _ *journal.Trip, i int) string { return fmt.Sprintf("%d", i+1) },
+		})
+	}
+	columns = append(columns, []stopTimeColumn{
+		{
+			Column{"track", "string", "", true, "Track the train used at the stop."},
+			func(_ *Options, trip *journal.Trip, i int) string {
+				return formatNullableString(trip.StopTimes[i].Track)
+			},
+		},
+		{
+			Column{"arrival_time", "integer", "unix seconds", true, "Arrival time at the stop. Empty for the first stop."},
+			func(_ *Options, trip *journal.Trip, i int) string {
+				return formatNullableUnix(trip.StopTimes[i].ArrivalTime)
+			},
+		},
+		{
+			Column{"departure_time", "integer", "unix seconds", true, "Departure time from the stop. Empty for the last stop."},
+			func(_ *Options, trip *journal.Trip, i int) string {
+				return formatNullableUnix(trip.StopTimes[i].DepartureTime)
+			},
+		},
+		{
+			Column{"last_observed", "integer", "unix seconds", false, "Time of the last feed message that contained the stop time."},
+			func(_ *Options, trip *journal.Trip, i int) string { return formatUnix(trip.StopTimes[i].LastObserved) },
+		},
+		{
+			Column{"marked_past", "integer", "unix seconds", true, "Time of the first feed message after the stop time disappeared from the feed."},
+			func(_ *Options, trip *journal.Trip, i int) string {
+				return formatNullableUnix(trip.StopTimes[i].MarkedPast)
+			},
+		},
+		{
+			Column{"is_actual", "boolean", "", false, "Whether the train had reached the stop when it disappeared from the feed. If false, the times are the last prediction."},
+			func(_ *Options, trip *journal.Trip, i int) string {
+				return fmt.Sprintf("%t", IsActual(trip.StopTimes[i]))
+			},
+		},
+		{
+			Column{"dwell_seconds", "integer", "seconds", true, "Departure time minus arrival time at the stop. Empty if either is missing or the departure is before the arrival."},
+			func(_ *Options, trip *journal.Trip, i int) string {
+				dwell, ok := DwellTime(trip.StopTimes[i])
+				if !ok || dwell < 0 {
+					return ""
+				}
+				return fmt.Sprintf("%d", int64(dwell/time.Second))
+			},
+		},
+	}...)
+	if opts.IncludeTravelTime {
+		columns = append(columns, stopTimeColumn{
+			Column{"travel_seconds", "integer", "seconds", true, "Arrival time at the next stop of the trip minus departure time from the stop. Empty for the last stop, if either time is missing, or if the arrival is before the departure."},
+			func(_ *Options, trip *journal.Trip, i int) string {
+				travel, ok := TravelTime(trip, i)
+				if !ok || travel < 0 {
+					return ""
+				}
+				return fmt.Sprintf("%d", int64(travel/time.Second))
+			},
+		})
+	}
+	return columns
+}
+
+// csvWriter writes trips.csv and stop_times.csv.
+type csvWriter struct {
+	opts            *Options
+	tripColumns     []tripColumn
+	stopTimeColumns []stopTimeColumn
+	trips           *csv.Writer
+	stopTimes       *csv.Writer
+}
+
+func newCsvWriter(opts *Options, trips io.Writer, stopTimes io.Writer) (*csvWriter, error) {
+	w := &csvWriter{
+		opts:            opts,
+		tripColumns:     tripColumns(opts),
+		stopTimeColumns: stopTimeColumns(opts),
+		trips:           csv.NewWriter(trips),
+		stopTimes:       csv.NewWriter(stopTimes),
+	}
+	var header []string
+	for _, c := range w.tripColumns {
+		header = append(header, c.Name)
+	}
+	if err := w.trips.Write(header); err != nil {
+		return nil, err
+	}
+	header = nil
+	for _, c := range w.stopTimeColumns {
+		header = append(header, c.Name)
+	}
+	if err := w.stopTimes.Write(header); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *csvWriter) write(trips []journal.Trip) error {
+	for i := range trips {
+		trip := &trips[i]
+		row := make([]string, len(w.tripColumns))
+		for j, c := range w.tripColumns {
+			row[j] = c.value(w.opts, trip)
+		}
+		if err := w.trips.Write(row); err != nil {
+			return err
+		}
+		for k := range trip.StopTimes {
+			row := make([]string, len(w.stopTimeColumns))
+			for j, c := range w.stopTimeColumns {
+				row[j] = c.value(w.opts, trip, k)
+			}
+			if err := w.stopTimes.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *csvWriter) flush() error {
+	w.trips.Flush()
+	if err := w.trips.Error(); err != nil {
+		return err
+	}
+	w.stopTimes.Flush()
+	return w.stopTimes.Error()
+}
+
+func formatReachedTerminal(opts *Options, trip *journal.Trip) string {
+	scheduledTrip, ok := opts.Schedule.Match(trip, opts.DayStart)
+	if !ok || len(scheduledTrip.StopTimes) == 0 {
+		return ""
+	}
+	scheduledLast := scheduledTrip.StopTimes[len(scheduledTrip.StopTimes)-1]
+	last, ok := LastStopTime(trip)
+	if !ok || scheduledLast.Stop == nil {
+		return ""
+	}
+	return fmt.Sprintf("%t", last.StopID == scheduledLast.Stop.Id)
+}
+
+func formatIsAdded(opts *Options, trip *journal.Trip) string {
+	if opts.AddedTrips[trip.TripUID] {
+		return "true"
+	}
+	if opts.Schedule == nil {
+		return ""
+	}
+	// A trip that matches no scheduled trip may still be a scheduled trip whose ID couldn't be
+	// matched, so it isn't assumed to be added.
+	if _, ok := opts.Schedule.Match(trip, opts.DayStart); !ok {
+		return ""
+	}
+	return "false"
+}
+
+func formatIsCanceled(opts *Options, trip *journal.Trip) string {
+	if opts.CanceledTrips == nil {
+		return ""
+	}
+	return fmt.Sprintf("%t", opts.CanceledTrips[trip.TripUID])
+}
+
+// formatStartDate returns the recorded start date of the trip in the GTFS date format.
+func formatStartDate(opts *Options, trip *journal.Trip) string {
+	startDate, ok := opts.StartDates[trip.TripUID]
+	if !ok {
+		if opts.DayStart.IsZero() {
+			return ""
+		}
+		startDate = opts.DayStart
+	}
+	return startDate.Format("20060102")
+}
+
+func formatDirectionID(d gtfs.DirectionID) string {
+	switch d {
+	case gtfs.DirectionID_False:
+		return "0"
+	case gtfs.DirectionID_True:
+		return "1"
+	default:
+		return ""
+	}
+}
+
+func formatUnix(t time.Time) string {
+	return fmt.Sprintf("%d", t.Unix())
+}
+
+func formatNullableUnix(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return formatUnix(*t)
+}
+
+func formatNullableString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,136 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jamespfennell/gtfs"
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+type routeDelivery struct {
+	operated     map[*gtfs.ScheduledTrip]bool
+	numUnmatched int
+}
+
+// serviceDeliveryExport compares the number of trips the static schedule has on each route on
+// the service day to the number that operated.
+//
+// A trip operated if it has at least one actual stop time; see IsActual. The journal has no
+// record of canceled trips, so trips that only ever had predictions are treated as not
+// operated. Each scheduled trip is counted once however many realtime trips matched it.
+// Operated trips that match no scheduled trip are counted separately, and routes that only
+// have such trips are still listed.
+//
+// The static schedule usually covers more routes than the exported feeds, so only routes that
+// have at least one realtime trip in the export are listed.
+type serviceDeliveryExport struct {
+	schedule     *Schedule
+	dayStart     time.Time
+	numScheduled map[string]int
+	routes       map[string]*routeDelivery
+}
+
+func newServiceDeliveryExport(opts Options) *serviceDeliveryExport {
+	e := &serviceDeliveryExport{
+		schedule:     opts.Schedule,
+		dayStart:     opts.DayStart,
+		numScheduled: map[string]int{},
+		routes:       map[string]*routeDelivery{},
+	}
+	for _, trip := range opts.Schedule.trips {
+		if trip.Route == nil {
+			continue
+		}
+		if trip.Service != nil && !serviceActive(trip.Service, opts.DayStart) {
+			continue
+		}
+		e.numScheduled[trip.Route.Id]++
+	}
+	return e
+}
+
+func (e *serviceDeliveryExport) route(routeID string) *routeDelivery {
+	r, ok := e.routes[routeID]
+	if !ok {
+		r = &routeDelivery{operated: map[*gtfs.ScheduledTrip]bool{}}
+		e.routes[routeID] = r
+	}
+	return r
+}
+
+func (e *serviceDeliveryExport) fileName() string {
+	return "service_delivery.csv"
+}
+
+func (e *serviceDeliveryExport) columns() []Column {
+	return []Column{
+		{"route_id", "string", "", false, "Route ID from the static schedule or the GTFS-RT feed."},
+		{"num_scheduled", "integer", "", false, "Number of trips on the route in the static schedule for the service day."},
+		{"num_operated", "integer", "", false, "Number of those scheduled trips that matched a trip with at least one actual stop time."},
+		{"num_unmatched", "integer", "", false, "Number of trips on the route with at least one actual stop time that matched no scheduled trip."},
+		{"delivery_percent", "float", "percent", true, "Percentage of scheduled trips that operated. Empty if the route has no scheduled trips."},
+	}
+}
+
+func (e *serviceDeliveryExport) add(_ string, trips []journal.Trip) {
+	for i := range trips {
+		trip := &trips[i]
+		scheduledTrip, ok := e.schedule.Match(trip, e.dayStart)
+		routeID := trip.RouteID
+		if ok && scheduledTrip.Route != nil {
+			routeID = scheduledTrip.Route.Id
+		}
+		r := e.route(routeID)
+		if !hasActualStopTime(trip) {
+			continue
+		}
+		if !ok {
+			r.numUnmatched++
+			continue
+		}
+		r.operated[scheduledTrip] = true
+	}
+}
+
+func hasActualStopTime(trip *journal.Trip) bool {
+	for _, stopTime := range trip.StopTimes {
+		if IsActual(stopTime) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *serviceDeliveryExport) csv() []byte {
+	var routeIDs []string
+	for routeID := range e.routes {
+		routeIDs = append(routeIDs, routeID)
+	}
+	sort.Strings(routeIDs)
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	// Writes to a bytes.Buffer don't fail.
+	_ = w.Write([]string{"route_id", "num_scheduled", "num_operated", "num_unmatched", "delivery_percent"})
+	for _, routeID := range routeIDs {
+		r := e.routes[routeID]
+		numScheduled := e.numScheduled[routeID]
+		var percent string
+		if numScheduled > 0 {
+			percent = fmt.Sprintf("%.1f", 100*float64(len(r.operated))/float64(numScheduled))
+		}
+		_ = w.Write([]string{
+			routeID,
+			strconv.Itoa(numScheduled),
+			strconv.Itoa(len(r.operated)),
+			strconv.Itoa(r.numUnmatched),
+			percent,
+		})
+	}
+	w.Flush()
+	return b.Bytes()
+}
@@ -0,0 +1,39 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Column describes a single column of an exported CSV file.
+type Column struct {
+	Name        string
+	Type        string
+	Units       string
+	Nullable    bool
+	Description string
+}
+
+// dataDictionary builds a README.md describing the columns of each file in the export.
+func dataDictionary(files []file, fileColumns map[string][]Column) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Data dictionary\n\n")
+	b.WriteString("This archive contains the following CSV files.\n")
+	for _, f := range files {
+		columns, ok := fileColumns[f.Name]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n", f.Name)
+		b.WriteString("| Column | Type | Units | Nullable | Description |\n")
+		b.WriteString("|---|---|---|---|---|\n")
+		for _, c := range columns {
+			nullable := "no"
+			if c.Nullable {
+				nullable = "yes"
+			}
+			fmt.Fprintf(&b, "| `%s` | %s | %s | %s | %s |\n", c.Name, c.Type, c.Units, nullable, c.Description)
+		}
+	}
+	return b.Bytes()
+}
@@ -4,46 +4,325 @@ import (
 	"archive/tar"
 	"bytes"
 	_ "embed"
+	"fmt"
+	"time"
 
 	"github.com/jamespfennell/gtfs/journal"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
 	"github.com/jamespfennell/xz"
 )
 
+// Options configures the export.
+type Options struct {
+	// Start and end of the service day being exported.
+	DayStart time.Time
+	DayEnd   time.Time
+
+	// Whether to drop stop times outside of the service day, and trips with no stop times left.
+	ClipStopTimesToDay bool
+
+	// If non-nil, only stop times whose local clock time is in the window are exported, along
+	// with trips that have stop times left. The location of DayStart is used. See WindowTrip.
+	TimeOfDayWindow *TimeOfDayWindow
+
+	// Whether to drop stop times that are predictions rather than actuals, and trips with no
+	// stop times left. See IsActual.
+	DropPredictions bool
+
+	// Whether to merge stop times within a trip that have the same stop ID. Trips with duplicate
+	// stop IDs are flagged in the export stats either way. See MergeDuplicateStopIDs.
+	MergeDuplicateStopIDs bool
+
+	// Terminals of routes keyed by route ID. Trips of these routes whose direction ID contradicts
+	// their stop sequence are flagged in the export stats. See IsDirectionInconsistent.
+	RouteTerminals map[string]RouteTerminals
+
+	// Whether to drop trips that are flagged for an inconsistent direction ID.
+	DropInconsistentDirections bool
+
+	// Stop IDs of non-revenue stops like yards. Trips with stop times at these stops are flagged
+	// in the export stats.
+	NonRevenueStopIDs map[string]bool
+
+	// Whether to drop the stop times at non-revenue stops, and trips with no stop times left.
+	DropNonRevenueStopTimes bool
+
+	// If positive, trips whose last observation is more than this long before DayEnd, or before
+	// DataEnd if it is earlier, are dropped as stale.
+	MaxTripAge time.Duration
+
+	// If non-zero, the time the data for the day ends, when it ends before DayEnd. This is the
+	// case for days that are not yet complete.
+	DataEnd time.Time
+
+	// Overrides of the trip filtering options for specific feeds, keyed by feed ID.
+	FeedOverrides map[string]FeedOptions
+
+	// Static schedule for the day. If non-nil, schedule-based exports like route_otp.csv are included.
+	Schedule *Schedule
+
+	// Whether to include service_delivery.csv, the number of scheduled trips of each route that
+	// operated. Requires Schedule. See serviceDeliveryExport.
+	IncludeServiceDelivery bool
+
+	// Thresholds used for the route_otp.csv export.
+	OnTimeThresholds OnTimeThresholds
+
+	// Whether to include a stop_sequence column in stop_times.csv.
+	IncludeStopSequence bool
+
+	// Whether to include a travel_seconds column in stop_times.csv, the time from the stop to the
+	// next stop of the trip.
+	IncludeTravelTime bool
+
+	// Whether to include a README.md describing the columns of every file in the archive.
+	IncludeDataDictionary bool
+
+	// Permission bits of the files in the archive. If zero, 0600 is used.
+	FileMode int64
+
+	// Modification time of the files in the archive. The archive contains no other timestamps,
+	// so exporting the same trips with the same options gives byte-identical archives.
+	ModTime time.Time
+
+	// Whether to include headways.csv, the time between consecutive departures at each stop.
+	IncludeHeadways bool
+
+	// Whether to include stop_throughput.csv, the number of trips of each route at each stop in
+	// each local hour. See throughputExport.
+	IncludeStopThroughput bool
+
+	// Whether to include first_last.csv, the first and last departure at each stop of each route
+	// in each direction. See firstLastExport.
+	IncludeFirstLast bool
+
+	// Whether to include combined.csv, a denormalized join of trips.csv and stop_times.csv with
+	// the trip columns repeated on each stop time row. See combinedExport.
+	IncludeCombined bool
+
+	// Vehicle assignments of the trips. If non-nil, vehicle_assignments.csv is included unless
+	// OmitVehicleIDs is set.
+	VehicleAssignments VehicleAssignments
+
+	// Start dates of the trips in the GTFS-RT feeds, for the start_date column of trips.csv.
+	// Trips without a start date have an empty value.
+	StartDates StartDates
+
+	// Trips marked as added in the GTFS-RT feeds, for the is_added column of trips.csv.
+	AddedTrips AddedTrips
+
+	// Trips marked as canceled in the GTFS-RT feeds, for the is_canceled column of trips.csv. If
+	// nil, is_canceled is empty.
+	CanceledTrips CanceledTrips
+
+	// Whether to drop trips that are marked as canceled. Otherwise canceled trips are exported
+	// with whatever stop times they have.
+	DropCanceledTrips bool
+
+	// Whether to omit the vehicle_id column of trips.csv, and vehicle_assignments.csv.
+	OmitVehicleIDs bool
+
+	// If non-nil, vehicle IDs are replaced with salted hashes.
+	VehicleIDAnonymizer *VehicleIDAnonymizer
+
+	// If non-nil, the track of each stop time is replaced with the known track it refers to.
+	// Trips with tracks not in the reference are flagged in the export stats and their tracks are
+	// left as they are. See NormalizeTracks.
+	TrackReference *TrackReference
+
+	// If non-nil, the archive is checked against the schema and the export fails on a mismatch.
+	Schema *Schema
+
+	// If non-nil, a provenance.json file describing how the archive was produced is included.
+	Provenance *Provenance
+
+	// If non-nil, a manifest.json listing the hashes of the files in the archive is included,
+	// along with its signature. See VerifyManifest.
+	ManifestSigner *ManifestSigner
+}
+
+// DefaultFileMode is the permission bits of the files in the archive if Options.FileMode is not set.
+const DefaultFileMode = 0600
+
+type file struct {
+	Name string
+	Body []byte
+}
+
+// derivedExport is an additional CSV file computed from the trips.
+//
+// Trips are provided to the export in chunks via add, after which csv is called once.
+type derivedExport interface {
+	fileName() string
+	columns() []Column
+	add(feedID string, trips []journal.Trip)
+	csv() []byte
+}
+
+func derivedExports(opts Options) []derivedExport {
+	var exports []derivedExport
+	if opts.Schedule != nil {
+		exports = append(exports, newRouteOtpExport(opts))
+	}
+	if opts.Schedule != nil && opts.IncludeServiceDelivery {
+		exports = append(exports, newServiceDeliveryExport(opts))
+	}
+	if opts.VehicleAssignments != nil && !opts.OmitVehicleIDs {
+		exports = append(exports, newVehicleAssignmentsExport(&opts))
+	}
+	if opts.IncludeHeadways {
+		exports = append(exports, newHeadwaysExport())
+	}
+	if opts.IncludeStopThroughput {
+		exports = append(exports, newThroughputExport(opts))
+	}
+	if opts.IncludeFirstLast {
+		exports = append(exports, newFirstLastExport(opts))
+	}
+	if opts.IncludeCombined {
+		exports = append(exports, newCombinedExport(&opts))
+	}
+	return exports
+}
+
 // Export exports the provided journal as a tar.xz archive of csv files.
 func Export(j *journal.Journal, filePrefix string) ([]byte, error) {
-	csvExport, err := j.ExportToCsv()
+	return export(func(f func(string, []journal.Trip) error) error {
+		return f("", j.Trips)
+	}, filePrefix, Options{})
+}
+
+// ExportStore exports the trips in the provided store as a tar.xz archive of csv files.
+func ExportStore(s *TripStore, filePrefix string, opts Options) ([]byte, error) {
+	return export(s.Range, filePrefix, opts)
+}
+
+// ExportStoreFeed exports the trips in the provided store that came from the feed as a tar.xz
+// archive of csv files.
+func ExportStoreFeed(s *TripStore, feedID string, filePrefix string, opts Options) ([]byte, error) {
+	return export(func(f func(string, []journal.Trip) error) error {
+		return s.Range(func(tripFeedID string, trips []journal.Trip) error {
+			if tripFeedID != feedID {
+				return nil
+			}
+			return f(tripFeedID, trips)
+		})
+	}, filePrefix, opts)
+}
+
+// ExportStoreTar exports the trips in the provided store as an uncompressed tar archive of csv files.
+//
+// It also returns statistics about the trips and stop times removed by filters.
+func ExportStoreTar(s *TripStore, filePrefix string, opts Options) ([]byte, metadata.ExportStats, error) {
+	return exportTar(s.Range, filePrefix, opts)
+}
+
+// Compress compresses the provided tar archive using xz.
+func Compress(b []byte) ([]byte, error) {
+	var out bytes.Buffer
+	xw := xz.NewWriter(&out)
+	if _, err := xw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := xw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// rangeFunc calls the provided function on each chunk of trips to export.
+type rangeFunc func(func(feedID string, trips []journal.Trip) error) error
+
+func export(rangeFunc rangeFunc, filePrefix string, opts Options) ([]byte, error) {
+	b, _, err := exportTar(rangeFunc, filePrefix, opts)
 	if err != nil {
 		return nil, err
 	}
+	return Compress(b)
+}
+
+func exportTar(rangeFunc rangeFunc, filePrefix string, opts Options) ([]byte, metadata.ExportStats, error) {
+	var stats metadata.ExportStats
+	derived := derivedExports(opts)
+	var tripsCsv, stopTimesCsv bytes.Buffer
+	w, err := newCsvWriter(&opts, &tripsCsv, &stopTimesCsv)
+	if err != nil {
+		return nil, stats, err
+	}
+	if err := rangeFunc(func(feedID string, trips []journal.Trip) error {
+		trips = filter(&opts, feedID, trips, &stats)
+		if err := w.write(trips); err != nil {
+			return err
+		}
+		for _, d := range derived {
+			d.add(feedID, trips)
+		}
+		return nil
+	}); err != nil {
+		return nil, stats, err
+	}
+	if err := w.flush(); err != nil {
+		return nil, stats, err
+	}
 	var out bytes.Buffer
-	xw := xz.NewWriter(&out)
-	tw := tar.NewWriter(xw)
-	var files = []struct {
-		Name string
-		Body []byte
-	}{
-		{"trips.csv", csvExport.TripsCsv},
-		{"stop_times.csv", csvExport.StopTimesCsv},
-		// TODO: add a readme
-	}
-	for _, file := range files {
+	tw := tar.NewWriter(&out)
+	var files = []file{
+		{"trips.csv", tripsCsv.Bytes()},
+		{"stop_times.csv", stopTimesCsv.Bytes()},
+	}
+	fileColumns := map[string][]Column{}
+	for _, c := range w.tripColumns {
+		fileColumns["trips.csv"] = append(fileColumns["trips.csv"], c.Column)
+	}
+	for _, c := range w.stopTimeColumns {
+		fileColumns["stop_times.csv"] = append(fileColumns["stop_times.csv"], c.Column)
+	}
+	for _, d := range derived {
+		files = append(files, file{d.fileName(), d.csv()})
+		fileColumns[d.fileName()] = d.columns()
+	}
+	if opts.Provenance != nil {
+		b, err := opts.Provenance.json()
+		if err != nil {
+			return nil, stats, err
+		}
+		files = append(files, file{"provenance.json", b})
+	}
+	if opts.IncludeDataDictionary {
+		files = append([]file{{"README.md", dataDictionary(files, fileColumns)}}, files...)
+	}
+	if opts.ManifestSigner != nil {
+		manifestFiles, err := signManifest(opts.ManifestSigner, files)
+		if err != nil {
+			return nil, stats, err
+		}
+		files = append(files, manifestFiles...)
+	}
+	mode := opts.FileMode
+	if mode == 0 {
+		mode = DefaultFileMode
+	}
+	for _, f := range files {
 		hdr := &tar.Header{
-			Name: filePrefix + file.Name,
-			Mode: 0600,
-			Size: int64(len(file.Body)),
+			Name:    filePrefix + f.Name,
+			Mode:    mode,
+			Size:    int64(len(f.Body)),
+			ModTime: opts.ModTime.Truncate(time.Second),
 		}
 		if err := tw.WriteHeader(hdr); err != nil {
-			return nil, err
+			return nil, stats, err
 		}
-		if _, err := tw.Write([]byte(file.Body)); err != nil {
-			return nil, err
+		if _, err := tw.Write(f.Body); err != nil {
+			return nil, stats, err
 		}
 	}
 	if err := tw.Close(); err != nil {
-		return nil, err
+		return nil, stats, err
 	}
-	if err := xw.Close(); err != nil {
-		return nil, err
+	if opts.Schema != nil {
+		if err := opts.Schema.Validate(out.Bytes(), filePrefix); err != nil {
+			return nil, stats, fmt.Errorf("export does not match the schema: %w", err)
+		}
 	}
-	return out.Bytes(), nil
+	return out.Bytes(), stats, nil
 }
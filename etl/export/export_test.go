@@ -3,14 +3,23 @@ package export
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/ed25519"
+	"encoding/csv"
+	"fmt"
 	"io"
 	"log"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jamespfennell/gtfs"
 	"github.com/jamespfennell/gtfs/journal"
+	gtfsrt "github.com/jamespfennell/gtfs/proto"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
 	"github.com/jamespfennell/xz"
+	"github.com/parquet-go/parquet-go"
 )
 
 var trip journal.Trip = journal.Trip{
@@ -50,14 +59,14 @@ var trip journal.Trip = journal.Trip{
 	NumScheduleRewrites: 1,
 }
 
-const expectedTripsCsv = `trip_uid,trip_id,route_id,direction_id,start_time,vehicle_id,last_observed,marked_past,num_updates,num_schedule_changes,num_schedule_rewrites
-TripUID,TripID,RouteID,1,100,VehicleID,400,600,100,2,1
+const expectedTripsCsv = `trip_uid,trip_id,route_id,direction_id,start_time,vehicle_id,last_observed,marked_past,num_updates,num_schedule_changes,num_schedule_rewrites,reached_terminal,is_added,is_canceled,start_date
+TripUID,TripID,RouteID,1,100,VehicleID,400,600,100,2,1,,,,
 `
 
-const expectedStopTimesCsv = `trip_uid,stop_id,track,arrival_time,departure_time,last_observed,marked_past
-TripUID,StopID1,Track1,,200,200,300
-TripUID,StopID2,,300,400,400,
-TripUID,StopID3,Track3,500,,400,
+const expectedStopTimesCsv = `trip_uid,stop_id,track,arrival_time,departure_time,last_observed,marked_past,is_actual,dwell_seconds
+TripUID,StopID1,Track1,,200,200,300,true,
+TripUID,StopID2,,300,400,400,,false,100
+TripUID,StopID3,Track3,500,,400,,false,
 `
 
 func TestAsCsv(t *testing.T) {
@@ -86,6 +95,1956 @@ func TestAsCsv(t *testing.T) {
 	}
 }
 
+const expectedTripsJson = `[
+  {
+    "TripUID": "TripUID",
+    "TripID": "TripID",
+    "RouteID": "RouteID",
+    "DirectionID": 1,
+    "StartTime": 100,
+    "VehicleID": "VehicleID",
+    "LastObserved": 400,
+    "MarkedPast": 600,
+    "NumUpdates": 100,
+    "NumScheduleChanges": 2,
+    "NumScheduleRewrites": 1,
+    "StopTimes": [
+      {
+        "StopID": "StopID1",
+        "Track": "Track1",
+        "ArrivalTime": null,
+        "DepartureTime": 200,
+        "LastObserved": 200,
+        "MarkedPast": 300
+      },
+      {
+        "StopID": "StopID2",
+        "Track": null,
+        "ArrivalTime": 300,
+        "DepartureTime": 400,
+        "LastObserved": 400,
+        "MarkedPast": null
+      },
+      {
+        "StopID": "StopID3",
+        "Track": "Track3",
+        "ArrivalTime": 500,
+        "DepartureTime": null,
+        "LastObserved": 400,
+        "MarkedPast": null
+      }
+    ]
+  }
+]`
+
+func TestAsJson(t *testing.T) {
+	prefix := "somePrefix_"
+
+	result, err := AsJson([]journal.Trip{trip}, prefix, Options{})
+	if err != nil {
+		t.Fatalf("AsJson function failed: %s", err)
+	}
+
+	actualFiles := unTar(result)
+	if len(actualFiles) != 1 {
+		t.Errorf("Expected a single file in tar file, got %d", len(actualFiles))
+	}
+
+	tripsJson, ok := actualFiles[prefix+"trips.json"]
+	if !ok {
+		t.Errorf("Did not find trips file in tar file")
+	} else if tripsJson != expectedTripsJson {
+		t.Errorf("Trips file actual:\n%s\n!= expected:\n%s\n", tripsJson, expectedTripsJson)
+	}
+
+	hashed := Options{VehicleIDAnonymizer: &VehicleIDAnonymizer{Salt: "salt"}}
+	for _, tc := range []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"omitted", Options{OmitVehicleIDs: true}, ""},
+		{"hashed", hashed, `"VehicleID": "` + vehicleID(&hashed, "VehicleID") + `"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := AsJson([]journal.Trip{trip}, prefix, tc.opts)
+			if err != nil {
+				t.Fatalf("AsJson function failed: %s", err)
+			}
+			tripsJson := unTar(result)[prefix+"trips.json"]
+			if strings.Contains(tripsJson, `"VehicleID": "VehicleID"`) {
+				t.Errorf("trips.json contains the raw vehicle ID:\n%s", tripsJson)
+			}
+			if tc.want == "" && strings.Contains(tripsJson, "VehicleID") {
+				t.Errorf("trips.json contains VehicleID:\n%s", tripsJson)
+			}
+			if tc.want != "" && !strings.Contains(tripsJson, tc.want) {
+				t.Errorf("trips.json doesn't contain %s:\n%s", tc.want, tripsJson)
+			}
+		})
+	}
+}
+
+// parquetTripRow is the columns of trips.parquet that TestAsParquet checks. The library doesn't
+// read optional columns into embedded structs, so the rows aren't read as parquetTrip.
+type parquetTripRow struct {
+	TripUID     string  `parquet:"trip_uid"`
+	DirectionID *bool   `parquet:"direction_id,optional"`
+	StartTime   int64   `parquet:"start_time"`
+	VehicleID   string  `parquet:"vehicle_id"`
+	MarkedPast  *int64  `parquet:"marked_past,optional"`
+	NumUpdates  int64   `parquet:"num_updates"`
+	StartDate   *string `parquet:"start_date,optional"`
+}
+
+func TestAsParquet(t *testing.T) {
+	prefix := "somePrefix_"
+	trip2 := trip
+	trip2.TripUID = "TripUID2"
+	trip2.DirectionID = gtfs.DirectionID_Unspecified
+
+	result, err := AsParquet([]journal.Trip{trip, trip2}, prefix, Options{})
+	if err != nil {
+		t.Fatalf("AsParquet function failed: %s", err)
+	}
+	actualFiles := unTar(result)
+
+	tripsParquet := actualFiles[prefix+"trips.parquet"]
+	trips, err := parquet.Read[parquetTripRow](strings.NewReader(tripsParquet), int64(len(tripsParquet)))
+	if err != nil {
+		t.Fatalf("failed to read trips.parquet: %s", err)
+	}
+	if len(trips) != 2 {
+		t.Fatalf("trips.parquet has %d rows, want 2", len(trips))
+	}
+	if got := trips[0]; got.TripUID != "TripUID" || got.DirectionID == nil || !*got.DirectionID || got.StartTime != 100 ||
+		got.MarkedPast == nil || *got.MarkedPast != 600 || got.NumUpdates != 100 || got.StartDate != nil {
+		t.Errorf("first row of trips.parquet = %+v", got)
+	}
+	if got := trips[1]; got.DirectionID != nil {
+		t.Errorf("direction_id of trip with no direction = %v, want null", *got.DirectionID)
+	}
+
+	stopTimesParquet := actualFiles[prefix+"stop_times.parquet"]
+	stopTimes, err := parquet.Read[parquetStopTime](strings.NewReader(stopTimesParquet), int64(len(stopTimesParquet)))
+	if err != nil {
+		t.Fatalf("failed to read stop_times.parquet: %s", err)
+	}
+	if len(stopTimes) != 6 {
+		t.Fatalf("stop_times.parquet has %d rows, want 6", len(stopTimes))
+	}
+	if got := stopTimes[0]; got.Track == nil || *got.Track != "Track1" || got.ArrivalTime != nil ||
+		got.DepartureTime == nil || *got.DepartureTime != 200 || !got.IsActual {
+		t.Errorf("first row of stop_times.parquet = %+v", got)
+	}
+	if got := stopTimes[1]; got.Track != nil || got.DwellSeconds == nil || *got.DwellSeconds != 100 {
+		t.Errorf("second row of stop_times.parquet = %+v", got)
+	}
+
+	// The Parquet files have the same columns as the CSV files.
+	for _, tc := range []struct {
+		schema *parquet.Schema
+		want   []Column
+	}{
+		{parquet.SchemaOf(parquetTrip{}), SchemaFor(Options{}).Files[0].Columns},
+		{parquet.SchemaOf(parquetTripWithoutVehicleID{}), SchemaFor(Options{OmitVehicleIDs: true}).Files[0].Columns},
+		{parquet.SchemaOf(parquetStopTime{}), SchemaFor(Options{}).Files[1].Columns},
+	} {
+		fields := tc.schema.Fields()
+		if len(fields) != len(tc.want) {
+			t.Errorf("%s has %d columns, want %d", tc.schema.Name(), len(fields), len(tc.want))
+			continue
+		}
+		for i, field := range fields {
+			if field.Name() != tc.want[i].Name || field.Optional() != tc.want[i].Nullable {
+				t.Errorf("column %d of %s = %s (optional: %t), want %s (nullable: %t)",
+					i, tc.schema.Name(), field.Name(), field.Optional(), tc.want[i].Name, tc.want[i].Nullable)
+			}
+		}
+	}
+
+	hashed := Options{VehicleIDAnonymizer: &VehicleIDAnonymizer{Salt: "salt"}}
+	result, err = AsParquet([]journal.Trip{trip}, prefix, hashed)
+	if err != nil {
+		t.Fatalf("AsParquet function failed: %s", err)
+	}
+	tripsParquet = unTar(result)[prefix+"trips.parquet"]
+	trips, err = parquet.Read[parquetTripRow](strings.NewReader(tripsParquet), int64(len(tripsParquet)))
+	if err != nil {
+		t.Fatalf("failed to read trips.parquet: %s", err)
+	}
+	if want := vehicleID(&hashed, "VehicleID"); trips[0].VehicleID != want {
+		t.Errorf("vehicle_id with hashed vehicle IDs = %q, want %q", trips[0].VehicleID, want)
+	}
+
+	result, err = AsParquet([]journal.Trip{trip}, prefix, Options{OmitVehicleIDs: true})
+	if err != nil {
+		t.Fatalf("AsParquet function failed: %s", err)
+	}
+	tripsParquet = unTar(result)[prefix+"trips.parquet"]
+	f, err := parquet.OpenFile(strings.NewReader(tripsParquet), int64(len(tripsParquet)))
+	if err != nil {
+		t.Fatalf("failed to open trips.parquet: %s", err)
+	}
+	if _, ok := f.Schema().Lookup("vehicle_id"); ok {
+		t.Errorf("trips.parquet with omitted vehicle IDs has a vehicle_id column")
+	}
+}
+
+func TestExportStore(t *testing.T) {
+	prefix := "somePrefix_"
+	trip2 := trip
+	trip2.TripUID = "TripUID2"
+	trip3 := trip
+	trip3.TripUID = "TripUID3"
+	j := journal.Journal{Trips: []journal.Trip{trip, trip2, trip3}}
+
+	s := NewTripStore(t.TempDir(), 1)
+	for _, trip := range j.Trips {
+		if err := s.Add("", trip); err != nil {
+			t.Fatalf("failed to add trip to store: %s", err)
+		}
+	}
+	if len(s.files) == 0 {
+		t.Errorf("expected trips to be spilled to disk")
+	}
+
+	want, err := Export(&j, prefix)
+	if err != nil {
+		t.Fatalf("Export function failed: %s", err)
+	}
+	got, err := ExportStore(s, prefix, Options{})
+	if err != nil {
+		t.Fatalf("ExportStore function failed: %s", err)
+	}
+	wantFiles := unTar(want)
+	gotFiles := unTar(got)
+	for name, wantFile := range wantFiles {
+		if gotFiles[name] != wantFile {
+			t.Errorf("File %s actual:\n%s\n!= expected:\n%s\n", name, gotFiles[name], wantFile)
+		}
+	}
+}
+
+func TestExportStoreRepeated(t *testing.T) {
+	trip2 := trip
+	trip2.TripUID = "TripUID2"
+	opts := Options{
+		DayStart:           time.Unix(250, 0),
+		DayEnd:             time.Unix(1000, 0),
+		ClipStopTimesToDay: true,
+	}
+	var wantTar []byte
+	var wantStats metadata.ExportStats
+	for _, limit := range []int{0, 1} {
+		s := NewTripStore(t.TempDir(), limit)
+		if err := s.Add("", trip, trip2); err != nil {
+			t.Fatalf("failed to add trips to store: %s", err)
+		}
+		for i := 0; i < 2; i++ {
+			b, stats, err := ExportStoreTar(s, "", opts)
+			if err != nil {
+				t.Fatalf("failed to export: %s", err)
+			}
+			if wantTar == nil {
+				wantTar, wantStats = b, stats
+				continue
+			}
+			if !bytes.Equal(b, wantTar) {
+				t.Errorf("limit=%d export %d: archive differs from the first export", limit, i)
+			}
+			if !reflect.DeepEqual(stats, wantStats) {
+				t.Errorf("limit=%d export %d: stats = %+v, want %+v", limit, i, stats, wantStats)
+			}
+		}
+	}
+	if got := wantStats.Dropped[DropStopTimeOutsideDay]; got != 2 {
+		t.Errorf("dropped %d stop times outside the day, want 2", got)
+	}
+	if len(trip.StopTimes) != 3 {
+		t.Errorf("the export changed the stop times of the trip added to the store")
+	}
+}
+
+func TestTripStoreDump(t *testing.T) {
+	s := NewTripStore(t.TempDir(), 1)
+	if err := s.Add("feed1", trip, trip); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	if err := s.Add("feed2", trip); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	var b bytes.Buffer
+	if err := s.Dump(&b); err != nil {
+		t.Fatalf("failed to dump store: %s", err)
+	}
+	loaded, err := LoadTripStore(&b, t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("failed to load store: %s", err)
+	}
+	var feedIDs []string
+	if err := loaded.Range(func(feedID string, trips []journal.Trip) error {
+		for range trips {
+			feedIDs = append(feedIDs, feedID)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to range over store: %s", err)
+	}
+	if want := []string{"feed1", "feed1", "feed2"}; !reflect.DeepEqual(feedIDs, want) {
+		t.Errorf("feed IDs of loaded trips = %v, want %v", feedIDs, want)
+	}
+	want, err := ExportStore(s, "prefix_", Options{})
+	if err != nil {
+		t.Fatalf("failed to export original store: %s", err)
+	}
+	got, err := ExportStore(loaded, "prefix_", Options{})
+	if err != nil {
+		t.Fatalf("failed to export loaded store: %s", err)
+	}
+	if !reflect.DeepEqual(unTar(got), unTar(want)) {
+		t.Errorf("export of loaded store differs from the export of the original store")
+	}
+}
+
+func TestExportStoreFeed(t *testing.T) {
+	otherTrip := trip
+	otherTrip.TripUID = "OtherTripUID"
+	otherTrip.StopTimes = nil
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("feed1", trip); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	if err := s.Add("feed2", otherTrip); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	b, err := ExportStoreFeed(s, "feed1", "prefix_", Options{})
+	if err != nil {
+		t.Fatalf("failed to export: %s", err)
+	}
+	files := unTar(b)
+	if files["prefix_trips.csv"] != expectedTripsCsv {
+		t.Errorf("Trips file actual:\n%s\n!= expected:\n%s", files["prefix_trips.csv"], expectedTripsCsv)
+	}
+	if files["prefix_stop_times.csv"] != expectedStopTimesCsv {
+		t.Errorf("Stop times file actual:\n%s\n!= expected:\n%s", files["prefix_stop_times.csv"], expectedStopTimesCsv)
+	}
+}
+
+func TestRouteTripCounts(t *testing.T) {
+	otherTrip := trip
+	otherTrip.TripUID = "OtherTripUID"
+	otherTrip.RouteID = "OtherRouteID"
+	b, err := Export(&journal.Journal{Trips: []journal.Trip{trip, otherTrip, trip}}, "prefix_")
+	if err != nil {
+		t.Fatalf("failed to export: %s", err)
+	}
+	counts, err := RouteTripCounts(b)
+	if err != nil {
+		t.Fatalf("failed to count trips: %s", err)
+	}
+	if want := map[string]int{"RouteID": 2, "OtherRouteID": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("route trip counts = %v, want %v", counts, want)
+	}
+}
+
+func TestReadCsv(t *testing.T) {
+	emptyTrip := trip
+	emptyTrip.TripUID = "EmptyTripUID"
+	emptyTrip.StopTimes = nil
+	trip2 := trip
+	trip2.TripUID = "TripUID2"
+	trip2.DirectionID = gtfs.DirectionID_Unspecified
+	trip2.MarkedPast = nil
+	want := []journal.Trip{trip, emptyTrip, trip2}
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("", want...); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	b, _, err := ExportStoreTar(s, "prefix_", Options{IncludeStopSequence: true, IncludeDataDictionary: true})
+	if err != nil {
+		t.Fatalf("failed to export: %s", err)
+	}
+	got, err := ReadCsv(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("failed to read archive: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("read trips:\n%+v\n!= exported trips:\n%+v", got, want)
+	}
+
+	errStop := fmt.Errorf("stop")
+	var n int
+	err = IterateCsv(bytes.NewReader(b), func(journal.Trip) error {
+		n++
+		return errStop
+	})
+	if err != errStop || n != 1 {
+		t.Errorf("IterateCsv returned %v after %d trip(s), want the callback's error after 1", err, n)
+	}
+}
+
+func TestDataDictionary(t *testing.T) {
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("", trip); err != nil {
+		t.Fatalf("failed to add trip to store: %s", err)
+	}
+	result, err := ExportStore(s, "", Options{IncludeDataDictionary: true})
+	if err != nil {
+		t.Fatalf("ExportStore function failed: %s", err)
+	}
+	readme, ok := unTar(result)["README.md"]
+	if !ok {
+		t.Fatalf("Did not find README.md in tar file")
+	}
+	for _, c := range tripColumns(&Options{}) {
+		if !strings.Contains(readme, "`"+c.Name+"`") {
+			t.Errorf("README.md does not describe column %s", c.Name)
+		}
+	}
+	for _, c := range stopTimeColumns(&Options{}) {
+		if !strings.Contains(readme, "`"+c.Name+"`") {
+			t.Errorf("README.md does not describe column %s", c.Name)
+		}
+	}
+	if strings.Contains(readme, "route_otp.csv") {
+		t.Errorf("README.md describes route_otp.csv, which is not in the archive")
+	}
+}
+
+func TestStopSequence(t *testing.T) {
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("", trip); err != nil {
+		t.Fatalf("failed to add trip to store: %s", err)
+	}
+	result, err := ExportStore(s, "", Options{IncludeStopSequence: true})
+	if err != nil {
+		t.Fatalf("ExportStore function failed: %s", err)
+	}
+	want := `trip_uid,stop_id,stop_sequence,track,arrival_time,departure_time,last_observed,marked_past,is_actual,dwell_seconds
+TripUID,StopID1,1,Track1,,200,200,300,true,
+TripUID,StopID2,2,,300,400,400,,false,100
+TripUID,StopID3,3,Track3,500,,400,,false,
+`
+	if got := unTar(result)["stop_times.csv"]; got != want {
+		t.Errorf("Stop times file actual:\n%s\n!= expected:\n%s\n", got, want)
+	}
+}
+
+func TestTravelTime(t *testing.T) {
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("", trip); err != nil {
+		t.Fatalf("failed to add trip to store: %s", err)
+	}
+	result, err := ExportStore(s, "", Options{IncludeTravelTime: true})
+	if err != nil {
+		t.Fatalf("ExportStore function failed: %s", err)
+	}
+	want := `trip_uid,stop_id,track,arrival_time,departure_time,last_observed,marked_past,is_actual,dwell_seconds,travel_seconds
+TripUID,StopID1,Track1,,200,200,300,true,,100
+TripUID,StopID2,,300,400,400,,false,100,100
+TripUID,StopID3,Track3,500,,400,,false,,
+`
+	if got := unTar(result)["stop_times.csv"]; got != want {
+		t.Errorf("Stop times file actual:\n%s\n!= expected:\n%s\n", got, want)
+	}
+
+	backwards := journal.Trip{TripUID: "TripUID", StopTimes: []journal.StopTime{
+		{StopID: "A", DepartureTime: ptr(time.Unix(200, 0))},
+		{StopID: "B", ArrivalTime: ptr(time.Unix(100, 0)), DepartureTime: ptr(time.Unix(300, 0))},
+		{StopID: "C"},
+	}}
+	for i, wantOk := range []bool{true, false, false} {
+		if _, ok := TravelTime(&backwards, i); ok != wantOk {
+			t.Errorf("TravelTime(trip, %d) ok = %t, want %t", i, ok, wantOk)
+		}
+	}
+	if travel, _ := TravelTime(&backwards, 0); travel != -100*time.Second {
+		t.Errorf("TravelTime(trip, 0) = %s, want -100s", travel)
+	}
+}
+
+func TestTripMetrics(t *testing.T) {
+	dwellTimes, travelTimes := TripMetrics(&trip)
+	wantDwellTimes := []*time.Duration{nil, ptr(100 * time.Second), nil}
+	if !reflect.DeepEqual(dwellTimes, wantDwellTimes) {
+		t.Errorf("dwell times = %v, want %v", dwellTimes, wantDwellTimes)
+	}
+	wantTravelTimes := []*time.Duration{ptr(100 * time.Second), ptr(100 * time.Second), nil}
+	if !reflect.DeepEqual(travelTimes, wantTravelTimes) {
+		t.Errorf("travel times = %v, want %v", travelTimes, wantTravelTimes)
+	}
+}
+
+func TestExportStats(t *testing.T) {
+	lateTrip := trip
+	lateTrip.TripUID = "TripUID2"
+	lateTrip.StopTimes = []journal.StopTime{
+		{StopID: "StopID1", ArrivalTime: ptr(time.Unix(5000, 0))},
+	}
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("", trip, lateTrip); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+
+	_, stats, err := ExportStoreTar(s, "", Options{
+		DayStart:           time.Unix(250, 0),
+		DayEnd:             time.Unix(1000, 0),
+		ClipStopTimesToDay: true,
+	})
+	if err != nil {
+		t.Fatalf("ExportStoreTar function failed: %s", err)
+	}
+
+	want := metadata.ExportStats{
+		TripsIn:      2,
+		TripsOut:     1,
+		StopTimesIn:  4,
+		StopTimesOut: 2,
+		FeedTripsOut: map[string]int{"": 1},
+		Dropped: map[string]int{
+			DropStopTimeOutsideDay: 2,
+			DropTripOutsideDay:     1,
+		},
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("ExportStats actual:\n%+v\n!= expected:\n%+v\n", stats, want)
+	}
+}
+
+func TestFeedOverrides(t *testing.T) {
+	otherRouteTrip := trip
+	otherRouteTrip.TripUID = "TripUID2"
+	otherRouteTrip.RouteID = "OtherRouteID"
+	s := NewTripStore(t.TempDir(), 1)
+	if err := s.Add("feed1", trip, otherRouteTrip); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	if err := s.Add("feed2", trip, otherRouteTrip); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+
+	noClip := false
+	_, stats, err := ExportStoreTar(s, "", Options{
+		DayStart:           time.Unix(250, 0),
+		DayEnd:             time.Unix(1000, 0),
+		ClipStopTimesToDay: true,
+		FeedOverrides: map[string]FeedOptions{
+			"feed2": {
+				ClipStopTimesToDay: &noClip,
+				RouteIDs:           []string{"RouteID"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("ExportStoreTar function failed: %s", err)
+	}
+
+	want := metadata.ExportStats{
+		TripsIn:      4,
+		TripsOut:     3,
+		StopTimesIn:  12,
+		StopTimesOut: 7,
+		FeedTripsOut: map[string]int{"feed1": 2, "feed2": 1},
+		Dropped: map[string]int{
+			DropStopTimeOutsideDay: 2,
+			DropRouteNotIncluded:   1,
+		},
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("ExportStats actual:\n%+v\n!= expected:\n%+v\n", stats, want)
+	}
+}
+
+func TestDeterministicArchive(t *testing.T) {
+	modTime := time.Date(2022, time.January, 2, 0, 0, 0, 0, time.UTC)
+	opts := Options{
+		FileMode:              0644,
+		ModTime:               modTime,
+		IncludeDataDictionary: true,
+	}
+	exportOnce := func() []byte {
+		s := NewTripStore(t.TempDir(), 0)
+		if err := s.Add("", trip); err != nil {
+			t.Fatalf("failed to add trips to store: %s", err)
+		}
+		b, err := ExportStore(s, "prefix_", opts)
+		if err != nil {
+			t.Fatalf("ExportStore function failed: %s", err)
+		}
+		return b
+	}
+
+	first := exportOnce()
+	time.Sleep(1100 * time.Millisecond)
+	second := exportOnce()
+	if !bytes.Equal(first, second) {
+		t.Errorf("exporting the same trips twice gave different archives")
+	}
+
+	tr := tar.NewReader(xz.NewReader(bytes.NewReader(first)))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read archive: %s", err)
+		}
+		if hdr.Mode != 0644 || !hdr.ModTime.Equal(modTime) {
+			t.Errorf("file %s has mode %o and mod time %s, want 644 and %s", hdr.Name, hdr.Mode, hdr.ModTime, modTime)
+		}
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("", trip); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	b, err := ExportStore(s, "prefix_", Options{
+		Provenance: &Provenance{
+			DatasetVersion: 4,
+			FeedIDs:        []string{"nycsubway_L"},
+			ServiceDay:     "2022-01-02",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to export: %s", err)
+	}
+	want := `{
+  "DatasetVersion": 4,
+  "FeedIDs": [
+    "nycsubway_L"
+  ],
+  "ServiceDay": "2022-01-02"
+}`
+	if got := unTar(b)["prefix_provenance.json"]; got != want {
+		t.Errorf("provenance.json actual:\n%s\n!= expected:\n%s", got, want)
+	}
+}
+
+func TestSignedManifest(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	otherPublicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("", trip); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	b, _, err := ExportStoreTar(s, "prefix_", Options{
+		IncludeDataDictionary: true,
+		ManifestSigner:        &ManifestSigner{Key: privateKey, KeyID: "key1"},
+	})
+	if err != nil {
+		t.Fatalf("failed to export: %s", err)
+	}
+
+	m, err := VerifyManifest(b, "prefix_", publicKey)
+	if err != nil {
+		t.Fatalf("failed to verify manifest: %s", err)
+	}
+	var names []string
+	for _, f := range m.Files {
+		names = append(names, f.Name)
+	}
+	if want := []string{"README.md", "trips.csv", "stop_times.csv"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("manifest files = %v, want %v", names, want)
+	}
+	if m.KeyID != "key1" {
+		t.Errorf("manifest key ID = %q, want key1", m.KeyID)
+	}
+
+	if _, err := VerifyManifest(b, "prefix_", otherPublicKey); err == nil {
+		t.Errorf("expected an error verifying with the wrong key")
+	}
+	tampered := bytes.Replace(b, []byte("TripUID"), []byte("TripUIE"), 1)
+	if _, err := VerifyManifest(tampered, "prefix_", publicKey); err == nil {
+		t.Errorf("expected an error verifying a modified archive")
+	}
+}
+
+func TestHeadways(t *testing.T) {
+	newTrip := func(tripUID string, directionID gtfs.DirectionID, departure int64) journal.Trip {
+		return journal.Trip{
+			TripUID:     tripUID,
+			RouteID:     "L",
+			DirectionID: directionID,
+			StopTimes: []journal.StopTime{
+				{StopID: "A", DepartureTime: ptr(time.Unix(departure, 0))},
+			},
+		}
+	}
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("",
+		newTrip("3", gtfs.DirectionID_True, 700),
+		newTrip("1", gtfs.DirectionID_True, 100),
+		newTrip("2", gtfs.DirectionID_True, 400),
+		// Only departure in the other direction.
+		newTrip("4", gtfs.DirectionID_False, 500),
+	); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	b, err := ExportStore(s, "prefix_", Options{IncludeHeadways: true})
+	if err != nil {
+		t.Fatalf("failed to export: %s", err)
+	}
+	want := `stop_id,route_id,direction_id,trip_uid,previous_trip_uid,departure_time,headway
+A,L,1,2,1,400,300
+A,L,1,3,2,700,300
+`
+	if got := unTar(b)["prefix_headways.csv"]; got != want {
+		t.Errorf("headways.csv actual:\n%s\n!= expected:\n%s", got, want)
+	}
+}
+
+func TestFirstLast(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("failed to load location: %s", err)
+	}
+	dayStart := time.Date(2023, time.March, 10, 0, 0, 0, 0, loc)
+	newTrip := func(tripUID string, directionID gtfs.DirectionID, stopTimes ...journal.StopTime) journal.Trip {
+		return journal.Trip{TripUID: tripUID, RouteID: "L", DirectionID: directionID, StopTimes: stopTimes}
+	}
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("",
+		newTrip("1", gtfs.DirectionID_True,
+			journal.StopTime{StopID: "A", DepartureTime: ptr(dayStart.Add(5*time.Hour + 30*time.Minute))},
+			journal.StopTime{StopID: "B", ArrivalTime: ptr(dayStart.Add(5*time.Hour + 40*time.Minute))},
+		),
+		newTrip("2", gtfs.DirectionID_True,
+			journal.StopTime{StopID: "A", DepartureTime: ptr(dayStart.Add(12 * time.Hour))},
+		),
+		// Overnight service of the same service day.
+		newTrip("3", gtfs.DirectionID_True,
+			journal.StopTime{StopID: "A", DepartureTime: ptr(dayStart.Add(25*time.Hour + 30*time.Minute))},
+		),
+		newTrip("4", gtfs.DirectionID_Unspecified,
+			journal.StopTime{StopID: "A", DepartureTime: ptr(dayStart.Add(8 * time.Hour))},
+			journal.StopTime{StopID: "B"},
+		),
+	); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	b, err := ExportStore(s, "prefix_", Options{DayStart: dayStart, DayEnd: dayStart.AddDate(0, 0, 1), IncludeFirstLast: true})
+	if err != nil {
+		t.Fatalf("failed to export: %s", err)
+	}
+	want := `stop_id,route_id,direction_id,first_departure,last_departure
+A,L,,08:00:00,08:00:00
+A,L,1,05:30:00,25:30:00
+B,L,1,05:40:00,05:40:00
+`
+	if got := unTar(b)["prefix_first_last.csv"]; got != want {
+		t.Errorf("first_last.csv actual:\n%s\n!= expected:\n%s", got, want)
+	}
+}
+
+func TestStartDate(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("failed to load location: %s", err)
+	}
+	dayStart := time.Date(2023, time.March, 10, 0, 0, 0, 0, loc)
+	message := func(createdAt time.Time, tripUpdates ...gtfs.Trip) *gtfs.Realtime {
+		return &gtfs.Realtime{CreatedAt: createdAt, Trips: tripUpdates}
+	}
+	tripUpdate := func(tripID string, startDate time.Time, hasStartDate bool, startTime time.Duration) gtfs.Trip {
+		return gtfs.Trip{
+			ID: gtfs.TripID{
+				ID:           tripID,
+				HasStartDate: hasStartDate,
+				StartDate:    startDate,
+				StartTime:    startTime,
+			},
+			Vehicle: &gtfs.Vehicle{ID: &gtfs.VehicleID{ID: "vehicle"}},
+		}
+	}
+	// The late trip belongs to the previous service day but starts after midnight, so it is in
+	// the journal of this day.
+	trips := []gtfs.Trip{
+		tripUpdate("000000_L..N", dayStart, true, 10*time.Hour),
+		tripUpdate("000000_M..N", dayStart.AddDate(0, 0, -1), true, 24*time.Hour+30*time.Minute),
+		tripUpdate("000000_G..N", dayStart, false, 11*time.Hour),
+	}
+	source := sliceSource{message(dayStart.Add(12*time.Hour), trips...)}
+	r := NewStartDateRecorder(&source)
+	j := journal.BuildJournal(r, dayStart, dayStart.AddDate(0, 0, 1))
+	if len(j.Trips) != 3 {
+		t.Fatalf("unexpected journal trips: %+v", j.Trips)
+	}
+
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("", j.Trips...); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	b, err := ExportStore(s, "", Options{DayStart: dayStart, DayEnd: dayStart.AddDate(0, 0, 1), StartDates: r.StartDates()})
+	if err != nil {
+		t.Fatalf("failed to export: %s", err)
+	}
+	rows := strings.Split(strings.TrimSpace(unTar(b)["trips.csv"]), "\n")
+	header := strings.Split(rows[0], ",")
+	got := map[string]string{}
+	for _, row := range rows[1:] {
+		values := strings.Split(row, ",")
+		for i, column := range header {
+			if column == "start_date" {
+				got[values[indexOf(header, "trip_id")]] = values[i]
+			}
+		}
+	}
+	// 000000_G..N has no start date in the feed, so it gets the service day.
+	want := map[string]string{"000000_L..N": "20230310", "000000_M..N": "20230309", "000000_G..N": "20230310"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("start dates = %v, want %v", got, want)
+	}
+}
+
+func TestIsAdded(t *testing.T) {
+	dayStart := time.Date(2023, time.March, 10, 0, 0, 0, 0, time.UTC)
+	tripUpdate := func(tripID string, scheduleRelationship gtfs.TripScheduleRelationship) gtfs.Trip {
+		return gtfs.Trip{
+			ID: gtfs.TripID{
+				ID:                   tripID,
+				HasStartDate:         true,
+				StartDate:            dayStart,
+				StartTime:            10 * time.Hour,
+				ScheduleRelationship: scheduleRelationship,
+			},
+			Vehicle: &gtfs.Vehicle{ID: &gtfs.VehicleID{ID: "vehicle"}},
+		}
+	}
+	source := sliceSource{&gtfs.Realtime{
+		CreatedAt: dayStart.Add(12 * time.Hour),
+		Trips: []gtfs.Trip{
+			tripUpdate("000000_L..N", gtfsrt.TripDescriptor_SCHEDULED),
+			tripUpdate("000000_M..N", gtfsrt.TripDescriptor_ADDED),
+			tripUpdate("000000_G..N", gtfsrt.TripDescriptor_CANCELED),
+		},
+	}}
+	r := NewScheduleRelationshipRecorder(&source)
+	j := journal.BuildJournal(r, dayStart, dayStart.AddDate(0, 0, 1))
+	var gotAdded, gotCanceled []string
+	for _, trip := range j.Trips {
+		if r.AddedTrips()[trip.TripUID] {
+			gotAdded = append(gotAdded, trip.TripID)
+		}
+		if r.CanceledTrips()[trip.TripUID] {
+			gotCanceled = append(gotCanceled, trip.TripID)
+		}
+	}
+	if want := []string{"000000_M..N"}; !reflect.DeepEqual(gotAdded, want) {
+		t.Errorf("added trips = %v, want %v", gotAdded, want)
+	}
+	if want := []string{"000000_G..N"}; !reflect.DeepEqual(gotCanceled, want) {
+		t.Errorf("canceled trips = %v, want %v", gotCanceled, want)
+	}
+
+	static := gtfs.Static{
+		Trips: []gtfs.ScheduledTrip{{ID: "Schedule-Weekday_TripID"}},
+	}
+	addedTrip := trip
+	addedTrip.TripUID = "TripUID2"
+	addedTrip.TripID = "AddedTripID"
+	unmatchedTrip := trip
+	unmatchedTrip.TripUID = "TripUID3"
+	unmatchedTrip.TripID = "OtherTripID"
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("", trip, addedTrip, unmatchedTrip); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		schedule *Schedule
+		want     map[string]string
+	}{
+		{"with schedule", NewSchedule(&static), map[string]string{"TripUID": "false", "TripUID2": "true", "TripUID3": ""}},
+		{"without schedule", nil, map[string]string{"TripUID": "", "TripUID2": "true", "TripUID3": ""}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := ExportStore(s, "", Options{
+				DayStart:   time.Unix(0, 0).UTC(),
+				Schedule:   tc.schedule,
+				AddedTrips: AddedTrips{"TripUID2": true},
+			})
+			if err != nil {
+				t.Fatalf("failed to export: %s", err)
+			}
+			rows := strings.Split(strings.TrimSpace(unTar(b)["trips.csv"]), "\n")
+			header := strings.Split(rows[0], ",")
+			got := map[string]string{}
+			for _, row := range rows[1:] {
+				values := strings.Split(row, ",")
+				got[values[indexOf(header, "trip_uid")]] = values[indexOf(header, "is_added")]
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("is_added = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsCanceled(t *testing.T) {
+	canceledTrip := trip
+	canceledTrip.TripUID = "TripUID2"
+	canceledTrip.TripID = "CanceledTripID"
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("", trip, canceledTrip); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	for _, tc := range []struct {
+		name          string
+		canceledTrips CanceledTrips
+		drop          bool
+		want          map[string]string
+	}{
+		{"not recorded", nil, false, map[string]string{"TripUID": "", "TripUID2": ""}},
+		{"recorded", CanceledTrips{"TripUID2": true}, false, map[string]string{"TripUID": "false", "TripUID2": "true"}},
+		{"dropped", CanceledTrips{"TripUID2": true}, true, map[string]string{"TripUID": "false"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := ExportStore(s, "", Options{
+				DayStart:          time.Unix(0, 0).UTC(),
+				CanceledTrips:     tc.canceledTrips,
+				DropCanceledTrips: tc.drop,
+			})
+			if err != nil {
+				t.Fatalf("failed to export: %s", err)
+			}
+			files := unTar(b)
+			rows := strings.Split(strings.TrimSpace(files["trips.csv"]), "\n")
+			header := strings.Split(rows[0], ",")
+			got := map[string]string{}
+			for _, row := range rows[1:] {
+				values := strings.Split(row, ",")
+				got[values[indexOf(header, "trip_uid")]] = values[indexOf(header, "is_canceled")]
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("is_canceled = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDropCanceledTrips(t *testing.T) {
+	newTrips := func() []journal.Trip {
+		return []journal.Trip{
+			{TripUID: "scheduled", StopTimes: []journal.StopTime{{StopID: "A"}}},
+			{TripUID: "canceled", StopTimes: []journal.StopTime{{StopID: "A"}}},
+		}
+	}
+	canceledTrips := CanceledTrips{"canceled": true}
+	for _, drop := range []bool{false, true} {
+		var stats metadata.ExportStats
+		trips := filter(&Options{CanceledTrips: canceledTrips, DropCanceledTrips: drop}, "", newTrips(), &stats)
+		wantTrips, wantDropped := 2, 0
+		if drop {
+			wantTrips, wantDropped = 1, 1
+		}
+		if len(trips) != wantTrips {
+			t.Errorf("drop=%t: got %d trips, want %d", drop, len(trips), wantTrips)
+		}
+		if got := stats.Dropped[DropTripCanceled]; got != wantDropped {
+			t.Errorf("drop=%t: dropped %d trips, want %d", drop, got, wantDropped)
+		}
+	}
+}
+
+func TestStopThroughput(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("failed to load location: %s", err)
+	}
+	// Clocks went back at 2:00 on 2023-11-05, so 1:00-2:00 happened twice.
+	firstOneAm := time.Date(2023, time.November, 5, 5, 0, 0, 0, time.UTC)
+	secondOneAm := firstOneAm.Add(time.Hour)
+	newTrip := func(tripUID, routeID string, stopTimes ...journal.StopTime) journal.Trip {
+		return journal.Trip{TripUID: tripUID, RouteID: routeID, StopTimes: stopTimes}
+	}
+	s := NewTripStore(t.TempDir(), 0)
+	trips := []journal.Trip{
+		newTrip("1", "L",
+			journal.StopTime{StopID: "A", DepartureTime: ptr(firstOneAm.Add(10 * time.Minute))},
+			journal.StopTime{StopID: "B", ArrivalTime: ptr(firstOneAm.Add(70 * time.Minute))},
+		),
+		newTrip("2", "L",
+			journal.StopTime{StopID: "A", DepartureTime: ptr(firstOneAm.Add(50 * time.Minute))},
+			journal.StopTime{StopID: "B"},
+		),
+		newTrip("3", "M",
+			journal.StopTime{StopID: "A", DepartureTime: ptr(secondOneAm.Add(5 * time.Minute))},
+		),
+	}
+	if err := s.Add("", trips...); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	dayStart := time.Date(2023, time.November, 5, 0, 0, 0, 0, loc)
+	b, err := ExportStore(s, "prefix_", Options{DayStart: dayStart, DayEnd: dayStart.AddDate(0, 0, 1), IncludeStopThroughput: true})
+	if err != nil {
+		t.Fatalf("failed to export: %s", err)
+	}
+	want := `stop_id,hour_local,route_id,trip_count
+A,2023-11-05T01:00:00-04:00,L,2
+A,2023-11-05T01:00:00-05:00,M,1
+B,2023-11-05T01:00:00-05:00,L,1
+B,,L,1
+`
+	got := unTar(b)["prefix_stop_throughput.csv"]
+	if got != want {
+		t.Errorf("stop_throughput.csv actual:\n%s\n!= expected:\n%s", got, want)
+	}
+
+	numStopTimes := 0
+	for _, trip := range trips {
+		numStopTimes += len(trip.StopTimes)
+	}
+	total := 0
+	for _, row := range strings.Split(strings.TrimSpace(got), "\n")[1:] {
+		var count int
+		if _, err := fmt.Sscanf(row[strings.LastIndex(row, ",")+1:], "%d", &count); err != nil {
+			t.Fatalf("failed to parse row %q: %s", row, err)
+		}
+		total += count
+	}
+	if total != numStopTimes {
+		t.Errorf("trip counts sum to %d, want the number of stop times %d", total, numStopTimes)
+	}
+}
+
+func TestCombined(t *testing.T) {
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("",
+		journal.Trip{
+			TripUID:      "1",
+			RouteID:      "L",
+			DirectionID:  gtfs.DirectionID_True,
+			StartTime:    time.Unix(100, 0),
+			LastObserved: time.Unix(300, 0),
+			StopTimes: []journal.StopTime{
+				{StopID: "A", DepartureTime: ptr(time.Unix(150, 0)), LastObserved: time.Unix(200, 0)},
+				{StopID: "B", ArrivalTime: ptr(time.Unix(250, 0)), LastObserved: time.Unix(300, 0)},
+			},
+		},
+		journal.Trip{
+			TripUID:      "2",
+			RouteID:      "L",
+			StartTime:    time.Unix(100, 0),
+			LastObserved: time.Unix(100, 0),
+		},
+	); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	b, err := ExportStore(s, "prefix_", Options{IncludeCombined: true})
+	if err != nil {
+		t.Fatalf("failed to export: %s", err)
+	}
+	want := `trip_uid,trip_id,route_id,direction_id,start_time,vehicle_id,last_observed,marked_past,num_updates,num_schedule_changes,num_schedule_rewrites,reached_terminal,is_added,is_canceled,start_date,stop_id,track,arrival_time,departure_time,stop_time_last_observed,stop_time_marked_past,is_actual,dwell_seconds
+1,,L,1,100,,300,,0,0,0,,,,,A,,,150,200,,false,
+1,,L,1,100,,300,,0,0,0,,,,,B,,250,,300,,false,
+2,,L,,100,,100,,0,0,0,,,,,,,,,,,,
+`
+	if got := unTar(b)["prefix_combined.csv"]; got != want {
+		t.Errorf("combined.csv actual:\n%s\n!= expected:\n%s", got, want)
+	}
+}
+
+func TestWriteNdjson(t *testing.T) {
+	j := journal.Journal{Trips: []journal.Trip{trip}}
+	archive, err := Export(&j, "prefix_")
+	if err != nil {
+		t.Fatalf("Export function failed: %s", err)
+	}
+
+	var out strings.Builder
+	if err := WriteNdjson(archive, &out); err != nil {
+		t.Fatalf("WriteNdjson function failed: %s", err)
+	}
+
+	want := `{"trip_uid":"TripUID","trip_id":"TripID","route_id":"RouteID","direction_id":1,"start_time":100,"vehicle_id":"VehicleID",` +
+		`"last_observed":400,"marked_past":600,"num_updates":100,"num_schedule_changes":2,"num_schedule_rewrites":1,"reached_terminal":null,"is_added":null,"is_canceled":null,"start_date":null,` +
+		`"stop_times":[` +
+		`{"trip_uid":"TripUID","stop_id":"StopID1","track":"Track1","arrival_time":null,"departure_time":200,"last_observed":200,"marked_past":300,"is_actual":true,"dwell_seconds":null},` +
+		`{"trip_uid":"TripUID","stop_id":"StopID2","track":null,"arrival_time":300,"departure_time":400,"last_observed":400,"marked_past":null,"is_actual":false,"dwell_seconds":100},` +
+		`{"trip_uid":"TripUID","stop_id":"StopID3","track":"Track3","arrival_time":500,"departure_time":null,"last_observed":400,"marked_past":null,"is_actual":false,"dwell_seconds":null}]}` + "\n"
+	if out.String() != want {
+		t.Errorf("NDJSON actual:\n%s\n!= expected:\n%s\n", out.String(), want)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	columnNames := func(header string) []Column {
+		var columns []Column
+		for _, name := range strings.Split(strings.SplitN(header, "\n", 2)[0], ",") {
+			columns = append(columns, Column{Name: name, Type: "string"})
+		}
+		return columns
+	}
+	schema := Schema{
+		Files: []FileSchema{
+			{Name: "trips.csv", Columns: columnNames(expectedTripsCsv)},
+			{Name: "stop_times.csv", Columns: columnNames(expectedStopTimesCsv)},
+		},
+	}
+	exportWithSchema := func(opts Options) error {
+		s := NewTripStore(t.TempDir(), 0)
+		if err := s.Add("", trip); err != nil {
+			t.Fatalf("failed to add trips to store: %s", err)
+		}
+		opts.Schema = &schema
+		_, _, err := ExportStoreTar(s, "prefix_", opts)
+		return err
+	}
+
+	if err := exportWithSchema(Options{}); err != nil {
+		t.Errorf("export with matching schema failed: %s", err)
+	}
+	if err := exportWithSchema(Options{IncludeStopSequence: true}); err == nil {
+		t.Errorf("expected an error for an export with an extra column")
+	}
+
+	schema.Files[0].Columns[4].Type = "boolean"
+	if err := exportWithSchema(Options{}); err == nil {
+		t.Errorf("expected an error for a value of the wrong type")
+	}
+
+	schema.Files[0].Columns[4].Type = "integer"
+	schema.Files = append(schema.Files, FileSchema{Name: "route_otp.csv"})
+	if err := exportWithSchema(Options{}); err == nil {
+		t.Errorf("expected an error for a file missing from the archive")
+	}
+}
+
+func TestSchemaFor(t *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{
+			IncludeStopSequence:   true,
+			IncludeHeadways:       true,
+			IncludeStopThroughput: true,
+			IncludeCombined:       true,
+			VehicleAssignments:    VehicleAssignments{},
+		},
+	} {
+		s := NewTripStore(t.TempDir(), 0)
+		if err := s.Add("", trip); err != nil {
+			t.Fatalf("failed to add trips to store: %s", err)
+		}
+		opts.Schema = SchemaFor(opts)
+		if _, _, err := ExportStoreTar(s, "prefix_", opts); err != nil {
+			t.Errorf("export doesn't match its own schema: %s", err)
+		}
+	}
+}
+
+type sliceSource []*gtfs.Realtime
+
+func (s *sliceSource) Next() *gtfs.Realtime {
+	if len(*s) == 0 {
+		return nil
+	}
+	next := (*s)[0]
+	*s = (*s)[1:]
+	return next
+}
+
+func TestVehicleAssignments(t *testing.T) {
+	startDate := time.Date(2022, time.January, 2, 0, 0, 0, 0, time.UTC)
+	message := func(createdAt int64, vehicleID string) *gtfs.Realtime {
+		tripUpdate := gtfs.Trip{
+			ID: gtfs.TripID{
+				ID:        "012345_L..N",
+				StartDate: startDate,
+				StartTime: time.Hour,
+			},
+		}
+		if vehicleID != "" {
+			tripUpdate.Vehicle = &gtfs.Vehicle{ID: &gtfs.VehicleID{ID: vehicleID}}
+		}
+		return &gtfs.Realtime{
+			CreatedAt: time.Unix(createdAt, 0),
+			Trips:     []gtfs.Trip{tripUpdate},
+		}
+	}
+	source := sliceSource{
+		message(100, ""),
+		message(200, "A"),
+		message(300, "A"),
+		message(400, "B"),
+	}
+	r := NewVehicleAssignmentRecorder(&source)
+	j := journal.BuildJournal(r, startDate, startDate.Add(24*time.Hour))
+	if len(j.Trips) != 1 || j.Trips[0].VehicleID != "B" {
+		t.Fatalf("unexpected journal trips: %+v", j.Trips)
+	}
+
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("feed", j.Trips...); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+	result, err := ExportStore(s, "", Options{
+		VehicleAssignments: VehicleAssignments{"feed": r.Assignments()},
+	})
+	if err != nil {
+		t.Fatalf("ExportStore function failed: %s", err)
+	}
+	tripUID := j.Trips[0].TripUID
+	want := "trip_uid,vehicle_id,observed_at\n" + tripUID + ",A,200\n" + tripUID + ",B,400\n"
+	if got := unTar(result)["vehicle_assignments.csv"]; got != want {
+		t.Errorf("Vehicle assignments file actual:\n%s\n!= expected:\n%s\n", got, want)
+	}
+}
+
+func TestWindowTrip(t *testing.T) {
+	loc, _ := time.LoadLocation("America/New_York")
+	at := func(hour, minute int) *time.Time {
+		return ptr(time.Date(2022, time.January, 2, hour, minute, 0, 0, loc))
+	}
+	testCases := []struct {
+		name          string
+		window        TimeOfDayWindow
+		stopTimes     []journal.StopTime
+		wantStopIDs   []string
+		wantRemaining bool
+	}{
+		{
+			name:   "spans end of window",
+			window: TimeOfDayWindow{7 * time.Hour, 10 * time.Hour},
+			stopTimes: []journal.StopTime{
+				{StopID: "A", DepartureTime: at(9, 50)},
+				{StopID: "B", ArrivalTime: at(10, 0)},
+				{StopID: "C"},
+			},
+			wantStopIDs:   []string{"A", "C"},
+			wantRemaining: true,
+		},
+		{
+			name:   "wraps around midnight",
+			window: TimeOfDayWindow{23 * time.Hour, time.Hour},
+			stopTimes: []journal.StopTime{
+				{StopID: "A", DepartureTime: at(22, 50)},
+				{StopID: "B", ArrivalTime: at(23, 30)},
+				{StopID: "C", ArrivalTime: at(24, 30)},
+				{StopID: "D", ArrivalTime: at(25, 30)},
+			},
+			wantStopIDs:   []string{"B", "C"},
+			wantRemaining: true,
+		},
+		{
+			name:   "outside window",
+			window: TimeOfDayWindow{7 * time.Hour, 10 * time.Hour},
+			stopTimes: []journal.StopTime{
+				{StopID: "A", ArrivalTime: at(12, 0)},
+			},
+			wantStopIDs:   nil,
+			wantRemaining: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			trip := journal.Trip{StopTimes: tc.stopTimes}
+			remaining := WindowTrip(&trip, tc.window, loc)
+			if remaining != tc.wantRemaining {
+				t.Errorf("WindowTrip() = %t, want %t", remaining, tc.wantRemaining)
+			}
+			var stopIDs []string
+			for _, stopTime := range trip.StopTimes {
+				stopIDs = append(stopIDs, stopTime.StopID)
+			}
+			if !reflect.DeepEqual(stopIDs, tc.wantStopIDs) {
+				t.Errorf("remaining stop IDs = %v, want %v", stopIDs, tc.wantStopIDs)
+			}
+		})
+	}
+}
+
+func TestDropPredictions(t *testing.T) {
+	trip := journal.Trip{
+		StopTimes: []journal.StopTime{
+			// Passed: marked past after the departure.
+			{StopID: "A", DepartureTime: ptr(time.Unix(100, 0)), MarkedPast: ptr(time.Unix(130, 0))},
+			// Passed: marked past after the arrival, even though departure was predicted later.
+			{StopID: "B", ArrivalTime: ptr(time.Unix(200, 0)), DepartureTime: ptr(time.Unix(260, 0)), MarkedPast: ptr(time.Unix(230, 0))},
+			// The trip disappeared from the feed before the train reached the stop.
+			{StopID: "C", ArrivalTime: ptr(time.Unix(400, 0)), MarkedPast: ptr(time.Unix(230, 0))},
+			// Still in the feed at the end of the day.
+			{StopID: "D", ArrivalTime: ptr(time.Unix(500, 0))},
+		},
+	}
+	var stats metadata.ExportStats
+	trips := filter(&Options{DropPredictions: true}, "", []journal.Trip{trip}, &stats)
+	if len(trips) != 1 {
+		t.Fatalf("got %d trips, want 1", len(trips))
+	}
+	var stopIDs []string
+	for _, stopTime := range trips[0].StopTimes {
+		stopIDs = append(stopIDs, stopTime.StopID)
+	}
+	if want := []string{"A", "B"}; !reflect.DeepEqual(stopIDs, want) {
+		t.Errorf("remaining stop IDs = %v, want %v", stopIDs, want)
+	}
+	if got := stats.Dropped[DropStopTimePrediction]; got != 2 {
+		t.Errorf("dropped %d predicted stop times, want 2", got)
+	}
+
+	onlyPredictions := journal.Trip{StopTimes: []journal.StopTime{{StopID: "A", ArrivalTime: ptr(time.Unix(100, 0))}}}
+	trips = filter(&Options{DropPredictions: true}, "", []journal.Trip{onlyPredictions}, &stats)
+	if len(trips) != 0 {
+		t.Errorf("got %d trips, want 0", len(trips))
+	}
+}
+
+func TestDuplicateStopIDs(t *testing.T) {
+	newTrip := func() journal.Trip {
+		return journal.Trip{
+			TripUID: "TripUID",
+			StopTimes: []journal.StopTime{
+				{StopID: "A", ArrivalTime: ptr(time.Unix(100, 0)), LastObserved: time.Unix(100, 0)},
+				{StopID: "B", ArrivalTime: ptr(time.Unix(200, 0)), LastObserved: time.Unix(150, 0)},
+				{StopID: "C", ArrivalTime: ptr(time.Unix(300, 0)), LastObserved: time.Unix(200, 0)},
+				// The feed later reported B again with an updated time.
+				{StopID: "B", ArrivalTime: ptr(time.Unix(250, 0)), LastObserved: time.Unix(250, 0)},
+			},
+		}
+	}
+	testCases := []struct {
+		name          string
+		merge         bool
+		wantStopIDs   []string
+		wantBArrival  int64
+		wantDuplicate int
+	}{
+		{
+			name:         "flag only",
+			merge:        false,
+			wantStopIDs:  []string{"A", "B", "C", "B"},
+			wantBArrival: 200,
+		},
+		{
+			name:          "merge",
+			merge:         true,
+			wantStopIDs:   []string{"A", "B", "C"},
+			wantBArrival:  250,
+			wantDuplicate: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stats metadata.ExportStats
+			trips := filter(&Options{MergeDuplicateStopIDs: tc.merge}, "", []journal.Trip{newTrip()}, &stats)
+			if len(trips) != 1 {
+				t.Fatalf("got %d trips, want 1", len(trips))
+			}
+			var stopIDs []string
+			for _, stopTime := range trips[0].StopTimes {
+				stopIDs = append(stopIDs, stopTime.StopID)
+			}
+			if !reflect.DeepEqual(stopIDs, tc.wantStopIDs) {
+				t.Errorf("stop IDs = %v, want %v", stopIDs, tc.wantStopIDs)
+			}
+			if got := trips[0].StopTimes[1].ArrivalTime.Unix(); got != tc.wantBArrival {
+				t.Errorf("arrival time at B = %d, want %d", got, tc.wantBArrival)
+			}
+			if got := stats.Flagged[FlagDuplicateStopID]; got != 1 {
+				t.Errorf("flagged %d trips with duplicate stop IDs, want 1", got)
+			}
+			if got := stats.Dropped[DropStopTimeDuplicate]; got != tc.wantDuplicate {
+				t.Errorf("dropped %d duplicate stop times, want %d", got, tc.wantDuplicate)
+			}
+		})
+	}
+}
+
+func TestInconsistentDirections(t *testing.T) {
+	newTrip := func(tripUID string, directionID gtfs.DirectionID, lastStopID string) journal.Trip {
+		return journal.Trip{
+			TripUID:     tripUID,
+			RouteID:     "L",
+			DirectionID: directionID,
+			StopTimes: []journal.StopTime{
+				{StopID: "L10N"},
+				{StopID: lastStopID},
+			},
+		}
+	}
+	terminals := map[string]RouteTerminals{
+		"L": {Direction0: []string{"L01N"}, Direction1: []string{"L29S"}},
+	}
+	newTrips := func() []journal.Trip {
+		return []journal.Trip{
+			newTrip("consistent", gtfs.DirectionID_False, "L01N"),
+			newTrip("inconsistent", gtfs.DirectionID_True, "L01N"),
+			newTrip("not at terminal", gtfs.DirectionID_True, "L08N"),
+			newTrip("no direction", gtfs.DirectionID_Unspecified, "L29S"),
+		}
+	}
+	for _, drop := range []bool{false, true} {
+		var stats metadata.ExportStats
+		trips := filter(&Options{RouteTerminals: terminals, DropInconsistentDirections: drop}, "", newTrips(), &stats)
+		if got := stats.Flagged[FlagInconsistentDirectionID]; got != 1 {
+			t.Errorf("drop=%t: flagged %d trips with inconsistent directions, want 1", drop, got)
+		}
+		wantTrips, wantDropped := 4, 0
+		if drop {
+			wantTrips, wantDropped = 3, 1
+		}
+		if len(trips) != wantTrips {
+			t.Errorf("drop=%t: got %d trips, want %d", drop, len(trips), wantTrips)
+		}
+		if got := stats.Dropped[DropTripInconsistentDirectionID]; got != wantDropped {
+			t.Errorf("drop=%t: dropped %d trips, want %d", drop, got, wantDropped)
+		}
+	}
+}
+
+func TestNonRevenueStops(t *testing.T) {
+	newTrips := func() []journal.Trip {
+		return []journal.Trip{
+			{
+				TripUID:   "revenue",
+				StopTimes: []journal.StopTime{{StopID: "A"}, {StopID: "B"}},
+			},
+			{
+				TripUID:   "partly non-revenue",
+				StopTimes: []journal.StopTime{{StopID: "A"}, {StopID: "Yard"}},
+			},
+			{
+				TripUID:   "only non-revenue",
+				StopTimes: []journal.StopTime{{StopID: "Yard"}},
+			},
+		}
+	}
+	nonRevenueStopIDs := map[string]bool{"Yard": true}
+	testCases := []struct {
+		drop             bool
+		wantStopTimes    []int
+		wantDroppedStops int
+		wantDroppedTrips int
+	}{
+		{drop: false, wantStopTimes: []int{2, 2, 1}},
+		{drop: true, wantStopTimes: []int{2, 1}, wantDroppedStops: 2, wantDroppedTrips: 1},
+	}
+	for _, tc := range testCases {
+		var stats metadata.ExportStats
+		trips := filter(&Options{NonRevenueStopIDs: nonRevenueStopIDs, DropNonRevenueStopTimes: tc.drop}, "", newTrips(), &stats)
+		var stopTimes []int
+		for _, trip := range trips {
+			stopTimes = append(stopTimes, len(trip.StopTimes))
+		}
+		if !reflect.DeepEqual(stopTimes, tc.wantStopTimes) {
+			t.Errorf("drop=%t: stop times per trip = %v, want %v", tc.drop, stopTimes, tc.wantStopTimes)
+		}
+		if got := stats.Flagged[FlagNonRevenueStop]; got != 2 {
+			t.Errorf("drop=%t: flagged %d trips, want 2", tc.drop, got)
+		}
+		if got := stats.Dropped[DropStopTimeNonRevenue]; got != tc.wantDroppedStops {
+			t.Errorf("drop=%t: dropped %d stop times, want %d", tc.drop, got, tc.wantDroppedStops)
+		}
+		if got := stats.Dropped[DropTripOnlyNonRevenue]; got != tc.wantDroppedTrips {
+			t.Errorf("drop=%t: dropped %d trips, want %d", tc.drop, got, tc.wantDroppedTrips)
+		}
+	}
+}
+
+func TestNegativeDwellTime(t *testing.T) {
+	badTrip := journal.Trip{
+		TripUID: "TripUID",
+		StopTimes: []journal.StopTime{
+			{StopID: "A", ArrivalTime: ptr(time.Unix(300, 0)), DepartureTime: ptr(time.Unix(200, 0)), LastObserved: time.Unix(300, 0)},
+		},
+	}
+	var stats metadata.ExportStats
+	trips := filter(&Options{}, "", []journal.Trip{badTrip, trip}, &stats)
+	if got := stats.Flagged[FlagNegativeDwellTime]; got != 1 {
+		t.Errorf("flagged %d trips with negative dwell times, want 1", got)
+	}
+	var tripsCsv, stopTimesCsv bytes.Buffer
+	w, err := newCsvWriter(&Options{}, &tripsCsv, &stopTimesCsv)
+	if err != nil {
+		t.Fatalf("failed to create writer: %s", err)
+	}
+	if err := w.write(trips[:1]); err != nil {
+		t.Fatalf("failed to write trips: %s", err)
+	}
+	if err := w.flush(); err != nil {
+		t.Fatalf("failed to write trips: %s", err)
+	}
+	if want := "TripUID,A,,300,200,300,,false,\n"; !strings.HasSuffix(stopTimesCsv.String(), want) {
+		t.Errorf("stop_times.csv = %q, want a row %q with an empty dwell time", stopTimesCsv.String(), want)
+	}
+}
+
+func TestNormalizeTracks(t *testing.T) {
+	r, err := ParseTrackReference([]byte(`{"Tracks": ["1", "2"], "Aliases": {"01": "1"}}`))
+	if err != nil {
+		t.Fatalf("failed to parse track reference: %s", err)
+	}
+	newTrip := func(tracks ...*string) journal.Trip {
+		trip := journal.Trip{TripUID: "TripUID"}
+		for _, track := range tracks {
+			trip.StopTimes = append(trip.StopTimes, journal.StopTime{StopID: "A", Track: track})
+		}
+		return trip
+	}
+	testCases := []struct {
+		trip        journal.Trip
+		wantTracks  []*string
+		wantFlagged int
+	}{
+		{
+			trip:       newTrip(ptr("1"), ptr("01"), ptr(" 2 "), nil),
+			wantTracks: []*string{ptr("1"), ptr("1"), ptr("2"), nil},
+		},
+		{
+			trip:        newTrip(ptr("1"), ptr("X")),
+			wantTracks:  []*string{ptr("1"), ptr("X")},
+			wantFlagged: 1,
+		},
+	}
+	for _, tc := range testCases {
+		var stats metadata.ExportStats
+		trips := filter(&Options{TrackReference: r}, "", []journal.Trip{tc.trip}, &stats)
+		var tracks []*string
+		for _, stopTime := range trips[0].StopTimes {
+			tracks = append(tracks, stopTime.Track)
+		}
+		if !reflect.DeepEqual(tracks, tc.wantTracks) {
+			t.Errorf("tracks = %v, want %v", formatTracks(tracks), formatTracks(tc.wantTracks))
+		}
+		if got := stats.Flagged[FlagUnknownTrack]; got != tc.wantFlagged {
+			t.Errorf("flagged %d trips, want %d", got, tc.wantFlagged)
+		}
+	}
+
+	for _, b := range []string{
+		`{"Tracks": ["1"], "Aliases": {"01": "2"}}`,
+		`{"Tracks": ["1", "01"], "Aliases": {"01": "1"}}`,
+	} {
+		if _, err := ParseTrackReference([]byte(b)); err == nil {
+			t.Errorf("expected an error parsing track reference %s", b)
+		}
+	}
+}
+
+func formatTracks(tracks []*string) []string {
+	var s []string
+	for _, track := range tracks {
+		s = append(s, formatNullableString(track))
+	}
+	return s
+}
+
+func TestClipTripDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("failed to load location: %s", err)
+	}
+	newTrip := func(times ...time.Time) journal.Trip {
+		var stopTimes []journal.StopTime
+		for i := range times {
+			stopTimes = append(stopTimes, journal.StopTime{ArrivalTime: &times[i]})
+		}
+		return journal.Trip{StopTimes: stopTimes}
+	}
+	// On the fall-back day 01:30 happens twice, first in EDT and then in EST.
+	fallBack := metadata.NewDay(2023, time.November, 5)
+	firstOneThirty := time.Date(2023, time.November, 5, 5, 30, 0, 0, time.UTC)
+	secondOneThirty := firstOneThirty.Add(time.Hour)
+	lastMinute := fallBack.End(loc).Add(-time.Minute)
+	trip := newTrip(firstOneThirty, secondOneThirty, lastMinute, lastMinute.Add(2*time.Minute))
+	if !ClipTrip(&trip, fallBack.Start(loc), fallBack.End(loc)) {
+		t.Fatalf("trip on the fall-back day was dropped")
+	}
+	if len(trip.StopTimes) != 3 {
+		t.Errorf("fall-back day: got %d stop times, want 3", len(trip.StopTimes))
+	}
+
+	// On the spring-forward day 23:30 is only 22.5 hours after midnight.
+	springForward := metadata.NewDay(2023, time.March, 12)
+	elevenThirty := time.Date(2023, time.March, 12, 23, 30, 0, 0, loc)
+	nextDay := time.Date(2023, time.March, 13, 0, 30, 0, 0, loc)
+	trip = newTrip(elevenThirty, nextDay)
+	if !ClipTrip(&trip, springForward.Start(loc), springForward.End(loc)) {
+		t.Fatalf("trip on the spring-forward day was dropped")
+	}
+	if len(trip.StopTimes) != 1 || !trip.StopTimes[0].ArrivalTime.Equal(elevenThirty) {
+		t.Errorf("spring-forward day: got stop times %v, want only the one at 23:30", trip.StopTimes)
+	}
+}
+
+func TestMaxTripAge(t *testing.T) {
+	dayEnd := time.Unix(10000, 0)
+	newTrip := func(tripUID string, lastObserved int64) journal.Trip {
+		return journal.Trip{
+			TripUID:      tripUID,
+			LastObserved: time.Unix(lastObserved, 0),
+		}
+	}
+	newTrips := func() []journal.Trip {
+		return []journal.Trip{newTrip("stale", 10000-3601), newTrip("recent", 10000-3600)}
+	}
+	hour := time.Hour
+	noLimit := time.Duration(0)
+	testCases := []struct {
+		name      string
+		opts      Options
+		wantTrips []string
+	}{
+		{"off", Options{DayEnd: dayEnd}, []string{"stale", "recent"}},
+		{"global", Options{DayEnd: dayEnd, MaxTripAge: time.Hour}, []string{"recent"}},
+		{"feed override", Options{DayEnd: dayEnd, FeedOverrides: map[string]FeedOptions{"feed": {MaxTripAge: &hour}}}, []string{"recent"}},
+		{"feed override disables", Options{DayEnd: dayEnd, MaxTripAge: time.Hour, FeedOverrides: map[string]FeedOptions{"feed": {MaxTripAge: &noLimit}}}, []string{"stale", "recent"}},
+		{"preliminary day", Options{DayEnd: dayEnd.Add(12 * time.Hour), DataEnd: dayEnd, MaxTripAge: time.Hour}, []string{"recent"}},
+		{"data end after day end", Options{DayEnd: dayEnd, DataEnd: dayEnd.Add(time.Hour), MaxTripAge: time.Hour}, []string{"recent"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stats metadata.ExportStats
+			var tripUIDs []string
+			for _, trip := range filter(&tc.opts, "feed", newTrips(), &stats) {
+				tripUIDs = append(tripUIDs, trip.TripUID)
+			}
+			if !reflect.DeepEqual(tripUIDs, tc.wantTrips) {
+				t.Errorf("trips = %v, want %v", tripUIDs, tc.wantTrips)
+			}
+			if got, want := stats.Dropped[DropTripStale], 2-len(tc.wantTrips); got != want {
+				t.Errorf("dropped %d stale trips, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestFirstAndLastStopTime(t *testing.T) {
+	singleStopTrip := trip
+	singleStopTrip.StopTimes = trip.StopTimes[1:2]
+	emptyTrip := trip
+	emptyTrip.StopTimes = nil
+
+	testCases := []struct {
+		name      string
+		trip      *journal.Trip
+		wantFirst string
+		wantLast  string
+		wantOk    bool
+	}{
+		{"multiple stops", &trip, "StopID1", "StopID3", true},
+		{"single stop", &singleStopTrip, "StopID2", "StopID2", true},
+		{"no stops", &emptyTrip, "", "", false},
+		{"nil trip", nil, "", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			first, ok := FirstStopTime(tc.trip)
+			if ok != tc.wantOk || first.StopID != tc.wantFirst {
+				t.Errorf("FirstStopTime() = (%s, %t), want (%s, %t)", first.StopID, ok, tc.wantFirst, tc.wantOk)
+			}
+			last, ok := LastStopTime(tc.trip)
+			if ok != tc.wantOk || last.StopID != tc.wantLast {
+				t.Errorf("LastStopTime() = (%s, %t), want (%s, %t)", last.StopID, ok, tc.wantLast, tc.wantOk)
+			}
+		})
+	}
+}
+
+func TestRouteOtp(t *testing.T) {
+	dayStart := time.Unix(0, 0).UTC()
+	route := gtfs.Route{Id: "RouteID"}
+	stop := func(id string) *gtfs.Stop {
+		return &gtfs.Stop{Id: id}
+	}
+	static := gtfs.Static{
+		Trips: []gtfs.ScheduledTrip{
+			{
+				ID:    "Schedule-Weekday_TripID",
+				Route: &route,
+				StopTimes: []gtfs.ScheduledStopTime{
+					// On time
+					{Stop: stop("StopID1"), DepartureTime: 180 * time.Second},
+					// Late
+					{Stop: stop("StopID2"), DepartureTime: 40 * time.Second},
+				},
+			},
+		},
+	}
+	unmatchedTrip := trip
+	unmatchedTrip.TripUID = "TripUID2"
+	unmatchedTrip.TripID = "OtherTripID"
+	j := journal.Journal{Trips: []journal.Trip{trip, unmatchedTrip}}
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("", j.Trips...); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+
+	result, err := ExportStore(s, "", Options{
+		DayStart:         dayStart,
+		Schedule:         NewSchedule(&static),
+		OnTimeThresholds: DefaultOnTimeThresholds(),
+	})
+	if err != nil {
+		t.Fatalf("ExportStore function failed: %s", err)
+	}
+
+	files := unTar(result)
+	want := "route_id,num_trips,num_stop_times,num_on_time,on_time_percent\nRouteID,1,2,1,50.0\n"
+	if got := files["route_otp.csv"]; got != want {
+		t.Errorf("Route OTP file actual:\n%s\n!= expected:\n%s\n", got, want)
+	}
+
+	// The scheduled trip ends at StopID2 but the realtime trip ends at StopID3.
+	wantTrips := `trip_uid,trip_id,route_id,direction_id,start_time,vehicle_id,last_observed,marked_past,num_updates,num_schedule_changes,num_schedule_rewrites,reached_terminal,is_added,is_canceled,start_date
+TripUID,TripID,RouteID,1,100,VehicleID,400,600,100,2,1,false,false,,19700101
+TripUID2,OtherTripID,RouteID,1,100,VehicleID,400,600,100,2,1,,,,19700101
+`
+	if got := files["trips.csv"]; got != wantTrips {
+		t.Errorf("Trips file actual:\n%s\n!= expected:\n%s\n", got, wantTrips)
+	}
+}
+
+func TestServiceDelivery(t *testing.T) {
+	route := gtfs.Route{Id: "RouteID"}
+	// A route of another feed, which isn't listed.
+	otherRoute := gtfs.Route{Id: "G"}
+	static := gtfs.Static{
+		Trips: []gtfs.ScheduledTrip{
+			{ID: "Schedule-Weekday_TripID", Route: &route},
+			{ID: "Schedule-Weekday_PredictedTripID", Route: &route},
+			{ID: "Schedule-Weekday_GTripID", Route: &otherRoute},
+		},
+	}
+	// Matches the same scheduled trip as trip.
+	rerunTrip := trip
+	rerunTrip.TripUID = "TripUID2"
+	predictedTrip := journal.Trip{
+		TripUID:   "TripUID3",
+		TripID:    "PredictedTripID",
+		RouteID:   "RouteID",
+		StopTimes: []journal.StopTime{{StopID: "StopID1", ArrivalTime: ptr(time.Unix(200, 0))}},
+	}
+	unmatchedTrip := trip
+	unmatchedTrip.TripUID = "TripUID4"
+	unmatchedTrip.TripID = "ShuttleTripID"
+	unmatchedTrip.RouteID = "Shuttle"
+	s := NewTripStore(t.TempDir(), 0)
+	if err := s.Add("", trip, rerunTrip, predictedTrip, unmatchedTrip); err != nil {
+		t.Fatalf("failed to add trips to store: %s", err)
+	}
+
+	result, err := ExportStore(s, "", Options{
+		DayStart:               time.Unix(0, 0).UTC(),
+		Schedule:               NewSchedule(&static),
+		IncludeServiceDelivery: true,
+	})
+	if err != nil {
+		t.Fatalf("ExportStore function failed: %s", err)
+	}
+
+	want := `route_id,num_scheduled,num_operated,num_unmatched,delivery_percent
+RouteID,2,1,0,50.0
+Shuttle,0,0,1,
+`
+	if got := unTar(result)["service_delivery.csv"]; got != want {
+		t.Errorf("Service delivery file actual:\n%s\n!= expected:\n%s\n", got, want)
+	}
+}
+
+func TestVehicleIDs(t *testing.T) {
+	day1 := time.Date(2022, time.January, 2, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	exportVehicleIDs := func(opts Options) []string {
+		s := NewTripStore(t.TempDir(), 0)
+		otherTrip := trip
+		otherTrip.TripUID = "TripUID2"
+		if err := s.Add("", trip, otherTrip); err != nil {
+			t.Fatalf("failed to add trips to store: %s", err)
+		}
+		b, err := ExportStore(s, "", opts)
+		if err != nil {
+			t.Fatalf("ExportStore function failed: %s", err)
+		}
+		records, err := csv.NewReader(strings.NewReader(unTar(b)["trips.csv"])).ReadAll()
+		if err != nil {
+			t.Fatalf("failed to parse trips.csv: %s", err)
+		}
+		i := slices.Index(records[0], "vehicle_id")
+		if i < 0 {
+			return nil
+		}
+		var vehicleIDs []string
+		for _, record := range records[1:] {
+			vehicleIDs = append(vehicleIDs, record[i])
+		}
+		return vehicleIDs
+	}
+
+	if got := exportVehicleIDs(Options{DayStart: day1, OmitVehicleIDs: true}); got != nil {
+		t.Errorf("vehicle IDs = %v, want no vehicle_id column", got)
+	}
+
+	anonymizer := &VehicleIDAnonymizer{Salt: "salt"}
+	got1 := exportVehicleIDs(Options{DayStart: day1, VehicleIDAnonymizer: anonymizer})
+	got2 := exportVehicleIDs(Options{DayStart: day2, VehicleIDAnonymizer: anonymizer})
+	if len(got1[0]) != 16 || got1[0] == "VehicleID" {
+		t.Errorf("vehicle ID = %q, want a 16 character hash", got1[0])
+	}
+	if got1[0] != got1[1] {
+		t.Errorf("vehicle IDs within a day = %v, want the same hash", got1)
+	}
+	if got1[0] == got2[0] {
+		t.Errorf("vehicle IDs on different days = %q and %q, want different hashes", got1[0], got2[0])
+	}
+
+	anonymizer.StableAcrossDays = true
+	got1 = exportVehicleIDs(Options{DayStart: day1, VehicleIDAnonymizer: anonymizer})
+	got2 = exportVehicleIDs(Options{DayStart: day2, VehicleIDAnonymizer: anonymizer})
+	if got1[0] != got2[0] {
+		t.Errorf("vehicle IDs on different days = %q and %q, want the same hash", got1[0], got2[0])
+	}
+}
+
+func TestClipTrip(t *testing.T) {
+	loc, _ := time.LoadLocation("America/New_York")
+	dayStart := time.Date(2022, time.January, 2, 0, 0, 0, 0, loc)
+	dayEnd := time.Date(2022, time.January, 3, 0, 0, 0, 0, loc)
+	at := func(hour, minute int) *time.Time {
+		return ptr(time.Date(2022, time.January, 2, hour, minute, 0, 0, loc))
+	}
+
+	testCases := []struct {
+		name          string
+		stopTimes     []journal.StopTime
+		wantStopIDs   []string
+		wantRemaining bool
+	}{
+		{
+			name: "straddles start of day",
+			stopTimes: []journal.StopTime{
+				{StopID: "A", DepartureTime: at(-1, 50)},
+				{StopID: "B", ArrivalTime: at(-1, 59), DepartureTime: at(0, 1)},
+				{StopID: "C", ArrivalTime: at(0, 10)},
+			},
+			wantStopIDs:   []string{"C"},
+			wantRemaining: true,
+		},
+		{
+			name: "straddles end of day",
+			stopTimes: []journal.StopTime{
+				{StopID: "A", DepartureTime: at(23, 50)},
+				{StopID: "B", ArrivalTime: at(24, 0)},
+				{StopID: "C", ArrivalTime: at(24, 10)},
+			},
+			wantStopIDs:   []string{"A"},
+			wantRemaining: true,
+		},
+		{
+			name: "entirely outside",
+			stopTimes: []journal.StopTime{
+				{StopID: "A", DepartureTime: at(24, 5)},
+				{StopID: "B", ArrivalTime: at(24, 10)},
+			},
+			wantRemaining: false,
+		},
+		{
+			name: "stop time without times is retained",
+			stopTimes: []journal.StopTime{
+				{StopID: "A"},
+			},
+			wantStopIDs:   []string{"A"},
+			wantRemaining: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			trip := journal.Trip{StopTimes: tc.stopTimes}
+			remaining := ClipTrip(&trip, dayStart, dayEnd)
+			if remaining != tc.wantRemaining {
+				t.Errorf("ClipTrip() = %t, want %t", remaining, tc.wantRemaining)
+			}
+			var stopIDs []string
+			for _, stopTime := range trip.StopTimes {
+				stopIDs = append(stopIDs, stopTime.StopID)
+			}
+			if !reflect.DeepEqual(stopIDs, tc.wantStopIDs) {
+				t.Errorf("Remaining stop IDs = %v, want %v", stopIDs, tc.wantStopIDs)
+			}
+		})
+	}
+}
+
+func TestExportChanges(t *testing.T) {
+	newTrip := func(tripUID string, stopIDs ...string) journal.Trip {
+		trip := journal.Trip{TripUID: tripUID, RouteID: "L"}
+		for _, stopID := range stopIDs {
+			trip.StopTimes = append(trip.StopTimes, journal.StopTime{StopID: stopID})
+		}
+		return trip
+	}
+	exportTrips := func(opts Options, trips ...journal.Trip) []byte {
+		s := NewTripStore(t.TempDir(), 0)
+		if err := s.Add("", trips...); err != nil {
+			t.Fatalf("failed to add trips to store: %s", err)
+		}
+		b, _, err := ExportStoreTar(s, "prefix_", opts)
+		if err != nil {
+			t.Fatalf("failed to export trips: %s", err)
+		}
+		return b
+	}
+	previous := exportTrips(Options{},
+		newTrip("unchanged", "A", "B"),
+		newTrip("changed", "A", "B"),
+		newTrip("removed", "A"),
+	)
+	current := exportTrips(Options{},
+		newTrip("unchanged", "A", "B"),
+		newTrip("changed", "A", "C"),
+		newTrip("added", "B"),
+	)
+
+	b, stats, err := ExportChanges(previous, current, "prefix_changes_", Options{})
+	if err != nil {
+		t.Fatalf("ExportChanges() err = %s", err)
+	}
+	if want := (ChangeStats{Added: 1, Removed: 1, Changed: 1}); stats != want {
+		t.Errorf("ExportChanges() stats = %+v, want %+v", stats, want)
+	}
+	compressed, err := Compress(b)
+	if err != nil {
+		t.Fatalf("failed to compress archive: %s", err)
+	}
+	files := unTar(compressed)
+	var gotTrips, gotStopTimes []string
+	for _, line := range strings.Split(strings.TrimSpace(files["prefix_changes_trips.csv"]), "\n")[1:] {
+		fields := strings.Split(line, ",")
+		gotTrips = append(gotTrips, fields[0]+":"+fields[1])
+	}
+	for _, line := range strings.Split(strings.TrimSpace(files["prefix_changes_stop_times.csv"]), "\n")[1:] {
+		fields := strings.Split(line, ",")
+		gotStopTimes = append(gotStopTimes, fields[0]+":"+fields[1])
+	}
+	wantTrips := []string{"changed:changed", "added:added", "removed:removed"}
+	if !reflect.DeepEqual(gotTrips, wantTrips) {
+		t.Errorf("trips = %v, want %v", gotTrips, wantTrips)
+	}
+	wantStopTimes := []string{"changed:A", "changed:C", "added:B"}
+	if !reflect.DeepEqual(gotStopTimes, wantStopTimes) {
+		t.Errorf("stop times = %v, want %v", gotStopTimes, wantStopTimes)
+	}
+
+	// Adding a column changes every trip that has values in it.
+	_, stats, err = ExportChanges(previous, exportTrips(Options{IncludeStopSequence: true}, newTrip("unchanged", "A", "B")), "prefix_changes_", Options{})
+	if err != nil {
+		t.Fatalf("ExportChanges() err = %s", err)
+	}
+	if want := (ChangeStats{Removed: 2, Changed: 1}); stats != want {
+		t.Errorf("ExportChanges() with new column stats = %+v, want %+v", stats, want)
+	}
+}
+
 func unTar(b []byte) map[string]string {
 	result := map[string]string{}
 	buf := bytes.NewBuffer(b)
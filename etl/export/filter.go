@@ -0,0 +1,177 @@
+package export
+
+import (
+	"time"
+
+	"github.com/jamespfennell/gtfs/journal"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+// Reasons that trips and stop times are dropped from the export.
+const (
+	DropStopTimeOutsideDay          = "stop_time_outside_day"
+	DropTripOutsideDay              = "trip_outside_day"
+	DropRouteNotIncluded            = "route_not_included"
+	DropStopTimeOutsideWindow       = "stop_time_outside_window"
+	DropTripOutsideWindow           = "trip_outside_window"
+	DropStopTimePrediction          = "stop_time_prediction"
+	DropTripOnlyPredictions         = "trip_only_predictions"
+	DropStopTimeDuplicate           = "stop_time_duplicate"
+	DropTripInconsistentDirectionID = "trip_inconsistent_direction_id"
+	DropStopTimeNonRevenue          = "stop_time_non_revenue"
+	DropTripOnlyNonRevenue          = "trip_only_non_revenue"
+	DropTripStale                   = "trip_stale"
+	DropTripCanceled                = "trip_canceled"
+)
+
+// Data quality issues that trips are flagged for in the export stats.
+const (
+	FlagDuplicateStopID         = "duplicate_stop_id"
+	FlagInconsistentDirectionID = "inconsistent_direction_id"
+	FlagNonRevenueStop          = "non_revenue_stop"
+	FlagNegativeDwellTime       = "negative_dwell_time"
+	FlagUnknownTrack            = "unknown_track"
+)
+
+// FeedOptions overrides the trip filtering options for the trips of a single feed.
+//
+// Nil or empty fields inherit the value from the archive-wide Options.
+type FeedOptions struct {
+	// Overrides Options.ClipStopTimesToDay.
+	ClipStopTimesToDay *bool
+
+	// If non-empty, only trips with one of these route IDs are exported.
+	RouteIDs []string
+
+	// Overrides Options.MaxTripAge.
+	MaxTripAge *time.Duration
+}
+
+// resolvedFilter is the filtering options that apply to the trips of one feed.
+type resolvedFilter struct {
+	clipStopTimesToDay bool
+	routeIDs           map[string]bool
+	maxTripAge         time.Duration
+}
+
+func resolveFilter(opts *Options, feedID string) resolvedFilter {
+	f := resolvedFilter{
+		clipStopTimesToDay: opts.ClipStopTimesToDay,
+		maxTripAge:         opts.MaxTripAge,
+	}
+	override, ok := opts.FeedOverrides[feedID]
+	if !ok {
+		return f
+	}
+	if override.ClipStopTimesToDay != nil {
+		f.clipStopTimesToDay = *override.ClipStopTimesToDay
+	}
+	if override.MaxTripAge != nil {
+		f.maxTripAge = *override.MaxTripAge
+	}
+	if len(override.RouteIDs) > 0 {
+		f.routeIDs = map[string]bool{}
+		for _, routeID := range override.RouteIDs {
+			f.routeIDs[routeID] = true
+		}
+	}
+	return f
+}
+
+// filter removes trips and stop times from a chunk of trips from the feed before it is exported,
+// and records what was removed in the stats.
+func filter(opts *Options, feedID string, trips []journal.Trip, stats *metadata.ExportStats) []journal.Trip {
+	f := resolveFilter(opts, feedID)
+	staleCutoff := opts.DayEnd
+	if !opts.DataEnd.IsZero() && opts.DataEnd.Before(staleCutoff) {
+		staleCutoff = opts.DataEnd
+	}
+	staleCutoff = staleCutoff.Add(-f.maxTripAge)
+	var result []journal.Trip
+	for i := range trips {
+		// The trips belong to the store and may be exported again, e.g. per feed, so the filters
+		// work on copies.
+		t := trips[i]
+		t.StopTimes = append([]journal.StopTime(nil), t.StopTimes...)
+		trip := &t
+		stats.TripsIn++
+		stats.StopTimesIn += len(trip.StopTimes)
+		if f.routeIDs != nil && !f.routeIDs[trip.RouteID] {
+			stats.Drop(DropRouteNotIncluded, 1)
+			continue
+		}
+		if opts.DropCanceledTrips && opts.CanceledTrips[trip.TripUID] {
+			stats.Drop(DropTripCanceled, 1)
+			continue
+		}
+		if f.maxTripAge > 0 && trip.LastObserved.Before(staleCutoff) {
+			stats.Drop(DropTripStale, 1)
+			continue
+		}
+		if CountDuplicateStopIDs(trip) > 0 {
+			stats.Flag(FlagDuplicateStopID, 1)
+			if opts.MergeDuplicateStopIDs {
+				stats.Drop(DropStopTimeDuplicate, MergeDuplicateStopIDs(trip))
+			}
+		}
+		if IsDirectionInconsistent(trip, opts.RouteTerminals) {
+			stats.Flag(FlagInconsistentDirectionID, 1)
+			if opts.DropInconsistentDirections {
+				stats.Drop(DropTripInconsistentDirectionID, 1)
+				continue
+			}
+		}
+		if n := CountNonRevenueStopTimes(trip, opts.NonRevenueStopIDs); n > 0 {
+			stats.Flag(FlagNonRevenueStop, 1)
+			if opts.DropNonRevenueStopTimes {
+				remaining := DropNonRevenueStopTimes(trip, opts.NonRevenueStopIDs)
+				stats.Drop(DropStopTimeNonRevenue, n)
+				if !remaining {
+					stats.Drop(DropTripOnlyNonRevenue, 1)
+					continue
+				}
+			}
+		}
+		if f.clipStopTimesToDay {
+			numStopTimes := len(trip.StopTimes)
+			remaining := ClipTrip(trip, opts.DayStart, opts.DayEnd)
+			stats.Drop(DropStopTimeOutsideDay, numStopTimes-len(trip.StopTimes))
+			if !remaining {
+				stats.Drop(DropTripOutsideDay, 1)
+				continue
+			}
+		}
+		if opts.TimeOfDayWindow != nil {
+			numStopTimes := len(trip.StopTimes)
+			remaining := WindowTrip(trip, *opts.TimeOfDayWindow, opts.DayStart.Location())
+			stats.Drop(DropStopTimeOutsideWindow, numStopTimes-len(trip.StopTimes))
+			if !remaining {
+				stats.Drop(DropTripOutsideWindow, 1)
+				continue
+			}
+		}
+		if opts.DropPredictions {
+			numStopTimes := len(trip.StopTimes)
+			remaining := DropPredictions(trip)
+			stats.Drop(DropStopTimePrediction, numStopTimes-len(trip.StopTimes))
+			if !remaining {
+				stats.Drop(DropTripOnlyPredictions, 1)
+				continue
+			}
+		}
+		if CountNegativeDwellTimes(trip) > 0 {
+			stats.Flag(FlagNegativeDwellTime, 1)
+		}
+		if opts.TrackReference != nil && NormalizeTracks(trip, opts.TrackReference) > 0 {
+			stats.Flag(FlagUnknownTrack, 1)
+		}
+		stats.TripsOut++
+		stats.StopTimesOut += len(trip.StopTimes)
+		if stats.FeedTripsOut == nil {
+			stats.FeedTripsOut = map[string]int{}
+		}
+		stats.FeedTripsOut[feedID]++
+		result = append(result, *trip)
+	}
+	return result
+}
@@ -0,0 +1,120 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+type firstLastDepartures struct {
+	first, last time.Time
+}
+
+// firstLastExport computes the first and last departure at each stop of each route in each
+// direction.
+//
+// As in headways.csv, departures are grouped by stop ID, route ID and direction ID, and the
+// departure time of a stop time is used, or the arrival time if there is no departure time, as at
+// terminals.
+//
+// All trips in an export belong to the service day starting at Options.DayStart, even when they
+// run after midnight, so the last departure of overnight service is after midnight and later than
+// every other departure of the day. Times are written as in the GTFS static format: the time
+// since noon minus 12 hours on the service day, in the location of DayStart, as HH:MM:SS. Times
+// after midnight are therefore 24:00:00 or more; e.g., a last train at 1:30 the next morning is
+// 25:30:00.
+type firstLastExport struct {
+	serviceDayStart time.Time
+	departures      map[headwayKey]*firstLastDepartures
+}
+
+func newFirstLastExport(opts Options) *firstLastExport {
+	noon := time.Date(opts.DayStart.Year(), opts.DayStart.Month(), opts.DayStart.Day(), 12, 0, 0, 0, opts.DayStart.Location())
+	return &firstLastExport{
+		serviceDayStart: noon.Add(-12 * time.Hour),
+		departures:      map[headwayKey]*firstLastDepartures{},
+	}
+}
+
+func (e *firstLastExport) fileName() string {
+	return "first_last.csv"
+}
+
+func (e *firstLastExport) columns() []Column {
+	return []Column{
+		{"stop_id", "string", "", false, "Stop ID from the GTFS-RT feed."},
+		{"route_id", "string", "", false, "Route ID of the trips."},
+		{"direction_id", "integer", "", true, "Direction ID of the trips: 0 or 1."},
+		{"first_departure", "string", "HH:MM:SS", false, "First departure of the service day, or arrival if the trip has no departure time. Times after midnight are 24:00:00 or more, as in GTFS."},
+		{"last_departure", "string", "HH:MM:SS", false, "Last departure of the service day, or arrival if the trip has no departure time. Times after midnight are 24:00:00 or more, as in GTFS."},
+	}
+}
+
+func (e *firstLastExport) add(_ string, trips []journal.Trip) {
+	for i := range trips {
+		trip := &trips[i]
+		for _, stopTime := range trip.StopTimes {
+			t := stopTime.DepartureTime
+			if t == nil {
+				t = stopTime.ArrivalTime
+			}
+			if t == nil {
+				continue
+			}
+			key := headwayKey{
+				stopID:      stopTime.StopID,
+				routeID:     trip.RouteID,
+				directionID: formatDirectionID(trip.DirectionID),
+			}
+			d, ok := e.departures[key]
+			if !ok {
+				e.departures[key] = &firstLastDepartures{first: *t, last: *t}
+				continue
+			}
+			if t.Before(d.first) {
+				d.first = *t
+			}
+			if t.After(d.last) {
+				d.last = *t
+			}
+		}
+	}
+}
+
+func (e *firstLastExport) csv() []byte {
+	var keys []headwayKey
+	for key := range e.departures {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].stopID != keys[j].stopID {
+			return keys[i].stopID < keys[j].stopID
+		}
+		if keys[i].routeID != keys[j].routeID {
+			return keys[i].routeID < keys[j].routeID
+		}
+		return keys[i].directionID < keys[j].directionID
+	})
+	var b bytes.Buffer
+	b.WriteString("stop_id,route_id,direction_id,first_departure,last_departure\n")
+	for _, key := range keys {
+		d := e.departures[key]
+		fmt.Fprintf(&b, "%s,%s,%s,%s,%s\n", key.stopID, key.routeID, key.directionID,
+			e.formatServiceTime(d.first), e.formatServiceTime(d.last))
+	}
+	return b.Bytes()
+}
+
+// formatServiceTime formats the time since the start of the service day as HH:MM:SS. Times before
+// the start of the service day are negative.
+func (e *firstLastExport) formatServiceTime(t time.Time) string {
+	seconds := int64(t.Sub(e.serviceDayStart) / time.Second)
+	sign := ""
+	if seconds < 0 {
+		sign, seconds = "-", -seconds
+	}
+	return fmt.Sprintf("%s%02d:%02d:%02d", sign, seconds/3600, seconds/60%60, seconds%60)
+}
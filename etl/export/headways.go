@@ -0,0 +1,103 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+type headwayKey struct {
+	stopID      string
+	routeID     string
+	directionID string
+}
+
+type headwayDeparture struct {
+	tripUID string
+	time    time.Time
+}
+
+// headwaysExport computes the time between consecutive departures at each stop.
+//
+// Departures are grouped by stop ID, route ID and direction ID, so trains of different routes
+// and trains going in opposite directions through the same stop are separate series. Trips
+// with no direction ID form their own series. The departure time of a stop time is used, or
+// the arrival time if there is no departure time, as at terminals. Series with a single
+// departure have no headways and are omitted.
+type headwaysExport struct {
+	departures map[headwayKey][]headwayDeparture
+}
+
+func newHeadwaysExport() *headwaysExport {
+	return &headwaysExport{departures: map[headwayKey][]headwayDeparture{}}
+}
+
+func (e *headwaysExport) fileName() string {
+	return "headways.csv"
+}
+
+func (e *headwaysExport) columns() []Column {
+	return []Column{
+		{"stop_id", "string", "", false, "Stop ID from the GTFS-RT feed."},
+		{"route_id", "string", "", false, "Route ID of both trips."},
+		{"direction_id", "integer", "", true, "Direction ID of both trips: 0 or 1."},
+		{"trip_uid", "string", "", false, "Trip that departed; references trips.csv."},
+		{"previous_trip_uid", "string", "", false, "Previous trip of the route in the direction to depart the stop; references trips.csv."},
+		{"departure_time", "integer", "unix seconds", false, "Departure time of the trip, or its arrival time if it has no departure time."},
+		{"headway", "integer", "seconds", false, "Time since the previous trip departed."},
+	}
+}
+
+func (e *headwaysExport) add(_ string, trips []journal.Trip) {
+	for i := range trips {
+		trip := &trips[i]
+		for _, stopTime := range trip.StopTimes {
+			t := stopTime.DepartureTime
+			if t == nil {
+				t = stopTime.ArrivalTime
+			}
+			if t == nil {
+				continue
+			}
+			key := headwayKey{
+				stopID:      stopTime.StopID,
+				routeID:     trip.RouteID,
+				directionID: formatDirectionID(trip.DirectionID),
+			}
+			e.departures[key] = append(e.departures[key], headwayDeparture{tripUID: trip.TripUID, time: *t})
+		}
+	}
+}
+
+func (e *headwaysExport) csv() []byte {
+	var keys []headwayKey
+	for key := range e.departures {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].stopID != keys[j].stopID {
+			return keys[i].stopID < keys[j].stopID
+		}
+		if keys[i].routeID != keys[j].routeID {
+			return keys[i].routeID < keys[j].routeID
+		}
+		return keys[i].directionID < keys[j].directionID
+	})
+	var b bytes.Buffer
+	b.WriteString("stop_id,route_id,direction_id,trip_uid,previous_trip_uid,departure_time,headway\n")
+	for _, key := range keys {
+		departures := e.departures[key]
+		sort.SliceStable(departures, func(i, j int) bool {
+			return departures[i].time.Before(departures[j].time)
+		})
+		for i := 1; i < len(departures); i++ {
+			fmt.Fprintf(&b, "%s,%s,%s,%s,%s,%d,%d\n", key.stopID, key.routeID, key.directionID,
+				departures[i].tripUID, departures[i-1].tripUID, departures[i].time.Unix(),
+				departures[i].time.Unix()-departures[i-1].time.Unix())
+		}
+	}
+	return b.Bytes()
+}
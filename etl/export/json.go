@@ -0,0 +1,116 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jamespfennell/gtfs"
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+// jsonTrip is a trip in trips.json. Times are unix seconds, as in the CSV files, and are null if
+// the trip doesn't have them. VehicleID is left out if vehicle IDs are omitted.
+type jsonTrip struct {
+	TripUID             string
+	TripID              string
+	RouteID             string
+	DirectionID         *int
+	StartTime           int64
+	VehicleID           *string `json:",omitempty"`
+	LastObserved        int64
+	MarkedPast          *int64
+	NumUpdates          int
+	NumScheduleChanges  int
+	NumScheduleRewrites int
+	StopTimes           []jsonStopTime
+}
+
+type jsonStopTime struct {
+	StopID        string
+	Track         *string
+	ArrivalTime   *int64
+	DepartureTime *int64
+	LastObserved  int64
+	MarkedPast    *int64
+}
+
+// AsJson exports the trips as a tar.xz archive containing a single <prefix>trips.json file: an
+// array of trip objects, each with its stop times as a nested array.
+//
+// Unlike the CSV export, no filters or derived files are applied; every trip is included as it is.
+// Of the options, only OmitVehicleIDs and VehicleIDAnonymizer are used.
+func AsJson(trips []journal.Trip, prefix string, opts Options) ([]byte, error) {
+	jsonTrips := make([]jsonTrip, 0, len(trips))
+	for i := range trips {
+		jsonTrips = append(jsonTrips, newJsonTrip(&opts, &trips[i]))
+	}
+	b, err := json.MarshalIndent(jsonTrips, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode trips as JSON: %w", err)
+	}
+	var out bytes.Buffer
+	tw := tar.NewWriter(&out)
+	if err := tw.WriteHeader(&tar.Header{
+		Name: prefix + "trips.json",
+		Mode: DefaultFileMode,
+		Size: int64(len(b)),
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return Compress(out.Bytes())
+}
+
+func newJsonTrip(opts *Options, trip *journal.Trip) jsonTrip {
+	t := jsonTrip{
+		TripUID:             trip.TripUID,
+		TripID:              trip.TripID,
+		RouteID:             trip.RouteID,
+		StartTime:           trip.StartTime.Unix(),
+		LastObserved:        trip.LastObserved.Unix(),
+		MarkedPast:          unixOrNull(trip.MarkedPast),
+		NumUpdates:          trip.NumUpdates,
+		NumScheduleChanges:  trip.NumScheduleChanges,
+		NumScheduleRewrites: trip.NumScheduleRewrites,
+		StopTimes:           make([]jsonStopTime, 0, len(trip.StopTimes)),
+	}
+	if !opts.OmitVehicleIDs {
+		vehicleID := vehicleID(opts, trip.VehicleID)
+		t.VehicleID = &vehicleID
+	}
+	switch trip.DirectionID {
+	case gtfs.DirectionID_False:
+		directionID := 0
+		t.DirectionID = &directionID
+	case gtfs.DirectionID_True:
+		directionID := 1
+		t.DirectionID = &directionID
+	}
+	for _, stopTime := range trip.StopTimes {
+		t.StopTimes = append(t.StopTimes, jsonStopTime{
+			StopID:        stopTime.StopID,
+			Track:         stopTime.Track,
+			ArrivalTime:   unixOrNull(stopTime.ArrivalTime),
+			DepartureTime: unixOrNull(stopTime.DepartureTime),
+			LastObserved:  stopTime.LastObserved.Unix(),
+			MarkedPast:    unixOrNull(stopTime.MarkedPast),
+		})
+	}
+	return t
+}
+
+func unixOrNull(t *time.Time) *int64 {
+	if t == nil {
+		return nil
+	}
+	unix := t.Unix()
+	return &unix
+}
@@ -0,0 +1,134 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	manifestFileName          = "manifest.json"
+	manifestSignatureFileName = "manifest.json.sig"
+)
+
+// ManifestSigner signs the manifest of an archive with an Ed25519 key.
+type ManifestSigner struct {
+	Key ed25519.PrivateKey
+	// Reference to the public key that consumers should verify the signature with, for example
+	// a URL. Recorded in the manifest.
+	KeyID string
+}
+
+// Manifest lists the files in an archive along with their SHA-256 hashes.
+//
+// It is written to manifest.json in the archive, and its Ed25519 signature is written to
+// manifest.json.sig as raw bytes. See VerifyManifest.
+type Manifest struct {
+	KeyID string `json:",omitempty"`
+	// Base64-encoded public key the manifest was signed with. This is informational: consumers
+	// should verify the signature with a key they obtained independently.
+	PublicKey string
+	// Files in the archive other than the manifest and its signature, in archive order.
+	// Names do not include the archive's file prefix.
+	Files []ManifestFile
+}
+
+type ManifestFile struct {
+	Name   string
+	Size   int64
+	Sha256 string
+}
+
+func signManifest(s *ManifestSigner, files []file) ([]file, error) {
+	m := Manifest{
+		KeyID:     s.KeyID,
+		PublicKey: base64.StdEncoding.EncodeToString(s.Key.Public().(ed25519.PublicKey)),
+	}
+	for _, f := range files {
+		sum := sha256.Sum256(f.Body)
+		m.Files = append(m.Files, ManifestFile{
+			Name:   f.Name,
+			Size:   int64(len(f.Body)),
+			Sha256: hex.EncodeToString(sum[:]),
+		})
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return []file{
+		{manifestFileName, b},
+		{manifestSignatureFileName, ed25519.Sign(s.Key, b)},
+	}, nil
+}
+
+// VerifyManifest checks that the uncompressed tar archive was signed with the private key
+// corresponding to the public key and has not been modified since, and returns its manifest.
+//
+// The archive must contain a manifest whose signature is valid, and exactly the files listed
+// in the manifest with the listed hashes.
+func VerifyManifest(tarBytes []byte, filePrefix string, publicKey ed25519.PublicKey) (*Manifest, error) {
+	nameToBody := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(tarBytes))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		name := strings.TrimPrefix(hdr.Name, filePrefix)
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from archive: %w", name, err)
+		}
+		nameToBody[name] = b
+	}
+	manifestBytes, ok := nameToBody[manifestFileName]
+	if !ok {
+		return nil, fmt.Errorf("%s missing from archive", manifestFileName)
+	}
+	signature, ok := nameToBody[manifestSignatureFileName]
+	if !ok {
+		return nil, fmt.Errorf("%s missing from archive", manifestSignatureFileName)
+	}
+	if !ed25519.Verify(publicKey, manifestBytes, signature) {
+		return nil, fmt.Errorf("manifest signature is not valid for the public key")
+	}
+	var m Manifest
+	if err := json.Unmarshal(manifestBytes, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	var errs []error
+	listed := map[string]bool{}
+	for _, f := range m.Files {
+		listed[f.Name] = true
+		b, ok := nameToBody[f.Name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: file missing from archive", f.Name))
+			continue
+		}
+		sum := sha256.Sum256(b)
+		if int64(len(b)) != f.Size || hex.EncodeToString(sum[:]) != f.Sha256 {
+			errs = append(errs, fmt.Errorf("%s: file does not match the manifest", f.Name))
+		}
+	}
+	for name := range nameToBody {
+		if !listed[name] && name != manifestFileName && name != manifestSignatureFileName {
+			errs = append(errs, fmt.Errorf("%s: file not in manifest", name))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
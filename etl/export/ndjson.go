@@ -0,0 +1,172 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jamespfennell/xz"
+)
+
+// WriteNdjson reads a tar.xz archive created by Export and writes one JSON object per trip to w,
+// one per line.
+//
+// Each object has a field for each column of trips.csv, in order, and a stop_times field that
+// contains the trip's rows of stop_times.csv. Values are typed using the data dictionary:
+// integers and booleans are written as JSON numbers and booleans, and empty nullable values as null.
+func WriteNdjson(archive []byte, w io.Writer) error {
+	var tripsCsv, stopTimesCsv []byte
+	tr := tar.NewReader(xz.NewReader(bytes.NewReader(archive)))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		switch {
+		case strings.HasSuffix(hdr.Name, "stop_times.csv"):
+			stopTimesCsv, err = io.ReadAll(tr)
+		case strings.HasSuffix(hdr.Name, "trips.csv"):
+			tripsCsv, err = io.ReadAll(tr)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s from archive: %w", hdr.Name, err)
+		}
+	}
+	if tripsCsv == nil || stopTimesCsv == nil {
+		return fmt.Errorf("archive does not contain trips.csv and stop_times.csv")
+	}
+	allColumns := &Options{IncludeStopSequence: true, IncludeTravelTime: true}
+	var tripCols, stopTimeCols []Column
+	for _, c := range tripColumns(allColumns) {
+		tripCols = append(tripCols, c.Column)
+	}
+	for _, c := range stopTimeColumns(allColumns) {
+		stopTimeCols = append(stopTimeCols, c.Column)
+	}
+
+	stopTimeHeader, stopTimeRows, err := readCsv(stopTimesCsv)
+	if err != nil {
+		return fmt.Errorf("failed to parse stop_times.csv: %w", err)
+	}
+	tripUidIndex := indexOf(stopTimeHeader, "trip_uid")
+	if tripUidIndex < 0 {
+		return fmt.Errorf("stop_times.csv has no trip_uid column")
+	}
+	tripUidToStopTimes := map[string][]ndjsonObject{}
+	for _, row := range stopTimeRows {
+		tripUid := row[tripUidIndex]
+		tripUidToStopTimes[tripUid] = append(tripUidToStopTimes[tripUid], newNdjsonObject(stopTimeHeader, row, stopTimeCols))
+	}
+
+	tripHeader, tripRows, err := readCsv(tripsCsv)
+	if err != nil {
+		return fmt.Errorf("failed to parse trips.csv: %w", err)
+	}
+	tripUidIndex = indexOf(tripHeader, "trip_uid")
+	if tripUidIndex < 0 {
+		return fmt.Errorf("trips.csv has no trip_uid column")
+	}
+	enc := json.NewEncoder(w)
+	for _, row := range tripRows {
+		o := newNdjsonObject(tripHeader, row, tripCols)
+		stopTimes := tripUidToStopTimes[row[tripUidIndex]]
+		if stopTimes == nil {
+			stopTimes = []ndjsonObject{}
+		}
+		o = append(o, ndjsonField{"stop_times", stopTimes})
+		if err := enc.Encode(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readCsv(b []byte) ([]string, [][]string, error) {
+	rows, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil, fmt.Errorf("no header row")
+	}
+	return rows[0], rows[1:], nil
+}
+
+func indexOf(header []string, name string) int {
+	for i, h := range header {
+		if h == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// ndjsonObject is a JSON object whose fields are written in order.
+type ndjsonObject []ndjsonField
+
+type ndjsonField struct {
+	name  string
+	value any
+}
+
+func newNdjsonObject(header, row []string, columns []Column) ndjsonObject {
+	nameToColumn := map[string]Column{}
+	for _, c := range columns {
+		nameToColumn[c.Name] = c
+	}
+	var o ndjsonObject
+	for i, name := range header {
+		o = append(o, ndjsonField{name, typedValue(nameToColumn[name], row[i])})
+	}
+	return o
+}
+
+// typedValue converts a CSV value to a JSON value using the column's type. Values of unknown
+// columns are written as strings.
+func typedValue(c Column, s string) any {
+	if s == "" && c.Nullable {
+		return nil
+	}
+	switch c.Type {
+	case "integer":
+		if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return json.Number(s)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	}
+	return s
+}
+
+func (o ndjsonObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, err := json.Marshal(f.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
@@ -0,0 +1,128 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+// OnTimeThresholds determines when a stop time is considered on time relative to the schedule.
+type OnTimeThresholds struct {
+	// Maximum number of seconds a train can be ahead of schedule and still be on time.
+	EarlySeconds int
+	// Maximum number of seconds a train can be behind schedule and still be on time.
+	LateSeconds int
+}
+
+// DefaultOnTimeThresholds returns the thresholds used when none are configured.
+func DefaultOnTimeThresholds() OnTimeThresholds {
+	return OnTimeThresholds{
+		EarlySeconds: 60,
+		LateSeconds:  300,
+	}
+}
+
+type routeOtp struct {
+	numTrips     int
+	numStopTimes int
+	numOnTime    int
+}
+
+// routeOtpExport computes the per-route on-time performance. Only trips and stop times
+// that match the static schedule are counted.
+type routeOtpExport struct {
+	schedule   *Schedule
+	dayStart   time.Time
+	thresholds OnTimeThresholds
+	routes     map[string]*routeOtp
+}
+
+func newRouteOtpExport(opts Options) *routeOtpExport {
+	return &routeOtpExport{
+		schedule:   opts.Schedule,
+		dayStart:   opts.DayStart,
+		thresholds: opts.OnTimeThresholds,
+		routes:     map[string]*routeOtp{},
+	}
+}
+
+func (e *routeOtpExport) fileName() string {
+	return "route_otp.csv"
+}
+
+func (e *routeOtpExport) columns() []Column {
+	return []Column{
+		{"route_id", "string", "", false, "Route ID from the GTFS-RT feed."},
+		{"num_trips", "integer", "", false, "Number of trips on the route that matched the static schedule."},
+		{"num_stop_times", "integer", "", false, "Number of stop times on matched trips that matched a scheduled stop time."},
+		{"num_on_time", "integer", "", false, "Number of those stop times within the on-time thresholds."},
+		{"on_time_percent", "float", "percent", false, "Percentage of stop times that were on time."},
+	}
+}
+
+func (e *routeOtpExport) add(_ string, trips []journal.Trip) {
+	for i := range trips {
+		trip := &trips[i]
+		scheduledTrip, ok := e.schedule.Match(trip, e.dayStart)
+		if !ok {
+			continue
+		}
+		stopIDToScheduled := map[string]time.Duration{}
+		for _, scheduled := range scheduledTrip.StopTimes {
+			if scheduled.Stop == nil {
+				continue
+			}
+			stopIDToScheduled[scheduled.Stop.Id] = scheduled.DepartureTime
+		}
+		var numStopTimes, numOnTime int
+		for _, stopTime := range trip.StopTimes {
+			scheduled, ok := stopIDToScheduled[stopTime.StopID]
+			if !ok {
+				continue
+			}
+			actual := stopTime.DepartureTime
+			if actual == nil {
+				actual = stopTime.ArrivalTime
+			}
+			if actual == nil {
+				continue
+			}
+			delay := actual.Sub(e.dayStart.Add(scheduled))
+			numStopTimes++
+			if -time.Duration(e.thresholds.EarlySeconds)*time.Second <= delay &&
+				delay <= time.Duration(e.thresholds.LateSeconds)*time.Second {
+				numOnTime++
+			}
+		}
+		if numStopTimes == 0 {
+			continue
+		}
+		r, ok := e.routes[trip.RouteID]
+		if !ok {
+			r = &routeOtp{}
+			e.routes[trip.RouteID] = r
+		}
+		r.numTrips++
+		r.numStopTimes += numStopTimes
+		r.numOnTime += numOnTime
+	}
+}
+
+func (e *routeOtpExport) csv() []byte {
+	var routeIDs []string
+	for routeID := range e.routes {
+		routeIDs = append(routeIDs, routeID)
+	}
+	sort.Strings(routeIDs)
+	var b bytes.Buffer
+	b.WriteString("route_id,num_trips,num_stop_times,num_on_time,on_time_percent\n")
+	for _, routeID := range routeIDs {
+		r := e.routes[routeID]
+		fmt.Fprintf(&b, "%s,%d,%d,%d,%.1f\n", routeID, r.numTrips, r.numStopTimes, r.numOnTime,
+			100*float64(r.numOnTime)/float64(r.numStopTimes))
+	}
+	return b.Bytes()
+}
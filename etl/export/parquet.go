@@ -0,0 +1,162 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/jamespfennell/gtfs"
+	"github.com/jamespfennell/gtfs/journal"
+	"github.com/parquet-go/parquet-go"
+)
+
+// parquetTrip is a row of trips.parquet. The columns are the columns of trips.csv with the default
+// export options, in the same order. Times are unix seconds.
+type parquetTrip struct {
+	parquetTripStart
+	VehicleID string `parquet:"vehicle_id"`
+	parquetTripEnd
+}
+
+// parquetTripWithoutVehicleID is a row of trips.parquet when vehicle IDs are omitted.
+type parquetTripWithoutVehicleID struct {
+	parquetTripStart
+	parquetTripEnd
+}
+
+// parquetTripStart and parquetTripEnd are the columns of trips.parquet before and after
+// vehicle_id.
+type parquetTripStart struct {
+	TripUID     string `parquet:"trip_uid"`
+	TripID      string `parquet:"trip_id"`
+	RouteID     string `parquet:"route_id"`
+	DirectionID *bool  `parquet:"direction_id,optional"`
+	StartTime   int64  `parquet:"start_time"`
+}
+
+type parquetTripEnd struct {
+	LastObserved        int64   `parquet:"last_observed"`
+	MarkedPast          *int64  `parquet:"marked_past,optional"`
+	NumUpdates          int64   `parquet:"num_updates"`
+	NumScheduleChanges  int64   `parquet:"num_schedule_changes"`
+	NumScheduleRewrites int64   `parquet:"num_schedule_rewrites"`
+	ReachedTerminal     *bool   `parquet:"reached_terminal,optional"`
+	IsAdded             *bool   `parquet:"is_added,optional"`
+	IsCanceled          *bool   `parquet:"is_canceled,optional"`
+	StartDate           *string `parquet:"start_date,optional"`
+}
+
+// parquetStopTime is a row of stop_times.parquet. The columns are the columns of stop_times.csv
+// with the default export options, in the same order. Times are unix seconds.
+type parquetStopTime struct {
+	TripUID       string  `parquet:"trip_uid"`
+	StopID        string  `parquet:"stop_id"`
+	Track         *string `parquet:"track,optional"`
+	ArrivalTime   *int64  `parquet:"arrival_time,optional"`
+	DepartureTime *int64  `parquet:"departure_time,optional"`
+	LastObserved  int64   `parquet:"last_observed"`
+	MarkedPast    *int64  `parquet:"marked_past,optional"`
+	IsActual      bool    `parquet:"is_actual"`
+	DwellSeconds  *int64  `parquet:"dwell_seconds,optional"`
+}
+
+// AsParquet exports the trips as a tar.xz archive containing <prefix>trips.parquet and
+// <prefix>stop_times.parquet.
+//
+// The files have the same columns as trips.csv and stop_times.csv exported with Export, with
+// typed values: empty CSV values are nulls, and direction_id is a boolean that is true for
+// direction 1. Like Export, there is no static schedule or service day, so start_date,
+// reached_terminal, is_added and is_canceled are always null. Of the options, only OmitVehicleIDs and
+// VehicleIDAnonymizer are used; vehicle_id is left out if vehicle IDs are omitted.
+func AsParquet(trips []journal.Trip, prefix string, opts Options) ([]byte, error) {
+	parquetTrips := make([]parquetTrip, 0, len(trips))
+	var parquetStopTimes []parquetStopTime
+	for i := range trips {
+		trip := &trips[i]
+		parquetTrips = append(parquetTrips, newParquetTrip(&opts, trip))
+		for _, stopTime := range trip.StopTimes {
+			parquetStopTimes = append(parquetStopTimes, newParquetStopTime(trip, stopTime))
+		}
+	}
+	var tripsParquet, stopTimesParquet bytes.Buffer
+	var err error
+	if opts.OmitVehicleIDs {
+		withoutVehicleIDs := make([]parquetTripWithoutVehicleID, 0, len(parquetTrips))
+		for _, t := range parquetTrips {
+			withoutVehicleIDs = append(withoutVehicleIDs, parquetTripWithoutVehicleID{t.parquetTripStart, t.parquetTripEnd})
+		}
+		err = parquet.Write(&tripsParquet, withoutVehicleIDs)
+	} else {
+		err = parquet.Write(&tripsParquet, parquetTrips)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write trips.parquet: %w", err)
+	}
+	if err := parquet.Write(&stopTimesParquet, parquetStopTimes); err != nil {
+		return nil, fmt.Errorf("failed to write stop_times.parquet: %w", err)
+	}
+	var out bytes.Buffer
+	tw := tar.NewWriter(&out)
+	for _, f := range []file{
+		{"trips.parquet", tripsParquet.Bytes()},
+		{"stop_times.parquet", stopTimesParquet.Bytes()},
+	} {
+		if err := tw.WriteHeader(&tar.Header{
+			Name: prefix + f.Name,
+			Mode: DefaultFileMode,
+			Size: int64(len(f.Body)),
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.Body); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return Compress(out.Bytes())
+}
+
+func newParquetTrip(opts *Options, trip *journal.Trip) parquetTrip {
+	t := parquetTrip{
+		parquetTripStart: parquetTripStart{
+			TripUID:   trip.TripUID,
+			TripID:    trip.TripID,
+			RouteID:   trip.RouteID,
+			StartTime: trip.StartTime.Unix(),
+		},
+		VehicleID: vehicleID(opts, trip.VehicleID),
+		parquetTripEnd: parquetTripEnd{
+			LastObserved:        trip.LastObserved.Unix(),
+			MarkedPast:          unixOrNull(trip.MarkedPast),
+			NumUpdates:          int64(trip.NumUpdates),
+			NumScheduleChanges:  int64(trip.NumScheduleChanges),
+			NumScheduleRewrites: int64(trip.NumScheduleRewrites),
+		},
+	}
+	if trip.DirectionID != gtfs.DirectionID_Unspecified {
+		directionID := trip.DirectionID == gtfs.DirectionID_True
+		t.DirectionID = &directionID
+	}
+	return t
+}
+
+func newParquetStopTime(trip *journal.Trip, stopTime journal.StopTime) parquetStopTime {
+	s := parquetStopTime{
+		TripUID:       trip.TripUID,
+		StopID:        stopTime.StopID,
+		Track:         stopTime.Track,
+		ArrivalTime:   unixOrNull(stopTime.ArrivalTime),
+		DepartureTime: unixOrNull(stopTime.DepartureTime),
+		LastObserved:  stopTime.LastObserved.Unix(),
+		MarkedPast:    unixOrNull(stopTime.MarkedPast),
+		IsActual:      IsActual(stopTime),
+	}
+	if dwell, ok := DwellTime(stopTime); ok && dwell >= 0 {
+		dwellSeconds := int64(dwell / time.Second)
+		s.DwellSeconds = &dwellSeconds
+	}
+	return s
+}
@@ -0,0 +1,30 @@
+package export
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Provenance describes the dataset version and processing run that produced an archive.
+//
+// It is written to provenance.json in the archive. All fields other than RunID and ProcessedAt
+// are derived from the data and the software, so exporting the same day twice with the same
+// software gives the same provenance unless a run ID is provided.
+type Provenance struct {
+	// Version of the dataset. Days are reprocessed when this changes.
+	DatasetVersion int
+	// VCS revision the ETL binary was built from. Empty if the binary has no build information.
+	SoftwareRevision string `json:",omitempty"`
+	// Feeds whose trips are in the archive, in order.
+	FeedIDs []string
+	// Service day of the archive, of the form YYYY-MM-DD.
+	ServiceDay string
+	// Explicitly provided identifier of the processing run.
+	RunID string `json:",omitempty"`
+	// Time processing started. Only set if RunID is set, as it differs between runs.
+	ProcessedAt *time.Time `json:",omitempty"`
+}
+
+func (p *Provenance) json() ([]byte, error) {
+	return json.MarshalIndent(p, "", "  ")
+}
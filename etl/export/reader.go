@@ -0,0 +1,225 @@
+package export
+
+import (
+	"archive/tar"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamespfennell/gtfs"
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+// ReadCsv reads all of the trips in an uncompressed tar archive created by the exporter.
+// See IterateCsv.
+func ReadCsv(r io.Reader) ([]journal.Trip, error) {
+	var trips []journal.Trip
+	err := IterateCsv(r, func(trip journal.Trip) error {
+		trips = append(trips, trip)
+		return nil
+	})
+	return trips, err
+}
+
+// IterateCsv calls fn on each trip in an uncompressed tar archive created by the exporter, in
+// the order of trips.csv. Stored tar.xz archives must be decompressed first, e.g. with xz.NewReader.
+//
+// The stop times are streamed: each trip is passed to fn once its rows of stop_times.csv have been
+// read, so only one trip's stop times are held in memory at a time. This requires the rows of
+// stop_times.csv to be grouped by trip and in the same order as trips.csv, as the exporter writes
+// them. The rows of trips.csv, which precedes stop_times.csv in the archive, are held in memory.
+//
+// Columns that are computed from other data, like is_actual, are ignored, and columns missing from
+// older archives are left as zero values.
+func IterateCsv(r io.Reader, fn func(journal.Trip) error) error {
+	var trips []journal.Trip
+	tripsRead := false
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("archive does not contain trips.csv and stop_times.csv")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		switch {
+		case strings.HasSuffix(hdr.Name, "stop_times.csv"):
+			if !tripsRead {
+				return fmt.Errorf("stop_times.csv precedes trips.csv in the archive")
+			}
+			return iterateStopTimes(tr, trips, fn)
+		case strings.HasSuffix(hdr.Name, "trips.csv"):
+			trips, err = readTrips(tr)
+			if err != nil {
+				return fmt.Errorf("failed to parse trips.csv: %w", err)
+			}
+			tripsRead = true
+		}
+	}
+}
+
+func readTrips(r io.Reader) ([]journal.Trip, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("no header row: %w", err)
+	}
+	var trips []journal.Trip
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return trips, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		p := rowParser{header: header, row: row}
+		trip := journal.Trip{
+			TripUID:             p.string("trip_uid"),
+			TripID:              p.string("trip_id"),
+			RouteID:             p.string("route_id"),
+			DirectionID:         p.directionID("direction_id"),
+			StartTime:           p.unix("start_time"),
+			VehicleID:           p.string("vehicle_id"),
+			LastObserved:        p.unix("last_observed"),
+			MarkedPast:          p.nullableUnix("marked_past"),
+			NumUpdates:          p.int("num_updates"),
+			NumScheduleChanges:  p.int("num_schedule_changes"),
+			NumScheduleRewrites: p.int("num_schedule_rewrites"),
+		}
+		if p.err != nil {
+			return nil, fmt.Errorf("trip %q: %w", trip.TripUID, p.err)
+		}
+		trips = append(trips, trip)
+	}
+}
+
+func iterateStopTimes(r io.Reader, trips []journal.Trip, fn func(journal.Trip) error) error {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("failed to parse stop_times.csv: no header row: %w", err)
+	}
+	// next is the index of the first trip that has not been passed to fn.
+	next := 0
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse stop_times.csv: %w", err)
+		}
+		p := rowParser{header: header, row: row}
+		tripUID := p.string("trip_uid")
+		stopTime := journal.StopTime{
+			StopID:        p.string("stop_id"),
+			ArrivalTime:   p.nullableUnix("arrival_time"),
+			DepartureTime: p.nullableUnix("departure_time"),
+			Track:         p.nullableString("track"),
+			LastObserved:  p.unix("last_observed"),
+			MarkedPast:    p.nullableUnix("marked_past"),
+		}
+		if p.err != nil {
+			return fmt.Errorf("failed to parse stop_times.csv: trip %q: %w", tripUID, p.err)
+		}
+		// Trips before the stop time's trip are complete, including trips with no stop times.
+		for next < len(trips) && trips[next].TripUID != tripUID {
+			if err := fn(trips[next]); err != nil {
+				return err
+			}
+			trips[next] = journal.Trip{}
+			next++
+		}
+		if next == len(trips) {
+			return fmt.Errorf("stop_times.csv is not grouped by trip in the order of trips.csv: unexpected stop time for trip %q", tripUID)
+		}
+		trips[next].StopTimes = append(trips[next].StopTimes, stopTime)
+	}
+	for ; next < len(trips); next++ {
+		if err := fn(trips[next]); err != nil {
+			return err
+		}
+		trips[next] = journal.Trip{}
+	}
+	return nil
+}
+
+// rowParser parses the values of a CSV row by column name. The first error is recorded in err
+// and parsing continues. Missing columns give zero values.
+type rowParser struct {
+	header []string
+	row    []string
+	err    error
+}
+
+func (p *rowParser) string(column string) string {
+	i := indexOf(p.header, column)
+	if i < 0 || i >= len(p.row) {
+		return ""
+	}
+	return p.row[i]
+}
+
+func (p *rowParser) nullableString(column string) *string {
+	s := p.string(column)
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (p *rowParser) int(column string) int {
+	s := p.string(column)
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil && p.err == nil {
+		p.err = fmt.Errorf("invalid %s %q", column, s)
+	}
+	return n
+}
+
+func (p *rowParser) nullableUnix(column string) *time.Time {
+	s := p.string(column)
+	if s == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		if p.err == nil {
+			p.err = fmt.Errorf("invalid %s %q", column, s)
+		}
+		return nil
+	}
+	t := time.Unix(n, 0)
+	return &t
+}
+
+func (p *rowParser) unix(column string) time.Time {
+	if t := p.nullableUnix(column); t != nil {
+		return *t
+	}
+	return time.Time{}
+}
+
+func (p *rowParser) directionID(column string) gtfs.DirectionID {
+	switch s := p.string(column); s {
+	case "0":
+		return gtfs.DirectionID_False
+	case "1":
+		return gtfs.DirectionID_True
+	case "":
+		return gtfs.DirectionID_Unspecified
+	default:
+		if p.err == nil {
+			p.err = fmt.Errorf("invalid %s %q", column, s)
+		}
+		return gtfs.DirectionID_Unspecified
+	}
+}
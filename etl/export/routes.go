@@ -0,0 +1,46 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jamespfennell/xz"
+)
+
+// RouteTripCounts reads a tar.xz archive created by Export and returns the number of trips of
+// each route in trips.csv, keyed by route ID.
+func RouteTripCounts(archive []byte) (map[string]int, error) {
+	tr := tar.NewReader(xz.NewReader(bytes.NewReader(archive)))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("archive does not contain trips.csv")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if !strings.HasSuffix(hdr.Name, "trips.csv") {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from archive: %w", hdr.Name, err)
+		}
+		header, rows, err := readCsv(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trips.csv: %w", err)
+		}
+		routeIDIndex := indexOf(header, "route_id")
+		if routeIDIndex < 0 {
+			return nil, fmt.Errorf("trips.csv has no route_id column")
+		}
+		counts := map[string]int{}
+		for _, row := range rows {
+			counts[row[routeIDIndex]]++
+		}
+		return counts, nil
+	}
+}
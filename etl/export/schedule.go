@@ -0,0 +1,108 @@
+package export
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jamespfennell/gtfs"
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+// Schedule is a static GTFS schedule indexed for matching realtime trips.
+type Schedule struct {
+	trips      []*gtfs.ScheduledTrip
+	keyToTrips map[string][]*gtfs.ScheduledTrip
+}
+
+// NewSchedule builds a schedule from a parsed static GTFS feed.
+func NewSchedule(static *gtfs.Static) *Schedule {
+	s := &Schedule{
+		keyToTrips: map[string][]*gtfs.ScheduledTrip{},
+	}
+	for i := range static.Trips {
+		trip := &static.Trips[i]
+		s.trips = append(s.trips, trip)
+		for _, key := range scheduleKeys(trip.ID) {
+			s.keyToTrips[key] = append(s.keyToTrips[key], trip)
+		}
+	}
+	return s
+}
+
+// scheduleKeys returns the keys under which a static trip ID is indexed.
+//
+// Static trip IDs in the NYC subway feed look like AFA23GEN-1093-Weekday-00_000600_1..S03R,
+// whereas the corresponding realtime trip ID is either 000600_1..S03R or 000600_1..S.
+// Trips are indexed by the full ID, the part after the first underscore, and that part
+// truncated after the direction character.
+func scheduleKeys(tripID string) []string {
+	keys := []string{tripID}
+	i := strings.Index(tripID, "_")
+	if i < 0 {
+		return keys
+	}
+	suffix := tripID[i+1:]
+	keys = append(keys, suffix)
+	if j := strings.Index(suffix, ".."); j >= 0 && j+3 < len(suffix) {
+		keys = append(keys, suffix[:j+3])
+	}
+	return keys
+}
+
+// Match returns the scheduled trip corresponding to the realtime trip on the service day
+// starting at dayStart.
+func (s *Schedule) Match(trip *journal.Trip, dayStart time.Time) (*gtfs.ScheduledTrip, bool) {
+	if s == nil {
+		return nil, false
+	}
+	for _, candidate := range s.keyToTrips[trip.TripID] {
+		if candidate.Route != nil && candidate.Route.Id != trip.RouteID {
+			continue
+		}
+		if candidate.Service != nil && !serviceActive(candidate.Service, dayStart) {
+			continue
+		}
+		return candidate, true
+	}
+	return nil, false
+}
+
+func serviceActive(service *gtfs.Service, dayStart time.Time) bool {
+	sameDate := func(t time.Time) bool {
+		y1, m1, d1 := t.Date()
+		y2, m2, d2 := dayStart.Date()
+		return y1 == y2 && m1 == m2 && d1 == d2
+	}
+	for _, removed := range service.RemovedDates {
+		if sameDate(removed) {
+			return false
+		}
+	}
+	for _, added := range service.AddedDates {
+		if sameDate(added) {
+			return true
+		}
+	}
+	if !sameDate(service.StartDate) && dayStart.Before(service.StartDate) {
+		return false
+	}
+	if !sameDate(service.EndDate) && service.EndDate.Before(dayStart) {
+		return false
+	}
+	switch dayStart.Weekday() {
+	case time.Monday:
+		return service.Monday
+	case time.Tuesday:
+		return service.Tuesday
+	case time.Wednesday:
+		return service.Wednesday
+	case time.Thursday:
+		return service.Thursday
+	case time.Friday:
+		return service.Friday
+	case time.Saturday:
+		return service.Saturday
+	default:
+		return service.Sunday
+	}
+}
@@ -0,0 +1,63 @@
+package export
+
+import (
+	"github.com/jamespfennell/gtfs"
+	"github.com/jamespfennell/gtfs/journal"
+	gtfsrt "github.com/jamespfennell/gtfs/proto"
+)
+
+// AddedTrips is the set of trip UIDs of trips that the GTFS-RT feed marks as added.
+type AddedTrips map[string]bool
+
+// CanceledTrips is the set of trip UIDs of trips that the GTFS-RT feed marks as canceled.
+type CanceledTrips map[string]bool
+
+// ScheduleRelationshipRecorder is a GTFS-RT source that records the trips marked as added or
+// canceled in the feed messages returned by the wrapped source.
+//
+// The journal doesn't keep the schedule relationship of trips. Building the journal from the
+// recorder instead of the wrapped source preserves which trips were added and canceled. A trip is
+// recorded as added or canceled if any message marks it as such.
+type ScheduleRelationshipRecorder struct {
+	source        journal.GtfsrtSource
+	addedTrips    AddedTrips
+	canceledTrips CanceledTrips
+}
+
+func NewScheduleRelationshipRecorder(source journal.GtfsrtSource) *ScheduleRelationshipRecorder {
+	return &ScheduleRelationshipRecorder{
+		source:        source,
+		addedTrips:    AddedTrips{},
+		canceledTrips: CanceledTrips{},
+	}
+}
+
+func (r *ScheduleRelationshipRecorder) Next() *gtfs.Realtime {
+	feedMessage := r.source.Next()
+	if feedMessage == nil {
+		return nil
+	}
+	for i := range feedMessage.Trips {
+		tripUpdate := &feedMessage.Trips[i]
+		if len(tripUpdate.ID.ID) < 6 {
+			continue
+		}
+		switch tripUpdate.ID.ScheduleRelationship {
+		case gtfsrt.TripDescriptor_ADDED:
+			r.addedTrips[journalTripUID(tripUpdate)] = true
+		case gtfsrt.TripDescriptor_CANCELED:
+			r.canceledTrips[journalTripUID(tripUpdate)] = true
+		}
+	}
+	return feedMessage
+}
+
+// AddedTrips returns the recorded added trips.
+func (r *ScheduleRelationshipRecorder) AddedTrips() AddedTrips {
+	return r.addedTrips
+}
+
+// CanceledTrips returns the recorded canceled trips.
+func (r *ScheduleRelationshipRecorder) CanceledTrips() CanceledTrips {
+	return r.canceledTrips
+}
@@ -0,0 +1,166 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Schema describes the CSV files an archive is expected to contain.
+type Schema struct {
+	Files []FileSchema
+}
+
+// FileSchema describes the columns of one CSV file in the archive.
+//
+// Only the Name, Type and Nullable fields of the columns are validated.
+type FileSchema struct {
+	Name    string
+	Columns []Column
+}
+
+// SchemaFor returns the schema of the CSV files in archives exported with the options. Its JSON
+// encoding can be passed to ParseSchema.
+//
+// Derived files are included if the options enable them, so the schema changes as features are
+// turned on and off. The Schema option itself is ignored.
+func SchemaFor(opts Options) *Schema {
+	var s Schema
+	var tripFile, stopTimeFile FileSchema
+	tripFile.Name = "trips.csv"
+	for _, c := range tripColumns(&opts) {
+		tripFile.Columns = append(tripFile.Columns, c.Column)
+	}
+	stopTimeFile.Name = "stop_times.csv"
+	for _, c := range stopTimeColumns(&opts) {
+		stopTimeFile.Columns = append(stopTimeFile.Columns, c.Column)
+	}
+	s.Files = append(s.Files, tripFile, stopTimeFile)
+	for _, d := range derivedExports(opts) {
+		s.Files = append(s.Files, FileSchema{Name: d.fileName(), Columns: d.columns()})
+	}
+	return &s
+}
+
+// ParseSchema parses a JSON schema definition. Unknown fields are rejected.
+func ParseSchema(b []byte) (*Schema, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	var s Schema
+	if err := d.Decode(&s); err != nil {
+		return nil, fmt.Errorf("failed to parse export schema: %w", err)
+	}
+	return &s, nil
+}
+
+// Validate checks that the CSV files in the uncompressed tar archive match the schema.
+//
+// Every file in the schema must be in the archive and every CSV file in the archive must be in
+// the schema. Headers must match the schema's columns exactly, every row must have one value
+// per column, and values must have the column's type. All mismatches are returned together.
+func (s *Schema) Validate(tarBytes []byte, filePrefix string) error {
+	nameToFile := map[string]FileSchema{}
+	for _, f := range s.Files {
+		nameToFile[f.Name] = f
+	}
+	var errs []error
+	seen := map[string]bool{}
+	tr := tar.NewReader(bytes.NewReader(tarBytes))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		name := strings.TrimPrefix(hdr.Name, filePrefix)
+		if !strings.HasSuffix(name, ".csv") {
+			continue
+		}
+		seen[name] = true
+		f, ok := nameToFile[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: file not in schema", name))
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("failed to read %s from archive: %w", name, err)
+		}
+		if err := f.validate(b); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	for _, f := range s.Files {
+		if !seen[f.Name] {
+			errs = append(errs, fmt.Errorf("%s: file missing from archive", f.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Maximum number of row errors reported per file.
+const maxRowErrors = 10
+
+func (f *FileSchema) validate(b []byte) error {
+	r := csv.NewReader(bytes.NewReader(b))
+	// Row lengths are checked below so that the error message can name the row.
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	var wantHeader []string
+	for _, c := range f.Columns {
+		wantHeader = append(wantHeader, c.Name)
+	}
+	if strings.Join(header, ",") != strings.Join(wantHeader, ",") {
+		return fmt.Errorf("header %v does not match schema columns %v", header, wantHeader)
+	}
+	var errs []error
+	for row := 2; len(errs) < maxRowErrors; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read row %d: %w", row, err)
+		}
+		if len(record) != len(f.Columns) {
+			errs = append(errs, fmt.Errorf("row %d has %d values, want %d", row, len(record), len(f.Columns)))
+			continue
+		}
+		for i, c := range f.Columns {
+			if !validValue(c, record[i]) {
+				errs = append(errs, fmt.Errorf("row %d: invalid %s value %q for column %s", row, c.Type, record[i], c.Name))
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validValue(c Column, s string) bool {
+	if s == "" {
+		return c.Nullable || c.Type == "string"
+	}
+	switch c.Type {
+	case "integer":
+		_, err := strconv.ParseInt(s, 10, 64)
+		return err == nil
+	case "boolean":
+		_, err := strconv.ParseBool(s)
+		return err == nil
+	case "float":
+		_, err := strconv.ParseFloat(s, 64)
+		return err == nil
+	}
+	return true
+}
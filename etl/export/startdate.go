@@ -0,0 +1,49 @@
+package export
+
+import (
+	"time"
+
+	"github.com/jamespfennell/gtfs"
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+// StartDates maps trip UID to the start date of the trip in the GTFS-RT feed.
+type StartDates map[string]time.Time
+
+// StartDateRecorder is a GTFS-RT source that records the start dates of trips in the feed
+// messages returned by the wrapped source.
+//
+// The journal only keeps the start time of each trip, which for trips that start after midnight
+// is on the calendar day after their start date. Building the journal from the recorder instead
+// of the wrapped source preserves the start dates.
+type StartDateRecorder struct {
+	source     journal.GtfsrtSource
+	startDates StartDates
+}
+
+func NewStartDateRecorder(source journal.GtfsrtSource) *StartDateRecorder {
+	return &StartDateRecorder{
+		source:     source,
+		startDates: StartDates{},
+	}
+}
+
+func (r *StartDateRecorder) Next() *gtfs.Realtime {
+	feedMessage := r.source.Next()
+	if feedMessage == nil {
+		return nil
+	}
+	for i := range feedMessage.Trips {
+		tripUpdate := &feedMessage.Trips[i]
+		if !tripUpdate.ID.HasStartDate || len(tripUpdate.ID.ID) < 6 {
+			continue
+		}
+		r.startDates[journalTripUID(tripUpdate)] = tripUpdate.ID.StartDate
+	}
+	return feedMessage
+}
+
+// StartDates returns the recorded start dates keyed by trip UID.
+func (r *StartDateRecorder) StartDates() StartDates {
+	return r.startDates
+}
@@ -0,0 +1,142 @@
+package export
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+// TripStore accumulates trips for export.
+//
+// Once the number of trips held in memory exceeds the store's limit, the trips are
+// spilled to a temporary file on disk. Spilled trips are read back one file at a
+// time when the store is exported, so at most roughly limit trips are held in memory.
+// The limit only applies to the trips: the exported CSV files and the archive are still
+// built in memory, so the memory used by an export grows with the size of the day.
+type TripStore struct {
+	dir      string
+	limit    int
+	segments []segment
+	numTrips int
+	files    []string
+}
+
+// segment is a run of consecutively added trips from the same feed.
+type segment struct {
+	FeedID string
+	Trips  []journal.Trip
+}
+
+// NewTripStore creates a new trip store that spills trips to files in the provided directory.
+//
+// A limit of zero or less means that all trips are held in memory.
+func NewTripStore(dir string, limit int) *TripStore {
+	return &TripStore{
+		dir:   dir,
+		limit: limit,
+	}
+}
+
+// Add adds trips from the feed to the store. Trips are exported in the order they are added.
+func (s *TripStore) Add(feedID string, trips ...journal.Trip) error {
+	if n := len(s.segments); n > 0 && s.segments[n-1].FeedID == feedID {
+		s.segments[n-1].Trips = append(s.segments[n-1].Trips, trips...)
+	} else {
+		s.segments = append(s.segments, segment{FeedID: feedID, Trips: trips})
+	}
+	s.numTrips += len(trips)
+	if s.limit <= 0 || s.numTrips <= s.limit {
+		return nil
+	}
+	return s.spill()
+}
+
+// Range calls f on each chunk of trips in the store, in order, along with the feed the trips came from.
+func (s *TripStore) Range(f func(feedID string, trips []journal.Trip) error) error {
+	for _, path := range s.files {
+		segments, err := readSegments(path)
+		if err != nil {
+			return err
+		}
+		for _, segment := range segments {
+			if err := f(segment.FeedID, segment.Trips); err != nil {
+				return err
+			}
+		}
+	}
+	for _, segment := range s.segments {
+		if err := f(segment.FeedID, segment.Trips); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dump writes all of the trips in the store to w, so that the export can be rerun against
+// exactly the same trips with LoadTripStore. The format is a stream of gob-encoded segments.
+func (s *TripStore) Dump(w io.Writer) error {
+	enc := gob.NewEncoder(w)
+	return s.Range(func(feedID string, trips []journal.Trip) error {
+		if err := enc.Encode(segment{FeedID: feedID, Trips: trips}); err != nil {
+			return fmt.Errorf("failed to write trips to dump: %w", err)
+		}
+		return nil
+	})
+}
+
+// LoadTripStore creates a trip store containing the trips in a dump written by Dump.
+//
+// The dir and limit arguments are as in NewTripStore.
+func LoadTripStore(r io.Reader, dir string, limit int) (*TripStore, error) {
+	s := NewTripStore(dir, limit)
+	dec := gob.NewDecoder(r)
+	for {
+		var seg segment
+		err := dec.Decode(&seg)
+		if err == io.EOF {
+			return s, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trips from dump: %w", err)
+		}
+		if err := s.Add(seg.FeedID, seg.Trips...); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *TripStore) spill() error {
+	path := filepath.Join(s.dir, fmt.Sprintf("trips_%06d.gob", len(s.files)))
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create trip spill file: %w", err)
+	}
+	if err := gob.NewEncoder(f).Encode(s.segments); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write trips to spill file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.files = append(s.files, path)
+	s.segments = nil
+	s.numTrips = 0
+	return nil
+}
+
+func readSegments(path string) ([]segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trip spill file: %w", err)
+	}
+	defer f.Close()
+	var segments []segment
+	if err := gob.NewDecoder(f).Decode(&segments); err != nil {
+		return nil, fmt.Errorf("failed to read trips from spill file: %w", err)
+	}
+	return segments, nil
+}
@@ -0,0 +1,107 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+type throughputKey struct {
+	stopID  string
+	hasTime bool
+	// Start of the local hour, in unix seconds.
+	hour    int64
+	routeID string
+}
+
+// throughputExport counts the trips of each route that stopped at each stop in each local hour.
+//
+// The departure time of a stop time is used, or the arrival time if there is no departure time,
+// as at terminals. Hours are in the location of Options.DayStart and are identified by the local
+// time at which they start, including the UTC offset. On the day clocks go back the repeated hour
+// is two separate hours with different offsets; on the day clocks go forward the skipped hour
+// doesn't appear. Stop times with neither an arrival nor a departure time are counted with an
+// empty hour, so the counts always sum to the number of stop times in stop_times.csv.
+type throughputExport struct {
+	loc    *time.Location
+	counts map[throughputKey]int
+}
+
+func newThroughputExport(opts Options) *throughputExport {
+	return &throughputExport{
+		loc:    opts.DayStart.Location(),
+		counts: map[throughputKey]int{},
+	}
+}
+
+func (e *throughputExport) fileName() string {
+	return "stop_throughput.csv"
+}
+
+func (e *throughputExport) columns() []Column {
+	return []Column{
+		{"stop_id", "string", "", false, "Stop ID from the GTFS-RT feed."},
+		{"hour_local", "string", "RFC 3339", true, "Local time at the start of the hour, with its UTC offset. Empty for stop times with no arrival or departure time."},
+		{"route_id", "string", "", false, "Route ID of the trips."},
+		{"trip_count", "integer", "", false, "Number of stop times of trips of the route at the stop in the hour."},
+	}
+}
+
+func (e *throughputExport) add(_ string, trips []journal.Trip) {
+	for i := range trips {
+		trip := &trips[i]
+		for _, stopTime := range trip.StopTimes {
+			key := throughputKey{
+				stopID:  stopTime.StopID,
+				routeID: trip.RouteID,
+			}
+			t := stopTime.DepartureTime
+			if t == nil {
+				t = stopTime.ArrivalTime
+			}
+			if t != nil {
+				key.hasTime = true
+				key.hour = hourStart(t.In(e.loc)).Unix()
+			}
+			e.counts[key]++
+		}
+	}
+}
+
+// hourStart returns the start of the local hour containing t. Unlike t.Truncate(time.Hour), this
+// is correct in locations whose UTC offset isn't a whole number of hours.
+func hourStart(t time.Time) time.Time {
+	return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+}
+
+func (e *throughputExport) csv() []byte {
+	var keys []throughputKey
+	for key := range e.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].stopID != keys[j].stopID {
+			return keys[i].stopID < keys[j].stopID
+		}
+		if keys[i].hasTime != keys[j].hasTime {
+			return keys[i].hasTime
+		}
+		if keys[i].hour != keys[j].hour {
+			return keys[i].hour < keys[j].hour
+		}
+		return keys[i].routeID < keys[j].routeID
+	})
+	var b bytes.Buffer
+	b.WriteString("stop_id,hour_local,route_id,trip_count\n")
+	for _, key := range keys {
+		var hour string
+		if key.hasTime {
+			hour = time.Unix(key.hour, 0).In(e.loc).Format(time.RFC3339)
+		}
+		fmt.Fprintf(&b, "%s,%s,%s,%d\n", key.stopID, hour, key.routeID, e.counts[key])
+	}
+	return b.Bytes()
+}
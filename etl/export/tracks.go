@@ -0,0 +1,73 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+// TrackReference is the known track identifiers, used to normalize the track column of
+// stop_times.csv. Build it using ParseTrackReference.
+type TrackReference struct {
+	// Map from each value accepted in the feed to the known track it refers to.
+	valueToTrack map[string]string
+}
+
+// trackReferenceFile is the JSON encoding of a TrackReference.
+type trackReferenceFile struct {
+	// The known track identifiers.
+	Tracks []string
+	// Map from other values that appear in the feeds to the known track they refer to; e.g.,
+	// "01" to "1".
+	Aliases map[string]string
+}
+
+// ParseTrackReference parses a track reference from its JSON encoding.
+func ParseTrackReference(b []byte) (*TrackReference, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	var f trackReferenceFile
+	if err := d.Decode(&f); err != nil {
+		return nil, fmt.Errorf("failed to parse track reference: %w", err)
+	}
+	r := TrackReference{valueToTrack: map[string]string{}}
+	for _, track := range f.Tracks {
+		r.valueToTrack[track] = track
+	}
+	for alias, track := range f.Aliases {
+		if !slices.Contains(f.Tracks, track) {
+			return nil, fmt.Errorf("track reference alias %q refers to unknown track %q", alias, track)
+		}
+		if slices.Contains(f.Tracks, alias) {
+			return nil, fmt.Errorf("track reference alias %q is also a track", alias)
+		}
+		r.valueToTrack[alias] = track
+	}
+	return &r, nil
+}
+
+// NormalizeTracks replaces the tracks of the trip's stop times with the known track they refer
+// to, and returns the number of stop times whose track is not in the reference.
+//
+// Surrounding whitespace is ignored when matching. Unknown tracks are left as they are, and stop
+// times without a track are skipped.
+func NormalizeTracks(trip *journal.Trip, r *TrackReference) int {
+	n := 0
+	for i := range trip.StopTimes {
+		stopTime := &trip.StopTimes[i]
+		if stopTime.Track == nil {
+			continue
+		}
+		track, ok := r.valueToTrack[strings.TrimSpace(*stopTime.Track)]
+		if !ok {
+			n++
+			continue
+		}
+		stopTime.Track = &track
+	}
+	return n
+}
@@ -0,0 +1,281 @@
+package export
+
+import (
+	"time"
+
+	"github.com/jamespfennell/gtfs"
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+// The journal types live in the upstream gtfs module, so helpers that operate on
+// them are defined here as functions rather than methods.
+
+// FirstStopTime returns the first stop time of the trip, if the trip has any stop times.
+//
+// For a trip with a single stop, the first and last stop times are the same.
+func FirstStopTime(trip *journal.Trip) (journal.StopTime, bool) {
+	if trip == nil || len(trip.StopTimes) == 0 {
+		return journal.StopTime{}, false
+	}
+	return trip.StopTimes[0], true
+}
+
+// LastStopTime returns the last stop time of the trip, if the trip has any stop times.
+//
+// For a trip with a single stop, the first and last stop times are the same.
+func LastStopTime(trip *journal.Trip) (journal.StopTime, bool) {
+	if trip == nil || len(trip.StopTimes) == 0 {
+		return journal.StopTime{}, false
+	}
+	return trip.StopTimes[len(trip.StopTimes)-1], true
+}
+
+// ClipTrip removes the stop times of the trip that are outside the window [start, end),
+// and returns whether any stop times remain.
+//
+// A stop time's position is determined by its arrival time, or its departure time if
+// there is no arrival time. Stop times with neither are retained.
+func ClipTrip(trip *journal.Trip, start, end time.Time) bool {
+	var retained []journal.StopTime
+	for _, stopTime := range trip.StopTimes {
+		t := stopTime.ArrivalTime
+		if t == nil {
+			t = stopTime.DepartureTime
+		}
+		if t != nil && (t.Before(start) || !t.Before(end)) {
+			continue
+		}
+		retained = append(retained, stopTime)
+	}
+	trip.StopTimes = retained
+	return len(retained) > 0
+}
+
+// DwellTime returns the departure time minus the arrival time of the stop time. ok is false if
+// either time is missing. A negative dwell time indicates bad data.
+func DwellTime(stopTime journal.StopTime) (dwell time.Duration, ok bool) {
+	if stopTime.ArrivalTime == nil || stopTime.DepartureTime == nil {
+		return 0, false
+	}
+	return stopTime.DepartureTime.Sub(*stopTime.ArrivalTime), true
+}
+
+// TravelTime returns the arrival time at the stop after the i-th stop time of the trip minus the
+// departure time from the i-th stop time. ok is false for the last stop time or if either time is
+// missing.
+func TravelTime(trip *journal.Trip, i int) (travel time.Duration, ok bool) {
+	if i+1 >= len(trip.StopTimes) {
+		return 0, false
+	}
+	departure, arrival := trip.StopTimes[i].DepartureTime, trip.StopTimes[i+1].ArrivalTime
+	if departure == nil || arrival == nil {
+		return 0, false
+	}
+	return arrival.Sub(*departure), true
+}
+
+// TripMetrics returns the dwell time and travel time of each stop time of the trip, as returned by
+// DwellTime and TravelTime. Both series have one entry per stop time, and the entries for missing
+// values are nil.
+func TripMetrics(trip *journal.Trip) (dwellTimes, travelTimes []*time.Duration) {
+	dwellTimes = make([]*time.Duration, len(trip.StopTimes))
+	travelTimes = make([]*time.Duration, len(trip.StopTimes))
+	for i, stopTime := range trip.StopTimes {
+		if dwell, ok := DwellTime(stopTime); ok {
+			dwellTimes[i] = &dwell
+		}
+		if travel, ok := TravelTime(trip, i); ok {
+			travelTimes[i] = &travel
+		}
+	}
+	return dwellTimes, travelTimes
+}
+
+// CountNegativeDwellTimes returns the number of stop times in the trip whose departure time is
+// before their arrival time.
+func CountNegativeDwellTimes(trip *journal.Trip) int {
+	n := 0
+	for _, stopTime := range trip.StopTimes {
+		if dwell, ok := DwellTime(stopTime); ok && dwell < 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// CountDuplicateStopIDs returns the number of stop times in the trip whose stop ID is the same as
+// that of an earlier stop time.
+func CountDuplicateStopIDs(trip *journal.Trip) int {
+	seen := map[string]bool{}
+	n := 0
+	for _, stopTime := range trip.StopTimes {
+		if seen[stopTime.StopID] {
+			n++
+		}
+		seen[stopTime.StopID] = true
+	}
+	return n
+}
+
+// RouteTerminals is the stop IDs of the terminals that a route's trips end at in each direction.
+type RouteTerminals struct {
+	Direction0 []string
+	Direction1 []string
+}
+
+// IsDirectionInconsistent returns whether the trip's direction ID contradicts its stop sequence,
+// given the terminals of each route keyed by route ID: the trip's last stop is a terminal of its
+// route in the other direction but not in its own. Trips without a direction ID, or whose route
+// has no terminals, are never inconsistent.
+func IsDirectionInconsistent(trip *journal.Trip, terminals map[string]RouteTerminals) bool {
+	routeTerminals, ok := terminals[trip.RouteID]
+	if !ok {
+		return false
+	}
+	lastStopTime, ok := LastStopTime(trip)
+	if !ok {
+		return false
+	}
+	var own, other []string
+	switch trip.DirectionID {
+	case gtfs.DirectionID_False:
+		own, other = routeTerminals.Direction0, routeTerminals.Direction1
+	case gtfs.DirectionID_True:
+		own, other = routeTerminals.Direction1, routeTerminals.Direction0
+	default:
+		return false
+	}
+	return containsStopID(other, lastStopTime.StopID) && !containsStopID(own, lastStopTime.StopID)
+}
+
+func containsStopID(stopIDs []string, stopID string) bool {
+	for _, s := range stopIDs {
+		if s == stopID {
+			return true
+		}
+	}
+	return false
+}
+
+// CountNonRevenueStopTimes returns the number of stop times in the trip at the non-revenue stops.
+func CountNonRevenueStopTimes(trip *journal.Trip, nonRevenueStopIDs map[string]bool) int {
+	n := 0
+	for _, stopTime := range trip.StopTimes {
+		if nonRevenueStopIDs[stopTime.StopID] {
+			n++
+		}
+	}
+	return n
+}
+
+// DropNonRevenueStopTimes removes the stop times of the trip at the non-revenue stops, and returns
+// whether the trip has any stop times left.
+func DropNonRevenueStopTimes(trip *journal.Trip, nonRevenueStopIDs map[string]bool) bool {
+	var retained []journal.StopTime
+	for _, stopTime := range trip.StopTimes {
+		if nonRevenueStopIDs[stopTime.StopID] {
+			continue
+		}
+		retained = append(retained, stopTime)
+	}
+	trip.StopTimes = retained
+	return len(retained) > 0
+}
+
+// MergeDuplicateStopIDs replaces the stop times in the trip that have the same stop ID with a
+// single stop time, and returns the number of stop times removed.
+//
+// The merged stop time is at the position of the first of them and is the one that was observed
+// most recently, so it has the latest times the feed reported; ties go to the later stop time.
+func MergeDuplicateStopIDs(trip *journal.Trip) int {
+	stopIDToIndex := map[string]int{}
+	var merged []journal.StopTime
+	for _, stopTime := range trip.StopTimes {
+		i, ok := stopIDToIndex[stopTime.StopID]
+		if !ok {
+			stopIDToIndex[stopTime.StopID] = len(merged)
+			merged = append(merged, stopTime)
+			continue
+		}
+		if !stopTime.LastObserved.Before(merged[i].LastObserved) {
+			merged[i] = stopTime
+		}
+	}
+	n := len(trip.StopTimes) - len(merged)
+	trip.StopTimes = merged
+	return n
+}
+
+// IsActual returns whether the stop time is an actual, i.e. the train had reached the stop,
+// rather than a prediction.
+//
+// Stops are removed from a trip in the feed once the train has passed them, at which point the
+// journal marks them as past. A stop time is an actual if it was marked past no earlier than its
+// arrival time (or its departure time, if there is no arrival time). Stop times that were still
+// in the feed when the journal ended are predictions, as are stop times marked past before their
+// time; e.g., the remaining stops of a trip that disappeared from the feed early.
+func IsActual(stopTime journal.StopTime) bool {
+	if stopTime.MarkedPast == nil {
+		return false
+	}
+	t := stopTime.ArrivalTime
+	if t == nil {
+		t = stopTime.DepartureTime
+	}
+	return t != nil && !stopTime.MarkedPast.Before(*t)
+}
+
+// DropPredictions removes the stop times of the trip that are predictions, and returns whether
+// any stop times remain.
+func DropPredictions(trip *journal.Trip) bool {
+	var retained []journal.StopTime
+	for _, stopTime := range trip.StopTimes {
+		if IsActual(stopTime) {
+			retained = append(retained, stopTime)
+		}
+	}
+	trip.StopTimes = retained
+	return len(retained) > 0
+}
+
+// TimeOfDayWindow is a range of local clock times [Start, End), given as durations since midnight.
+//
+// If End is before Start the window wraps around midnight; e.g., 22:00-02:00.
+type TimeOfDayWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// Contains returns whether the local clock time of t in the location is in the window.
+func (w TimeOfDayWindow) Contains(t time.Time, loc *time.Location) bool {
+	t = t.In(loc)
+	hour, minute, second := t.Clock()
+	d := time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second
+	if w.Start <= w.End {
+		return w.Start <= d && d < w.End
+	}
+	return w.Start <= d || d < w.End
+}
+
+// WindowTrip removes the stop times of the trip whose local clock time is outside the window,
+// and returns whether any stop times remain.
+//
+// As in ClipTrip, a stop time's position is determined by its arrival time, or its departure time
+// if there is no arrival time, and stop times with neither are retained. Each stop time is judged
+// on its own, so a trip that spans a boundary of the window keeps only the part inside the window,
+// and an overnight trip keeps the stop times on both sides of midnight that are in the window.
+func WindowTrip(trip *journal.Trip, window TimeOfDayWindow, loc *time.Location) bool {
+	var retained []journal.StopTime
+	for _, stopTime := range trip.StopTimes {
+		t := stopTime.ArrivalTime
+		if t == nil {
+			t = stopTime.DepartureTime
+		}
+		if t != nil && !window.Contains(*t, loc) {
+			continue
+		}
+		retained = append(retained, stopTime)
+	}
+	trip.StopTimes = retained
+	return len(retained) > 0
+}
@@ -0,0 +1,127 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jamespfennell/gtfs"
+	"github.com/jamespfennell/gtfs/journal"
+)
+
+// VehicleAssignment records that a vehicle was assigned to a trip.
+type VehicleAssignment struct {
+	VehicleID string
+	// Time of the first feed message in which the vehicle was assigned to the trip.
+	ObservedAt time.Time
+}
+
+// VehicleAssignments maps feed ID and trip UID to the trip's vehicle assignments, in order.
+type VehicleAssignments map[string]map[string][]VehicleAssignment
+
+// VehicleAssignmentRecorder is a GTFS-RT source that records the vehicle assignments of trips
+// in the feed messages returned by the wrapped source.
+//
+// The journal only keeps the last vehicle of each trip. Building the journal from the recorder
+// instead of the wrapped source preserves the full history of assignments.
+type VehicleAssignmentRecorder struct {
+	source      journal.GtfsrtSource
+	assignments map[string][]VehicleAssignment
+}
+
+func NewVehicleAssignmentRecorder(source journal.GtfsrtSource) *VehicleAssignmentRecorder {
+	return &VehicleAssignmentRecorder{
+		source:      source,
+		assignments: map[string][]VehicleAssignment{},
+	}
+}
+
+func (r *VehicleAssignmentRecorder) Next() *gtfs.Realtime {
+	feedMessage := r.source.Next()
+	if feedMessage == nil {
+		return nil
+	}
+	for i := range feedMessage.Trips {
+		tripUpdate := &feedMessage.Trips[i]
+		if tripUpdate.Vehicle == nil || len(tripUpdate.ID.ID) < 6 {
+			continue
+		}
+		vehicle := tripUpdate.GetVehicle()
+		vehicleID := vehicle.GetID().ID
+		tripUID := journalTripUID(tripUpdate)
+		assignments := r.assignments[tripUID]
+		if n := len(assignments); n > 0 && assignments[n-1].VehicleID == vehicleID {
+			continue
+		}
+		r.assignments[tripUID] = append(assignments, VehicleAssignment{
+			VehicleID:  vehicleID,
+			ObservedAt: feedMessage.CreatedAt,
+		})
+	}
+	return feedMessage
+}
+
+// Assignments returns the recorded vehicle assignments keyed by trip UID.
+func (r *VehicleAssignmentRecorder) Assignments() map[string][]VehicleAssignment {
+	return r.assignments
+}
+
+// journalTripUID returns the UID the journal gives to the trip of the trip update. The trip ID
+// must have at least 6 characters.
+func journalTripUID(tripUpdate *gtfs.Trip) string {
+	startTime := tripUpdate.ID.StartDate.Add(tripUpdate.ID.StartTime)
+	return fmt.Sprintf("%d%s", startTime.Unix(), tripUpdate.ID.ID[6:])
+}
+
+// vehicleAssignmentsExport writes vehicle_assignments.csv, which lists every vehicle assigned
+// to each exported trip.
+type vehicleAssignmentsExport struct {
+	opts        *Options
+	assignments VehicleAssignments
+	b           bytes.Buffer
+	w           *csv.Writer
+}
+
+func newVehicleAssignmentsExport(opts *Options) *vehicleAssignmentsExport {
+	e := &vehicleAssignmentsExport{
+		opts:        opts,
+		assignments: opts.VehicleAssignments,
+	}
+	e.w = csv.NewWriter(&e.b)
+	// Writes to a bytes.Buffer don't fail.
+	_ = e.w.Write([]string{"trip_uid", "vehicle_id", "observed_at"})
+	return e
+}
+
+func (e *vehicleAssignmentsExport) fileName() string {
+	return "vehicle_assignments.csv"
+}
+
+func (e *vehicleAssignmentsExport) columns() []Column {
+	return []Column{
+		{"trip_uid", "string", "", false, "Trip the vehicle was assigned to; references trips.csv."},
+		{"vehicle_id", "string", "", false, vehicleIDDescription(e.opts, "ID of the vehicle.")},
+		{"observed_at", "integer", "unix seconds", false, "Time of the first feed message in which the vehicle was assigned to the trip."},
+	}
+}
+
+func (e *vehicleAssignmentsExport) add(feedID string, trips []journal.Trip) {
+	tripUIDToAssignments := e.assignments[feedID]
+	for i := range trips {
+		tripUID := trips[i].TripUID
+		for _, assignment := range tripUIDToAssignments[tripUID] {
+			_ = e.w.Write([]string{
+				tripUID,
+				vehicleID(e.opts, assignment.VehicleID),
+				strconv.FormatInt(assignment.ObservedAt.Unix(), 10),
+			})
+		}
+	}
+}
+
+func (e *vehicleAssignmentsExport) csv() []byte {
+	e.w.Flush()
+	return e.b.Bytes()
+}
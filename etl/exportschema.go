@@ -0,0 +1,23 @@
+package etl
+
+import (
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/export"
+)
+
+// PrintExportSchema writes the schema of the CSV files in the archives the pipeline currently
+// produces to stdout, as JSON.
+//
+// The schema reflects the export options in the config, and is in the format read by
+// ExportSchemaPath, so consumers can check it against their expectations in CI.
+func PrintExportSchema(ec *config.Config) error {
+	day := lastBacklogDay(ec)
+	opts, err := newExportOptions(ec, day.Start(ec.Timezone.AsLoc()), day.End(ec.Timezone.AsLoc()))
+	if err != nil {
+		return err
+	}
+	if ec.IncludeVehicleAssignments {
+		opts.VehicleAssignments = export.VehicleAssignments{}
+	}
+	return writeJson(export.SchemaFor(opts))
+}
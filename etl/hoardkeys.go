@@ -0,0 +1,183 @@
+package etl
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	hconfig "github.com/jamespfennell/hoard/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+)
+
+// Hoard archive names end with .tar.<ext>, optionally with a compression level before the .tar.
+var hoardArchiveRegex = regexp.MustCompile(`(?:_(\d+))?\.tar\.(` + hconfig.ExtensionRegex + `)$`)
+
+// feedIDsForHoardKeys returns the feeds that the Hoard object keys belong to.
+//
+// Hoard stores objects for a feed under <prefix>/<feed ID>/ in each object storage.
+func feedIDsForHoardKeys(hc *hconfig.Config, keys []string) ([]string, error) {
+	var feedIDs []string
+	seen := map[string]bool{}
+	for _, key := range keys {
+		feedID, err := feedIDForHoardKey(hc, key)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[feedID] {
+			seen[feedID] = true
+			feedIDs = append(feedIDs, feedID)
+		}
+	}
+	sort.Strings(feedIDs)
+	return feedIDs, nil
+}
+
+func feedIDForHoardKey(hc *hconfig.Config, key string) (string, error) {
+	for _, objectStorage := range hc.ObjectStorage {
+		rest := strings.TrimPrefix(key, strings.Trim(objectStorage.Prefix, "/")+"/")
+		if objectStorage.Prefix == "" {
+			rest = key
+		}
+		feedID, _, ok := strings.Cut(rest, "/")
+		if !ok {
+			continue
+		}
+		for _, feed := range hc.Feeds {
+			if feed.ID == feedID {
+				return feedID, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Hoard object key %q does not belong to any feed in the Hoard config", key)
+}
+
+// retrieveHoardKeys downloads and unpacks the Hoard objects into <dir>/<feed ID>.
+//
+// Every key is checked to exist before any data is downloaded. Each object is read from
+// the first Hoard object storage that contains it. All requests wait for the limiter.
+func retrieveHoardKeys(ctx context.Context, hc *hconfig.Config, keys []string, dir string, limiter *storage.RateLimiter) error {
+	buckets, err := newHoardBuckets(hc, limiter)
+	if err != nil {
+		return err
+	}
+	keyToBucket := map[string]*storage.Bucket{}
+	for _, key := range keys {
+		for _, b := range buckets {
+			exists, err := b.Exists(ctx, key)
+			if err != nil {
+				return fmt.Errorf("failed to check if Hoard object %s exists: %w", key, err)
+			}
+			if exists {
+				keyToBucket[key] = b
+				break
+			}
+		}
+		if keyToBucket[key] == nil {
+			return fmt.Errorf("Hoard object %s does not exist", key)
+		}
+	}
+	for _, key := range keys {
+		feedID, err := feedIDForHoardKey(hc, key)
+		if err != nil {
+			return err
+		}
+		if err := readHoardArchive(ctx, keyToBucket[key], key, filepath.Join(dir, feedID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newHoardBuckets returns a client for each of the Hoard object storages, in the order of the
+// Hoard config. All requests made by the clients wait for the limiter.
+func newHoardBuckets(hc *hconfig.Config, limiter *storage.RateLimiter) ([]*storage.Bucket, error) {
+	var buckets []*storage.Bucket
+	for _, objectStorage := range hc.ObjectStorage {
+		url := objectStorage.Endpoint
+		if objectStorage.Insecure && !strings.Contains(url, "://") {
+			url = "http://" + url
+		}
+		b, err := storage.NewBucket(url, objectStorage.AccessKey, objectStorage.SecretKey, objectStorage.BucketName)
+		if err != nil {
+			return nil, err
+		}
+		b.SetRateLimiter(limiter)
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+func readHoardArchive(ctx context.Context, bucket *storage.Bucket, key string, dir string) error {
+	b, err := bucket.Read(ctx, key)
+	if err != nil {
+		return err
+	}
+	log.Printf("Unpacking Hoard object %s", key)
+	if err := unpackHoardArchive(key, b, dir); err != nil {
+		return fmt.Errorf("failed to unpack Hoard object %s: %w", key, err)
+	}
+	return nil
+}
+
+func unpackHoardArchive(key string, b []byte, dir string) error {
+	match := hoardArchiveRegex.FindStringSubmatch(path.Base(key))
+	if match == nil {
+		return fmt.Errorf("not a Hoard archive")
+	}
+	format, ok := hconfig.NewFormatFromExtension(match[2])
+	if !ok {
+		return fmt.Errorf("unknown compression format %s", match[2])
+	}
+	level := 0
+	if match[1] != "" {
+		level, _ = strconv.Atoi(match[1])
+	}
+	r, err := hconfig.NewSpecWithLevel(format, level).NewReader(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Skip the Hoard manifest and anything that isn't a regular file.
+		if hdr.Typeflag != tar.TypeReg || strings.HasPrefix(path.Base(hdr.Name), ".") {
+			continue
+		}
+		target := filepath.Join(dir, filepath.Base(hdr.Name))
+		f, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		// The GTFS-RT export uses the modification time to filter files to the day.
+		if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+}
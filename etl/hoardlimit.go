@@ -0,0 +1,72 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	hconfig "github.com/jamespfennell/hoard/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+)
+
+var (
+	hoardLimiterOnce sync.Once
+	hoardLimiter     *storage.RateLimiter
+)
+
+// hoardRateLimiter returns the limiter shared by all reads from Hoard in the process, or nil if
+// the config doesn't limit them.
+//
+// hoard.Retrieve doesn't accept an HTTP client, so when reads are limited the data is retrieved
+// with retrieveHoardHours instead, whose clients wait for the limiter and pause it on Retry-After
+// headers.
+func hoardRateLimiter(ec *config.Config) *storage.RateLimiter {
+	hoardLimiterOnce.Do(func() {
+		if ec.HoardRequestsPerSecond <= 0 {
+			return
+		}
+		hoardLimiter = storage.NewRateLimiter(ec.HoardRequestsPerSecond)
+	})
+	return hoardLimiter
+}
+
+// retrieveHoardHours downloads and unpacks the Hoard archives of the feeds for the hours between
+// start and end into <dir>/<feed ID>. Like hoard.Retrieve, both ends are truncated to the hour and
+// the hour of end is included.
+//
+// Hoard stores the archives of an hour under <prefix>/<feed ID>/YYYY/MM/DD/HH/ in UTC. Archives
+// replicated in more than one object storage are read from the first one that lists them. All
+// requests wait for the limiter.
+func retrieveHoardHours(ctx context.Context, hc *hconfig.Config, feedIDs []string, start, end time.Time, dir string, limiter *storage.RateLimiter) error {
+	buckets, err := newHoardBuckets(hc, limiter)
+	if err != nil {
+		return err
+	}
+	for _, feedID := range feedIDs {
+		for h := start.UTC().Truncate(time.Hour); !h.After(end); h = h.Add(time.Hour) {
+			seen := map[string]bool{}
+			for i, objectStorage := range hc.ObjectStorage {
+				prefix := path.Join(objectStorage.Prefix, feedID, h.Format("2006/01/02/15")) + "/"
+				keys, err := buckets[i].List(ctx, prefix)
+				if err != nil {
+					return fmt.Errorf("failed to list Hoard objects for %s: %w", feedID, err)
+				}
+				for _, key := range keys {
+					name := path.Base(key)
+					if seen[name] || !hoardArchiveRegex.MatchString(name) {
+						continue
+					}
+					seen[name] = true
+					if err := readHoardArchive(ctx, buckets[i], key, filepath.Join(dir, feedID)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package etl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/export"
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+	"github.com/jamespfennell/xz"
+)
+
+// journalDumpName returns the file name of the journal dump of the day.
+func journalDumpName(ec *config.Config, day metadata.Day) string {
+	return fmt.Sprintf("%s%s_journal.gob", ec.RemotePrefix, day)
+}
+
+// dumpJournal writes the trips of the day, exactly as they are passed to the export, to the
+// journal dump directory and/or object storage, if the config enables it.
+//
+// The upload is xz-compressed and is stored next to the day's archives. It is not recorded in
+// the metadata and is overwritten when the day is processed again.
+func dumpJournal(ctx context.Context, day metadata.Day, s *export.TripStore, tmpDir string, ec *config.Config, sc *storage.Client) error {
+	if ec.JournalDumpDir == "" && !ec.UploadJournalDump {
+		return nil
+	}
+	dir := ec.JournalDumpDir
+	if dir == "" {
+		dir = tmpDir
+	}
+	path := filepath.Join(dir, journalDumpName(ec, day))
+	if err := writeJournalDump(s, path); err != nil {
+		return err
+	}
+	log.Printf("%s: wrote journal dump to %s", day, path)
+	if !ec.UploadJournalDump {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read journal dump: %w", err)
+	}
+	compressed, err := export.Compress(b)
+	if err != nil {
+		return fmt.Errorf("failed to compress journal dump: %w", err)
+	}
+	target := fmt.Sprintf("%s/%s.xz", day.MonthString(), journalDumpName(ec, day))
+	if err := sc.Write(ctx, compressed, target); err != nil {
+		return fmt.Errorf("failed to copy journal dump to object storage: %w", err)
+	}
+	log.Printf("%s: uploaded journal dump to %s", day, target)
+	return nil
+}
+
+func writeJournalDump(s *export.TripStore, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create journal dump: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	if err := s.Dump(w); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write journal dump: %w", err)
+	}
+	return f.Close()
+}
+
+type ExportJournalOptions struct {
+	// Location of the journal dump: a local path or, if FromStorage is set, a path in object storage.
+	// Dumps whose name ends in .xz are decompressed.
+	DumpPath    string
+	FromStorage bool
+	// Path on disk to write the tar.xz CSV archive to.
+	OutputPath string
+}
+
+// ExportJournal reruns the export step of the day against a journal dump and writes the CSV
+// archive to disk, using the export options in the config.
+//
+// Vehicle assignments, start dates and schedule relationships are not part of the dump, so
+// vehicle_assignments.csv is never included, the start_date column of trips.csv is the service
+// day, is_canceled is empty and is_added is never true.
+func ExportJournal(ctx context.Context, day metadata.Day, opts ExportJournalOptions, ec *config.Config, sc *storage.Client) error {
+	var r io.Reader
+	if opts.FromStorage {
+		b, err := sc.Read(ctx, opts.DumpPath)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	} else {
+		f, err := os.Open(opts.DumpPath)
+		if err != nil {
+			return fmt.Errorf("failed to open journal dump: %w", err)
+		}
+		defer f.Close()
+		r = bufio.NewReader(f)
+	}
+	if strings.HasSuffix(opts.DumpPath, ".xz") {
+		r = xz.NewReader(r)
+	}
+	tmpDir, err := os.MkdirTemp("", fmt.Sprintf("subwaydatanyc_%s_*", day))
+	if err != nil {
+		return fmt.Errorf("failed to create temporary working directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tripStore, err := export.LoadTripStore(r, tmpDir, ec.MaxInMemoryTrips)
+	if err != nil {
+		return err
+	}
+	exportOpts, err := newExportOptions(ec, day.Start(ec.Timezone.AsLoc()), day.End(ec.Timezone.AsLoc()))
+	if err != nil {
+		return err
+	}
+	csvTarBytes, exportStats, err := export.ExportStoreTar(tripStore, fmt.Sprintf("%s%s_", ec.RemotePrefix, day), exportOpts)
+	if err != nil {
+		return fmt.Errorf("failed to export trips to CSV: %w", err)
+	}
+	log.Printf("%s: exported %d/%d trips and %d/%d stop times (dropped: %v, flagged: %v)", day,
+		exportStats.TripsOut, exportStats.TripsIn, exportStats.StopTimesOut, exportStats.StopTimesIn, exportStats.Dropped, exportStats.Flagged)
+	csvBytes, err := export.Compress(csvTarBytes)
+	if err != nil {
+		return fmt.Errorf("failed to compress CSV export: %w", err)
+	}
+	if err := os.WriteFile(opts.OutputPath, csvBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write CSV export: %w", err)
+	}
+	log.Printf("%s: wrote CSV export to %s", day, opts.OutputPath)
+	return nil
+}
@@ -0,0 +1,137 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+// Number of HEAD requests made at once by CheckKeys.
+const keysCheckConcurrency = 16
+
+type KeysCheckOptions struct {
+	Output OutputFormat
+}
+
+// keyToCheck is an archive referenced by the metadata along with the key it should have.
+type keyToCheck struct {
+	day           metadata.Day
+	archive       string
+	path          string
+	expectedPaths []string
+}
+
+// CheckKeys checks that every archive in the metadata is stored at the key the pipeline would
+// write it to, and that an object exists at that key.
+//
+// The expected key is computed from the day, the archive's checksum and the RemotePrefix in the
+// config. Archives of preliminary days may have the preliminary tag or not, as TagPreliminaryKeys
+// may have changed since they were written. Unlike reconcile, this doesn't list the bucket, so it
+// is cheap enough to run as a periodic health check. An error is returned if any problem is found.
+func CheckKeys(ctx context.Context, ec *config.Config, sc *storage.Client, opts KeysCheckOptions) error {
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	keys := keysToCheck(ec, m)
+	report := KeysReport{
+		NumChecked: len(keys),
+		Problems:   []KeyProblem{},
+	}
+	var mu sync.Mutex
+	l := newLimiter(keysCheckConcurrency)
+	for _, key := range keys {
+		key := key
+		l.run(func() error {
+			exists, err := sc.Exists(ctx, key.path)
+			if err != nil {
+				return err
+			}
+			problem := KeyProblem{
+				Day:     key.day,
+				Archive: key.archive,
+				Path:    key.path,
+				Missing: !exists,
+			}
+			if !containsString(key.expectedPaths, key.path) {
+				problem.ExpectedPath = key.expectedPaths[0]
+			}
+			if problem.Missing || problem.ExpectedPath != "" {
+				mu.Lock()
+				report.Problems = append(report.Problems, problem)
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := l.wait(); err != nil {
+		return err
+	}
+	sort.Slice(report.Problems, func(i, j int) bool {
+		if report.Problems[i].Day != report.Problems[j].Day {
+			return report.Problems[i].Day.Before(report.Problems[j].Day)
+		}
+		return report.Problems[i].Archive < report.Problems[j].Archive
+	})
+	if opts.Output == OutputJson {
+		if err := writeJson(report); err != nil {
+			return err
+		}
+	} else {
+		for _, problem := range report.Problems {
+			switch {
+			case problem.Missing && problem.ExpectedPath != "":
+				fmt.Printf("%s %s: %s is missing and doesn't match the expected key %s\n", problem.Day, problem.Archive, problem.Path, problem.ExpectedPath)
+			case problem.Missing:
+				fmt.Printf("%s %s: %s is missing\n", problem.Day, problem.Archive, problem.Path)
+			default:
+				fmt.Printf("%s %s: %s doesn't match the expected key %s\n", problem.Day, problem.Archive, problem.Path, problem.ExpectedPath)
+			}
+		}
+		fmt.Printf("%d archive(s) checked, %d problem(s)\n", report.NumChecked, len(report.Problems))
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%d of %d archive key(s) have problems", len(report.Problems), report.NumChecked)
+	}
+	return nil
+}
+
+func keysToCheck(ec *config.Config, m *metadata.Metadata) []keyToCheck {
+	var keys []keyToCheck
+	for _, processedDay := range m.ProcessedDays {
+		tags := []string{""}
+		if processedDay.Preliminary {
+			tags = append(tags, preliminaryTag)
+		}
+		add := func(kind, ext string, artifact metadata.Artifact) {
+			key := keyToCheck{
+				day:     processedDay.Day,
+				archive: kind + "." + ext,
+				path:    artifact.Path,
+			}
+			for _, tag := range tags {
+				key.expectedPaths = append(key.expectedPaths, archiveKey(ec, processedDay.Day, kind, artifact.Checksum, tag, ext))
+			}
+			keys = append(keys, key)
+		}
+		add("csv", "tar.xz", processedDay.Csv)
+		if processedDay.CsvUncompressed != nil {
+			add("csv", "tar", *processedDay.CsvUncompressed)
+		}
+		if !processedDay.GtfsrtPruned {
+			add("gtfsrt", "tar.xz", processedDay.Gtfsrt)
+		}
+		for _, feedCsv := range processedDay.FeedCsv {
+			add(feedCsv.FeedID+"_csv", "tar.xz", feedCsv.Artifact)
+		}
+		if processedDay.ChangesCsv != nil {
+			add("changes_csv", "tar.xz", processedDay.ChangesCsv.Artifact)
+		}
+	}
+	return keys
+}
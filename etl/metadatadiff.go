@@ -0,0 +1,72 @@
+package etl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+// SnapshotMetadata writes the current metadata to a local file, for later use with DiffMetadata.
+//
+// Sharded metadata is combined, so the snapshot is a single file.
+func SnapshotMetadata(ctx context.Context, path string, sc *storage.Client) error {
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata snapshot: %w", err)
+	}
+	return nil
+}
+
+// DiffMetadata reports the processed days that were added, removed or changed in the current
+// metadata relative to the snapshot at the path.
+func DiffMetadata(ctx context.Context, snapshotPath string, output OutputFormat, sc *storage.Client) error {
+	b, err := os.ReadFile(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata snapshot: %w", err)
+	}
+	var snapshot metadata.Metadata
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return fmt.Errorf("failed to parse metadata snapshot: %w", err)
+	}
+	if len(snapshot.Shards) > 0 {
+		return fmt.Errorf("metadata snapshot is a shard index; create a combined snapshot with the metadata snapshot command")
+	}
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	changes, err := metadata.Diff(&snapshot, m)
+	if err != nil {
+		return fmt.Errorf("failed to diff metadata: %w", err)
+	}
+	if output == OutputJson {
+		return writeJson(changes)
+	}
+	fmt.Printf("%d day(s) added:", len(changes.Added))
+	for _, processedDay := range changes.Added {
+		fmt.Printf(" %s", processedDay.Day)
+	}
+	fmt.Printf("\n%d day(s) removed:", len(changes.Removed))
+	for _, processedDay := range changes.Removed {
+		fmt.Printf(" %s", processedDay.Day)
+	}
+	fmt.Printf("\n%d day(s) changed\n", len(changes.Changed))
+	for _, dayDiff := range changes.Changed {
+		fmt.Printf("%s\n", dayDiff.Day)
+		for _, field := range dayDiff.Fields {
+			fmt.Printf("  %s: %s -> %s\n", field.Field, field.Old, field.New)
+		}
+	}
+	return nil
+}
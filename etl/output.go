@@ -0,0 +1,181 @@
+package etl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+// OutputFormat is the format that reporting commands write their results in.
+//
+// Text output is intended for humans and may change. JSON output is written to stdout
+// as a single document whose structure is given by the corresponding report type
+// (for example, BacklogReport), and is stable. Logs are always written to stderr.
+type OutputFormat string
+
+const (
+	OutputText OutputFormat = "text"
+	OutputJson OutputFormat = "json"
+)
+
+// ParseOutputFormat parses the value of the --output flag.
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch OutputFormat(s) {
+	case "", OutputText:
+		return OutputText, nil
+	case OutputJson:
+		return OutputJson, nil
+	default:
+		return "", fmt.Errorf("unknown output format %q (must be text or json)", s)
+	}
+}
+
+func writeJson(v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(b))
+	return err
+}
+
+// BacklogReport is the JSON output of a backlog dry run.
+type BacklogReport struct {
+	// Days that would be processed, in the order they would be processed.
+	PendingDays []BacklogReportDay
+	// Days that are skipped because of the config.
+	SkippedDays []metadata.SkippedDay
+}
+
+type BacklogReportDay struct {
+	Day     metadata.Day
+	FeedIDs []string
+	// Whether the day is incomplete and would be processed as preliminary.
+	Preliminary bool `json:",omitempty"`
+}
+
+// BacklogEstimate is the JSON output of backlog --estimate.
+type BacklogEstimate struct {
+	// Number of days that would be processed.
+	NumDays int
+	// Number of recently processed days the averages are computed from.
+	NumSampleDays int
+	// Average per-day processing time, in seconds. Zero if no sample day records its processing time.
+	AverageSeconds       float64
+	AverageDownloadBytes int64
+	AverageUploadBytes   int64
+	// Projected wall-clock time to process the backlog at the configured concurrency, in seconds.
+	EstimatedSeconds       float64
+	EstimatedDownloadBytes int64
+	EstimatedUploadBytes   int64
+}
+
+// ReprocessReport is the JSON output of a reprocess dry run.
+type ReprocessReport struct {
+	// Target days grouped by the software version they were last processed with.
+	Versions []ReprocessReportVersion
+	NumDays  int
+	// Estimated number of bytes downloaded from Hoard, based on the size of the existing GTFS-RT archives.
+	EstimatedDownloadBytes int64
+	// Estimated number of bytes uploaded to object storage, based on the size of the existing archives.
+	EstimatedUploadBytes int64
+}
+
+type ReprocessReportVersion struct {
+	SoftwareVersion int
+	Days            []metadata.Day
+}
+
+// ReconcileReport is the JSON output of the reconcile command.
+type ReconcileReport struct {
+	// Days whose archives are in storage but which are missing from the metadata.
+	MissingFromMetadata []metadata.Day
+	// Days in the metadata whose archives are missing from storage.
+	MissingFromStorage []metadata.Day
+	// Whether the metadata was updated.
+	Applied bool
+}
+
+// KeysReport is the JSON output of the keys check command.
+type KeysReport struct {
+	// Number of archives in the metadata that were checked.
+	NumChecked int
+	// Archives whose key doesn't match the key scheme or which don't exist in storage.
+	Problems []KeyProblem
+}
+
+type KeyProblem struct {
+	Day metadata.Day
+	// Kind of archive, e.g. csv.tar.xz or nycsubway_L_csv.tar.xz.
+	Archive string
+	// Key in the metadata.
+	Path string
+	// Key computed from the day and checksum, if different from Path.
+	ExpectedPath string `json:",omitempty"`
+	// Whether no object exists at Path.
+	Missing bool
+}
+
+// CoverageReport is the output of the coverage command, both as JSON and when exported to a file.
+type CoverageReport struct {
+	GeneratedAt time.Time
+	// Last day covered by the report.
+	LastDay metadata.Day
+	// One row per feed per month, ordered by feed ID and then month.
+	Rows []CoverageRow
+}
+
+type CoverageRow struct {
+	FeedID string
+	// Month of the form YYYY-MM.
+	Month string
+	// Number of days in the month on which the feed is active, up to the last day of the report.
+	NumDays int
+	// Days that were processed with the feed.
+	PresentDays int
+	// Days that are neither processed nor skipped.
+	MissingDays int
+	// Days that were processed with the feed from partial data and will be processed again.
+	PreliminaryDays int
+	// Days that are deliberately never processed.
+	SkippedDays int
+	// Number of trips of the feed in the CSV exports of the present and preliminary days. Days
+	// processed before export statistics were recorded count as zero trips, as do days with
+	// several feeds processed before the trips were counted per feed.
+	Trips int
+}
+
+// BenchmarkReport is the output of the benchmark command.
+type BenchmarkReport struct {
+	Day     metadata.Day
+	FeedIDs []string
+	// Whether the archives were uploaded and the metadata updated.
+	Uploaded bool
+	// Steps of the run in the order they ran. The upload step is absent if nothing was uploaded.
+	Steps []BenchmarkStep
+	// Time taken by the whole run, in seconds.
+	TotalSeconds float64
+}
+
+type BenchmarkStep struct {
+	// One of download, parse, merge, export and upload.
+	Name    string
+	Seconds float64
+}
+
+// RoutesReport is the JSON output of the routes command.
+type RoutesReport struct {
+	Day metadata.Day
+	// Feeds whose trips are counted.
+	FeedIDs []string
+	// Routes with at least one trip, ordered by route ID.
+	Routes []RouteTripCount
+}
+
+type RouteTripCount struct {
+	RouteID string
+	Trips   int
+}
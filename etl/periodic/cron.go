@@ -0,0 +1,186 @@
+package periodic
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day of month, month and day
+// of week.
+type cronSchedule struct {
+	minutes     [60]bool
+	hours       [24]bool
+	daysOfMonth [32]bool
+	months      [13]bool
+	daysOfWeek  [7]bool
+	// Whether the day of month and day of week fields are restricted, i.e. don't start with *. As
+	// in standard cron, if both are restricted a day matches if either field matches.
+	domRestricted bool
+	dowRestricted bool
+}
+
+// NewCronInterval returns an interval that starts at each minute matching the five-field cron
+// expression; e.g., "0 2 * * *" starts at 02:00 every day and "30 4 * * 1-5" at 04:30 on weekdays.
+//
+// Each field is *, a number, a range a-b, or a comma-separated list of these, optionally followed
+// by a step /n; e.g., */15 is every 15 minutes. Days of the week are 0-7, where both 0 and 7 are
+// Sunday. Names of months and days are not supported.
+//
+// Times are interpreted in the timezone of the config passed to Run. On the day clocks go forward,
+// times in the skipped hour start the interval once, at the transition; on the day clocks go back,
+// times in the repeated hour match twice. Expressions that never match, like "0 0 31 2 *", are
+// rejected.
+func NewCronInterval(expr string) (Interval, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return Interval{}, fmt.Errorf("cron expression %q must have 5 fields, got %d", expr, len(fields))
+	}
+	s := &cronSchedule{
+		domRestricted: !strings.HasPrefix(fields[2], "*"),
+		dowRestricted: !strings.HasPrefix(fields[4], "*"),
+	}
+	var daysOfWeek [8]bool
+	for i, f := range []struct {
+		name     string
+		min, max int
+		values   []bool
+	}{
+		{"minute", 0, 59, s.minutes[:]},
+		{"hour", 0, 23, s.hours[:]},
+		{"day of month", 1, 31, s.daysOfMonth[:]},
+		{"month", 1, 12, s.months[:]},
+		{"day of week", 0, 7, daysOfWeek[:]},
+	} {
+		if err := parseCronField(fields[i], f.min, f.max, f.values); err != nil {
+			return Interval{}, fmt.Errorf("invalid %s field in cron expression %q: %w", f.name, expr, err)
+		}
+	}
+	copy(s.daysOfWeek[:], daysOfWeek[:7])
+	s.daysOfWeek[0] = s.daysOfWeek[0] || daysOfWeek[7]
+	if !s.matchesSomeDay() {
+		return Interval{}, fmt.Errorf("cron expression %q never matches: none of the months have the days of the month", expr)
+	}
+	return Interval{cron: s}, nil
+}
+
+// daysInMonth is the largest number of days in each month, including February of leap years.
+var daysInMonth = [13]int{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+// matchesSomeDay returns whether some day of some year matches the day and month fields.
+func (s *cronSchedule) matchesSomeDay() bool {
+	if s.domRestricted && s.dowRestricted {
+		// Every day of the week occurs in every month.
+		return true
+	}
+	for month := 1; month <= 12; month++ {
+		if !s.months[month] {
+			continue
+		}
+		for day := 1; day <= daysInMonth[month]; day++ {
+			if s.daysOfMonth[day] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseCronField sets values[i] for each i in [min, max] matched by the field.
+func parseCronField(field string, min, max int, values []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return fmt.Errorf("invalid step %q", stepPart)
+			}
+			part = rangePart
+		}
+		first, last := min, max
+		if part != "*" {
+			firstPart, lastPart, isRange := strings.Cut(part, "-")
+			var err error
+			first, err = strconv.Atoi(firstPart)
+			if err != nil {
+				return fmt.Errorf("invalid value %q", firstPart)
+			}
+			last = first
+			if hasStep {
+				// As in standard cron, a/n is the same as a-max/n.
+				last = max
+			}
+			if isRange {
+				last, err = strconv.Atoi(lastPart)
+				if err != nil {
+					return fmt.Errorf("invalid value %q", lastPart)
+				}
+			}
+			if first < min || last > max || last < first {
+				return fmt.Errorf("%q is not within %d-%d", part, min, max)
+			}
+		}
+		for i := first; i <= last; i += step {
+			values[i] = true
+		}
+	}
+	return nil
+}
+
+// matches returns whether the local clock time of t matches the schedule.
+func (s *cronSchedule) matches(t time.Time) bool {
+	return s.minutes[t.Minute()] && s.hours[t.Hour()] && s.months[t.Month()] && s.matchesDay(t)
+}
+
+// next returns the first minute strictly after t that matches the schedule, in the location of
+// t. It returns false if no minute in the next 5 years matches.
+func (s *cronSchedule) next(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !s.months[t.Month()] || !s.matchesDay(t) {
+			y, m, d := t.Date()
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.matches(t) || s.matchesSkipped(t) {
+			return t, true
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}, false
+}
+
+// matchesSkipped returns whether clocks went forward at t, and one of the local clock times that
+// were skipped matches the schedule.
+func (s *cronSchedule) matchesSkipped(t time.Time) bool {
+	before := t.Add(-time.Minute)
+	_, offsetBefore := before.Zone()
+	_, offset := t.Zone()
+	if offset <= offsetBefore {
+		return false
+	}
+	// The skipped clock times are represented in UTC, which has no transitions.
+	clock := func(t time.Time) time.Time {
+		y, m, d := t.Date()
+		return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, time.UTC)
+	}
+	for skipped := clock(before).Add(time.Minute); skipped.Before(clock(t)); skipped = skipped.Add(time.Minute) {
+		if s.matches(skipped) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesDay returns whether the day of t matches the day of month and day of week fields.
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom, dow := s.daysOfMonth[t.Day()], s.daysOfWeek[t.Weekday()]
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
@@ -0,0 +1,216 @@
+package periodic
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	testCases := []struct {
+		field    string
+		min, max int
+		want     []int
+		wantErr  bool
+	}{
+		{field: "*", min: 0, max: 3, want: []int{0, 1, 2, 3}},
+		{field: "2", min: 0, max: 3, want: []int{2}},
+		{field: "1-2", min: 0, max: 3, want: []int{1, 2}},
+		{field: "0,3", min: 0, max: 3, want: []int{0, 3}},
+		{field: "*/2", min: 0, max: 5, want: []int{0, 2, 4}},
+		{field: "1/2", min: 0, max: 5, want: []int{1, 3, 5}},
+		{field: "1-4/3", min: 0, max: 5, want: []int{1, 4}},
+		{field: "0-1,4-5", min: 0, max: 5, want: []int{0, 1, 4, 5}},
+		{field: "4", min: 0, max: 3, wantErr: true},
+		{field: "0", min: 1, max: 3, wantErr: true},
+		{field: "3-1", min: 0, max: 3, wantErr: true},
+		{field: "*/0", min: 0, max: 3, wantErr: true},
+		{field: "a", min: 0, max: 3, wantErr: true},
+		{field: "1-b", min: 0, max: 3, wantErr: true},
+		{field: "", min: 0, max: 3, wantErr: true},
+	}
+	for _, tc := range testCases {
+		values := make([]bool, tc.max+1)
+		err := parseCronField(tc.field, tc.min, tc.max, values)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseCronField(%q) succeeded, want an error", tc.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCronField(%q) failed: %s", tc.field, err)
+			continue
+		}
+		var got []int
+		for i, v := range values {
+			if v {
+				got = append(got, i)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseCronField(%q) = %v, want %v", tc.field, got, tc.want)
+		}
+	}
+}
+
+func TestNewCronIntervalErrors(t *testing.T) {
+	for _, expr := range []string{
+		"0 0 * *",
+		"60 0 * * *",
+		"0 24 * * *",
+		"0 0 0 * *",
+		"0 0 * 13 *",
+		"0 0 * * 8",
+		"0 0 31 2 *",
+		"0 0 30,31 2 *",
+		"0 0 31 4,6,9,11 *",
+	} {
+		if _, err := NewCronInterval(expr); err == nil {
+			t.Errorf("NewCronInterval(%q) succeeded, want an error", expr)
+		}
+	}
+	for _, expr := range []string{
+		"0 0 29 2 *",
+		"0 0 31 2 1",
+		"0 0 31 2,3 *",
+	} {
+		if _, err := NewCronInterval(expr); err != nil {
+			t.Errorf("NewCronInterval(%q) failed: %s", expr, err)
+		}
+	}
+}
+
+func TestMatchesDay(t *testing.T) {
+	// 2023-03-01 was a Wednesday.
+	wednesdayFirst := time.Date(2023, time.March, 1, 0, 0, 0, 0, time.UTC)
+	thursdaySecond := wednesdayFirst.AddDate(0, 0, 1)
+	mondayThirteenth := wednesdayFirst.AddDate(0, 0, 12)
+	testCases := []struct {
+		expr string
+		day  time.Time
+		want bool
+	}{
+		{"0 0 * * *", thursdaySecond, true},
+		{"0 0 1 * *", wednesdayFirst, true},
+		{"0 0 1 * *", thursdaySecond, false},
+		{"0 0 * * 1", mondayThirteenth, true},
+		{"0 0 * * 1", wednesdayFirst, false},
+		{"0 0 * * 7", mondayThirteenth.AddDate(0, 0, -1), true},
+		// Both fields are restricted, so either one matching is enough.
+		{"0 0 1 * 1", wednesdayFirst, true},
+		{"0 0 1 * 1", mondayThirteenth, true},
+		{"0 0 1 * 1", thursdaySecond, false},
+		// A field starting with * isn't restricted, so both have to match.
+		{"0 0 1 * */2", wednesdayFirst, false},
+		{"0 0 */2 * 3", wednesdayFirst, true},
+		{"0 0 */2 * 3", thursdaySecond, false},
+	}
+	for _, tc := range testCases {
+		interval, err := NewCronInterval(tc.expr)
+		if err != nil {
+			t.Fatalf("NewCronInterval(%q) failed: %s", tc.expr, err)
+		}
+		if got := interval.cron.matchesDay(tc.day); got != tc.want {
+			t.Errorf("%q matches %s = %t, want %t", tc.expr, tc.day.Format("Mon 2006-01-02"), got, tc.want)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("failed to load location: %s", err)
+	}
+	// Clocks went forward at 02:00 on 2023-03-12 and back at 02:00 on 2023-11-05.
+	springForward := time.Date(2023, time.March, 12, 7, 0, 0, 0, time.UTC).In(loc)
+	fallBack := time.Date(2023, time.November, 5, 6, 0, 0, 0, time.UTC).In(loc)
+	testCases := []struct {
+		name string
+		expr string
+		from time.Time
+		want []time.Time
+	}{
+		{
+			name: "every day",
+			expr: "30 4 * * *",
+			from: time.Date(2023, time.March, 1, 5, 0, 0, 0, loc),
+			want: []time.Time{
+				time.Date(2023, time.March, 2, 4, 30, 0, 0, loc),
+				time.Date(2023, time.March, 3, 4, 30, 0, 0, loc),
+			},
+		},
+		{
+			name: "skipped time runs at the transition",
+			expr: "0 2 * * *",
+			from: time.Date(2023, time.March, 11, 12, 0, 0, 0, loc),
+			want: []time.Time{
+				springForward,
+				time.Date(2023, time.March, 13, 2, 0, 0, 0, loc),
+			},
+		},
+		{
+			name: "several skipped times run once",
+			expr: "*/20 2 * * *",
+			from: time.Date(2023, time.March, 12, 1, 50, 0, 0, loc),
+			want: []time.Time{
+				springForward,
+				time.Date(2023, time.March, 13, 2, 0, 0, 0, loc),
+			},
+		},
+		{
+			name: "times after the skipped hour",
+			expr: "0 1,3 * * *",
+			from: time.Date(2023, time.March, 12, 0, 0, 0, 0, loc),
+			want: []time.Time{
+				time.Date(2023, time.March, 12, 1, 0, 0, 0, loc),
+				springForward,
+				time.Date(2023, time.March, 13, 1, 0, 0, 0, loc),
+			},
+		},
+		{
+			name: "repeated time runs twice",
+			expr: "30 1 * * *",
+			from: time.Date(2023, time.November, 5, 0, 0, 0, 0, loc),
+			want: []time.Time{
+				fallBack.Add(-30 * time.Minute),
+				fallBack.Add(30 * time.Minute),
+				time.Date(2023, time.November, 6, 1, 30, 0, 0, loc),
+			},
+		},
+		{
+			name: "time after the repeated hour",
+			expr: "0 2 * * *",
+			from: time.Date(2023, time.November, 5, 0, 0, 0, 0, loc),
+			want: []time.Time{
+				fallBack.Add(time.Hour),
+				time.Date(2023, time.November, 6, 2, 0, 0, 0, loc),
+			},
+		},
+		{
+			name: "leap day",
+			expr: "0 0 29 2 *",
+			from: time.Date(2023, time.March, 1, 0, 0, 0, 0, loc),
+			want: []time.Time{
+				time.Date(2024, time.February, 29, 0, 0, 0, 0, loc),
+				time.Date(2028, time.February, 29, 0, 0, 0, 0, loc),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			interval, err := NewCronInterval(tc.expr)
+			if err != nil {
+				t.Fatalf("NewCronInterval(%q) failed: %s", tc.expr, err)
+			}
+			from := tc.from
+			for _, want := range tc.want {
+				got, ok := interval.cron.next(from)
+				if !ok || !got.Equal(want) {
+					t.Fatalf("next(%s) = %s, %t, want %s", from, got, ok, want)
+				}
+				from = got
+			}
+		})
+	}
+}
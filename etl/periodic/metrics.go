@@ -0,0 +1,95 @@
+package periodic
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are the Prometheus metrics of the periodic runner. Metrics implements
+// etl.BacklogObserver and is updated by the backlog runs.
+type Metrics struct {
+	registry      *prometheus.Registry
+	daysProcessed prometheus.Counter
+	daysFailed    prometheus.Counter
+	dayDuration   prometheus.Histogram
+	backlogDays   prometheus.Gauge
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		daysProcessed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "etl_days_processed_total",
+			Help: "Number of days processed successfully.",
+		}),
+		daysFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "etl_days_failed_total",
+			Help: "Number of days that failed to process.",
+		}),
+		dayDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "etl_day_processing_duration_seconds",
+			Help: "Time taken to process a day, whether it succeeded or failed.",
+			// 30 seconds to about 2 hours.
+			Buckets: prometheus.ExponentialBuckets(30, 2, 9),
+		}),
+		backlogDays: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "etl_backlog_days",
+			Help: "Number of days remaining in the current backlog run, or in the last one if none is running.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.daysProcessed,
+		m.daysFailed,
+		m.dayDuration,
+		m.backlogDays,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *Metrics) BacklogSize(numDays int) {
+	m.backlogDays.Set(float64(numDays))
+}
+
+func (m *Metrics) DayFinished(_ metadata.Day, duration time.Duration, err error) {
+	m.dayDuration.Observe(duration.Seconds())
+	m.backlogDays.Dec()
+	if err != nil {
+		m.daysFailed.Inc()
+	} else {
+		m.daysProcessed.Inc()
+	}
+}
+
+// ServeMetrics serves the metrics at /metrics on the port until the context is done.
+//
+// It returns an error if the port can't be listened on; errors after that are logged.
+func ServeMetrics(ctx context.Context, m *Metrics, port int) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics requests: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Printf("Serving metrics on port %d", port)
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics server failed: %s", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	return nil
+}
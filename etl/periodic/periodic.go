@@ -3,6 +3,7 @@ package periodic
 import (
 	"context"
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
@@ -12,9 +13,23 @@ import (
 	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
 )
 
+// Interval is either a daily time-of-day window, from NewInterval, or the minutes matching a cron
+// expression, from NewCronInterval. The backlog is run at the start of the window or at each
+// matching minute.
 type Interval struct {
 	Start time.Duration
 	End   time.Duration
+	// If non-nil, the interval is a cron schedule and Start and End are unused.
+	cron *cronSchedule
+}
+
+// ParseInterval parses either a window (HH:MM:SS-HH:MM:SS) or a five-field cron expression,
+// depending on the form of the string.
+func ParseInterval(s string) (Interval, error) {
+	if len(strings.Fields(s)) > 1 {
+		return NewCronInterval(s)
+	}
+	return NewInterval(s)
 }
 
 // HH:MM:SS-HH:MM:SS
@@ -41,23 +56,117 @@ func NewInterval(s string) (Interval, error) {
 	}, nil
 }
 
-func Run(ctx context.Context, ec *config.Config, hc *hconfig.Config, sc *storage.Client, intervals []Interval) {
+// Run runs the backlog at the start of each interval until the context is cancelled.
+// Cron intervals are interpreted in the config's timezone. If a backlog run is still going when
+// a cron interval next matches, that start is skipped.
+//
+// If statePath is non-empty, the progress of the runner is persisted to that file. When the
+// runner starts inside one of the intervals and the backlog run for that interval didn't
+// finish, for example because the previous process was stopped part way through, the backlog
+// is run immediately instead of waiting for the next interval. Cron intervals have no end, so
+// they are never resumed.
+//
+// If metrics is non-nil, it is updated by each backlog run.
+func Run(ctx context.Context, ec *config.Config, hc *hconfig.Config, sc *storage.Client, intervals []Interval, statePath string, metrics *Metrics) {
+	loc := ec.Timezone.AsLoc()
 	var starts []time.Duration
 	startToTimeout := map[time.Duration]time.Duration{}
+	var schedules []*cronSchedule
 	for _, interval := range intervals {
+		if interval.cron != nil {
+			schedules = append(schedules, interval.cron)
+			continue
+		}
 		starts = append(starts, interval.Start)
 		startToTimeout[interval.Start] = interval.End - interval.Start
 	}
-	ticker := NewTicker(starts, ec.Timezone.AsLoc())
-	defer ticker.Stop()
+	var tickerC <-chan time.Duration
+	if len(starts) > 0 {
+		ticker := NewTicker(starts, loc)
+		defer ticker.Stop()
+		tickerC = ticker.C
+	}
+	if statePath != "" {
+		state, err := ReadState(statePath)
+		if err != nil {
+			log.Printf("Ignoring periodic state: %s", err)
+		}
+		if intervalStart, ok := activeIntervalStart(intervals, time.Now().In(loc)); ok {
+			if state.IntervalStart.Equal(intervalStart) && state.Finished {
+				log.Printf("Backlog already finished for the interval starting at %s", intervalStart)
+			} else {
+				fmt.Println("Resuming backlog for the interval starting at", intervalStart)
+				runBacklog(ctx, ec, hc, sc, intervalStart, statePath, metrics)
+			}
+		}
+	}
 	for {
+		// The next cron start is recalculated after each backlog run, so starts that pass while the
+		// backlog is running are skipped.
+		var cronTimer *time.Timer
+		var cronC <-chan time.Time
+		cronStart, ok := nextCronStart(schedules, time.Now().In(loc))
+		if ok {
+			log.Printf("next cron start at %s\n", cronStart)
+			cronTimer = time.NewTimer(time.Until(cronStart))
+			cronC = cronTimer.C
+		}
 		select {
-		case start := <-ticker.C:
+		case <-cronC:
+			fmt.Println("Running backlog for time", cronStart)
+			runBacklog(ctx, ec, hc, sc, cronStart, statePath, metrics)
+		case start := <-tickerC:
+			stopTimer(cronTimer)
 			//ctx, cancelFunc := context.WithTimeout(ctx, startToTimeout[start])
 			fmt.Println("Running backlog for time", start)
-			etl.Backlog(ctx, ec, hc, sc, etl.BacklogOptions{})
+			now := time.Now().In(loc)
+			y, m, d := now.Date()
+			runBacklog(ctx, ec, hc, sc, atClockTime(time.Date(y, m, d, 0, 0, 0, 0, loc), start), statePath, metrics)
 		case <-ctx.Done():
+			stopTimer(cronTimer)
 			return
 		}
 	}
 }
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// nextCronStart returns the first minute after now that matches any of the schedules.
+func nextCronStart(schedules []*cronSchedule, now time.Time) (time.Time, bool) {
+	var next time.Time
+	var found bool
+	for _, s := range schedules {
+		t, ok := s.next(now)
+		if ok && (!found || t.Before(next)) {
+			next, found = t, true
+		}
+	}
+	return next, found
+}
+
+func runBacklog(ctx context.Context, ec *config.Config, hc *hconfig.Config, sc *storage.Client, intervalStart time.Time, statePath string, metrics *Metrics) {
+	if statePath != "" {
+		if err := writeState(statePath, State{IntervalStart: intervalStart}); err != nil {
+			log.Printf("%s", err)
+		}
+	}
+	// Failures are logged and the next run retries the failed days, so they don't stop the loop.
+	var opts etl.BacklogOptions
+	if metrics != nil {
+		opts.Observer = metrics
+	}
+	if err := etl.Backlog(ctx, ec, hc, sc, opts); err != nil {
+		log.Printf("Backlog run failed: %s", err)
+	}
+	if statePath == "" || ctx.Err() != nil {
+		return
+	}
+	now := time.Now()
+	if err := writeState(statePath, State{IntervalStart: intervalStart, Finished: true, FinishedAt: &now}); err != nil {
+		log.Printf("%s", err)
+	}
+}
@@ -0,0 +1,78 @@
+package periodic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// State is the progress of the periodic runner. It is persisted to a local file so that after a
+// restart the runner resumes the interval it was in, rather than waiting for the next one or
+// running a finished interval again.
+type State struct {
+	// Start of the interval of the most recent backlog run.
+	IntervalStart time.Time
+	// Whether that backlog run finished. Runs that are interrupted, for example by a redeploy,
+	// are not finished.
+	Finished bool
+	// Time the most recent backlog run finished, if it finished.
+	FinishedAt *time.Time `json:",omitempty"`
+}
+
+// ReadState reads the state from the file. If the file doesn't exist the zero state is returned.
+func ReadState(path string) (State, error) {
+	var s State
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("failed to read periodic state %s: %w", path, err)
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("failed to parse periodic state %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// writeState writes the state to the file. The state is written to a temporary file first so
+// that a crash never leaves a partially written file.
+func writeState(path string, s State) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write periodic state %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write periodic state %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write periodic state %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write periodic state %s: %w", path, err)
+	}
+	return nil
+}
+
+// activeIntervalStart returns the start of the interval that now is in, if any.
+func activeIntervalStart(intervals []Interval, now time.Time) (time.Time, bool) {
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	for _, interval := range intervals {
+		start := atClockTime(midnight, interval.Start)
+		end := atClockTime(midnight, interval.End)
+		if !now.Before(start) && now.Before(end) {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
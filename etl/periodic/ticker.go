@@ -23,7 +23,7 @@ func NewTicker(starts []time.Duration, loc *time.Location) *Ticker {
 
 		for {
 			now := time.Now().In(loc)
-			absStart := midnight.Add(starts[nextStart])
+			absStart := atClockTime(midnight, starts[nextStart])
 			pauseTime := absStart.Sub(now)
 			if pauseTime >= 0 {
 				log.Printf("pausing for %s\n", pauseTime)
@@ -58,6 +58,13 @@ func NewTicker(starts []time.Duration, loc *time.Location) *Ticker {
 	}
 }
 
+// atClockTime returns the time on the day of midnight whose local clock time is the provided
+// duration after midnight. This differs from midnight.Add(d) on days with a DST transition.
+func atClockTime(midnight time.Time, d time.Duration) time.Time {
+	y, m, day := midnight.Date()
+	return time.Date(y, m, day, 0, 0, 0, int(d), midnight.Location())
+}
+
 func (t *Ticker) Stop() {
 	t.stopFunc()
 }
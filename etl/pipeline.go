@@ -6,14 +6,22 @@ import (
 	"context"
 	"crypto/sha256"
 	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/jamespfennell/gtfs"
 	"github.com/jamespfennell/gtfs/journal"
 	"github.com/jamespfennell/hoard"
 	hconfig "github.com/jamespfennell/hoard/config"
@@ -30,87 +38,852 @@ type BacklogOptions struct {
 	Limit       *int
 	DryRun      bool
 	Concurrency int
+	// Format of the report written in dry-run mode.
+	Output OutputFormat
+	// If true, only the projected time and bytes of processing the backlog are reported.
+	Estimate bool
+	// If true, the days after the last complete day, including the current day, are also
+	// processed with the data available so far, and marked as preliminary. Otherwise they are
+	// never processed by the backlog; see config.LastCompleteDay.
+	IncludeIncomplete bool
+	// If true, the pending days are processed in a random order instead of newest first, to
+	// surface bugs that depend on the order days are processed in. The order is determined by
+	// Seed, or by a seed chosen from the current time if Seed is nil; either way the seed is
+	// logged so that the order can be reproduced.
+	Shuffle bool
+	Seed    *int64
+	// If non-nil, notified of the size of the backlog and of each day as it finishes.
+	Observer BacklogObserver
+}
+
+// BacklogObserver is notified of the progress of a backlog run; e.g., to export metrics.
+//
+// DayFinished may be called concurrently when the backlog runs with more than one day at a time.
+type BacklogObserver interface {
+	// BacklogSize is called with the number of days the backlog will process, before any are processed.
+	BacklogSize(numDays int)
+	// DayFinished is called when a day has been processed, with the error if it failed.
+	DayFinished(day metadata.Day, duration time.Duration, err error)
+}
+
+// Number of recently processed days used to compute per-day averages for backlog estimates.
+const estimateSampleDays = 30
+
+// lastBacklogDay returns the most recent day whose data is expected to be complete in Hoard.
+func lastBacklogDay(ec *config.Config) metadata.Day {
+	return config.LastCompleteDay(time.Now(), ec.Timezone.AsLoc())
 }
 
 // Backlog runs the ETL pipeline for all days in the backlog.
 func Backlog(ctx context.Context, ec *config.Config, hc *hconfig.Config, sc *storage.Client, opts BacklogOptions) error {
-	now := time.Now().In(ec.Timezone.AsLoc()).Add(-29 * time.Hour).Format("2006-01-02")
-	endDay, _ := metadata.ParseDay(now)
+	endDay := lastBacklogDay(ec)
 
 	m, err := sc.GetMetadata(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to obtain metadata: %w", err)
 	}
 
-	pendingDays := config.CalculatePendingDays(ec.Feeds, m.ProcessedDays, endDay, softwareVersion)
+	skippedDays := config.SkippedDays(ec.Feeds, ec.SkipDays, endDay)
+	for _, skippedDay := range skippedDays {
+		log.Printf("Skipping %s: %s", skippedDay.Day, skippedDay.Reason)
+	}
+	if !opts.DryRun && !opts.Estimate && !reflect.DeepEqual(skippedDays, m.SkippedDays) {
+		if err := sc.UpdateMetadata(ctx, func(m *metadata.Metadata) bool {
+			m.SkippedDays = skippedDays
+			return true
+		}); err != nil {
+			return fmt.Errorf("failed to record skipped days in metadata: %w", err)
+		}
+	}
+	feedNames := ec.FeedNames()
+	if len(feedNames) == 0 {
+		feedNames = nil
+	}
+	if !opts.DryRun && !opts.Estimate && !reflect.DeepEqual(feedNames, m.FeedNames) {
+		if err := sc.UpdateMetadata(ctx, func(m *metadata.Metadata) bool {
+			m.FeedNames = feedNames
+			return true
+		}); err != nil {
+			return fmt.Errorf("failed to record feed names in metadata: %w", err)
+		}
+	}
+
+	pendingDays := config.CalculatePendingDays(ec.ActiveFeeds(), m.ProcessedDays, ec.SkipDays, endDay, softwareVersion)
+	if opts.IncludeIncomplete {
+		pendingDays = append(config.IncompleteDays(ec.ActiveFeeds(), m.ProcessedDays, ec.SkipDays, time.Now(), ec.Timezone.AsLoc()), pendingDays...)
+	}
+	pendingDays = withoutDeletedDays(pendingDays, m.DeletedDays)
+	pendingDays = withPublishedFeeds(pendingDays, m.ProcessedDays, ec)
+	if opts.Shuffle {
+		seed := time.Now().UnixNano()
+		if opts.Seed != nil {
+			seed = *opts.Seed
+		}
+		log.Printf("Shuffling the backlog with seed %d; pass --shuffle --seed %d to reproduce the order", seed, seed)
+		shuffleDays(pendingDays, seed)
+	}
+	if opts.Estimate {
+		numDays := len(pendingDays)
+		if opts.Limit != nil && *opts.Limit < numDays {
+			numDays = *opts.Limit
+		}
+		return reportBacklogEstimate(estimateBacklog(m.ProcessedDays, numDays, opts.Concurrency), opts.Output)
+	}
+	if opts.DryRun && opts.Output == OutputJson {
+		report := BacklogReport{
+			PendingDays: []BacklogReportDay{},
+			SkippedDays: skippedDays,
+		}
+		for i, pendingDay := range pendingDays {
+			if opts.Limit != nil && *opts.Limit <= i {
+				break
+			}
+			report.PendingDays = append(report.PendingDays, BacklogReportDay{
+				Day:         pendingDay.Day,
+				FeedIDs:     pendingDay.FeedIDs,
+				Preliminary: pendingDay.Preliminary,
+			})
+		}
+		if report.SkippedDays == nil {
+			report.SkippedDays = []metadata.SkippedDay{}
+		}
+		return writeJson(report)
+	}
+	if opts.Observer != nil {
+		numDays := len(pendingDays)
+		if opts.Limit != nil && *opts.Limit < numDays {
+			numDays = *opts.Limit
+		}
+		opts.Observer.BacklogSize(numDays)
+	}
 	if len(pendingDays) == 0 {
 		log.Println("No days in the backlog")
 		return nil
 	}
 	log.Printf("%d days in the backlog:\n", len(pendingDays))
-	l := newLimiter(opts.Concurrency)
+	return runPendingDays(ctx, pendingDays, opts.Limit, opts.Concurrency, opts.DryRun, opts.Observer, ec, hc, sc)
+}
+
+// withPublishedFeeds adds to each pending day the feeds that its published version was processed
+// with. The feed selection only chooses which days are run: processing a day replaces all of its
+// published data, so running it with just the selected feeds would drop the data of the others.
+func withPublishedFeeds(pendingDays []config.PendingDay, processedDays []metadata.ProcessedDay, ec *config.Config) []config.PendingDay {
+	dayToFeeds := map[metadata.Day][]string{}
+	for _, processedDay := range processedDays {
+		dayToFeeds[processedDay.Day] = processedDay.Feeds
+	}
+	for i := range pendingDays {
+		pendingDays[i].FeedIDs = addPublishedFeeds(ec, pendingDays[i].Day, pendingDays[i].FeedIDs, dayToFeeds[pendingDays[i].Day])
+	}
+	return pendingDays
+}
+
+// addPublishedFeeds returns the union of the feed IDs and the published feeds of the day, in
+// order. Published feeds that are no longer in the config or not active on the day are left out.
+func addPublishedFeeds(ec *config.Config, day metadata.Day, feedIDs, publishedFeedIDs []string) []string {
+	configured := map[string]bool{}
+	for _, feedID := range config.FeedIDsForDay(ec.Feeds, day) {
+		configured[feedID] = true
+	}
+	union := map[string]bool{}
+	for _, feedID := range feedIDs {
+		union[feedID] = true
+	}
+	for _, feedID := range publishedFeedIDs {
+		if configured[feedID] {
+			union[feedID] = true
+		}
+	}
+	result := make([]string, 0, len(union))
+	for feedID := range union {
+		result = append(result, feedID)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// matchesSelectedFeeds returns whether a day processed with the feeds includes a selected feed.
+// If no default feeds are set every day matches.
+func matchesSelectedFeeds(ec *config.Config, feedIDs []string) bool {
+	if len(ec.DefaultFeeds) == 0 {
+		return true
+	}
+	selected := map[string]bool{}
+	for _, feed := range ec.ActiveFeeds() {
+		selected[feed.Id] = true
+	}
+	for _, feedID := range feedIDs {
+		if selected[feedID] {
+			return true
+		}
+	}
+	return false
+}
+
+// unselectedFeeds returns the feeds of the day that are not selected. It is empty if no default
+// feeds are set.
+func unselectedFeeds(ec *config.Config, feedIDs []string) []string {
+	if len(ec.DefaultFeeds) == 0 {
+		return nil
+	}
+	selected := map[string]bool{}
+	for _, feed := range ec.ActiveFeeds() {
+		selected[feed.Id] = true
+	}
+	var result []string
+	for _, feedID := range feedIDs {
+		if !selected[feedID] {
+			result = append(result, feedID)
+		}
+	}
+	return result
+}
+
+// withoutDeletedDays removes the days with tombstones from the pending days. Deleted days are only
+// processed again if they are run explicitly.
+func withoutDeletedDays(pendingDays []config.PendingDay, deletedDays []metadata.DeletedDay) []config.PendingDay {
+	deleted := map[metadata.Day]bool{}
+	for _, deletedDay := range deletedDays {
+		deleted[deletedDay.Day] = true
+	}
+	var result []config.PendingDay
+	for _, pendingDay := range pendingDays {
+		if deleted[pendingDay.Day] {
+			log.Printf("Skipping %s: the day was deleted", pendingDay.Day)
+			continue
+		}
+		result = append(result, pendingDay)
+	}
+	return result
+}
+
+// shuffleDays puts the days in a random order determined by the seed.
+func shuffleDays(days []config.PendingDay, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(len(days), func(i, j int) {
+		days[i], days[j] = days[j], days[i]
+	})
+}
+
+// runPendingDays runs the pipeline for the pending days, in order, up to the limit.
+//
+// Unless in dry-run mode, days that fail are recorded in the dead-letter list in the metadata,
+// and days that succeed are removed from it, and the alert webhook is notified of each failed day
+// and of the run's completion. A PartialFailureError is returned if some days failed, and an
+// AllDaysFailedError if every day failed. If observer is non-nil it is notified as each day
+// finishes.
+func runPendingDays(ctx context.Context, pendingDays []config.PendingDay, limit *int, concurrency int, dryRun bool,
+	observer BacklogObserver, ec *config.Config, hc *hconfig.Config, sc *storage.Client) error {
+	alerts := newAlerter(ec)
+	defer alerts.wait()
+	l := newLimiter(concurrency)
+	failures := map[metadata.Day]error{}
+	var failuresM sync.Mutex
+	var attempted []config.PendingDay
 	for i, pendingDay := range pendingDays {
 		pendingDay := pendingDay
-		if opts.Limit != nil && *opts.Limit <= i {
+		if limit != nil && *limit <= i {
 			fmt.Println("Reached limit, ending...")
 			break
 		}
+		attempted = append(attempted, pendingDay)
 		l.run(func() error {
 			log.Printf("Processing backlog for %s\n", pendingDay.Day)
-			if opts.DryRun {
+			if dryRun {
 				log.Printf("Skipping because in dry-run mode")
 				return nil
 			}
-			err := Run(
+			start := time.Now()
+			err := run(
 				ctx,
 				pendingDay.Day,
 				pendingDay.FeedIDs,
+				runOptions{preliminary: pendingDay.Preliminary},
 				ec,
 				hc,
 				sc,
 			)
+			if observer != nil {
+				observer.DayFinished(pendingDay.Day, time.Since(start), err)
+			}
 			if err != nil {
 				log.Printf("%s: failed: %s", pendingDay.Day, err)
+				failuresM.Lock()
+				failures[pendingDay.Day] = err
+				failuresM.Unlock()
+				day := pendingDay.Day
+				alerts.send(ctx, AlertPayload{
+					Event:   AlertDayFailed,
+					Day:     &day,
+					FeedIDs: pendingDay.FeedIDs,
+					Error:   err.Error(),
+				})
 			} else {
 				log.Printf("%s: success", pendingDay.Day)
 			}
+			return nil
+		})
+	}
+	l.wait()
+	if !dryRun {
+		if err := updateFailedDays(ctx, attempted, failures, sc); err != nil {
+			log.Printf("Failed to update the dead-letter list in the metadata: %s", err)
+		}
+		stats := sc.MetadataUpdateStats()
+		log.Printf("Metadata updates: %d (%d written, %d conflict(s), %d file(s) written); read %s, update %s, write %s",
+			stats.Updates, stats.Commits, stats.Conflicts, stats.FilesWritten, stats.ReadDuration.Round(time.Millisecond),
+			stats.UpdateDuration.Round(time.Millisecond), stats.WriteDuration.Round(time.Millisecond))
+	}
+	var failedDays []metadata.Day
+	for day := range failures {
+		failedDays = append(failedDays, day)
+	}
+	sort.Slice(failedDays, func(i, j int) bool {
+		return failedDays[i].Before(failedDays[j])
+	})
+	if !dryRun && len(attempted) > 0 {
+		alerts.send(ctx, AlertPayload{
+			Event:      AlertRunCompleted,
+			NumDays:    len(attempted),
+			NumFailed:  len(failedDays),
+			FailedDays: failedDays,
+		})
+	}
+	return failedDaysError(failedDays, len(attempted))
+}
+
+// failedDaysError returns the error for a run of numDays days in which the days failed, or nil if
+// none failed.
+func failedDaysError(failedDays []metadata.Day, numDays int) error {
+	if len(failedDays) == 0 {
+		return nil
+	}
+	if len(failedDays) == numDays {
+		return &AllDaysFailedError{FailedDays: failedDays}
+	}
+	return &PartialFailureError{FailedDays: failedDays, NumDays: numDays}
+}
+
+// PartialFailureError is returned by Backlog, RerunFailed and RunRange when they ran but some days failed
+// to process. The error lists the failed days, and is printed when the command exits.
+//
+// Other errors returned by them are fatal; e.g., the metadata could not be read.
+type PartialFailureError struct {
+	FailedDays []metadata.Day
+	NumDays    int
+}
+
+func (e *PartialFailureError) Error() string {
+	return fmt.Sprintf("%d of %d day(s) failed: %s", len(e.FailedDays), e.NumDays, e.FailedDays)
+}
+
+// AllDaysFailedError is returned instead of a PartialFailureError when every day of the run failed.
+// This usually means a problem that isn't specific to the days, such as Hoard being unreachable,
+// so it is fatal.
+type AllDaysFailedError struct {
+	FailedDays []metadata.Day
+}
+
+func (e *AllDaysFailedError) Error() string {
+	return fmt.Sprintf("all %d day(s) failed: %s", len(e.FailedDays), e.FailedDays)
+}
+
+type ReprocessOptions struct {
+	// First and last days (inclusive) of the range to reprocess. Only days that have
+	// already been processed are reprocessed.
+	FirstDay    metadata.Day
+	LastDay     metadata.Day
+	DryRun      bool
+	Concurrency int
+	Output      OutputFormat
+	// If non-nil, days whose reprocessed export has more than this percentage fewer trips or stop
+	// times than the published version are not published.
+	MaxRegressionPercent *float64
+}
+
+// Reprocess runs the ETL pipeline again for already processed days in a range.
+//
+// If default feeds are set, only days processed with at least one of them are reprocessed. Each
+// day is reprocessed with all of the feeds it was published with, plus the active feeds.
+//
+// With MaxRegressionPercent, days that fail the quality regression check keep their published
+// data and are added to the dead-letter list, marked as needing review. Running them again with
+// RerunFailed publishes them without the check.
+func Reprocess(ctx context.Context, ec *config.Config, hc *hconfig.Config, sc *storage.Client, opts ReprocessOptions) error {
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to obtain metadata: %w", err)
+	}
+	var targets []metadata.ProcessedDay
+	for _, processedDay := range m.ProcessedDays {
+		if processedDay.Day.Before(opts.FirstDay) || opts.LastDay.Before(processedDay.Day) {
+			continue
+		}
+		if !matchesSelectedFeeds(ec, processedDay.Feeds) {
+			continue
+		}
+		targets = append(targets, processedDay)
+	}
+	if opts.DryRun {
+		return reportReprocess(targets, opts.Output)
+	}
+	log.Printf("%d days to reprocess", len(targets))
+	l := newLimiter(opts.Concurrency)
+	var regressed []config.PendingDay
+	regressions := map[metadata.Day]error{}
+	var regressionsM sync.Mutex
+	for _, target := range targets {
+		day := target.Day
+		publishedFeedIDs := target.Feeds
+		l.run(func() error {
+			feedIDs := config.FeedIDsForDay(ec.ActiveFeeds(), day)
+			if len(feedIDs) == 0 {
+				log.Printf("%s: skipping because no feeds are active", day)
+				return nil
+			}
+			feedIDs = addPublishedFeeds(ec, day, feedIDs, publishedFeedIDs)
+			err := run(ctx, day, feedIDs, runOptions{maxRegressionPercent: opts.MaxRegressionPercent}, ec, hc, sc)
+			if err != nil {
+				log.Printf("%s: failed: %s", day, err)
+			} else {
+				log.Printf("%s: success", day)
+			}
+			var regression *QualityRegressionError
+			if errors.As(err, &regression) {
+				regressionsM.Lock()
+				regressed = append(regressed, config.PendingDay{Day: day, FeedIDs: feedIDs})
+				regressions[day] = err
+				regressionsM.Unlock()
+			}
 			return err
 		})
 	}
-	return l.wait()
+	err = l.wait()
+	if len(regressed) > 0 {
+		if err := updateFailedDays(ctx, regressed, regressions, sc); err != nil {
+			log.Printf("Failed to record the days that regressed in the dead-letter list: %s", err)
+		}
+	}
+	return err
+}
+
+// estimateBacklog projects the cost of processing numDays days using the averages of the most recently processed days.
+func estimateBacklog(processedDays []metadata.ProcessedDay, numDays int, concurrency int) BacklogEstimate {
+	recent := append([]metadata.ProcessedDay(nil), processedDays...)
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[j].Created.Before(recent[i].Created)
+	})
+	var e BacklogEstimate
+	e.NumDays = numDays
+	var totalSeconds float64
+	var totalDownloadBytes, totalUploadBytes int64
+	var numTimedDays int
+	for _, processedDay := range recent {
+		if e.NumSampleDays == estimateSampleDays {
+			break
+		}
+		e.NumSampleDays++
+		totalDownloadBytes += processedDay.Gtfsrt.Size
+		totalUploadBytes += processedDay.Gtfsrt.Size + processedDay.Csv.Size
+		if processedDay.ProcessingSeconds > 0 {
+			numTimedDays++
+			totalSeconds += processedDay.ProcessingSeconds
+		}
+	}
+	if e.NumSampleDays == 0 {
+		return e
+	}
+	e.AverageDownloadBytes = totalDownloadBytes / int64(e.NumSampleDays)
+	e.AverageUploadBytes = totalUploadBytes / int64(e.NumSampleDays)
+	e.EstimatedDownloadBytes = e.AverageDownloadBytes * int64(numDays)
+	e.EstimatedUploadBytes = e.AverageUploadBytes * int64(numDays)
+	if numTimedDays > 0 {
+		e.AverageSeconds = totalSeconds / float64(numTimedDays)
+		e.EstimatedSeconds = e.AverageSeconds * float64(numDays) / float64(max(concurrency, 1))
+	}
+	return e
+}
+
+func reportBacklogEstimate(e BacklogEstimate, output OutputFormat) error {
+	if output == OutputJson {
+		return writeJson(e)
+	}
+	fmt.Printf("%d day(s) in the backlog\n", e.NumDays)
+	if e.NumSampleDays == 0 {
+		fmt.Println("No processed days to base an estimate on.")
+		return nil
+	}
+	fmt.Printf("Averages over the %d most recently processed day(s):\n", e.NumSampleDays)
+	if e.AverageSeconds > 0 {
+		fmt.Printf("  time: %s per day\n", time.Duration(e.AverageSeconds*float64(time.Second)).Round(time.Second))
+	}
+	fmt.Printf("  download: %d bytes per day\n", e.AverageDownloadBytes)
+	fmt.Printf("  upload: %d bytes per day\n", e.AverageUploadBytes)
+	if e.EstimatedSeconds > 0 {
+		fmt.Printf("Estimated time: %s\n", time.Duration(e.EstimatedSeconds*float64(time.Second)).Round(time.Second))
+	} else {
+		fmt.Println("Estimated time: unknown (no processed days record their processing time)")
+	}
+	fmt.Printf("Estimated download: %d bytes\n", e.EstimatedDownloadBytes)
+	fmt.Printf("Estimated upload: %d bytes\n", e.EstimatedUploadBytes)
+	return nil
+}
+
+func reportReprocess(targets []metadata.ProcessedDay, output OutputFormat) error {
+	report := ReprocessReport{
+		Versions: []ReprocessReportVersion{},
+		NumDays:  len(targets),
+	}
+	versionToIndex := map[int]int{}
+	for _, target := range targets {
+		i, ok := versionToIndex[target.SoftwareVersion]
+		if !ok {
+			i = len(report.Versions)
+			versionToIndex[target.SoftwareVersion] = i
+			report.Versions = append(report.Versions, ReprocessReportVersion{
+				SoftwareVersion: target.SoftwareVersion,
+			})
+		}
+		report.Versions[i].Days = append(report.Versions[i].Days, target.Day)
+		report.EstimatedDownloadBytes += target.Gtfsrt.Size
+		report.EstimatedUploadBytes += target.Gtfsrt.Size + target.Csv.Size
+	}
+	sort.Slice(report.Versions, func(i, j int) bool {
+		return report.Versions[i].SoftwareVersion < report.Versions[j].SoftwareVersion
+	})
+	if output == OutputJson {
+		return writeJson(report)
+	}
+	fmt.Printf("Will reprocess %d day(s) with software version %d:\n", report.NumDays, softwareVersion)
+	for _, v := range report.Versions {
+		fmt.Printf("  %d day(s) currently at version %d: %s\n", len(v.Days), v.SoftwareVersion, v.Days)
+	}
+	fmt.Printf("Estimated download: %d bytes\n", report.EstimatedDownloadBytes)
+	fmt.Printf("Estimated upload: %d bytes\n", report.EstimatedUploadBytes)
+	fmt.Println("Skipping reprocessing because dry run mode is on.")
+	return nil
+}
+
+// Today runs the ETL pipeline for the current day using whatever data is available so far.
+//
+// The resulting data is marked as preliminary in the metadata, and the day will be
+// processed again by the backlog once it is complete.
+func Today(ctx context.Context, ec *config.Config, hc *hconfig.Config, sc *storage.Client) error {
+	day := metadata.DayOf(time.Now().In(ec.Timezone.AsLoc()))
+	feedIDs := config.FeedIDsForDay(ec.ActiveFeeds(), day)
+	if len(feedIDs) == 0 {
+		return fmt.Errorf("no feeds are active on %s", day)
+	}
+	log.Printf("%s: processing partial data for the current day", day)
+	return run(ctx, day, feedIDs, runOptions{preliminary: true}, ec, hc, sc)
+}
+
+type DeleteOptions struct {
+	Days   []metadata.Day
+	DryRun bool
+	// Whether to record a tombstone for each deleted day in the metadata, so that consumers
+	// mirroring the data know that the day was deleted intentionally.
+	Tombstone bool
+	// Reason for the deletion recorded in the tombstones.
+	Reason string
+	// Whether to also write a deletion marker object to object storage for each deleted day, next
+	// to where its archives were. Requires Tombstone.
+	DeletionMarker bool
+	// Whether to also delete the archives of the deleted days from object storage. Otherwise only
+	// the metadata is updated, and the archives are left in place.
+	DeleteArchives bool
 }
 
 // DeleteDays deletes the specified days from the metadata.
-func DeleteDays(ctx context.Context, days []metadata.Day, dryRun bool, ec *config.Config, sc *storage.Client) error {
+//
+// If default feeds are set, only days processed with at least one of the default feeds are
+// deleted, and days that were also processed with other feeds are skipped, since deleting them
+// would delete the data of those feeds too. The feeds and archive sizes of each day are printed before anything is deleted, so that a dry
+// run shows how much data would be removed.
+func DeleteDays(ctx context.Context, opts DeleteOptions, ec *config.Config, sc *storage.Client) error {
+	if opts.DeletionMarker && !opts.Tombstone {
+		return fmt.Errorf("deletion markers can only be written along with tombstones")
+	}
 	daysSet := map[metadata.Day]bool{}
-	for _, day := range days {
+	for _, day := range opts.Days {
 		daysSet[day] = true
 	}
-	sc.UpdateMetadata(ctx, func(md *metadata.Metadata) bool {
+	now := time.Now().UTC()
+	var tombstones []metadata.DeletedDay
+	var deletedDays []metadata.ProcessedDay
+	if err := sc.UpdateMetadata(ctx, func(md *metadata.Metadata) bool {
 		var deleted []metadata.Day
+		var totalBytes int64
+		tombstones = nil
+		deletedDays = nil
 		retainedDays := make([]metadata.ProcessedDay, 0, len(md.ProcessedDays))
 		for _, day := range md.ProcessedDays {
-			if daysSet[day.Day] {
+			if daysSet[day.Day] && matchesSelectedFeeds(ec, day.Feeds) {
+				if others := unselectedFeeds(ec, day.Feeds); len(others) > 0 {
+					fmt.Printf("Skipping %s: it was also processed with the unselected feeds %s\n", day.Day, others)
+					retainedDays = append(retainedDays, day)
+					continue
+				}
 				deleted = append(deleted, day.Day)
+				deletedDays = append(deletedDays, day)
+				dayBytes := archivesSize(&day)
+				totalBytes += dayBytes
+				fmt.Printf("Will delete %s: feeds %s, %d archive(s) totalling %d bytes\n", day.Day, day.Feeds, len(artifacts(&day)), dayBytes)
+				tombstones = append(tombstones, metadata.DeletedDay{
+					Day:     day.Day,
+					Feeds:   day.Feeds,
+					Deleted: now,
+					Reason:  opts.Reason,
+				})
 				continue
 			}
 			retainedDays = append(retainedDays, day)
 		}
 		fmt.Printf("Will delete %d day(s): %s\n", len(deleted), deleted)
+		if opts.DeleteArchives {
+			fmt.Printf("Will delete their archives, freeing %d bytes\n", totalBytes)
+		} else {
+			fmt.Printf("Their archives, %d bytes, will be left in object storage\n", totalBytes)
+		}
 		md.ProcessedDays = retainedDays
-		if dryRun {
+		if opts.Tombstone {
+			for _, tombstone := range tombstones {
+				md.DeletedDays = append(removeDeletedDay(md.DeletedDays, tombstone.Day), tombstone)
+			}
+			sort.Slice(md.DeletedDays, func(i, j int) bool {
+				return md.DeletedDays[j].Day.Before(md.DeletedDays[i].Day)
+			})
+		}
+		if opts.DryRun {
 			fmt.Println("Skipping deletions because dry run mode is on.")
 			return false
 		}
 		fmt.Printf("Deleted %d day(s).\n", len(deleted))
 		return true
-	})
+	}); err != nil {
+		return fmt.Errorf("failed to update metadata: %w", err)
+	}
+	if opts.DryRun {
+		return nil
+	}
+	if opts.DeletionMarker {
+		for _, tombstone := range tombstones {
+			b, err := json.MarshalIndent(tombstone, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := sc.Write(ctx, b, deletionMarkerKey(ec, tombstone.Day)); err != nil {
+				return fmt.Errorf("failed to write deletion marker for %s: %w", tombstone.Day, err)
+			}
+		}
+	}
+	if opts.DeleteArchives {
+		deleteArchives(ctx, deletedDays, sc)
+	}
+	return nil
+}
+
+// deleteArchives deletes the archives of the days from object storage, printing the number of
+// bytes freed so far after each deletion. Failures are logged and don't stop the other deletions.
+func deleteArchives(ctx context.Context, days []metadata.ProcessedDay, sc *storage.Client) {
+	var freedBytes int64
+	for i := range days {
+		for _, artifact := range artifacts(&days[i]) {
+			if err := sc.Delete(ctx, artifact.Path); err != nil {
+				log.Printf("%s: failed to delete archive %s: %s", days[i].Day, artifact.Path, err)
+				continue
+			}
+			freedBytes += artifact.Size
+			fmt.Printf("Deleted %s (%d bytes); %d bytes freed so far\n", artifact.Path, artifact.Size, freedBytes)
+		}
+	}
+	fmt.Printf("Freed %d bytes.\n", freedBytes)
+}
+
+// deletionMarkerKey returns the object key of the deletion marker of a day.
+func deletionMarkerKey(ec *config.Config, day metadata.Day) string {
+	return fmt.Sprintf("%s/%s%s_deleted.json", day.MonthString(), ec.RemotePrefix, day)
+}
+
+// removeDeletedDay returns the tombstones without the one for the day, if there is one.
+func removeDeletedDay(deletedDays []metadata.DeletedDay, day metadata.Day) []metadata.DeletedDay {
+	var result []metadata.DeletedDay
+	for _, deletedDay := range deletedDays {
+		if deletedDay.Day != day {
+			result = append(result, deletedDay)
+		}
+	}
+	return result
+}
+
+type PruneOptions struct {
+	// Days whose GTFS-RT archive is older than this many days are pruned.
+	OlderThanDays int
+	// Only prune days containing one of these feeds. If empty, days for all feeds are pruned.
+	FeedIDs []string
+	DryRun  bool
+}
+
+// Prune deletes the GTFS-RT archives of old days from object storage and marks them as pruned in the metadata.
+func Prune(ctx context.Context, opts PruneOptions, ec *config.Config, sc *storage.Client) error {
+	cutoff := metadata.DayOf(time.Now().In(ec.Timezone.AsLoc()).AddDate(0, 0, -opts.OlderThanDays))
+	feedIDsSet := map[string]bool{}
+	for _, feedID := range opts.FeedIDs {
+		feedIDsSet[feedID] = true
+	}
+	matchesFeeds := func(feedIDs []string) bool {
+		if len(feedIDsSet) == 0 {
+			return true
+		}
+		for _, feedID := range feedIDs {
+			if feedIDsSet[feedID] {
+				return true
+			}
+		}
+		return false
+	}
+	// The days are marked as pruned in the metadata before their archives are deleted, so that a
+	// failed metadata update never leaves the metadata pointing at a deleted archive.
+	var toPrune []metadata.ProcessedDay
+	if err := sc.UpdateMetadata(ctx, func(md *metadata.Metadata) bool {
+		toPrune = nil
+		var totalBytes int64
+		for i, day := range md.ProcessedDays {
+			if day.GtfsrtPruned || !day.Day.Before(cutoff) || !matchesFeeds(day.Feeds) {
+				continue
+			}
+			toPrune = append(toPrune, day)
+			totalBytes += day.Gtfsrt.Size
+			fmt.Printf("Will prune %s: %s (%d bytes)\n", day.Day, day.Gtfsrt.Path, day.Gtfsrt.Size)
+			if !opts.DryRun {
+				md.ProcessedDays[i].GtfsrtPruned = true
+			}
+		}
+		fmt.Printf("Will prune %d day(s), freeing %d bytes\n", len(toPrune), totalBytes)
+		if len(toPrune) == 0 {
+			return false
+		}
+		if opts.DryRun {
+			fmt.Println("Skipping pruning because dry run mode is on.")
+			return false
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	if opts.DryRun || len(toPrune) == 0 {
+		return nil
+	}
+	var numPruned int
+	var freedBytes int64
+	for _, day := range toPrune {
+		if err := sc.Delete(ctx, day.Gtfsrt.Path); err != nil {
+			log.Printf("%s: failed to delete the GTFS-RT archive %s, which is marked as pruned: %s", day.Day, day.Gtfsrt.Path, err)
+			continue
+		}
+		numPruned++
+		freedBytes += day.Gtfsrt.Size
+	}
+	fmt.Printf("Pruned %d of %d day(s), freeing %d bytes.\n", numPruned, len(toPrune), freedBytes)
+	if numPruned < len(toPrune) {
+		return fmt.Errorf("failed to delete the GTFS-RT archives of %d day(s)", len(toPrune)-numPruned)
+	}
 	return nil
 }
 
 // Run runs the ETL pipeline for the provided day.
 func Run(ctx context.Context, day metadata.Day, feedIDs []string, ec *config.Config, hc *hconfig.Config, sc *storage.Client) error {
+	return run(ctx, day, feedIDs, runOptions{}, ec, hc, sc)
+}
+
+// RunRange runs the ETL pipeline for each day from firstDay to lastDay (inclusive), in order, with
+// the feeds that are active on the day and any other feeds the day was published with. Days with
+// no active feeds are skipped.
+//
+// A day that fails doesn't stop the run. At the end the days that succeeded are printed, and a
+// PartialFailureError or AllDaysFailedError listing the failed days is returned if any failed.
+func RunRange(ctx context.Context, firstDay, lastDay metadata.Day, ec *config.Config, hc *hconfig.Config, sc *storage.Client) error {
+	if lastDay.Before(firstDay) {
+		return fmt.Errorf("the last day %s is before the first day %s", lastDay, firstDay)
+	}
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to obtain metadata: %w", err)
+	}
+	dayToFeeds := map[metadata.Day][]string{}
+	for _, processedDay := range m.ProcessedDays {
+		dayToFeeds[processedDay.Day] = processedDay.Feeds
+	}
+	var succeeded, failed []metadata.Day
+	for day := firstDay; !lastDay.Before(day); day = day.Next() {
+		feedIDs := config.FeedIDsForDay(ec.ActiveFeeds(), day)
+		if len(feedIDs) == 0 {
+			log.Printf("%s: skipping because no feeds are active", day)
+			continue
+		}
+		feedIDs = addPublishedFeeds(ec, day, feedIDs, dayToFeeds[day])
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := run(ctx, day, feedIDs, runOptions{}, ec, hc, sc); err != nil {
+			log.Printf("%s: failed: %s", day, err)
+			failed = append(failed, day)
+			continue
+		}
+		log.Printf("%s: success", day)
+		succeeded = append(succeeded, day)
+	}
+	fmt.Printf("%d day(s) succeeded: %s\n", len(succeeded), succeeded)
+	return failedDaysError(failed, len(succeeded)+len(failed))
+}
+
+// RunFromHoardKeys runs the ETL pipeline for the provided day and feeds using exactly the provided
+// Hoard objects as input for the feeds they belong to, instead of all of the Hoard objects for the
+// day.
+//
+// Each key is the full object key of a Hoard archive in the Hoard object storage, and must belong
+// to one of the feeds. The data of feeds without keys is downloaded from Hoard as usual, so that
+// the day is recorded with all of its feeds and isn't processed again by the next backlog run.
+func RunFromHoardKeys(ctx context.Context, day metadata.Day, feedIDs []string, keys []string, ec *config.Config, hc *hconfig.Config, sc *storage.Client) error {
+	keyFeedIDs, err := feedIDsForHoardKeys(hc, keys)
+	if err != nil {
+		return err
+	}
+	for _, keyFeedID := range keyFeedIDs {
+		if !slices.Contains(feedIDs, keyFeedID) {
+			return fmt.Errorf("Hoard objects of feed %s were provided but the feed is not processed for %s", keyFeedID, day)
+		}
+	}
+	return run(ctx, day, feedIDs, runOptions{hoardKeys: keys}, ec, hc, sc)
+}
+
+type runOptions struct {
+	// Whether the day is not yet complete.
+	preliminary bool
+	// If non-empty, the Hoard object keys to use as input for the feeds they belong to.
+	hoardKeys []string
+	// If non-empty, a directory with one subdirectory of GTFS-RT files per feed to use as input
+	// instead of downloading the data from Hoard.
+	inputDir string
+	// Whether to stop after creating the archives, without uploading them or updating the metadata.
+	noUpload bool
+	// If non-nil, the time taken by each step of the run is recorded.
+	timer *stepTimer
+	// If non-zero, only feed messages created at or before this time are used.
+	asOf time.Time
+	// If non-empty, the CSV archive is also written to this path on disk.
+	outputPath string
+	// If non-nil, the day is not uploaded if its export has more than this percentage fewer
+	// trips or stop times than the published version of the day. See checkQualityRegression.
+	maxRegressionPercent *float64
+}
+
+func run(ctx context.Context, day metadata.Day, feedIDs []string, opts runOptions, ec *config.Config, hc *hconfig.Config, sc *storage.Client) error {
 	log.Printf("starting %s", day)
+	startedAt := time.Now()
+	// Feeds are processed, archived and recorded in the metadata in order of feed ID.
+	feedIDs = append([]string(nil), feedIDs...)
+	sort.Strings(feedIDs)
 	tmpDir, err := os.MkdirTemp("", fmt.Sprintf("subwaydatanyc_%s_*", day))
 	if err != nil {
 		return fmt.Errorf("failed to create temporary working directory: %w", err)
@@ -122,83 +895,349 @@ func Run(ctx context.Context, day metadata.Day, feedIDs []string, ec *config.Con
 
 	// Stage one: download the data from Hoard
 	log.Printf("%s: stage 1 (download data)", day)
+	opts.timer.begin(stepDownload)
+	dataDir := tmpDir
+	if opts.inputDir != "" {
+		dataDir = opts.inputDir
+	}
 	availableFeedIDs := map[string]bool{}
 	for _, feed := range hc.Feeds {
 		availableFeedIDs[feed.ID] = true
 	}
+	keyFeedIDs, err := feedIDsForHoardKeys(hc, opts.hoardKeys)
+	if err != nil {
+		return err
+	}
 	var feeds []hconfig.Feed
+	var retrieveFeedIDs []string
 	for _, feedID := range feedIDs {
 		if !availableFeedIDs[feedID] {
 			return fmt.Errorf("feed %q does not appear in the Hoard config", feedID)
 		}
+		if slices.Contains(keyFeedIDs, feedID) {
+			continue
+		}
 		feeds = append(feeds, hconfig.Feed{
 			ID: feedID,
 		})
+		retrieveFeedIDs = append(retrieveFeedIDs, feedID)
+	}
+	limiter := hoardRateLimiter(ec)
+	if opts.inputDir != "" {
+		log.Printf("%s: using data in %s instead of downloading it", day, opts.inputDir)
+	} else {
+		if len(opts.hoardKeys) > 0 {
+			if err := retrieveHoardKeys(ctx, hc, opts.hoardKeys, tmpDir, limiter); err != nil {
+				return err
+			}
+		}
+		retrieveEnd := day.End(ec.Timezone.AsLoc()).Add(4 * time.Hour)
+		if !opts.asOf.IsZero() && opts.asOf.Before(retrieveEnd) {
+			retrieveEnd = opts.asOf
+		}
+		retrieveStart := day.Start(ec.Timezone.AsLoc()).Add(-4 * time.Hour)
+		if len(retrieveFeedIDs) == 0 {
+			// All of the feeds' data was provided as Hoard keys.
+		} else if limiter != nil {
+			err = retrieveHoardHours(ctx, hc, retrieveFeedIDs, retrieveStart, retrieveEnd, tmpDir, limiter)
+		} else {
+			err = hoard.Retrieve(
+				&hconfig.Config{
+					Feeds:         feeds,
+					ObjectStorage: hc.ObjectStorage,
+				},
+				hoard.RetrieveOptions{
+					Path:            tmpDir,
+					KeepPacked:      false,
+					FlattenTimeDirs: true,
+					FlattenFeedDirs: false,
+					Start:           retrieveStart,
+					End:             retrieveEnd,
+				},
+			)
+		}
 	}
-	err = hoard.Retrieve(
-		&hconfig.Config{
-			Feeds:         feeds,
-			ObjectStorage: hc.ObjectStorage,
-		},
-		hoard.RetrieveOptions{
-			Path:            tmpDir,
-			KeepPacked:      false,
-			FlattenTimeDirs: true,
-			FlattenFeedDirs: false,
-			Start:           day.Start(ec.Timezone.AsLoc()).Add(-4 * time.Hour),
-			End:             day.End(ec.Timezone.AsLoc()).Add(4 * time.Hour),
-		},
-	)
 	if err != nil {
 		return err
 	}
+	var messageGaps []metadata.MessageGap
+	if ec.MaxMessageGapMinutes > 0 && !opts.preliminary {
+		messageGaps, err = findMessageGaps(dataDir, feedIDs, start, end, time.Duration(ec.MaxMessageGapMinutes)*time.Minute)
+		if err != nil {
+			return err
+		}
+		for _, gap := range messageGaps {
+			log.Printf("%s: feed %s has no messages from %s to %s (%s)", day, gap.FeedID,
+				gap.Start.Format(time.RFC3339), gap.End.Format(time.RFC3339), gap.End.Sub(gap.Start))
+		}
+		if len(messageGaps) > 0 {
+			log.Printf("%s: marking day as needing review: %d message gap(s) longer than %d minute(s)", day, len(messageGaps), ec.MaxMessageGapMinutes)
+		}
+	}
 
 	// Stage two: run the journal code on each directory of downloaded data.
 	log.Printf("%s: stage 2 (journal)", day)
-	mergedJournal := journal.Journal{}
-	for _, feedID := range feedIDs {
-		source, err := journal.NewDirectoryGtfsrtSource(filepath.Join(tmpDir, feedID))
-		if err != nil {
-			return err
+	opts.timer.begin(stepParse)
+	spillDir := filepath.Join(tmpDir, "spill")
+	if err := os.Mkdir(spillDir, 0700); err != nil {
+		return fmt.Errorf("failed to create spill directory: %w", err)
+	}
+	tripStore := export.NewTripStore(spillDir, ec.MaxInMemoryTrips)
+	parseConcurrency, err := config.ParseConcurrency(ec.ParseConcurrency)
+	if err != nil {
+		return err
+	}
+	// Journals are built concurrently but added to the trip store in feed order
+	// so that the output is deterministic. Each journal holds a slot in the buffer
+	// from when it starts being built until it has been added to the store. Slots
+	// are taken in feed order, so the journal the store is waiting for always has one.
+	bufferSize := ec.JournalBufferSize
+	if bufferSize <= 0 {
+		bufferSize = len(feedIDs)
+	}
+	buffer := make(chan struct{}, bufferSize)
+	journals := make([]chan *journal.Journal, len(feedIDs))
+	for i := range journals {
+		journals[i] = make(chan *journal.Journal, 1)
+	}
+	storeErr := make(chan error, 1)
+	go func() {
+		var err error
+		for i := range journals {
+			j := <-journals[i]
+			if j != nil && err == nil {
+				err = tripStore.Add(feedIDs[i], j.Trips...)
+			}
+			<-buffer
 		}
-		j := journal.BuildJournal(
-			source,
-			day.Start(ec.Timezone.AsLoc()),
-			day.End(ec.Timezone.AsLoc()),
-		)
-		mergedJournal.Trips = append(mergedJournal.Trips, j.Trips...)
+		storeErr <- err
+	}()
+	recorders := make([]*export.VehicleAssignmentRecorder, len(feedIDs))
+	startDateRecorders := make([]*export.StartDateRecorder, len(feedIDs))
+	relationshipRecorders := make([]*export.ScheduleRelationshipRecorder, len(feedIDs))
+	pl := newLimiter(parseConcurrency)
+	for i, feedID := range feedIDs {
+		i, feedID := i, feedID
+		buffer <- struct{}{}
+		pl.run(func() error {
+			var j *journal.Journal
+			defer func() { journals[i] <- j }()
+			var source journal.GtfsrtSource
+			source, err := journal.NewDirectoryGtfsrtSource(filepath.Join(dataDir, feedID))
+			if err != nil {
+				return err
+			}
+			if !opts.asOf.IsZero() {
+				source = &asOfSource{source: source, asOf: opts.asOf}
+			}
+			if ec.IncludeVehicleAssignments {
+				recorders[i] = export.NewVehicleAssignmentRecorder(source)
+				source = recorders[i]
+			}
+			startDateRecorders[i] = export.NewStartDateRecorder(source)
+			source = startDateRecorders[i]
+			relationshipRecorders[i] = export.NewScheduleRelationshipRecorder(source)
+			source = relationshipRecorders[i]
+			j = journal.BuildJournal(
+				source,
+				day.Start(ec.Timezone.AsLoc()),
+				day.End(ec.Timezone.AsLoc()),
+			)
+			return nil
+		})
+	}
+	parseErr := pl.wait()
+	opts.timer.begin(stepMerge)
+	if err := <-storeErr; parseErr != nil {
+		return parseErr
+	} else if err != nil {
+		return err
+	}
+	if err := dumpJournal(ctx, day, tripStore, tmpDir, ec, sc); err != nil {
+		return err
 	}
 
 	// Stage three: export all of the trips.
 	log.Printf("%s: stage 3 (create csv)", day)
-	csvBytes, err := export.Export(&mergedJournal, fmt.Sprintf("%s%s_", ec.RemotePrefix, day))
+	opts.timer.begin(stepExport)
+	exportOpts, err := newExportOptions(ec, start, end)
+	if err != nil {
+		return err
+	}
+	if !opts.asOf.IsZero() {
+		exportOpts.DataEnd = opts.asOf
+	} else if opts.preliminary {
+		exportOpts.DataEnd = startedAt
+	}
+	if ec.IncludeProvenance {
+		exportOpts.Provenance = &export.Provenance{
+			DatasetVersion:   softwareVersion,
+			SoftwareRevision: softwareRevision(),
+			FeedIDs:          feedIDs,
+			ServiceDay:       day.String(),
+			RunID:            ec.ProvenanceRunID,
+		}
+		if ec.ProvenanceRunID != "" {
+			exportOpts.Provenance.ProcessedAt = &startedAt
+		}
+	}
+	exportOpts.StartDates = export.StartDates{}
+	for _, r := range startDateRecorders {
+		for tripUID, startDate := range r.StartDates() {
+			exportOpts.StartDates[tripUID] = startDate
+		}
+	}
+	exportOpts.AddedTrips = export.AddedTrips{}
+	exportOpts.CanceledTrips = export.CanceledTrips{}
+	for _, r := range relationshipRecorders {
+		for tripUID := range r.AddedTrips() {
+			exportOpts.AddedTrips[tripUID] = true
+		}
+		for tripUID := range r.CanceledTrips() {
+			exportOpts.CanceledTrips[tripUID] = true
+		}
+	}
+	if ec.IncludeVehicleAssignments {
+		exportOpts.VehicleAssignments = export.VehicleAssignments{}
+		for i, r := range recorders {
+			exportOpts.VehicleAssignments[feedIDs[i]] = r.Assignments()
+		}
+	}
+	csvTarBytes, exportStats, err := export.ExportStoreTar(tripStore, fmt.Sprintf("%s%s_", ec.RemotePrefix, day), exportOpts)
 	if err != nil {
 		return fmt.Errorf("failed to export trips to CSV: %w", err)
 	}
+	log.Printf("%s: exported %d/%d trips and %d/%d stop times (dropped: %v, flagged: %v)", day,
+		exportStats.TripsOut, exportStats.TripsIn, exportStats.StopTimesOut, exportStats.StopTimesIn, exportStats.Dropped, exportStats.Flagged)
+	csvBytes, err := export.Compress(csvTarBytes)
+	if err != nil {
+		return fmt.Errorf("failed to compress CSV export: %w", err)
+	}
+
+	if err := checkArchiveSize(ec, day, "csv.tar.xz", csvBytes); err != nil {
+		return err
+	}
+	if ec.UploadUncompressedCsv {
+		if err := checkArchiveSize(ec, day, "csv.tar", csvTarBytes); err != nil {
+			return err
+		}
+	}
+	if opts.outputPath != "" {
+		if err := os.WriteFile(opts.outputPath, csvBytes, 0644); err != nil {
+			return fmt.Errorf("failed to write CSV export: %w", err)
+		}
+		log.Printf("%s: wrote CSV export to %s", day, opts.outputPath)
+		if opts.noUpload {
+			// The CSV archive is all that is wanted, so the GTFS-RT archive isn't built.
+			opts.timer.end()
+			return nil
+		}
+	}
 
 	// Stage four: create the tar xz of GTFS files.
 	log.Printf("%s: stage 4 (create gtfsrt)", day)
-	gtfsrtBytes, err := createGtfsrtExport(start, end, tmpDir, feedIDs)
+	gtfsrtBytes, err := createGtfsrtExport(start, end, dataDir, feedIDs, exportOpts)
 	if err != nil {
 		return fmt.Errorf("failed to create GTFS-RT export: %w", err)
 	}
+	if err := checkArchiveSize(ec, day, "gtfsrt.tar.xz", gtfsrtBytes); err != nil {
+		return err
+	}
+
+	if opts.noUpload {
+		opts.timer.end()
+		log.Printf("%s: not uploading %d bytes of CSV and %d bytes of GTFS-RT", day, len(csvBytes), len(gtfsrtBytes))
+		return nil
+	}
+
+	if opts.maxRegressionPercent != nil {
+		if err := checkQualityRegression(ctx, day, feedIDs, exportStats, *opts.maxRegressionPercent, sc); err != nil {
+			return err
+		}
+	}
 
 	// Stage five: upload data to object storage.
 	log.Printf("%s: stage 5 (upload)", day)
+	opts.timer.begin(stepUpload)
 	csvSha256, err := calculateSha256(csvBytes)
 	if err != nil {
 		return fmt.Errorf("failed to calculate SHA-256 hash of CSV upload: %w", err)
 	}
-	target := fmt.Sprintf("%s/%s%s_%s_%s.tar.xz", day.MonthString(), ec.RemotePrefix, day, "csv", csvSha256)
+	// Preliminary archives are optionally tagged so that they can't be confused with final ones.
+	var tag string
+	if opts.preliminary && ec.TagPreliminaryKeys {
+		tag = preliminaryTag
+	}
+	target := archiveKey(ec, day, "csv", csvSha256, tag, "tar.xz")
 	if err := sc.Write(ctx, csvBytes, target); err != nil {
 		return fmt.Errorf("failed to copy csv bytes to object storage: %w", err)
 	}
 
+	var csvUncompressed *metadata.Artifact
+	if ec.UploadUncompressedCsv {
+		csvTarSha256, err := calculateSha256(csvTarBytes)
+		if err != nil {
+			return fmt.Errorf("failed to calculate SHA-256 hash of uncompressed CSV upload: %w", err)
+		}
+		csvTarTarget := archiveKey(ec, day, "csv", csvTarSha256, tag, "tar")
+		if err := sc.Write(ctx, csvTarBytes, csvTarTarget); err != nil {
+			return fmt.Errorf("failed to copy uncompressed csv bytes to object storage: %w", err)
+		}
+		csvUncompressed = &metadata.Artifact{
+			Size:     int64(len(csvTarBytes)),
+			Path:     csvTarTarget,
+			Checksum: csvTarSha256,
+		}
+	}
+
+	var changesCsv *metadata.ChangesArtifact
+	if ec.UploadChangesCsv {
+		changesCsv, err = uploadChangesCsv(ctx, day, csvTarBytes, tag, exportOpts, ec, sc)
+		if err != nil {
+			return err
+		}
+	}
+
+	var feedCsv []metadata.FeedArtifact
+	if ec.PerFeedArchives {
+		for _, feedID := range feedIDs {
+			feedOpts := exportOpts
+			if exportOpts.Provenance != nil {
+				provenance := *exportOpts.Provenance
+				provenance.FeedIDs = []string{feedID}
+				feedOpts.Provenance = &provenance
+			}
+			feedCsvBytes, err := export.ExportStoreFeed(tripStore, feedID, fmt.Sprintf("%s%s_%s_", ec.RemotePrefix, day, feedID), feedOpts)
+			if err != nil {
+				return fmt.Errorf("failed to export trips of feed %s to CSV: %w", feedID, err)
+			}
+			if err := checkArchiveSize(ec, day, feedID+"_csv.tar.xz", feedCsvBytes); err != nil {
+				return err
+			}
+			feedCsvSha256, err := calculateSha256(feedCsvBytes)
+			if err != nil {
+				return fmt.Errorf("failed to calculate SHA-256 hash of CSV upload for feed %s: %w", feedID, err)
+			}
+			feedCsvTarget := archiveKey(ec, day, feedID+"_csv", feedCsvSha256, tag, "tar.xz")
+			if err := sc.Write(ctx, feedCsvBytes, feedCsvTarget); err != nil {
+				return fmt.Errorf("failed to copy csv bytes for feed %s to object storage: %w", feedID, err)
+			}
+			feedCsv = append(feedCsv, metadata.FeedArtifact{
+				FeedID: feedID,
+				Artifact: metadata.Artifact{
+					Size:     int64(len(feedCsvBytes)),
+					Path:     feedCsvTarget,
+					Checksum: feedCsvSha256,
+				},
+			})
+		}
+	}
+
 	gtfsrtSha256, err := calculateSha256(gtfsrtBytes)
 	if err != nil {
 		return fmt.Errorf("failed to calculate SHA-256 hash of GTFS-RT upload: %w", err)
 	}
-	gtfsrtTarget := fmt.Sprintf("%s/%s%s_%s_%s.tar.xz", day.MonthString(), ec.RemotePrefix, day, "gtfsrt", gtfsrtSha256)
+	gtfsrtTarget := archiveKey(ec, day, "gtfsrt", gtfsrtSha256, tag, "tar.xz")
 	if err := sc.Write(ctx, gtfsrtBytes, gtfsrtTarget); err != nil {
 		return fmt.Errorf("failed to copy gtfsrt to object storage: %w", err)
 	}
@@ -220,29 +1259,294 @@ func Run(ctx context.Context, day metadata.Day, feedIDs []string, ec *config.Con
 			Path:     gtfsrtTarget,
 			Checksum: gtfsrtSha256,
 		},
+		CsvUncompressed: csvUncompressed,
+		FeedCsv:         feedCsv,
+		ChangesCsv:      changesCsv,
+		Preliminary:     opts.preliminary,
+		ExportStats:     &exportStats,
+		NeedsReview:     len(messageGaps) > 0,
+		MessageGaps:     messageGaps,
 	}
+	newProcessedDay.ProcessingSeconds = time.Since(startedAt).Seconds()
+	var replaced *metadata.ProcessedDay
+	var tombstoned bool
 	if err := sc.UpdateMetadata(
 		ctx,
 		func(m *metadata.Metadata) bool {
+			replaced = nil
+			tombstoned = false
 			for i := range m.ProcessedDays {
 				if m.ProcessedDays[i].Day == day {
 					if m.ProcessedDays[i].SoftwareVersion > softwareVersion {
 						log.Printf("Not updating Git metadata: existing data built with newer software")
 						return false
 					}
+					if opts.preliminary && !m.ProcessedDays[i].Preliminary {
+						log.Printf("Not updating metadata: existing data is complete")
+						return false
+					}
+					if m.ProcessedDays[i].Preliminary {
+						previous := m.ProcessedDays[i]
+						replaced = &previous
+					}
 					m.ProcessedDays[i] = newProcessedDay
 					return true
 				}
 			}
 			m.ProcessedDays = append(m.ProcessedDays, newProcessedDay)
+			// A day that was deleted and is processed again is no longer deleted.
+			if deletedDays := removeDeletedDay(m.DeletedDays, day); len(deletedDays) != len(m.DeletedDays) {
+				m.DeletedDays = deletedDays
+				tombstoned = true
+			}
 			return true
 		},
 	); err != nil {
 		return fmt.Errorf("failed to update metadata: %w", err)
 	}
+	if tombstoned {
+		if err := sc.Delete(ctx, deletionMarkerKey(ec, day)); err != nil {
+			log.Printf("%s: failed to delete deletion marker: %s", day, err)
+		}
+	}
+	if replaced != nil && ec.TagPreliminaryKeys {
+		deleteReplacedArtifacts(ctx, day, replaced, &newProcessedDay, sc)
+	}
+	opts.timer.end()
 	return nil
 }
 
+// preliminaryTag is added to the object keys of preliminary archives, before the extension.
+const preliminaryTag = ".preliminary"
+
+// ArchiveTooLargeError is returned when an archive of a day is larger than the maximum archive size.
+type ArchiveTooLargeError struct {
+	Day     metadata.Day
+	Archive string
+	Size    int64
+	Limit   int64
+}
+
+func (e *ArchiveTooLargeError) Error() string {
+	return fmt.Sprintf("the %s archive of %s is %d bytes, more than the limit of %d bytes set by MaxArchiveBytes; "+
+		"check the day's data for duplicated trips before raising the limit", e.Archive, e.Day, e.Size, e.Limit)
+}
+
+// checkArchiveSize returns an ArchiveTooLargeError if the archive is larger than the maximum archive size.
+func checkArchiveSize(ec *config.Config, day metadata.Day, archive string, b []byte) error {
+	limit, ok := ec.MaxArchiveSize()
+	if !ok || int64(len(b)) <= limit {
+		return nil
+	}
+	return &ArchiveTooLargeError{Day: day, Archive: archive, Size: int64(len(b)), Limit: limit}
+}
+
+// archiveKey returns the object key of an archive of the day. The kind is csv or gtfsrt, preceded
+// by the feed ID for per-feed archives, and the tag is either empty or preliminaryTag.
+func archiveKey(ec *config.Config, day metadata.Day, kind, checksum, tag, ext string) string {
+	return fmt.Sprintf("%s/%s%s_%s_%s%s.%s", day.MonthString(), ec.RemotePrefix, day, kind, checksum, tag, ext)
+}
+
+// deleteReplacedArtifacts deletes the archives of a preliminary day from object storage once the
+// day has been replaced in the metadata. Failures are only logged, as the metadata no longer
+// references the archives.
+func deleteReplacedArtifacts(ctx context.Context, day metadata.Day, replaced, current *metadata.ProcessedDay, sc *storage.Client) {
+	inUse := map[string]bool{}
+	for _, path := range artifactPaths(current) {
+		inUse[path] = true
+	}
+	for _, path := range artifactPaths(replaced) {
+		if inUse[path] {
+			continue
+		}
+		if err := sc.Delete(ctx, path); err != nil {
+			log.Printf("%s: failed to delete preliminary archive %s: %s", day, path, err)
+			continue
+		}
+		log.Printf("%s: deleted preliminary archive %s", day, path)
+	}
+}
+
+func artifactPaths(processedDay *metadata.ProcessedDay) []string {
+	var paths []string
+	for _, artifact := range artifacts(processedDay) {
+		paths = append(paths, artifact.Path)
+	}
+	return paths
+}
+
+// artifacts returns the archives of the day that are in object storage.
+func artifacts(processedDay *metadata.ProcessedDay) []metadata.Artifact {
+	archives := []metadata.Artifact{processedDay.Csv}
+	if !processedDay.GtfsrtPruned {
+		archives = append(archives, processedDay.Gtfsrt)
+	}
+	if processedDay.CsvUncompressed != nil {
+		archives = append(archives, *processedDay.CsvUncompressed)
+	}
+	for _, feedCsv := range processedDay.FeedCsv {
+		archives = append(archives, feedCsv.Artifact)
+	}
+	if processedDay.ChangesCsv != nil {
+		archives = append(archives, processedDay.ChangesCsv.Artifact)
+	}
+	return archives
+}
+
+func archivesSize(processedDay *metadata.ProcessedDay) int64 {
+	var size int64
+	for _, artifact := range artifacts(processedDay) {
+		size += artifact.Size
+	}
+	return size
+}
+
+func newExportOptions(ec *config.Config, dayStart, dayEnd time.Time) (export.Options, error) {
+	opts := export.Options{
+		DayStart:               dayStart,
+		DayEnd:                 dayEnd,
+		ClipStopTimesToDay:     ec.ClipStopTimesToDay,
+		DropPredictions:        ec.DropPredictions,
+		MergeDuplicateStopIDs:  ec.MergeDuplicateStopIDs,
+		MaxTripAge:             time.Duration(ec.MaxTripAgeMinutes) * time.Minute,
+		OnTimeThresholds:       export.DefaultOnTimeThresholds(),
+		IncludeDataDictionary:  ec.IncludeDataDictionary,
+		IncludeStopSequence:    ec.IncludeStopSequence,
+		IncludeTravelTime:      ec.IncludeTravelTime,
+		IncludeHeadways:        ec.IncludeHeadways,
+		IncludeStopThroughput:  ec.IncludeStopThroughput,
+		IncludeCombined:        ec.IncludeCombinedCsv,
+		IncludeServiceDelivery: ec.IncludeServiceDeliveryCsv,
+		IncludeFirstLast:       ec.IncludeFirstLastCsv,
+	}
+	windowStart, windowEnd, ok, err := config.ParseTimeOfDayWindow(ec.TimeOfDayWindow)
+	if err != nil {
+		return export.Options{}, err
+	}
+	if ok {
+		opts.TimeOfDayWindow = &export.TimeOfDayWindow{Start: windowStart, End: windowEnd}
+	}
+	fileMode, err := config.ParseArchiveFileMode(ec.ArchiveFileMode)
+	if err != nil {
+		return export.Options{}, err
+	}
+	opts.FileMode = fileMode
+	if ec.ArchiveModTime == config.ArchiveModTimeDay {
+		opts.ModTime = dayStart
+	} else {
+		opts.ModTime = time.Unix(0, 0)
+	}
+	for routeID, terminals := range ec.RouteTerminals {
+		if opts.RouteTerminals == nil {
+			opts.RouteTerminals = map[string]export.RouteTerminals{}
+		}
+		opts.RouteTerminals[routeID] = export.RouteTerminals{
+			Direction0: terminals.Direction0StopIDs,
+			Direction1: terminals.Direction1StopIDs,
+		}
+	}
+	opts.DropInconsistentDirections = ec.DropInconsistentDirections
+	opts.DropCanceledTrips = ec.DropCanceledTrips
+	switch ec.VehicleIDs {
+	case config.VehicleIDsOmit:
+		opts.OmitVehicleIDs = true
+	case config.VehicleIDsHash:
+		opts.VehicleIDAnonymizer = &export.VehicleIDAnonymizer{
+			Salt:             ec.VehicleIDSalt,
+			StableAcrossDays: ec.VehicleIDHashAcrossDays,
+		}
+	}
+	for _, stopID := range ec.NonRevenueStopIDs {
+		if opts.NonRevenueStopIDs == nil {
+			opts.NonRevenueStopIDs = map[string]bool{}
+		}
+		opts.NonRevenueStopIDs[stopID] = true
+	}
+	opts.DropNonRevenueStopTimes = ec.DropNonRevenueStopTimes
+	signingKey, ok, err := config.ParseManifestSigningKey(ec.ManifestSigningKey)
+	if err != nil {
+		return export.Options{}, err
+	}
+	if ok {
+		opts.ManifestSigner = &export.ManifestSigner{Key: signingKey, KeyID: ec.ManifestKeyID}
+	}
+	for feedID, feedOpts := range ec.FeedExportOptions {
+		if opts.FeedOverrides == nil {
+			opts.FeedOverrides = map[string]export.FeedOptions{}
+		}
+		feedOverride := export.FeedOptions{
+			ClipStopTimesToDay: feedOpts.ClipStopTimesToDay,
+			RouteIDs:           feedOpts.RouteIDs,
+		}
+		if feedOpts.MaxTripAgeMinutes != nil {
+			maxTripAge := time.Duration(*feedOpts.MaxTripAgeMinutes) * time.Minute
+			feedOverride.MaxTripAge = &maxTripAge
+		}
+		opts.FeedOverrides[feedID] = feedOverride
+	}
+	if ec.OnTimeEarlySeconds != 0 {
+		opts.OnTimeThresholds.EarlySeconds = ec.OnTimeEarlySeconds
+	}
+	if ec.OnTimeLateSeconds != 0 {
+		opts.OnTimeThresholds.LateSeconds = ec.OnTimeLateSeconds
+	}
+	if ec.StaticGtfsPath != "" {
+		b, err := os.ReadFile(ec.StaticGtfsPath)
+		if err != nil {
+			return export.Options{}, fmt.Errorf("failed to read the static GTFS file from disk: %w", err)
+		}
+		static, err := gtfs.ParseStatic(b, gtfs.ParseStaticOptions{})
+		if err != nil {
+			return export.Options{}, fmt.Errorf("failed to parse the static GTFS file: %w", err)
+		}
+		opts.Schedule = export.NewSchedule(static)
+	}
+	if ec.ExportSchemaPath != "" {
+		b, err := os.ReadFile(ec.ExportSchemaPath)
+		if err != nil {
+			return export.Options{}, fmt.Errorf("failed to read the export schema from disk: %w", err)
+		}
+		opts.Schema, err = export.ParseSchema(b)
+		if err != nil {
+			return export.Options{}, err
+		}
+	}
+	if ec.TrackReferencePath != "" {
+		b, err := os.ReadFile(ec.TrackReferencePath)
+		if err != nil {
+			return export.Options{}, fmt.Errorf("failed to read the track reference from disk: %w", err)
+		}
+		opts.TrackReference, err = export.ParseTrackReference(b)
+		if err != nil {
+			return export.Options{}, err
+		}
+	}
+	return opts, nil
+}
+
+// softwareRevision returns the VCS revision the binary was built from, with a -dirty suffix if
+// the working tree had local modifications. It is empty if the build information is unavailable.
+func softwareRevision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	var revision string
+	var modified bool
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision != "" && modified {
+		revision += "-dirty"
+	}
+	return revision
+}
+
 func calculateSha256(b []byte) (string, error) {
 	h := sha256.New()
 	h.Write(b)
@@ -252,20 +1556,25 @@ func calculateSha256(b []byte) (string, error) {
 //go:embed gtfsrt_readme.md
 var gtfsrtReadme []byte
 
-func createGtfsrtExport(start, end time.Time, sourceDir string, feedIDs []string) ([]byte, error) {
+// createGtfsrtExport creates a tar.xz archive of the GTFS-RT files.
+//
+// The file mode and the mod time of the readme are taken from the export options; the data
+// files keep the mod times they had in Hoard.
+func createGtfsrtExport(start, end time.Time, sourceDir string, feedIDs []string, opts export.Options) ([]byte, error) {
 	var gtfsrtTarXz bytes.Buffer
 	xw := xz.NewWriter(&gtfsrtTarXz)
 	tw := tar.NewWriter(xw)
-	now := time.Now()
+	mode := opts.FileMode
+	if mode == 0 {
+		mode = export.DefaultFileMode
+	}
 	if err := tw.WriteHeader(&tar.Header{
 		// We chose this file name so that it appears first in the archive file.
 		// The filename readme.md would appear below the nycsubway_*.gtfsrt data files.
-		Name:       "gtfsrt_readme.md",
-		Mode:       0600,
-		Size:       int64(len(gtfsrtReadme)),
-		ModTime:    now,
-		AccessTime: now,
-		ChangeTime: now,
+		Name:    "gtfsrt_readme.md",
+		Mode:    mode,
+		Size:    int64(len(gtfsrtReadme)),
+		ModTime: opts.ModTime.Truncate(time.Second),
 	}); err != nil {
 		return nil, err
 	}
@@ -294,7 +1603,7 @@ func createGtfsrtExport(start, end time.Time, sourceDir string, feedIDs []string
 			}
 			hdr := &tar.Header{
 				Name:       file.Name(),
-				Mode:       0600,
+				Mode:       mode,
 				Size:       info.Size(),
 				ModTime:    info.ModTime(),
 				AccessTime: info.ModTime(),
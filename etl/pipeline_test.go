@@ -0,0 +1,24 @@
+package etl
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+func TestFailedDaysError(t *testing.T) {
+	failed := []metadata.Day{metadata.NewDay(2023, time.March, 1)}
+	if err := failedDaysError(nil, 2); err != nil {
+		t.Errorf("failedDaysError() with no failed days = %v, want nil", err)
+	}
+	var partialFailure *PartialFailureError
+	if err := failedDaysError(failed, 2); !errors.As(err, &partialFailure) {
+		t.Errorf("failedDaysError() with some failed days = %v, want a PartialFailureError", err)
+	}
+	var allFailed *AllDaysFailedError
+	if err := failedDaysError(failed, 1); !errors.As(err, &allFailed) || errors.As(err, &partialFailure) {
+		t.Errorf("failedDaysError() with every day failed = %v, want an AllDaysFailedError", err)
+	}
+}
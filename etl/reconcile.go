@@ -0,0 +1,175 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+type ReconcileOptions struct {
+	// Whether to update the metadata. If false the differences are only reported.
+	Apply  bool
+	Output OutputFormat
+}
+
+// Reconcile compares the metadata against the objects in storage and, if opts.Apply is set, fixes the metadata.
+//
+// Days whose archives are in storage but which are missing from the metadata are marked as processed.
+// The archives don't record the software version that built them, so these days have software version
+// 0 and will be rebuilt by the next backlog run. Days in the metadata whose archives are missing from
+// storage are removed from the metadata, making them pending again.
+func Reconcile(ctx context.Context, ec *config.Config, sc *storage.Client, opts ReconcileOptions) error {
+	objects, err := sc.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	healed, pending := reconcile(ec, m, objects)
+	report := ReconcileReport{
+		MissingFromMetadata: []metadata.Day{},
+		MissingFromStorage:  []metadata.Day{},
+	}
+	for _, processedDay := range healed {
+		report.MissingFromMetadata = append(report.MissingFromMetadata, processedDay.Day)
+	}
+	for day := range pending {
+		report.MissingFromStorage = append(report.MissingFromStorage, day)
+	}
+	sort.Slice(report.MissingFromStorage, func(i, j int) bool {
+		return report.MissingFromStorage[i].Before(report.MissingFromStorage[j])
+	})
+	if opts.Output == OutputJson {
+		report.Applied = opts.Apply
+		if err := writeJson(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("%d day(s) in storage but missing from the metadata: %s\n", len(report.MissingFromMetadata), report.MissingFromMetadata)
+		fmt.Printf("%d day(s) in the metadata but missing from storage: %s\n", len(report.MissingFromStorage), report.MissingFromStorage)
+	}
+	if !opts.Apply {
+		log.Printf("Not updating metadata: --apply not set")
+		return nil
+	}
+	if len(healed) == 0 && len(pending) == 0 {
+		return nil
+	}
+	return sc.UpdateMetadata(ctx, func(m *metadata.Metadata) bool {
+		existing := map[metadata.Day]bool{}
+		retainedDays := make([]metadata.ProcessedDay, 0, len(m.ProcessedDays)+len(healed))
+		for _, processedDay := range m.ProcessedDays {
+			existing[processedDay.Day] = true
+			if pending[processedDay.Day] {
+				continue
+			}
+			retainedDays = append(retainedDays, processedDay)
+		}
+		for _, processedDay := range healed {
+			// The metadata may have changed since it was read above.
+			if existing[processedDay.Day] {
+				continue
+			}
+			retainedDays = append(retainedDays, processedDay)
+		}
+		m.ProcessedDays = retainedDays
+		return true
+	})
+}
+
+// storageKeyRegex matches the object keys of the archives written by the pipeline, which have the form
+// YYYY-MM/<RemotePrefix>YYYY-MM-DD_<kind>_<checksum>[.preliminary].<extension>.
+var storageKeyRegex = regexp.MustCompile(`^\d{4}-\d{2}/(.*)(\d{4}-\d{2}-\d{2})_(csv|gtfsrt)_([0-9a-f]{12})(\.preliminary)?\.(tar\.xz|tar)$`)
+
+// reconcile returns the days that should be added to the metadata and the days that should be removed from it.
+func reconcile(ec *config.Config, m *metadata.Metadata, objects []storage.Object) ([]metadata.ProcessedDay, map[metadata.Day]bool) {
+	paths := map[string]bool{}
+	dayToObjects := map[metadata.Day]map[string]storage.Object{}
+	for _, o := range objects {
+		paths[o.Path] = true
+		match := storageKeyRegex.FindStringSubmatch(o.Path)
+		if match == nil || match[1] != ec.RemotePrefix {
+			continue
+		}
+		day, err := metadata.ParseDay(match[2])
+		if err != nil {
+			continue
+		}
+		kind := match[3] + "." + match[6]
+		if dayToObjects[day] == nil {
+			dayToObjects[day] = map[string]storage.Object{}
+		}
+		// If a day was processed more than once, use the most recent final archive, or the most
+		// recent preliminary archive if there is no final one.
+		previous, ok := dayToObjects[day][kind]
+		preliminary := match[5] != ""
+		if !ok || (isPreliminaryKey(previous.Path) && !preliminary) ||
+			(isPreliminaryKey(previous.Path) == preliminary && previous.LastModified.Before(o.LastModified)) {
+			dayToObjects[day][kind] = o
+		}
+	}
+
+	inMetadata := map[metadata.Day]bool{}
+	pending := map[metadata.Day]bool{}
+	for _, processedDay := range m.ProcessedDays {
+		inMetadata[processedDay.Day] = true
+		if !paths[processedDay.Csv.Path] || (!processedDay.GtfsrtPruned && !paths[processedDay.Gtfsrt.Path]) {
+			pending[processedDay.Day] = true
+		}
+	}
+	// The archives of deleted days are left in object storage, but the days must not come back.
+	for _, deletedDay := range m.DeletedDays {
+		inMetadata[deletedDay.Day] = true
+	}
+
+	var healed []metadata.ProcessedDay
+	for day, kindToObject := range dayToObjects {
+		if inMetadata[day] {
+			continue
+		}
+		csv, csvOk := kindToObject["csv.tar.xz"]
+		gtfsrt, gtfsrtOk := kindToObject["gtfsrt.tar.xz"]
+		if !csvOk || !gtfsrtOk {
+			continue
+		}
+		processedDay := metadata.ProcessedDay{
+			Day:     day,
+			Feeds:   config.FeedIDsForDay(ec.Feeds, day),
+			Created: csv.LastModified,
+			Csv:     newArtifact(csv),
+			Gtfsrt:  newArtifact(gtfsrt),
+			// Untagged archives may also be preliminary, but this can't be determined from the key.
+			Preliminary: isPreliminaryKey(csv.Path),
+		}
+		if csvTar, ok := kindToObject["csv.tar"]; ok {
+			artifact := newArtifact(csvTar)
+			processedDay.CsvUncompressed = &artifact
+		}
+		healed = append(healed, processedDay)
+	}
+	sort.Slice(healed, func(i, j int) bool {
+		return healed[i].Day.Before(healed[j].Day)
+	})
+	return healed, pending
+}
+
+func isPreliminaryKey(path string) bool {
+	match := storageKeyRegex.FindStringSubmatch(path)
+	return match != nil && match[5] != ""
+}
+
+func newArtifact(o storage.Object) metadata.Artifact {
+	return metadata.Artifact{
+		Size:     o.Size,
+		Path:     o.Path,
+		Checksum: storageKeyRegex.FindStringSubmatch(o.Path)[4],
+	}
+}
@@ -0,0 +1,102 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+// QualityRegressionError is returned when a reprocessed day has many fewer trips or stop times
+// than the published version of the day, in which case the published version is kept.
+type QualityRegressionError struct {
+	Day metadata.Day
+	// What regressed: trips or stop times.
+	Measure              string
+	Published            int
+	Reprocessed          int
+	MaxRegressionPercent float64
+}
+
+func (e *QualityRegressionError) Error() string {
+	return fmt.Sprintf("reprocessing %s produced %d %s, %.1f%% fewer than the %d published, more than the tolerance of %.1f%%; "+
+		"the published data was kept; review the day and run it again with rerun-failed to publish it anyway",
+		e.Day, e.Reprocessed, e.Measure, regressionPercent(e.Published, e.Reprocessed), e.Published, e.MaxRegressionPercent)
+}
+
+// checkQualityRegression returns a QualityRegressionError if the export of the day has more than
+// maxRegressionPercent percent fewer trips or stop times than the published version of the day.
+// Days that haven't been published, were published without export statistics, or were published
+// with different feeds than the export always pass, since their counts aren't comparable.
+func checkQualityRegression(ctx context.Context, day metadata.Day, feedIDs []string, stats metadata.ExportStats, maxRegressionPercent float64, sc *storage.Client) error {
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to obtain metadata: %w", err)
+	}
+	for _, processedDay := range m.ProcessedDays {
+		if processedDay.Day != day {
+			continue
+		}
+		if processedDay.ExportStats == nil {
+			log.Printf("%s: skipping the quality regression check because the published day has no export statistics", day)
+			return nil
+		}
+		if !sameFeeds(processedDay.Feeds, feedIDs) {
+			log.Printf("%s: skipping the quality regression check because the day was published with the feeds %v, not %v",
+				day, processedDay.Feeds, feedIDs)
+			return nil
+		}
+		return compareExportStats(day, *processedDay.ExportStats, stats, maxRegressionPercent)
+	}
+	return nil
+}
+
+func compareExportStats(day metadata.Day, published, reprocessed metadata.ExportStats, maxRegressionPercent float64) error {
+	for _, c := range []struct {
+		measure                string
+		published, reprocessed int
+	}{
+		{"trips", published.TripsOut, reprocessed.TripsOut},
+		{"stop times", published.StopTimesOut, reprocessed.StopTimesOut},
+	} {
+		if regressionPercent(c.published, c.reprocessed) > maxRegressionPercent {
+			return &QualityRegressionError{
+				Day:                  day,
+				Measure:              c.measure,
+				Published:            c.published,
+				Reprocessed:          c.reprocessed,
+				MaxRegressionPercent: maxRegressionPercent,
+			}
+		}
+	}
+	return nil
+}
+
+// regressionPercent returns how much smaller the current count is than the previous count, as a
+// percentage of the previous count. It is negative if the current count is larger.
+func regressionPercent(previous, current int) float64 {
+	if previous == 0 {
+		return 0
+	}
+	return 100 * float64(previous-current) / float64(previous)
+}
+
+// sameFeeds returns whether the two lists contain the same feed IDs, in any order.
+func sameFeeds(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
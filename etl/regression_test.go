@@ -0,0 +1,84 @@
+package etl
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+func TestRegressionPercent(t *testing.T) {
+	testCases := []struct {
+		previous, current int
+		want              float64
+	}{
+		{100, 100, 0},
+		{100, 90, 10},
+		{100, 0, 100},
+		{100, 110, -10},
+		{0, 0, 0},
+		{0, 10, 0},
+	}
+	for _, tc := range testCases {
+		if got := regressionPercent(tc.previous, tc.current); got != tc.want {
+			t.Errorf("regressionPercent(%d, %d) = %v, want %v", tc.previous, tc.current, got, tc.want)
+		}
+	}
+}
+
+func TestCompareExportStats(t *testing.T) {
+	day := metadata.NewDay(2023, time.March, 1)
+	stats := func(trips, stopTimes int) metadata.ExportStats {
+		return metadata.ExportStats{TripsOut: trips, StopTimesOut: stopTimes}
+	}
+	testCases := []struct {
+		name        string
+		published   metadata.ExportStats
+		reprocessed metadata.ExportStats
+		wantMeasure string
+	}{
+		{"same counts", stats(100, 1000), stats(100, 1000), ""},
+		{"at the tolerance", stats(100, 1000), stats(90, 900), ""},
+		{"trips beyond the tolerance", stats(100, 1000), stats(89, 1000), "trips"},
+		{"stop times beyond the tolerance", stats(100, 1000), stats(100, 899), "stop times"},
+		{"larger counts", stats(100, 1000), stats(200, 2000), ""},
+		{"nothing published", stats(0, 0), stats(0, 0), ""},
+		{"nothing published before", stats(0, 0), stats(100, 1000), ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := compareExportStats(day, tc.published, tc.reprocessed, 10)
+			if tc.wantMeasure == "" {
+				if err != nil {
+					t.Errorf("compareExportStats returned an error: %s", err)
+				}
+				return
+			}
+			var regressionErr *QualityRegressionError
+			if !errors.As(err, &regressionErr) {
+				t.Fatalf("compareExportStats returned %v, want a QualityRegressionError", err)
+			}
+			if regressionErr.Measure != tc.wantMeasure {
+				t.Errorf("regressed measure = %q, want %q", regressionErr.Measure, tc.wantMeasure)
+			}
+		})
+	}
+}
+
+func TestSameFeeds(t *testing.T) {
+	testCases := []struct {
+		a, b []string
+		want bool
+	}{
+		{[]string{"a", "b"}, []string{"b", "a"}, true},
+		{[]string{"a", "b"}, []string{"a"}, false},
+		{[]string{"a"}, []string{"b"}, false},
+		{nil, nil, true},
+	}
+	for _, tc := range testCases {
+		if got := sameFeeds(tc.a, tc.b); got != tc.want {
+			t.Errorf("sameFeeds(%v, %v) = %t, want %t", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
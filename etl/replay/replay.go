@@ -0,0 +1,231 @@
+// Package replay replays the GTFS-RT data of a processed day as if it were live.
+//
+// This is a development and testing tool for consumer apps; it is not used by the pipeline.
+package replay
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+	"github.com/jamespfennell/xz"
+)
+
+type Options struct {
+	// How many times faster than real time to replay the day. 1 replays in real time.
+	Speed float64
+
+	// Simulated time between snapshots. At each snapshot, the most recent GTFS-RT message of each
+	// feed at that simulated time is published, if it changed.
+	Interval time.Duration
+
+	// If set, each published message is POSTed to this URL with the feed ID in the X-Feed-Id header.
+	TargetUrl string
+
+	// If non-zero, the most recent message of each feed is served at /<feed ID> on this port.
+	Port int
+
+	// Client used to POST messages to the target URL.
+	Client *http.Client
+}
+
+// message is a GTFS-RT message from the day's archive.
+type message struct {
+	feedID string
+	time   time.Time
+	body   []byte
+}
+
+// Run replays the GTFS-RT archive of the processed day.
+//
+// The raw GTFS-RT messages are replayed rather than messages rebuilt from the CSV export, so
+// consumers see exactly what the pipeline saw. Days whose GTFS-RT archive has been pruned can't
+// be replayed.
+func Run(ctx context.Context, day metadata.Day, sc *storage.Client, opts Options) error {
+	if opts.TargetUrl == "" && opts.Port == 0 {
+		return fmt.Errorf("a target URL or a port to serve on is required")
+	}
+	if opts.Speed <= 0 {
+		return fmt.Errorf("speed must be positive, got %v", opts.Speed)
+	}
+	if opts.Interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %s", opts.Interval)
+	}
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	var processedDay *metadata.ProcessedDay
+	for i := range m.ProcessedDays {
+		if m.ProcessedDays[i].Day == day {
+			processedDay = &m.ProcessedDays[i]
+		}
+	}
+	if processedDay == nil {
+		return fmt.Errorf("day %s has not been processed", day)
+	}
+	if processedDay.GtfsrtPruned {
+		return fmt.Errorf("the GTFS-RT archive of day %s has been pruned", day)
+	}
+	log.Printf("Downloading %s", processedDay.Gtfsrt.Path)
+	b, err := sc.Read(ctx, processedDay.Gtfsrt.Path)
+	if err != nil {
+		return err
+	}
+	messages, err := readArchive(b, processedDay.Feeds)
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return fmt.Errorf("the GTFS-RT archive of day %s contains no messages", day)
+	}
+	log.Printf("Replaying %d messages from %s to %s at %vx speed",
+		len(messages), messages[0].time, messages[len(messages)-1].time, opts.Speed)
+
+	s := &server{latest: map[string][]byte{}}
+	if opts.Port != 0 {
+		httpServer := &http.Server{Addr: fmt.Sprintf(":%d", opts.Port), Handler: s}
+		go func() {
+			log.Printf("Serving replayed messages on port %d", opts.Port)
+			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Replay server failed: %s", err)
+			}
+		}()
+		defer httpServer.Shutdown(context.Background())
+	}
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	t := time.NewTicker(time.Duration(float64(opts.Interval) / opts.Speed))
+	defer t.Stop()
+	simulated := messages[0].time
+	published := map[string]time.Time{}
+	next := 0
+	for next < len(messages) {
+		latest := map[string]message{}
+		for next < len(messages) && !messages[next].time.After(simulated) {
+			latest[messages[next].feedID] = messages[next]
+			next++
+		}
+		for _, feedID := range sortedKeys(latest) {
+			msg := latest[feedID]
+			if published[feedID].Equal(msg.time) {
+				continue
+			}
+			published[feedID] = msg.time
+			s.set(feedID, msg.body)
+			if opts.TargetUrl != "" {
+				if err := post(ctx, client, opts.TargetUrl, msg); err != nil {
+					log.Printf("Failed to post message for %s at %s: %s", feedID, msg.time, err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		simulated = simulated.Add(opts.Interval)
+	}
+	log.Printf("Finished replaying %s", day)
+	return nil
+}
+
+// readArchive returns the GTFS-RT messages in the archive in time order.
+//
+// Hoard names files with the feed ID as a prefix, so each file is assigned to the longest
+// of the feed IDs that prefixes its name.
+func readArchive(b []byte, feedIDs []string) ([]message, error) {
+	var messages []message
+	tr := tar.NewReader(xz.NewReader(bytes.NewReader(b)))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GTFS-RT archive: %w", err)
+		}
+		if !strings.HasSuffix(hdr.Name, ".gtfsrt") {
+			continue
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from GTFS-RT archive: %w", hdr.Name, err)
+		}
+		var feedID string
+		for _, candidate := range feedIDs {
+			if strings.HasPrefix(hdr.Name, candidate) && len(candidate) > len(feedID) {
+				feedID = candidate
+			}
+		}
+		messages = append(messages, message{feedID: feedID, time: hdr.ModTime, body: body})
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].time.Before(messages[j].time)
+	})
+	return messages, nil
+}
+
+func post(ctx context.Context, client *http.Client, url string, msg message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(msg.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Feed-Id", msg.feedID)
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]message) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// server serves the most recently published message of each feed.
+type server struct {
+	mu     sync.RWMutex
+	latest map[string][]byte
+}
+
+func (s *server) set(feedID string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest[feedID] = body
+}
+
+func (s *server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	body, ok := s.latest[strings.TrimPrefix(r.URL.Path, "/")]
+	s.mu.RUnlock()
+	if !ok {
+		http.Error(rw, "no message for this feed yet", http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/x-protobuf")
+	rw.Write(body)
+}
@@ -0,0 +1,102 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/export"
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+type RoutesOptions struct {
+	// If non-empty, only trips from these feeds are counted. This requires the day's per-feed
+	// archives, as the combined archive does not record which feed each trip came from.
+	FeedIDs []string
+	Output  OutputFormat
+}
+
+// Routes reports the routes that ran on a processed day, with their number of trips, by reading
+// the day's stored CSV export.
+func Routes(ctx context.Context, day metadata.Day, opts RoutesOptions, sc *storage.Client) error {
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	var processedDay *metadata.ProcessedDay
+	for i := range m.ProcessedDays {
+		if m.ProcessedDays[i].Day == day {
+			processedDay = &m.ProcessedDays[i]
+			break
+		}
+	}
+	if processedDay == nil {
+		return fmt.Errorf("day %s has not been processed", day)
+	}
+	paths, err := routesArchivePaths(processedDay, opts.FeedIDs)
+	if err != nil {
+		return err
+	}
+	counts := map[string]int{}
+	for _, path := range paths {
+		b, err := sc.Read(ctx, path)
+		if err != nil {
+			return err
+		}
+		archiveCounts, err := export.RouteTripCounts(b)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		for routeID, n := range archiveCounts {
+			counts[routeID] += n
+		}
+	}
+	report := RoutesReport{
+		Day:     day,
+		FeedIDs: processedDay.Feeds,
+		Routes:  []RouteTripCount{},
+	}
+	if len(opts.FeedIDs) > 0 {
+		report.FeedIDs = opts.FeedIDs
+	}
+	for routeID, n := range counts {
+		report.Routes = append(report.Routes, RouteTripCount{RouteID: routeID, Trips: n})
+	}
+	sort.Slice(report.Routes, func(i, j int) bool {
+		return report.Routes[i].RouteID < report.Routes[j].RouteID
+	})
+	if opts.Output == OutputJson {
+		return writeJson(report)
+	}
+	fmt.Printf("%d route(s) ran on %s:\n", len(report.Routes), day)
+	for _, route := range report.Routes {
+		fmt.Printf("  %s: %d trip(s)\n", route.RouteID, route.Trips)
+	}
+	return nil
+}
+
+// routesArchivePaths returns the paths of the archives containing the trips of the feeds, or
+// of all feeds if feedIDs is empty.
+func routesArchivePaths(processedDay *metadata.ProcessedDay, feedIDs []string) ([]string, error) {
+	if len(feedIDs) == 0 {
+		return []string{processedDay.Csv.Path}, nil
+	}
+	var paths []string
+	for _, feedID := range feedIDs {
+		if !containsString(processedDay.Feeds, feedID) {
+			return nil, fmt.Errorf("day %s was not processed with feed %s (processed feeds: %v)", processedDay.Day, feedID, processedDay.Feeds)
+		}
+		found := false
+		for _, feedCsv := range processedDay.FeedCsv {
+			if feedCsv.FeedID == feedID {
+				paths = append(paths, feedCsv.Path)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("day %s has no per-feed archive for feed %s; the day must be processed with PerFeedArchives to filter by feed", processedDay.Day, feedID)
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,141 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+type StatusOptions struct {
+	// If non-nil, Status returns a BacklogTooLargeError if the backlog has more days than this.
+	MaxBacklog *int
+	Output     OutputFormat
+}
+
+// StatusReport is the output of the status command.
+type StatusReport struct {
+	GeneratedAt time.Time
+	// Most recent processed day, or null if no days have been processed.
+	LastProcessedDay *metadata.Day
+	// Number of days the backlog would process.
+	BacklogDays int
+	// Oldest day in the backlog, or null if the backlog is empty.
+	OldestPendingDay *metadata.Day
+	// Number of days in the dead-letter list.
+	FailedDays int
+	// Feeds with days in the backlog that haven't been processed with the feed, in order of feed
+	// ID. Days that are pending only because they were processed by an older version of the
+	// software, or are preliminary, don't make their feeds lag.
+	LaggingFeeds []StatusFeed
+}
+
+type StatusFeed struct {
+	FeedID string
+	// Number of days in the backlog that require the feed but weren't processed with it.
+	PendingDays int
+	// Most recent processed day that includes the feed, or null if there is none.
+	LastProcessedDay *metadata.Day
+}
+
+// BacklogTooLargeError is returned by Status when the backlog has more days than the maximum.
+type BacklogTooLargeError struct {
+	BacklogDays int
+	MaxBacklog  int
+}
+
+func (e *BacklogTooLargeError) Error() string {
+	return fmt.Sprintf("the backlog has %d day(s), more than the maximum of %d", e.BacklogDays, e.MaxBacklog)
+}
+
+// Status reports the health of the pipeline: the most recent processed day, the size of the
+// backlog and the feeds that are lagging.
+//
+// Like coverage, the report is derived from the metadata. The backlog is the one the backlog
+// command would process, without the incomplete days.
+func Status(ctx context.Context, ec *config.Config, sc *storage.Client, opts StatusOptions) error {
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	report := status(ec.ActiveFeeds(), m, ec.SkipDays, lastBacklogDay(ec))
+	if opts.Output == OutputJson {
+		if err := writeJson(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Last processed day: %s\n", formatOptionalDay(report.LastProcessedDay))
+		fmt.Printf("Backlog: %d day(s), oldest %s\n", report.BacklogDays, formatOptionalDay(report.OldestPendingDay))
+		fmt.Printf("Failed days: %d\n", report.FailedDays)
+		fmt.Printf("Lagging feeds: %d\n", len(report.LaggingFeeds))
+		for _, feed := range report.LaggingFeeds {
+			fmt.Printf("  %s: %d pending day(s), last processed %s\n", feed.FeedID, feed.PendingDays, formatOptionalDay(feed.LastProcessedDay))
+		}
+	}
+	if opts.MaxBacklog != nil && report.BacklogDays > *opts.MaxBacklog {
+		return &BacklogTooLargeError{BacklogDays: report.BacklogDays, MaxBacklog: *opts.MaxBacklog}
+	}
+	return nil
+}
+
+func status(feeds []config.Feed, m *metadata.Metadata, skipDays []config.SkipDays, lastDay metadata.Day) StatusReport {
+	report := StatusReport{
+		GeneratedAt:  time.Now().UTC(),
+		FailedDays:   len(m.FailedDays),
+		LaggingFeeds: []StatusFeed{},
+	}
+	feedToLastProcessedDay := map[string]metadata.Day{}
+	dayToFeeds := map[metadata.Day]map[string]bool{}
+	for _, processedDay := range m.ProcessedDays {
+		day := processedDay.Day
+		dayToFeeds[day] = map[string]bool{}
+		for _, feedID := range processedDay.Feeds {
+			dayToFeeds[day][feedID] = true
+		}
+		if report.LastProcessedDay == nil || report.LastProcessedDay.Before(day) {
+			report.LastProcessedDay = &day
+		}
+		for _, feedID := range processedDay.Feeds {
+			if last, ok := feedToLastProcessedDay[feedID]; !ok || last.Before(day) {
+				feedToLastProcessedDay[feedID] = day
+			}
+		}
+	}
+	pendingDays := config.CalculatePendingDays(feeds, m.ProcessedDays, skipDays, lastDay, softwareVersion)
+	pendingDays = withoutDeletedDays(pendingDays, m.DeletedDays)
+	report.BacklogDays = len(pendingDays)
+	feedToPendingDays := map[string]int{}
+	for _, pendingDay := range pendingDays {
+		day := pendingDay.Day
+		if report.OldestPendingDay == nil || day.Before(*report.OldestPendingDay) {
+			report.OldestPendingDay = &day
+		}
+		for _, feedID := range pendingDay.FeedIDs {
+			if !dayToFeeds[day][feedID] {
+				feedToPendingDays[feedID]++
+			}
+		}
+	}
+	for feedID, n := range feedToPendingDays {
+		feed := StatusFeed{FeedID: feedID, PendingDays: n}
+		if last, ok := feedToLastProcessedDay[feedID]; ok {
+			feed.LastProcessedDay = &last
+		}
+		report.LaggingFeeds = append(report.LaggingFeeds, feed)
+	}
+	sort.Slice(report.LaggingFeeds, func(i, j int) bool {
+		return report.LaggingFeeds[i].FeedID < report.LaggingFeeds[j].FeedID
+	})
+	return report
+}
+
+func formatOptionalDay(day *metadata.Day) string {
+	if day == nil {
+		return "none"
+	}
+	return day.String()
+}
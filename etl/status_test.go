@@ -0,0 +1,69 @@
+package etl
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+func TestStatus(t *testing.T) {
+	day1 := metadata.NewDay(2023, time.March, 1)
+	day2 := day1.Next()
+	day3 := day2.Next()
+	day4 := day3.Next()
+	feeds := []config.Feed{
+		{Id: "a", FirstDay: day1},
+		{Id: "b", FirstDay: day2},
+	}
+	m := &metadata.Metadata{
+		ProcessedDays: []metadata.ProcessedDay{
+			{Day: day1, Feeds: []string{"a"}, SoftwareVersion: softwareVersion},
+			// Pending: b is missing.
+			{Day: day2, Feeds: []string{"a"}, SoftwareVersion: softwareVersion},
+			// Pending only because it was processed by an older version.
+			{Day: day3, Feeds: []string{"a", "b"}, SoftwareVersion: softwareVersion - 1},
+		},
+		FailedDays: []metadata.FailedDay{{Day: day4, FeedIDs: []string{"a", "b"}}},
+	}
+
+	report := status(feeds, m, nil, day4)
+
+	if report.BacklogDays != 3 {
+		t.Errorf("BacklogDays = %d, want 3", report.BacklogDays)
+	}
+	if report.OldestPendingDay == nil || *report.OldestPendingDay != day2 {
+		t.Errorf("OldestPendingDay = %v, want %s", report.OldestPendingDay, day2)
+	}
+	if report.LastProcessedDay == nil || *report.LastProcessedDay != day3 {
+		t.Errorf("LastProcessedDay = %v, want %s", report.LastProcessedDay, day3)
+	}
+	if report.FailedDays != 1 {
+		t.Errorf("FailedDays = %d, want 1", report.FailedDays)
+	}
+	wantLaggingFeeds := []StatusFeed{
+		{FeedID: "a", PendingDays: 1, LastProcessedDay: &day3},
+		{FeedID: "b", PendingDays: 2, LastProcessedDay: &day3},
+	}
+	if !reflect.DeepEqual(report.LaggingFeeds, wantLaggingFeeds) {
+		t.Errorf("LaggingFeeds = %+v, want %+v", report.LaggingFeeds, wantLaggingFeeds)
+	}
+}
+
+func TestStatusEmptyBacklog(t *testing.T) {
+	day := metadata.NewDay(2023, time.March, 1)
+	feeds := []config.Feed{{Id: "a", FirstDay: day}}
+	m := &metadata.Metadata{
+		ProcessedDays: []metadata.ProcessedDay{
+			{Day: day, Feeds: []string{"a"}, SoftwareVersion: softwareVersion},
+		},
+	}
+
+	report := status(feeds, m, nil, day)
+
+	if report.BacklogDays != 0 || report.OldestPendingDay != nil || len(report.LaggingFeeds) != 0 {
+		t.Errorf("unexpected report for an empty backlog: %+v", report)
+	}
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// RateLimiter spaces out requests so that at most a fixed number are started per second,
+// across all of the goroutines that share it.
+//
+// A nil *RateLimiter does not limit requests.
+type RateLimiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+}
+
+// NewRateLimiter returns a limiter that allows the given number of requests per second.
+func NewRateLimiter(requestsPerSecond float64) *RateLimiter {
+	return &RateLimiter{interval: time.Duration(float64(time.Second) / requestsPerSecond)}
+}
+
+// Wait blocks until the next request may be started, or the context is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	t := l.next
+	if t.Before(now) {
+		t = now
+	}
+	l.next = t.Add(l.interval)
+	l.mu.Unlock()
+	d := time.Until(t)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Pause delays all requests that haven't started yet until d from now; e.g., to honor a
+// Retry-After header returned to any of the goroutines.
+func (l *RateLimiter) Pause(d time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.next) {
+		l.next = until
+	}
+}
+
+// RetryAfter parses the Retry-After header of a response, which is either a number of
+// seconds or an HTTP date.
+func RetryAfter(h http.Header) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// SetRateLimiter makes every request to the bucket, including retries, wait for the limiter.
+// Retry-After headers in responses pause the limiter.
+func (b *Bucket) SetRateLimiter(l *RateLimiter) {
+	if l == nil {
+		return
+	}
+	b.sc.Handlers.Send.PushFront(func(r *request.Request) {
+		// If the context is done the request fails when it is sent.
+		_ = l.Wait(r.Context())
+	})
+	b.sc.Handlers.Retry.PushFront(func(r *request.Request) {
+		if r.HTTPResponse == nil {
+			return
+		}
+		if d, ok := RetryAfter(r.HTTPResponse.Header); ok {
+			l.Pause(d)
+		}
+	})
+}
@@ -4,16 +4,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net/http"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/jamespfennell/subwaydata.nyc/etl/config"
@@ -23,86 +29,470 @@ import (
 type Client struct {
 	ec            *config.Config
 	sc            *s3.S3
+	mirrors       []mirror
+	uploads       chan struct{}
+	mirrorsWg     sync.WaitGroup
 	metadataMutex sync.RWMutex
+	statsMutex    sync.Mutex
+	metadataStats MetadataUpdateStats
+}
+
+type mirror struct {
+	name   string
+	prefix string
+	sc     *s3.S3
 }
 
 func NewClient(ec *config.Config) (*Client, error) {
+	r := newRetryer(ec.StorageRetries())
+	sc, err := newS3Client(ec.BucketUrl, ec.BucketAccessKey, ec.BucketSecretKey, r)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{ec: ec, sc: sc}
+	for _, m := range ec.Mirrors {
+		sc, err := newS3Client(m.BucketUrl, m.BucketAccessKey, m.BucketSecretKey, r)
+		if err != nil {
+			return nil, err
+		}
+		c.mirrors = append(c.mirrors, mirror{
+			name:   m.BucketName,
+			prefix: m.BucketPrefix,
+			sc:     sc,
+		})
+	}
+	if ec.MaxConcurrentUploads > 0 {
+		c.uploads = make(chan struct{}, ec.MaxConcurrentUploads)
+	}
+	return c, nil
+}
+
+// newRetryer returns a retryer that retries transient failures of requests with exponential
+// backoff and jitter. Requests that fail with a 4xx response, other than 429, are not retried.
+func newRetryer(maxRetries int, baseBackoff time.Duration) request.Retryer {
+	return client.DefaultRetryer{
+		NumMaxRetries:    maxRetries,
+		MinRetryDelay:    baseBackoff,
+		MinThrottleDelay: baseBackoff,
+		MaxRetryDelay:    maxRetryDelay,
+		MaxThrottleDelay: maxRetryDelay,
+	}
+}
+
+// maxRetryDelay is the maximum delay between retries of a request to object storage.
+const maxRetryDelay = 30 * time.Second
+
+func newS3Client(url, accessKey, secretKey string, retryer request.Retryer) (*s3.S3, error) {
 	s3Config := &aws.Config{
-		Credentials: credentials.NewStaticCredentials(ec.BucketAccessKey, ec.BucketSecretKey, ""),
-		Endpoint:    aws.String(ec.BucketUrl),
+		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
+		Endpoint:    aws.String(url),
 		Region:      aws.String("us-east-1"),
 	}
+	request.WithRetryer(s3Config, retryer)
 
 	newSession, err := session.NewSession(s3Config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize object storage client: %w", err)
 	}
-	return &Client{ec: ec, sc: s3.New(newSession)}, nil
+	return s3.New(newSession), nil
 }
 
+// Write writes the bytes to the primary bucket and all mirrors.
+//
+// Write returns once the write to the primary bucket has completed. Writes to mirrors
+// continue in the background; use WaitForMirrors to wait for them to finish.
 func (c *Client) Write(ctx context.Context, b []byte, remotePath string) error {
+	c.writeMirrors(ctx, b, remotePath)
+	if err := c.put(ctx, c.sc, c.ec.BucketName, filepath.Join(c.ec.BucketPrefix, remotePath), b); err != nil {
+		return fmt.Errorf("failed to copy bytes to object storage: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) writeMirrors(ctx context.Context, b []byte, remotePath string) {
+	for _, m := range c.mirrors {
+		m := m
+		c.mirrorsWg.Add(1)
+		go func() {
+			defer c.mirrorsWg.Done()
+			if err := c.put(context.WithoutCancel(ctx), m.sc, m.name, filepath.Join(m.prefix, remotePath), b); err != nil {
+				log.Printf("Warning: failed to copy %s to mirror bucket %s: %s", remotePath, m.name, err)
+			}
+		}()
+	}
+}
+
+// WaitForMirrors waits for all in-progress writes to mirrors to finish.
+func (c *Client) WaitForMirrors() {
+	c.mirrorsWg.Wait()
+}
+
+// Delete deletes the object at the remote path from the primary bucket and all mirrors.
+func (c *Client) Delete(ctx context.Context, remotePath string) error {
 	ctx, cancel := context.WithDeadline(ctx, time.Now().UTC().Add(5*60*time.Second))
 	defer cancel()
-	object := s3.PutObjectInput{
+	for _, m := range c.mirrors {
+		if _, err := m.sc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(m.name),
+			Key:    aws.String(filepath.Join(m.prefix, remotePath)),
+		}); err != nil {
+			log.Printf("Warning: failed to delete %s from mirror bucket %s: %s", remotePath, m.name, err)
+		}
+	}
+	if _, err := c.sc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.ec.BucketName),
+		Key:    aws.String(filepath.Join(c.ec.BucketPrefix, remotePath)),
+	}); err != nil {
+		return fmt.Errorf("failed to delete %s from object storage: %w", remotePath, err)
+	}
+	return nil
+}
+
+// Read reads the object at the remote path from the primary bucket.
+func (c *Client) Read(ctx context.Context, remotePath string) ([]byte, error) {
+	ctx, cancel := context.WithDeadline(ctx, time.Now().UTC().Add(5*60*time.Second))
+	defer cancel()
+	o, err := c.sc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.ec.BucketName),
+		Key:    aws.String(filepath.Join(c.ec.BucketPrefix, remotePath)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from object storage: %w", remotePath, err)
+	}
+	defer o.Body.Close()
+	return io.ReadAll(o.Body)
+}
+
+// Exists returns whether an object exists at the remote path in the primary bucket.
+func (c *Client) Exists(ctx context.Context, remotePath string) (bool, error) {
+	ctx, cancel := context.WithDeadline(ctx, time.Now().UTC().Add(60*time.Second))
+	defer cancel()
+	_, err := c.sc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(c.ec.BucketName),
 		Key:    aws.String(filepath.Join(c.ec.BucketPrefix, remotePath)),
-		Body:   bytes.NewReader(b),
-		ACL:    aws.String("public-read"),
+	})
+	if err != nil {
+		if a, ok := err.(awserr.RequestFailure); ok && a.StatusCode() == 404 {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check for %s in object storage: %w", remotePath, err)
+	}
+	return true, nil
+}
+
+// Object describes an object in the primary bucket.
+type Object struct {
+	// Path of the object relative to the bucket prefix; i.e., the remote path passed to Write.
+	Path         string
+	Size         int64
+	LastModified time.Time
+}
+
+// List lists all objects in the primary bucket whose remote path starts with the prefix.
+func (c *Client) List(ctx context.Context, prefix string) ([]Object, error) {
+	ctx, cancel := context.WithDeadline(ctx, time.Now().UTC().Add(5*60*time.Second))
+	defer cancel()
+	bucketPrefix := c.ec.BucketPrefix
+	if bucketPrefix != "" {
+		bucketPrefix += "/"
+	}
+	var objects []Object
+	if err := c.sc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.ec.BucketName),
+		Prefix: aws.String(bucketPrefix + prefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, o := range page.Contents {
+			objects = append(objects, Object{
+				Path:         strings.TrimPrefix(aws.StringValue(o.Key), bucketPrefix),
+				Size:         aws.Int64Value(o.Size),
+				LastModified: aws.TimeValue(o.LastModified),
+			})
+		}
+		return true
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list objects in object storage: %w", err)
+	}
+	return objects, nil
+}
+
+func (c *Client) put(ctx context.Context, sc *s3.S3, bucket, key string, b []byte, opts ...request.Option) error {
+	if c.uploads != nil {
+		c.uploads <- struct{}{}
+		defer func() { <-c.uploads }()
+	}
+	ctx, cancel := context.WithDeadline(ctx, time.Now().UTC().Add(5*60*time.Second))
+	defer cancel()
+	// Objects are always fully in memory before they are uploaded, so the size is known and is
+	// sent explicitly rather than left to the SDK, for backends that require Content-Length.
+	object := s3.PutObjectInput{
+		Bucket:        aws.String(bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(b),
+		ContentLength: aws.Int64(int64(len(b))),
+		ACL:           aws.String("public-read"),
+	}
+	if identity, ok := c.ec.WriterIdentity(); ok {
+		object.Metadata = map[string]*string{"Written-By": aws.String(identity)}
+	}
+	_, err := sc.PutObjectWithContext(ctx, &object, opts...)
+	return err
+}
+
+// ErrMetadataConflict is returned when a conditional write of a metadata file fails because
+// the file changed since it was read.
+var ErrMetadataConflict = errors.New("metadata was modified concurrently")
+
+// writeMetadataFile writes a metadata file to the primary bucket and all mirrors.
+//
+// If conditional writes are enabled the write to the primary bucket only succeeds if the file's
+// ETag is still etag, or if the file still doesn't exist when etag is empty. Mirrors are
+// written unconditionally after the primary write succeeds.
+func (c *Client) writeMetadataFile(ctx context.Context, b []byte, remotePath, etag string) error {
+	if !c.ec.MetadataConditionalWrites {
+		return c.Write(ctx, b, remotePath)
+	}
+	header := map[string]string{"If-Match": etag}
+	if etag == "" {
+		header = map[string]string{"If-None-Match": "*"}
 	}
-	_, err := c.sc.PutObjectWithContext(ctx, &object)
+	err := c.put(ctx, c.sc, c.ec.BucketName, filepath.Join(c.ec.BucketPrefix, remotePath), b,
+		request.WithSetRequestHeaders(header))
 	if err != nil {
+		if a, ok := err.(awserr.RequestFailure); ok && (a.StatusCode() == http.StatusPreconditionFailed || a.StatusCode() == http.StatusConflict) {
+			return fmt.Errorf("failed to write %s: %w", remotePath, ErrMetadataConflict)
+		}
 		return fmt.Errorf("failed to copy bytes to object storage: %w", err)
 	}
+	c.writeMirrors(ctx, b, remotePath)
 	return nil
 }
 
+// GetMetadata reads the metadata. If the metadata is sharded, the shards are read and combined.
 func (c *Client) GetMetadata(ctx context.Context) (*metadata.Metadata, error) {
+	m, _, _, err := c.getMetadata(ctx)
+	return m, err
+}
+
+// getMetadata reads the metadata and also returns whether it is sharded and the ETags of the
+// metadata files that exist, keyed by remote path.
+func (c *Client) getMetadata(ctx context.Context) (*metadata.Metadata, bool, map[string]string, error) {
 	c.metadataMutex.RLock()
 	defer c.metadataMutex.RUnlock()
+	etags := map[string]string{}
+	m, etag, err := c.readMetadataFile(ctx, c.ec.MetadataPath)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	etags[c.ec.MetadataPath] = etag
+	sharded := len(m.Shards) > 0
+	var shards []metadata.Metadata
+	for _, name := range m.Shards {
+		shardPath := metadata.ShardPath(c.ec.MetadataPath, name)
+		shard, etag, err := c.readMetadataFile(ctx, shardPath)
+		if err != nil {
+			return nil, false, nil, fmt.Errorf("failed to read metadata shard %s: %w", name, err)
+		}
+		etags[shardPath] = etag
+		shards = append(shards, *shard)
+	}
+	metadata.Combine(m, shards)
+	return m, sharded, etags, nil
+}
+
+// readMetadataFile reads a metadata file and its ETag. If the file doesn't exist, empty
+// metadata and an empty ETag are returned.
+func (c *Client) readMetadataFile(ctx context.Context, remotePath string) (*metadata.Metadata, string, error) {
 	ctx, cancel := context.WithDeadline(ctx, time.Now().UTC().Add(5*60*time.Second))
 	defer cancel()
 	o, err := c.sc.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(c.ec.BucketName),
-		Key:    aws.String(filepath.Join(c.ec.BucketPrefix, c.ec.MetadataPath)),
+		Key:    aws.String(filepath.Join(c.ec.BucketPrefix, remotePath)),
 	})
 	if err != nil {
 		if a, ok := err.(awserr.Error); ok {
 			if a.Code() == s3.ErrCodeNoSuchKey {
-				return &metadata.Metadata{}, nil
+				return &metadata.Metadata{}, "", nil
 			}
 		}
+		return nil, "", err
 	}
 	defer o.Body.Close()
 	b, err := io.ReadAll(o.Body)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	var m metadata.Metadata
 	if err := json.Unmarshal(b, &m); err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return &m, nil
+	return &m, aws.StringValue(o.ETag), nil
 }
 
 type UpdateMetadataFunc func(*metadata.Metadata) bool
 
+// Maximum number of times UpdateMetadata reads and writes the metadata if conditional writes
+// keep failing because of concurrent updates.
+const maxMetadataUpdateAttempts = 5
+
+// MetadataUpdateStats are cumulative counts and durations of the metadata updates made by a
+// client, for deciding whether updates are a bottleneck.
+type MetadataUpdateStats struct {
+	// Number of calls to UpdateMetadata, including ones where nothing was written.
+	Updates int
+	// Number of updates that wrote the metadata.
+	Commits int
+	// Number of attempts that were retried after a conflict.
+	Conflicts int
+	// Number of metadata files written.
+	FilesWritten int
+	// Time spent reading the metadata, applying updates and writing the metadata.
+	ReadDuration   time.Duration
+	UpdateDuration time.Duration
+	WriteDuration  time.Duration
+}
+
+// metadataUpdateTiming is the time taken by each step of a single metadata update attempt.
+type metadataUpdateTiming struct {
+	read, update, write time.Duration
+	committed           bool
+	filesWritten        int
+}
+
+// MetadataUpdateStats returns the statistics of all metadata updates made by the client so far.
+func (c *Client) MetadataUpdateStats() MetadataUpdateStats {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	return c.metadataStats
+}
+
+func (c *Client) recordMetadataUpdate(attempts []metadataUpdateTiming) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	c.metadataStats.Updates++
+	c.metadataStats.Conflicts += len(attempts) - 1
+	for _, t := range attempts {
+		c.metadataStats.ReadDuration += t.read
+		c.metadataStats.UpdateDuration += t.update
+		c.metadataStats.WriteDuration += t.write
+		c.metadataStats.FilesWritten += t.filesWritten
+	}
+	if attempts[len(attempts)-1].committed {
+		c.metadataStats.Commits++
+	}
+}
+
 // UpdateMetadata updates the metadata stored in the object storage.
+//
+// If the config enables metadata sharding, only the shards whose contents changed are written,
+// and the index file is only written if the list of shards or the rest of the metadata changed.
+//
+// If the config enables conditional metadata writes, each file is only written if it hasn't
+// changed since it was read. On a conflict the metadata is read again and f is applied again,
+// so f may be called more than once.
+//
+// The time taken by each update is logged, along with the number of attempts it needed.
 func (c *Client) UpdateMetadata(ctx context.Context, f UpdateMetadataFunc) error {
-	m, err := c.GetMetadata(ctx)
+	startedAt := time.Now()
+	var attempts []metadataUpdateTiming
+	for attempt := 1; ; attempt++ {
+		var timing metadataUpdateTiming
+		err := c.updateMetadata(ctx, f, &timing)
+		attempts = append(attempts, timing)
+		if !errors.Is(err, ErrMetadataConflict) || attempt == maxMetadataUpdateAttempts {
+			c.recordMetadataUpdate(attempts)
+			if timing.committed && err == nil {
+				log.Printf("Updated metadata in %s (attempts: %d, read: %s, update: %s, write: %s, files written: %d)",
+					time.Since(startedAt).Round(time.Millisecond), attempt, timing.read.Round(time.Millisecond),
+					timing.update.Round(time.Millisecond), timing.write.Round(time.Millisecond), timing.filesWritten)
+			}
+			return err
+		}
+		log.Printf("Retrying metadata update after conflict (attempt %d of %d): %s", attempt, maxMetadataUpdateAttempts, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+}
+
+func (c *Client) updateMetadata(ctx context.Context, f UpdateMetadataFunc, timing *metadataUpdateTiming) error {
+	readStartedAt := time.Now()
+	m, sharded, etags, err := c.getMetadata(ctx)
+	timing.read = time.Since(readStartedAt)
 	if err != nil {
 		return err
 	}
+	updateStartedAt := time.Now()
 	c.metadataMutex.Lock()
 	defer c.metadataMutex.Unlock()
+	// If the stored metadata is not sharded yet, all of the files are written.
+	var oldFiles map[string][]byte
+	if sharded {
+		sort.Sort(sort.Reverse(byDay(m.ProcessedDays)))
+		oldFiles, err = c.metadataFiles(m)
+		if err != nil {
+			return err
+		}
+	}
 	if commit := f(m); !commit {
+		timing.update = time.Since(updateStartedAt)
 		return nil
 	}
 	sort.Sort(sort.Reverse(byDay(m.ProcessedDays)))
-	b, err := json.MarshalIndent(m, "", "  ")
+	newFiles, err := c.metadataFiles(m)
 	if err != nil {
 		return err
 	}
-	return c.Write(ctx, b, c.ec.MetadataPath)
+	// Shards are written before the index so that the index never references a missing shard.
+	var paths []string
+	for remotePath := range newFiles {
+		if remotePath != c.ec.MetadataPath {
+			paths = append(paths, remotePath)
+		}
+	}
+	sort.Strings(paths)
+	paths = append(paths, c.ec.MetadataPath)
+	timing.update = time.Since(updateStartedAt)
+	writeStartedAt := time.Now()
+	defer func() { timing.write = time.Since(writeStartedAt) }()
+	for _, remotePath := range paths {
+		b := newFiles[remotePath]
+		if !c.ec.ShardMetadata || !bytes.Equal(b, oldFiles[remotePath]) {
+			if err := c.writeMetadataFile(ctx, b, remotePath, etags[remotePath]); err != nil {
+				return err
+			}
+			timing.filesWritten++
+		}
+	}
+	timing.committed = true
+	return nil
+}
+
+// metadataFiles returns the contents of the metadata files keyed by remote path.
+func (c *Client) metadataFiles(m *metadata.Metadata) (map[string][]byte, error) {
+	if !c.ec.ShardMetadata {
+		b, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{c.ec.MetadataPath: b}, nil
+	}
+	index, shards := metadata.Shard(m, c.ec.MetadataPath)
+	files := map[string][]byte{}
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	files[c.ec.MetadataPath] = b
+	for name, shard := range shards {
+		b, err := json.MarshalIndent(shard, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		files[metadata.ShardPath(c.ec.MetadataPath, name)] = b
+	}
+	return files, nil
 }
 
 type byDay []metadata.ProcessedDay
@@ -118,3 +508,66 @@ func (b byDay) Swap(i, j int) {
 func (b byDay) Less(i, j int) bool {
 	return b[i].Day.Before(b[j].Day)
 }
+
+// Bucket provides read access to an arbitrary bucket, such as the bucket Hoard stores data in.
+type Bucket struct {
+	name string
+	sc   *s3.S3
+}
+
+func NewBucket(url, accessKey, secretKey, name string) (*Bucket, error) {
+	sc, err := newS3Client(url, accessKey, secretKey, newRetryer(config.DefaultMaxRetries, config.DefaultBaseBackoff))
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{name: name, sc: sc}, nil
+}
+
+// Exists returns whether an object with the key exists in the bucket.
+func (b *Bucket) Exists(ctx context.Context, key string) (bool, error) {
+	ctx, cancel := context.WithDeadline(ctx, time.Now().UTC().Add(60*time.Second))
+	defer cancel()
+	_, err := b.sc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if a, ok := err.(awserr.RequestFailure); ok && a.StatusCode() == 404 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// List returns the keys of the objects in the bucket that start with the prefix.
+func (b *Bucket) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	if err := b.sc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.name),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, o := range page.Contents {
+			keys = append(keys, aws.StringValue(o.Key))
+		}
+		return true
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list %s in object storage: %w", prefix, err)
+	}
+	return keys, nil
+}
+
+// Read reads the object with the key.
+func (b *Bucket) Read(ctx context.Context, key string) ([]byte, error) {
+	ctx, cancel := context.WithDeadline(ctx, time.Now().UTC().Add(5*60*time.Second))
+	defer cancel()
+	o, err := b.sc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from object storage: %w", key, err)
+	}
+	defer o.Body.Close()
+	return io.ReadAll(o.Body)
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/config"
+)
+
+func TestRetries(t *testing.T) {
+	testCases := []struct {
+		name         string
+		statusCodes  []int
+		wantRequests int32
+		wantErr      bool
+	}{
+		{"server errors are retried", []int{500, 500, 200}, 3, false},
+		{"too many server errors", []int{500, 500, 500, 500}, 4, true},
+		{"forbidden is not retried", []int{403, 200}, 1, true},
+		{"not found is not retried", []int{404, 200}, 1, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var numRequests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := atomic.AddInt32(&numRequests, 1) - 1
+				statusCode := tc.statusCodes[len(tc.statusCodes)-1]
+				if int(i) < len(tc.statusCodes) {
+					statusCode = tc.statusCodes[i]
+				}
+				w.WriteHeader(statusCode)
+				if statusCode == http.StatusOK {
+					w.Write([]byte("content"))
+				}
+			}))
+			defer server.Close()
+			sc, err := newS3Client(server.URL, "access-key", "secret-key", newRetryer(3, time.Millisecond))
+			if err != nil {
+				t.Fatalf("failed to create client: %s", err)
+			}
+			// The bucket name isn't a valid host name, so the client puts it in the path instead of
+			// in the host name of the test server.
+			c := &Client{ec: &config.Config{BucketName: "test_bucket"}, sc: sc}
+
+			b, err := c.Read(context.Background(), "path")
+
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Read succeeded, want an error")
+				}
+			} else if err != nil {
+				t.Errorf("Read failed: %s", err)
+			} else if string(b) != "content" {
+				t.Errorf("Read returned %q, want %q", b, "content")
+			}
+			if got := atomic.LoadInt32(&numRequests); got != tc.wantRequests {
+				t.Errorf("server received %d requests, want %d", got, tc.wantRequests)
+			}
+		})
+	}
+}
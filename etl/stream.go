@@ -0,0 +1,46 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl/export"
+	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+// Stream downloads the stored CSV export of the day and writes its trips to stdout as NDJSON.
+//
+// The CSV files do not record which feed each trip came from, so feedIDs can't be used to
+// filter trips. Instead, an error is returned if the day was not processed with all of the feeds.
+func Stream(ctx context.Context, day metadata.Day, feedIDs []string, sc *storage.Client) error {
+	m, err := sc.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	var processedDay *metadata.ProcessedDay
+	for i := range m.ProcessedDays {
+		if m.ProcessedDays[i].Day == day {
+			processedDay = &m.ProcessedDays[i]
+			break
+		}
+	}
+	if processedDay == nil {
+		return fmt.Errorf("day %s has not been processed", day)
+	}
+	for _, feedID := range feedIDs {
+		found := false
+		for _, processedFeedID := range processedDay.Feeds {
+			found = found || processedFeedID == feedID
+		}
+		if !found {
+			return fmt.Errorf("day %s was not processed with feed %s (processed feeds: %v)", day, feedID, processedDay.Feeds)
+		}
+	}
+	b, err := sc.Read(ctx, processedDay.Csv.Path)
+	if err != nil {
+		return err
+	}
+	return export.WriteNdjson(b, os.Stdout)
+}
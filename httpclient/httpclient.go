@@ -0,0 +1,139 @@
+// Package httpclient builds the HTTP clients used to fetch configs and metadata.
+package httpclient
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options configures an HTTP client.
+type Options struct {
+	// URL of the proxy to send all requests through. If empty, the standard HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables are used.
+	Proxy string
+
+	// Timeout for each request, including reading the response body. Zero means no timeout.
+	Timeout time.Duration
+
+	// Whether to skip verification of TLS certificates. This should only be used with
+	// proxies that intercept TLS traffic and whose certificate can't be installed.
+	InsecureSkipVerify bool
+
+	// User-Agent header sent with every request. If empty, Go's default is used.
+	UserAgent string
+
+	// If non-nil, called on every request before it is sent; e.g., to add authentication headers.
+	Signer Signer
+}
+
+// Signer modifies a request before it is sent.
+type Signer func(r *http.Request) error
+
+// Headers set by the HMAC signer.
+const (
+	DefaultSignatureHeader = "X-Signature"
+	TimestampHeader        = "X-Signature-Timestamp"
+)
+
+// NewHmacSigner returns a signer that authenticates requests using an HMAC-SHA256 of the request
+// with the secret.
+//
+// The signed message is the method, the URL and the Unix timestamp of the request, separated by
+// newlines. The timestamp is sent in the X-Signature-Timestamp header and the hex-encoded signature
+// in the provided header, or X-Signature if empty.
+func NewHmacSigner(secret string, header string) Signer {
+	if header == "" {
+		header = DefaultSignatureHeader
+	}
+	return func(r *http.Request) error {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		r.Header.Set(TimestampHeader, timestamp)
+		r.Header.Set(header, Sign(secret, r.Method, r.URL.String(), timestamp))
+		return nil
+	}
+}
+
+// Sign computes the hex-encoded HMAC-SHA256 signature used by NewHmacSigner.
+func Sign(secret, method, url, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + url + "\n" + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// transport sets the User-Agent and signs requests before passing them to the base transport.
+type transport struct {
+	base      http.RoundTripper
+	userAgent string
+	signer    Signer
+}
+
+func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the original request.
+	r = r.Clone(r.Context())
+	if t.userAgent != "" {
+		r.Header.Set("User-Agent", t.userAgent)
+	}
+	if t.signer != nil {
+		if err := t.signer(r); err != nil {
+			return nil, fmt.Errorf("failed to sign request: %w", err)
+		}
+	}
+	return t.base.RoundTrip(r)
+}
+
+// New builds a new HTTP client.
+func New(opts Options) (*http.Client, error) {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.Proxy = http.ProxyFromEnvironment
+	if opts.Proxy != "" {
+		proxyUrl, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy URL %q: %w", opts.Proxy, err)
+		}
+		base.Proxy = http.ProxyURL(proxyUrl)
+	}
+	if opts.InsecureSkipVerify {
+		base.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	var rt http.RoundTripper = base
+	if opts.UserAgent != "" || opts.Signer != nil {
+		rt = &transport{
+			base:      base,
+			userAgent: opts.UserAgent,
+			signer:    opts.Signer,
+		}
+	}
+	return &http.Client{
+		Transport: rt,
+		Timeout:   opts.Timeout,
+	}, nil
+}
+
+// IsUrl returns whether the location is an HTTP or HTTPS URL, rather than a path on disk.
+func IsUrl(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// Get fetches the URL and returns the body of the response.
+//
+// An error is returned if the response status is not 200 OK.
+func Get(client *http.Client, url string) ([]byte, error) {
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
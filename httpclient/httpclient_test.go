@@ -0,0 +1,38 @@
+package httpclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserAgentAndSigning(t *testing.T) {
+	secret := "secret"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("User-Agent"); got != "test-agent" {
+			t.Errorf("User-Agent = %q, want %q", got, "test-agent")
+		}
+		url := "http://" + r.Host + r.URL.String()
+		want := Sign(secret, r.Method, url, r.Header.Get(TimestampHeader))
+		if got := r.Header.Get("X-Custom-Signature"); got != want {
+			t.Errorf("signature = %q, want %q", got, want)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client, err := New(Options{
+		UserAgent: "test-agent",
+		Signer:    NewHmacSigner(secret, "X-Custom-Signature"),
+	})
+	if err != nil {
+		t.Fatalf("failed to build client: %s", err)
+	}
+	b, err := Get(client, server.URL+"/metadata.json?a=b")
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	if string(b) != "ok" {
+		t.Errorf("Get() = %q, want %q", b, "ok")
+	}
+}
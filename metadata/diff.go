@@ -0,0 +1,110 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// Changes is the difference between the processed days of two versions of the metadata.
+type Changes struct {
+	// Days that are only in the new metadata, in order of day.
+	Added []ProcessedDay
+	// Days that are only in the old metadata, in order of day.
+	Removed []ProcessedDay
+	// Days that are in both but whose entries differ, in order of day.
+	Changed []DayDiff
+}
+
+// DayDiff is the difference between the old and new entries of a processed day.
+type DayDiff struct {
+	Day Day
+	// Fields of the entry that differ, in the order they are declared in ProcessedDay.
+	Fields []FieldDiff
+}
+
+// FieldDiff is the old and new values of a field of a processed day, in their JSON encodings.
+// A value is null if the field is empty and omitted from the metadata.
+type FieldDiff struct {
+	Field string
+	Old   json.RawMessage
+	New   json.RawMessage
+}
+
+// Empty returns whether the two versions of the metadata have the same processed days.
+func (d *Changes) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Diff returns the difference between the processed days of the old and new metadata.
+//
+// Fields are compared by their JSON encodings, so the diff reflects exactly what changed in
+// the metadata file.
+func Diff(old, new *Metadata) (Changes, error) {
+	oldDays := map[Day]*ProcessedDay{}
+	for i := range old.ProcessedDays {
+		oldDays[old.ProcessedDays[i].Day] = &old.ProcessedDays[i]
+	}
+	newDays := map[Day]*ProcessedDay{}
+	for i := range new.ProcessedDays {
+		newDays[new.ProcessedDays[i].Day] = &new.ProcessedDays[i]
+	}
+	var d Changes
+	for day, oldDay := range oldDays {
+		if _, ok := newDays[day]; !ok {
+			d.Removed = append(d.Removed, *oldDay)
+		}
+	}
+	for day, newDay := range newDays {
+		oldDay, ok := oldDays[day]
+		if !ok {
+			d.Added = append(d.Added, *newDay)
+			continue
+		}
+		fields, err := diffProcessedDays(oldDay, newDay)
+		if err != nil {
+			return Changes{}, err
+		}
+		if len(fields) > 0 {
+			d.Changed = append(d.Changed, DayDiff{Day: day, Fields: fields})
+		}
+	}
+	sort.Slice(d.Added, func(i, j int) bool { return d.Added[i].Day.Before(d.Added[j].Day) })
+	sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].Day.Before(d.Removed[j].Day) })
+	sort.Slice(d.Changed, func(i, j int) bool { return d.Changed[i].Day.Before(d.Changed[j].Day) })
+	return d, nil
+}
+
+func diffProcessedDays(old, new *ProcessedDay) ([]FieldDiff, error) {
+	var fields []FieldDiff
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(new).Elem()
+	t := oldValue.Type()
+	for i := 0; i < t.NumField(); i++ {
+		oldField, err := encodeField(oldValue.Field(i))
+		if err != nil {
+			return nil, err
+		}
+		newField, err := encodeField(newValue.Field(i))
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(oldField, newField) {
+			continue
+		}
+		fields = append(fields, FieldDiff{
+			Field: t.Field(i).Name,
+			Old:   oldField,
+			New:   newField,
+		})
+	}
+	return fields, nil
+}
+
+func encodeField(v reflect.Value) (json.RawMessage, error) {
+	if v.IsZero() {
+		return json.RawMessage("null"), nil
+	}
+	return json.Marshal(v.Interface())
+}
@@ -8,6 +8,48 @@ import (
 
 type Metadata struct {
 	ProcessedDays []ProcessedDay
+	// Days that are deliberately never processed.
+	SkippedDays []SkippedDay `json:",omitempty"`
+	// File names of the shards containing the processed days, relative to the directory of this file.
+	// If non-empty, ProcessedDays is empty and the processed days are split by year across the shards.
+	Shards []string `json:",omitempty"`
+	// Days whose most recent processing attempt failed; the dead-letter list.
+	FailedDays []FailedDay `json:",omitempty"`
+	// Names displayed in place of feed IDs, keyed by feed ID.
+	FeedNames map[string]string `json:",omitempty"`
+	// Days that were processed and then intentionally deleted, most recent first. A day is
+	// removed from this list if it is processed again.
+	DeletedDays []DeletedDay `json:",omitempty"`
+}
+
+// DeletedDay is a tombstone recording that a processed day was intentionally deleted.
+type DeletedDay struct {
+	Day Day
+	// Feeds the day was processed with.
+	Feeds   []string
+	Deleted time.Time
+	Reason  string `json:",omitempty"`
+}
+
+// FailedDay records a day that failed to process, so that it can be run again once the cause
+// is fixed.
+type FailedDay struct {
+	Day     Day
+	FeedIDs []string
+	// Sanitized description of the error returned by the most recent attempt. The full error is
+	// only in the logs of the run.
+	Error string
+	// Number of consecutive attempts that failed.
+	Attempts    int
+	LastAttempt time.Time
+	// Whether the most recent attempt failed because of a problem with the data, such as an
+	// archive exceeding the maximum size, that should be looked at before the day is rerun.
+	NeedsReview bool `json:",omitempty"`
+}
+
+type SkippedDay struct {
+	Day    Day
+	Reason string
 }
 
 type Day struct {
@@ -23,6 +65,96 @@ type ProcessedDay struct {
 	SoftwareVersion int
 	Csv             Artifact
 	Gtfsrt          Artifact
+	// Uncompressed tar archive of the CSV files. Only present if the pipeline
+	// was configured to upload it.
+	CsvUncompressed *Artifact `json:",omitempty"`
+	// CSV archives containing the trips of a single feed, in order of feed ID. Only present if
+	// the pipeline was configured to upload them; Csv always contains the trips of all feeds.
+	FeedCsv []FeedArtifact `json:",omitempty"`
+	// CSV archive of the trips that changed since the previous version of the day. Only present
+	// if the pipeline was configured to upload it and the day had been processed before.
+	ChangesCsv *ChangesArtifact `json:",omitempty"`
+	// Whether the day was processed before it was complete, in which case the
+	// data is partial and the day will be processed again.
+	Preliminary bool `json:",omitempty"`
+	// Whether the GTFS-RT archive has been deleted from object storage under the
+	// retention policy. Pruned days are not reprocessed.
+	GtfsrtPruned bool `json:",omitempty"`
+	// Statistics about the trips and stop times filtered out of the CSV export.
+	ExportStats *ExportStats `json:",omitempty"`
+	// Wall-clock time it took to process the day, in seconds.
+	ProcessingSeconds float64 `json:",omitempty"`
+	// Whether the day failed the completeness check and its data should be reviewed before use.
+	// The day is still published.
+	NeedsReview bool `json:",omitempty"`
+	// Periods of the service day with no messages from a feed that are longer than the configured
+	// threshold.
+	MessageGaps []MessageGap `json:",omitempty"`
+}
+
+// MessageGap is a period in which a feed has no GTFS-RT messages.
+type MessageGap struct {
+	FeedID string
+	// Time of the last message before the gap, or the start of the service day.
+	Start time.Time
+	// Time of the first message after the gap, or the end of the service day.
+	End time.Time
+}
+
+// ExportStats records how many trips and stop times were in the input to the export
+// and in the output, and why data was dropped.
+type ExportStats struct {
+	TripsIn      int
+	TripsOut     int
+	StopTimesIn  int
+	StopTimesOut int
+	// Map from feed ID to the number of trips of the feed in the output. Not present for days
+	// exported before it was recorded.
+	FeedTripsOut map[string]int `json:",omitempty"`
+	// Map from drop reason to the number of trips or stop times dropped for that reason.
+	Dropped map[string]int `json:",omitempty"`
+	// Map from data quality issue to the number of trips with that issue. Flagged trips are
+	// exported unless they are also dropped.
+	Flagged map[string]int `json:",omitempty"`
+}
+
+// Drop records that n trips or stop times were dropped for the reason.
+func (s *ExportStats) Drop(reason string, n int) {
+	if n == 0 {
+		return
+	}
+	if s.Dropped == nil {
+		s.Dropped = map[string]int{}
+	}
+	s.Dropped[reason] += n
+}
+
+// Flag records that n trips have the data quality issue.
+func (s *ExportStats) Flag(issue string, n int) {
+	if n == 0 {
+		return
+	}
+	if s.Flagged == nil {
+		s.Flagged = map[string]int{}
+	}
+	s.Flagged[issue] += n
+}
+
+// FeedArtifact is an artifact containing the data of a single feed.
+type FeedArtifact struct {
+	FeedID string
+	Artifact
+}
+
+// ChangesArtifact is an archive of the trips that were added, removed or changed relative to a
+// previous version of a day.
+type ChangesArtifact struct {
+	Artifact
+	// Creation time of the previous version.
+	Since   time.Time
+	Added   int
+	Removed int
+	Changed int
 }
 
 type Artifact struct {
@@ -39,6 +171,16 @@ func NewDay(year int, month time.Month, day int) Day {
 	return d
 }
 
+// DayOf returns the day containing the provided time, in the time's location.
+func DayOf(t time.Time) Day {
+	y, m, d := t.Date()
+	return Day{
+		year:  y,
+		month: m,
+		day:   d,
+	}
+}
+
 func ParseDay(s string) (Day, error) {
 	t, err := time.Parse("2006-01-02", s)
 	if err != nil {
@@ -84,10 +226,16 @@ func (d Day) Format(layout string) string {
 	return time.Date(d.year, d.month, d.day, 12, 0, 0, 0, time.UTC).Format(layout)
 }
 
+// Start returns the midnight at the start of the day in the location.
+//
+// The day runs from Start to End, which is the next day's midnight. On days with a DST
+// transition this is not 24 hours: e.g., in New York the spring-forward day is 23 hours
+// and the fall-back day is 25 hours.
 func (d Day) Start(loc *time.Location) time.Time {
 	return time.Date(d.year, d.month, d.day, 0, 0, 0, 0, loc)
 }
 
+// End returns the midnight at the end of the day in the location. See Start.
 func (d Day) End(loc *time.Location) time.Time {
 	return time.Date(d.year, d.month, d.day+1, 0, 0, 0, 0, loc)
 }
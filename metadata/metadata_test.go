@@ -3,7 +3,9 @@ package metadata
 import (
 	_ "embed"
 	"encoding/json"
+	"reflect"
 	"testing"
+	"time"
 )
 
 //go:embed nycsubway.json
@@ -22,3 +24,114 @@ func TestSerializeRoundTrip(t *testing.T) {
 		t.Errorf("re-written metadata doesn't match original. Original\n%s\nRe-Written:\n%s", sampleConfig, string(b))
 	}
 }
+
+func TestShardRoundTrip(t *testing.T) {
+	var m Metadata
+	if err := json.Unmarshal([]byte(sampleConfig), &m); err != nil {
+		t.Fatalf("failed to parse metadata: %s", err)
+	}
+	index, shards := Shard(&m, "data/subwaydatanyc_metadata.json")
+	if len(index.ProcessedDays) != 0 {
+		t.Errorf("index contains %d processed days, want 0", len(index.ProcessedDays))
+	}
+	var orderedShards []Metadata
+	for _, name := range index.Shards {
+		shard, ok := shards[name]
+		if !ok {
+			t.Fatalf("index references shard %s which was not returned", name)
+		}
+		for _, processedDay := range shard.ProcessedDays {
+			if want := ShardName("subwaydatanyc_metadata.json", processedDay.Day.YearString()); name != want {
+				t.Errorf("day %s is in shard %s, want %s", processedDay.Day, name, want)
+			}
+		}
+		orderedShards = append(orderedShards, shard)
+	}
+	Combine(&index, orderedShards)
+	a, _ := json.Marshal(m)
+	b, _ := json.Marshal(index)
+	if string(a) != string(b) {
+		t.Errorf("combined metadata doesn't match original. Original\n%s\nCombined:\n%s", a, b)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	var sample Metadata
+	if err := json.Unmarshal([]byte(sampleConfig), &sample); err != nil {
+		t.Fatalf("failed to parse metadata: %s", err)
+	}
+	newDay := func(day int) ProcessedDay {
+		processedDay := sample.ProcessedDays[0]
+		processedDay.Day = NewDay(2100, time.January, day)
+		return processedDay
+	}
+	old := Metadata{ProcessedDays: []ProcessedDay{newDay(1), newDay(2), newDay(3)}}
+	new := Metadata{ProcessedDays: []ProcessedDay{newDay(2), newDay(3), newDay(4)}}
+	new.ProcessedDays[0].SoftwareVersion++
+	new.ProcessedDays[0].Preliminary = true
+	removed := old.ProcessedDays[0]
+	added := new.ProcessedDays[2]
+
+	d, err := Diff(&old, &new)
+	if err != nil {
+		t.Fatalf("failed to diff metadata: %s", err)
+	}
+	if len(d.Removed) != 1 || d.Removed[0].Day != removed.Day {
+		t.Errorf("removed = %v, want %s", d.Removed, removed.Day)
+	}
+	if len(d.Added) != 1 || d.Added[0].Day != added.Day {
+		t.Errorf("added = %v, want %s", d.Added, added.Day)
+	}
+	if len(d.Changed) != 1 || d.Changed[0].Day != new.ProcessedDays[0].Day {
+		t.Fatalf("changed = %v, want %s", d.Changed, new.ProcessedDays[0].Day)
+	}
+	var fields []string
+	for _, f := range d.Changed[0].Fields {
+		fields = append(fields, f.Field)
+	}
+	if want := []string{"SoftwareVersion", "Preliminary"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("changed fields = %v, want %v", fields, want)
+	}
+	if got := string(d.Changed[0].Fields[1].Old); got != "null" {
+		t.Errorf("old value of Preliminary = %s, want null", got)
+	}
+
+	d, err = Diff(&old, &old)
+	if err != nil {
+		t.Fatalf("failed to diff metadata: %s", err)
+	}
+	if !d.Empty() {
+		t.Errorf("diff of metadata with itself is not empty: %v", d)
+	}
+}
+
+func TestDayStartEndDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("failed to load location: %s", err)
+	}
+	testCases := []struct {
+		day  Day
+		want time.Duration
+	}{
+		{NewDay(2023, time.March, 11), 24 * time.Hour},
+		{NewDay(2023, time.March, 12), 23 * time.Hour},
+		{NewDay(2023, time.November, 5), 25 * time.Hour},
+		{NewDay(2023, time.November, 6), 24 * time.Hour},
+	}
+	for _, tc := range testCases {
+		start, end := tc.day.Start(loc), tc.day.End(loc)
+		if got := end.Sub(start); got != tc.want {
+			t.Errorf("%s: length = %s, want %s", tc.day, got, tc.want)
+		}
+		if got := DayOf(start); got != tc.day {
+			t.Errorf("%s: day of start = %s", tc.day, got)
+		}
+		if got := DayOf(end.Add(-time.Second)); got != tc.day {
+			t.Errorf("%s: day of last second = %s", tc.day, got)
+		}
+		if !tc.day.Next().Start(loc).Equal(end) {
+			t.Errorf("%s: end %s is not the start of the next day", tc.day, end)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package metadata
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// ShardName returns the file name of the shard containing the processed days of the year.
+//
+// It is the file name of the metadata file with the year inserted before the extension;
+// e.g., subwaydatanyc_metadata_2022.json.
+func ShardName(metadataPath string, year string) string {
+	base := path.Base(metadataPath)
+	ext := path.Ext(base)
+	return strings.TrimSuffix(base, ext) + "_" + year + ext
+}
+
+// ShardPath returns the path of the shard relative to the same root as the metadata path.
+func ShardPath(metadataPath string, shardName string) string {
+	return path.Join(path.Dir(metadataPath), shardName)
+}
+
+// Shard splits the metadata into an index file and one shard per year.
+//
+// The index contains everything except the processed days, along with the list of shards.
+// Shards are keyed by their file name.
+func Shard(m *Metadata, metadataPath string) (Metadata, map[string]Metadata) {
+	index := *m
+	index.ProcessedDays = []ProcessedDay{}
+	index.Shards = nil
+	shards := map[string]Metadata{}
+	for _, processedDay := range m.ProcessedDays {
+		name := ShardName(metadataPath, processedDay.Day.YearString())
+		shard := shards[name]
+		shard.ProcessedDays = append(shard.ProcessedDays, processedDay)
+		shards[name] = shard
+	}
+	for name := range shards {
+		index.Shards = append(index.Shards, name)
+	}
+	// Most recent years first, matching the order of the processed days.
+	sort.Sort(sort.Reverse(sort.StringSlice(index.Shards)))
+	return index, shards
+}
+
+// Combine adds the processed days in the shards to the index, and removes the list of shards.
+func Combine(index *Metadata, shards []Metadata) {
+	for _, shard := range shards {
+		index.ProcessedDays = append(index.ProcessedDays, shard.ProcessedDays...)
+	}
+	index.Shards = nil
+}
@@ -2,30 +2,105 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	hconfig "github.com/jamespfennell/hoard/config"
 	"github.com/jamespfennell/subwaydata.nyc/etl"
 	"github.com/jamespfennell/subwaydata.nyc/etl/config"
 	"github.com/jamespfennell/subwaydata.nyc/etl/periodic"
+	"github.com/jamespfennell/subwaydata.nyc/etl/replay"
 	"github.com/jamespfennell/subwaydata.nyc/etl/storage"
+	"github.com/jamespfennell/subwaydata.nyc/httpclient"
 	"github.com/jamespfennell/subwaydata.nyc/metadata"
 	"github.com/jamespfennell/subwaydata.nyc/website"
 	"github.com/urfave/cli/v2"
 )
 
 const (
-	etlConfig   = "etl-config"
-	hoardConfig = "hoard-config"
+	etlConfig     = "etl-config"
+	hoardConfig   = "hoard-config"
+	output        = "output"
+	runID         = "run-id"
+	parallelFeeds = "parallel-feeds"
+
+	proxy              = "proxy"
+	httpTimeout        = "http-timeout"
+	insecureSkipVerify = "insecure-skip-verify"
+	userAgent          = "user-agent"
+	signingSecret      = "signing-secret"
+	signingHeader      = "signing-header"
+)
+
+// Exit codes. A partial failure means that a backlog ran but some of its days failed; the failed
+// days are printed and retrying the backlog only processes them. A backlog that is too large is
+// reported by the status command. Any other error is fatal, e.g. an invalid config, failing to
+// read the metadata or every day of a backlog failing.
+const (
+	exitFatal           = 1
+	exitPartialFailure  = 2
+	exitBacklogTooLarge = 3
 )
 
 func main() {
-	app := &cli.App{
+	app := newApp()
+	if err := app.Run(os.Args); err != nil {
+		fmt.Println("Error:", err)
+		var partialFailure *etl.PartialFailureError
+		if errors.As(err, &partialFailure) {
+			os.Exit(exitPartialFailure)
+		}
+		var backlogTooLarge *etl.BacklogTooLargeError
+		if errors.As(err, &backlogTooLarge) {
+			os.Exit(exitBacklogTooLarge)
+		}
+		os.Exit(exitFatal)
+	}
+}
+
+// newApp returns the command line app. It is separate from main so that tests can parse flags.
+func newApp() *cli.App {
+	return &cli.App{
 		Name:     "subwaydatanyc",
 		HelpName: "subwaydatanyc",
 		Usage:    "tools for the subwaydata.nyc project",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        proxy,
+				Usage:       "URL of a proxy to send HTTP requests for configs and metadata through",
+				DefaultText: "read from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables",
+			},
+			&cli.DurationFlag{
+				Name:  httpTimeout,
+				Usage: "timeout for HTTP requests for configs and metadata",
+				Value: time.Minute,
+			},
+			&cli.BoolFlag{
+				Name:  insecureSkipVerify,
+				Usage: "skip verification of TLS certificates in HTTP requests for configs and metadata",
+			},
+			&cli.StringFlag{
+				Name:  userAgent,
+				Usage: "User-Agent header of HTTP requests for configs and metadata",
+				Value: "subwaydatanyc",
+			},
+			&cli.StringFlag{
+				Name:    signingSecret,
+				Usage:   "if set, HTTP requests for configs and metadata are signed with an HMAC-SHA256 using this secret",
+				EnvVars: []string{"SUBWAYDATANYC_SIGNING_SECRET"},
+			},
+			&cli.StringFlag{
+				Name:  signingHeader,
+				Usage: "header the request signature is sent in",
+				Value: httpclient.DefaultSignatureHeader,
+			},
+		},
 		Commands: []*cli.Command{
 			{
 				Name:  "etl",
@@ -33,14 +108,28 @@ func main() {
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:     hoardConfig,
-						Usage:    "path to the Hoard config file",
+						Usage:    "path or URL of the Hoard config file",
 						Required: true,
 					},
 					&cli.StringFlag{
 						Name:     etlConfig,
-						Usage:    "path to the ETL config file",
+						Usage:    "path or URL of the ETL config file",
 						Required: true,
 					},
+					&cli.StringFlag{
+						Name:  output,
+						Usage: "format of the output of reporting commands (text or json)",
+						Value: string(etl.OutputText),
+					},
+					&cli.StringFlag{
+						Name:  runID,
+						Usage: "identifier of the processing run recorded in provenance.json; overrides ProvenanceRunID in the ETL config",
+					},
+					&cli.StringFlag{
+						Name: parallelFeeds,
+						Usage: "number of feeds to process concurrently within each day: an integer, \"auto\" for the number of CPUs, or a multiple like \"2x\"; " +
+							"overrides ParseConcurrency in the ETL config",
+					},
 				},
 				Subcommands: []*cli.Command{
 					{
@@ -55,12 +144,34 @@ func main() {
 								Name:  "yes",
 								Usage: "perform the deletions",
 							},
+							&cli.BoolFlag{
+								Name:  "tombstone",
+								Usage: "record in the metadata that the days were deleted, so that consumers mirroring the data can remove them",
+							},
+							&cli.StringFlag{
+								Name:  "reason",
+								Usage: "reason for the deletion recorded in the tombstones",
+							},
+							&cli.BoolFlag{
+								Name:  "deletion-marker",
+								Usage: "also write a JSON deletion marker object for each day to object storage; requires --tombstone",
+							},
+							&cli.BoolFlag{
+								Name:  "delete-archives",
+								Usage: "also delete the archives of the days from object storage; otherwise only the metadata is updated",
+							},
+							feedFlag("only delete days processed with one of these feeds"),
+							allFeedsFlag(),
 						},
 						Action: func(c *cli.Context) error {
 							session, err := newSession(c)
 							if err != nil {
 								return err
 							}
+							if err := selectFeeds(c, session); err != nil {
+								return err
+							}
+							defer session.sc.WaitForMirrors()
 							var days []metadata.Day
 							for _, rawDay := range c.StringSlice("day") {
 								day, err := metadata.ParseDay(rawDay)
@@ -70,19 +181,343 @@ func main() {
 								days = append(days, day)
 							}
 							ctx := context.Background()
-							return etl.DeleteDays(ctx, days, !c.Bool("yes"), session.ec, session.sc)
+							return etl.DeleteDays(ctx, etl.DeleteOptions{
+								Days:           days,
+								DryRun:         !c.Bool("yes"),
+								Tombstone:      c.Bool("tombstone"),
+								Reason:         c.String("reason"),
+								DeletionMarker: c.Bool("deletion-marker"),
+								DeleteArchives: c.Bool("delete-archives"),
+							}, session.ec, session.sc)
+						},
+					},
+					{
+						Name:  "prune",
+						Usage: "delete old GTFS-RT archives from object storage",
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:     "older-than",
+								Usage:    "prune days that are more than this many days old",
+								Required: true,
+							},
+							&cli.StringSliceFlag{
+								Name:        "feed",
+								Usage:       "only prune days containing this feed (ID or alias)",
+								DefaultText: "all feeds",
+							},
+							&cli.BoolFlag{
+								Name:  "yes",
+								Usage: "perform the deletions",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							defer session.sc.WaitForMirrors()
+							opts := etl.PruneOptions{
+								OlderThanDays: c.Int("older-than"),
+								FeedIDs:       session.ec.ResolveFeedIDs(c.StringSlice("feed")),
+								DryRun:        !c.Bool("yes"),
+							}
+							return etl.Prune(context.Background(), opts, session.ec, session.sc)
+						},
+					},
+					{
+						Name:  "reconcile",
+						Usage: "compare the metadata against the archives in object storage and fix differences",
+						Description: "Days whose archives are in object storage but are missing from the metadata are added to the metadata. " +
+							"Days in the metadata whose archives are missing from object storage are removed from the metadata so that they are processed again. " +
+							"By default the differences are only reported.",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "apply",
+								Usage: "update the metadata",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							defer session.sc.WaitForMirrors()
+							opts := etl.ReconcileOptions{
+								Apply:  c.Bool("apply"),
+								Output: session.output,
+							}
+							return etl.Reconcile(context.Background(), session.ec, session.sc, opts)
 						},
 					},
 					{
-						Name:        "run",
-						Usage:       "run the ETL pipeline for a specific day",
-						UsageText:   "etl run YYYY-MM-DD",
-						Description: "Runs the pipeline for the specified day (YYYY-MM-DD).",
+						Name:  "metadata",
+						Usage: "inspect the metadata",
+						Subcommands: []*cli.Command{
+							{
+								Name:        "snapshot",
+								Usage:       "write the current metadata to a local file",
+								UsageText:   "etl metadata snapshot FILE",
+								Description: "Writes the current metadata, with any shards combined, to FILE for later use with the diff command.",
+								Action: func(c *cli.Context) error {
+									session, err := newSession(c)
+									if err != nil {
+										return err
+									}
+									if c.Args().Len() != 1 {
+										return fmt.Errorf("exactly one file must be provided")
+									}
+									return etl.SnapshotMetadata(context.Background(), c.Args().Get(0), session.sc)
+								},
+							},
+							{
+								Name:        "diff",
+								Usage:       "compare the current metadata against a snapshot",
+								UsageText:   "etl metadata diff SNAPSHOT",
+								Description: "Lists the processed days that were added, removed or changed since the snapshot, with the changed fields of each day.",
+								Action: func(c *cli.Context) error {
+									session, err := newSession(c)
+									if err != nil {
+										return err
+									}
+									if c.Args().Len() != 1 {
+										return fmt.Errorf("exactly one snapshot file must be provided")
+									}
+									return etl.DiffMetadata(context.Background(), c.Args().Get(0), session.output, session.sc)
+								},
+							},
+						},
+					},
+					{
+						Name:        "config-check",
+						Usage:       "check the ETL and Hoard configs",
+						Description: "Validates the ETL config and checks that every feed that would be processed is in the Hoard config.",
+						Flags: []cli.Flag{
+							feedFlag("feed to check"),
+							allFeedsFlag(),
+						},
 						Action: func(c *cli.Context) error {
 							session, err := newSession(c)
 							if err != nil {
 								return err
 							}
+							if err := selectFeeds(c, session); err != nil {
+								return err
+							}
+							if err := checkHoardFeeds(session.ec, session.hc); err != nil {
+								return err
+							}
+							fmt.Printf("Configs are valid; %d feed(s) would be processed\n", len(session.ec.ActiveFeeds()))
+							return nil
+						},
+					},
+					{
+						Name:  "export-schema",
+						Usage: "print the schema of the CSV files the pipeline currently produces",
+						Description: "Prints, as JSON, the columns of each CSV file in the archives with their types and nullability, given the export options in the ETL config. " +
+							"The output can be used as the ExportSchemaPath file.",
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							return etl.PrintExportSchema(session.ec)
+						},
+					},
+					{
+						Name:  "keys",
+						Usage: "inspect the object keys of the archives",
+						Subcommands: []*cli.Command{
+							{
+								Name:  "check",
+								Usage: "check that every archive in the metadata is in object storage at the expected key",
+								Description: "For each archive in the metadata, computes the key the pipeline would write it to from the day and checksum, " +
+									"and checks that the metadata uses that key and that an object exists there. Exits with status 1 if any problem is found.",
+								Action: func(c *cli.Context) error {
+									session, err := newSession(c)
+									if err != nil {
+										return err
+									}
+									return etl.CheckKeys(context.Background(), session.ec, session.sc, etl.KeysCheckOptions{
+										Output: session.output,
+									})
+								},
+							},
+						},
+					},
+					{
+						Name:  "coverage",
+						Usage: "report how many days of each feed have been processed, per month",
+						Description: "Reports, per feed per month, the number of days present, missing, preliminary and skipped, and the total number of trips. " +
+							"The report is derived from the metadata. With --export it is written to a CSV or JSON file, depending on the extension.",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "export",
+								Usage: "path of a .csv or .json file to write the report to",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							opts := etl.CoverageOptions{
+								ExportPath: c.String("export"),
+								Output:     session.output,
+							}
+							return etl.Coverage(context.Background(), session.ec, session.sc, opts)
+						},
+					},
+					{
+						Name:  "status",
+						Usage: "summarize the health of the pipeline",
+						Description: "Reports the most recent processed day, the size of the backlog, its oldest day, and the feeds with days in the backlog. " +
+							"The report is derived from the metadata. Exits with status 3 if the backlog has more days than --max-backlog.",
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:        "max-backlog",
+								Usage:       "exit with status 3 if the backlog has more than this many days",
+								DefaultText: "no limit",
+							},
+							feedFlag("feed to report on"),
+							allFeedsFlag(),
+						},
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							if err := selectFeeds(c, session); err != nil {
+								return err
+							}
+							opts := etl.StatusOptions{
+								Output: session.output,
+							}
+							if c.IsSet("max-backlog") {
+								maxBacklog := c.Int("max-backlog")
+								opts.MaxBacklog = &maxBacklog
+							}
+							return etl.Status(context.Background(), session.ec, session.sc, opts)
+						},
+					},
+					{
+						Name:      "export-journal",
+						Usage:     "rerun the export step of a day against a journal dump",
+						UsageText: "etl export-journal --output-file PATH DUMP YYYY-MM-DD",
+						Description: "Loads the trips in a journal dump written by the pipeline (see JournalDumpDir and UploadJournalDump in the ETL config) " +
+							"and exports them to a CSV archive on disk with the export options in the ETL config. Nothing is uploaded.",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "output-file",
+								Usage:    "path to write the tar.xz CSV archive to",
+								Required: true,
+							},
+							&cli.BoolFlag{
+								Name:  "from-storage",
+								Usage: "read the dump from object storage instead of disk",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							if c.Args().Len() != 2 {
+								return fmt.Errorf("expected exactly two arguments DUMP YYYY-MM-DD")
+							}
+							day, err := metadata.ParseDay(c.Args().Get(1))
+							if err != nil {
+								return err
+							}
+							opts := etl.ExportJournalOptions{
+								DumpPath:    c.Args().Get(0),
+								FromStorage: c.Bool("from-storage"),
+								OutputPath:  c.String("output-file"),
+							}
+							return etl.ExportJournal(context.Background(), day, opts, session.ec, session.sc)
+						},
+					},
+					{
+						Name:        "stream",
+						Usage:       "write the trips of a processed day to stdout as NDJSON",
+						UsageText:   "etl stream YYYY-MM-DD",
+						Description: "Downloads the CSV export of the specified day (YYYY-MM-DD) and writes one JSON object per trip, including its stop times, per line.",
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{
+								Name:  "feed",
+								Usage: "fail unless the day was processed with this feed (ID or alias); may be repeated",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							if c.Args().Len() != 1 {
+								return fmt.Errorf("expected exactly one argument YYYY-MM-DD")
+							}
+							day, err := metadata.ParseDay(c.Args().First())
+							if err != nil {
+								return err
+							}
+							return etl.Stream(context.Background(), day, session.ec.ResolveFeedIDs(c.StringSlice("feed")), session.sc)
+						},
+					},
+					{
+						Name:        "routes",
+						Usage:       "list the routes that ran on a processed day",
+						UsageText:   "etl routes YYYY-MM-DD",
+						Description: "Downloads the CSV export of the specified day (YYYY-MM-DD) and prints each route that has trips, with its number of trips.",
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{
+								Name:  "feed",
+								Usage: "only count trips from this feed (ID or alias), using the day's per-feed archives; may be repeated",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							if c.Args().Len() != 1 {
+								return fmt.Errorf("expected exactly one argument YYYY-MM-DD")
+							}
+							day, err := metadata.ParseDay(c.Args().First())
+							if err != nil {
+								return err
+							}
+							return etl.Routes(context.Background(), day, etl.RoutesOptions{
+								FeedIDs: session.ec.ResolveFeedIDs(c.StringSlice("feed")),
+								Output:  session.output,
+							}, session.sc)
+						},
+					},
+					{
+						Name:      "run",
+						Usage:     "run the ETL pipeline for a specific day",
+						UsageText: "etl run YYYY-MM-DD [YYYY-MM-DD]",
+						Description: "Runs the pipeline for the specified day (YYYY-MM-DD), or for every day between the two days (inclusive). " +
+							"With a range, a day that fails doesn't stop the run; the days that succeeded and failed are printed at the end " +
+							"and the exit status is 2 if some failed and 1 if all of them failed.",
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{
+								Name:  "hoard-key",
+								Usage: "full object key of a Hoard archive to use as input instead of all of the Hoard data for the day for the feed it belongs to; may be repeated",
+							},
+							feedFlag("feed to process"),
+							allFeedsFlag(),
+						},
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							if err := selectFeeds(c, session); err != nil {
+								return err
+							}
+							if err := checkHoardFeeds(session.ec, session.hc); err != nil {
+								return err
+							}
+							defer session.sc.WaitForMirrors()
 							args := c.Args()
 							switch args.Len() {
 							case 0:
@@ -92,24 +527,156 @@ func main() {
 								if err != nil {
 									return err
 								}
+								feedIDs, err := feedIDsForDay(session.ec, d)
+								if err != nil {
+									return err
+								}
+								if keys := c.StringSlice("hoard-key"); len(keys) > 0 {
+									return etl.RunFromHoardKeys(context.Background(), d, feedIDs, keys, session.ec, session.hc, session.sc)
+								}
 								return etl.Run(
 									context.Background(),
 									d,
-									// TODO: !!!
-									[]string{"nycsubway_L"},
+									feedIDs,
 									session.ec,
 									session.hc,
 									session.sc,
 								)
+							case 2:
+								if c.IsSet("hoard-key") {
+									return fmt.Errorf("--hoard-key can only be used with a single day")
+								}
+								firstDay, err := metadata.ParseDay(args.Get(0))
+								if err != nil {
+									return err
+								}
+								lastDay, err := metadata.ParseDay(args.Get(1))
+								if err != nil {
+									return err
+								}
+								return etl.RunRange(context.Background(), firstDay, lastDay, session.ec, session.hc, session.sc)
 							default:
-								return fmt.Errorf("too many command line arguments passed")
+								return fmt.Errorf("expected one day or two days, got %d arguments", args.Len())
 							}
 						},
 					},
 					{
-						Name:        "backlog",
-						Usage:       "run the ETL pipeline for all days that are not up-to-date",
-						Description: "Runs the pipeline for days that are not up to date.",
+						Name:      "benchmark",
+						Usage:     "run the ETL pipeline for a day and report the time taken by each step",
+						UsageText: "etl benchmark YYYY-MM-DD",
+						Description: "Runs the pipeline for the specified day (YYYY-MM-DD) and prints the time taken to download, parse, merge, export and upload the data. " +
+							"With --no-upload, nothing is written to object storage.",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "input-dir",
+								Usage: "directory with one subdirectory of GTFS-RT files per feed to use as input instead of downloading from Hoard",
+							},
+							&cli.BoolFlag{
+								Name:  "no-upload",
+								Usage: "don't upload the archives or update the metadata",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							if c.String("input-dir") == "" {
+								if err := checkHoardFeeds(session.ec, session.hc); err != nil {
+									return err
+								}
+							}
+							defer session.sc.WaitForMirrors()
+							if c.Args().Len() != 1 {
+								return fmt.Errorf("exactly one day must be provided")
+							}
+							d, err := metadata.ParseDay(c.Args().Get(0))
+							if err != nil {
+								return err
+							}
+							return etl.Benchmark(context.Background(), d, etl.BenchmarkOptions{
+								InputDir: c.String("input-dir"),
+								NoUpload: c.Bool("no-upload"),
+								Output:   session.output,
+							}, session.ec, session.hc, session.sc)
+						},
+					},
+					{
+						Name:      "as-of",
+						Usage:     "reconstruct the CSV export of a day as it was known at a past time",
+						UsageText: "etl as-of --output-file PATH YYYY-MM-DD TIME",
+						Description: "Runs the pipeline for the specified day (YYYY-MM-DD) using only the feed messages created at or before TIME, " +
+							"and writes the CSV archive to the output path. TIME is either HH:MM or HH:MM:SS in the config's timezone, or an RFC 3339 timestamp. " +
+							"Nothing is written to object storage.",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "output-file",
+								Usage:    "path to write the tar.xz CSV archive to",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "input-dir",
+								Usage: "directory with one subdirectory of GTFS-RT files per feed to use as input instead of downloading from Hoard",
+							},
+							feedFlag("feed to process"),
+							allFeedsFlag(),
+						},
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							if err := selectFeeds(c, session); err != nil {
+								return err
+							}
+							if c.String("input-dir") == "" {
+								if err := checkHoardFeeds(session.ec, session.hc); err != nil {
+									return err
+								}
+							}
+							if c.Args().Len() != 2 {
+								return fmt.Errorf("exactly one day and one time must be provided")
+							}
+							d, err := metadata.ParseDay(c.Args().Get(0))
+							if err != nil {
+								return err
+							}
+							t, err := etl.ParseAsOfTime(d, c.Args().Get(1), session.ec)
+							if err != nil {
+								return err
+							}
+							feedIDs, err := feedIDsForDay(session.ec, d)
+							if err != nil {
+								return err
+							}
+							return etl.AsOf(context.Background(), d, feedIDs, etl.AsOfOptions{
+								Time:       t,
+								InputDir:   c.String("input-dir"),
+								OutputPath: c.String("output-file"),
+							}, session.ec, session.hc, session.sc)
+						},
+					},
+					{
+						Name:        "today",
+						Usage:       "run the ETL pipeline for the current day using the data available so far",
+						Description: "Runs the pipeline for the current day. The output is partial and is marked as preliminary in the metadata.",
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							if err := checkHoardFeeds(session.ec, session.hc); err != nil {
+								return err
+							}
+							defer session.sc.WaitForMirrors()
+							return etl.Today(context.Background(), session.ec, session.hc, session.sc)
+						},
+					},
+					{
+						Name:  "backlog",
+						Usage: "run the ETL pipeline for all days that are not up-to-date",
+						Description: "Runs the pipeline for days that are not up to date. " +
+							"Exits with status 0 if all days succeeded, 2 if some days failed (the failed days are printed), and 1 on any other error.",
 						Flags: []cli.Flag{
 							&cli.IntFlag{
 								Name:        "limit",
@@ -117,26 +684,64 @@ func main() {
 								Usage:       "maximum number of days to process",
 								DefaultText: "no limit",
 							},
-							&cli.IntFlag{
+							&cli.StringFlag{
 								Name:    "concurrency",
 								Aliases: []string{"c"},
-								Value:   1,
-								Usage:   "number of days to run concurrently",
+								Value:   "1",
+								Usage:   "number of days to run concurrently: an integer, \"auto\" for the number of CPUs, or a multiple like \"2x\"",
 							},
 							&cli.BoolFlag{
 								Name:    "dry-run",
 								Aliases: []string{"d"},
 								Usage:   "only calculate the days that need to be updated, but don't update them",
 							},
+							&cli.BoolFlag{
+								Name:  "estimate",
+								Usage: "only report the projected time and bytes of processing the backlog, based on recently processed days",
+							},
+							&cli.BoolFlag{
+								Name:  "include-today",
+								Usage: "also process the current day, and any other day whose data isn't complete yet, as preliminary",
+							},
+							&cli.BoolFlag{
+								Name:  "shuffle",
+								Usage: "process the days in a random order instead of newest first; the seed is logged",
+							},
+							&cli.Int64Flag{
+								Name:        "seed",
+								Usage:       "seed for the order of --shuffle, to reproduce a previous run",
+								DefaultText: "chosen from the current time",
+							},
+							feedFlag("feed to process"),
+							allFeedsFlag(),
 						},
 						Action: func(c *cli.Context) error {
 							session, err := newSession(c)
 							if err != nil {
 								return err
 							}
+							if err := selectFeeds(c, session); err != nil {
+								return err
+							}
+							if err := checkHoardFeeds(session.ec, session.hc); err != nil {
+								return err
+							}
+							defer session.sc.WaitForMirrors()
+							concurrency, err := config.ParseConcurrency(c.String("concurrency"))
+							if err != nil {
+								return err
+							}
 							opts := etl.BacklogOptions{
-								DryRun:      c.Bool("dry-run"),
-								Concurrency: c.Int("concurrency"),
+								DryRun:            c.Bool("dry-run"),
+								Concurrency:       concurrency,
+								Output:            session.output,
+								Estimate:          c.Bool("estimate"),
+								Shuffle:           c.Bool("shuffle"),
+								IncludeIncomplete: c.Bool("include-today"),
+							}
+							if c.IsSet("seed") {
+								seed := c.Int64("seed")
+								opts.Seed = &seed
 							}
 							if c.IsSet("limit") {
 								l := c.Int("limit")
@@ -146,30 +751,230 @@ func main() {
 						},
 					},
 					{
-						Name:  "periodic",
-						Usage: "run the ETL pipeline periodically",
+						Name:  "rerun-failed",
+						Usage: "run the ETL pipeline again for all days in the dead-letter list",
+						Description: "Days that fail in a backlog or rerun are recorded in the dead-letter list in the metadata. " +
+							"This command runs them again with the feeds they failed with; days that succeed are removed from the list and days that fail again have their attempt count incremented. " +
+							"Exits with status 0 if all days succeeded, 2 if some days failed (the failed days are printed), and 1 on any other error.",
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:        "limit",
+								Aliases:     []string{"l"},
+								Usage:       "maximum number of days to process",
+								DefaultText: "no limit",
+							},
+							&cli.StringFlag{
+								Name:    "concurrency",
+								Aliases: []string{"c"},
+								Value:   "1",
+								Usage:   "number of days to run concurrently: an integer, \"auto\" for the number of CPUs, or a multiple like \"2x\"",
+							},
+							&cli.BoolFlag{
+								Name:    "dry-run",
+								Aliases: []string{"d"},
+								Usage:   "only list the failed days, but don't run them",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							if err := checkHoardFeeds(session.ec, session.hc); err != nil {
+								return err
+							}
+							defer session.sc.WaitForMirrors()
+							concurrency, err := config.ParseConcurrency(c.String("concurrency"))
+							if err != nil {
+								return err
+							}
+							opts := etl.RerunFailedOptions{
+								DryRun:      c.Bool("dry-run"),
+								Concurrency: concurrency,
+							}
+							if c.IsSet("limit") {
+								l := c.Int("limit")
+								opts.Limit = &l
+							}
+							return etl.RerunFailed(context.Background(), session.ec, session.hc, session.sc, opts)
+						},
+					},
+					{
+						Name:        "reprocess",
+						Usage:       "run the ETL pipeline again for processed days in a range",
+						UsageText:   "etl reprocess YYYY-MM-DD YYYY-MM-DD",
+						Description: "Runs the pipeline again for all processed days between the two days (inclusive).",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "concurrency",
+								Aliases: []string{"c"},
+								Value:   "1",
+								Usage:   "number of days to run concurrently",
+							},
+							&cli.BoolFlag{
+								Name:    "dry-run",
+								Aliases: []string{"d"},
+								Usage:   "only report the days that would be reprocessed, but don't reprocess them",
+							},
+							&cli.Float64Flag{
+								Name: "max-regression",
+								Usage: "don't publish a day if it has more than this percentage fewer trips or stop times than the published version; " +
+									"the day is added to the failed days and marked as needing review",
+								DefaultText: "no check",
+							},
+							feedFlag("feed to process"),
+							allFeedsFlag(),
+						},
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							if err := selectFeeds(c, session); err != nil {
+								return err
+							}
+							if err := checkHoardFeeds(session.ec, session.hc); err != nil {
+								return err
+							}
+							defer session.sc.WaitForMirrors()
+							args := c.Args()
+							if args.Len() != 2 {
+								return fmt.Errorf("expected two days, got %d arguments", args.Len())
+							}
+							firstDay, err := metadata.ParseDay(args.Get(0))
+							if err != nil {
+								return err
+							}
+							lastDay, err := metadata.ParseDay(args.Get(1))
+							if err != nil {
+								return err
+							}
+							concurrency, err := config.ParseConcurrency(c.String("concurrency"))
+							if err != nil {
+								return err
+							}
+							opts := etl.ReprocessOptions{
+								FirstDay:    firstDay,
+								LastDay:     lastDay,
+								DryRun:      c.Bool("dry-run"),
+								Concurrency: concurrency,
+								Output:      session.output,
+							}
+							if c.IsSet("max-regression") {
+								maxRegression := c.Float64("max-regression")
+								if maxRegression < 0 {
+									return fmt.Errorf("--max-regression must not be negative")
+								}
+								opts.MaxRegressionPercent = &maxRegression
+							}
+							return etl.Reprocess(context.Background(), session.ec, session.hc, session.sc, opts)
+						},
+					},
+					{
+						Name:        "periodic",
+						Usage:       "run the ETL pipeline periodically",
+						Description: "Runs the backlog at the start of each interval. Each interval is either a daily window HH:MM:SS-HH:MM:SS or a quoted five-field cron expression like \"0 */6 * * *\", in the ETL config timezone. Days that fail are logged and retried at the next interval; the command only exits, with status 1, on a fatal error.",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "state-file",
+								Usage: "local file recording the progress of the runner, so that after a restart an unfinished interval is resumed",
+							},
+							&cli.IntFlag{
+								Name:        "metrics-port",
+								Usage:       "port to serve Prometheus metrics on, at /metrics",
+								DefaultText: "no metrics server",
+							},
+							feedFlag("feed to process"),
+							allFeedsFlag(),
+						},
 						Action: func(c *cli.Context) error {
 							session, err := newSession(c)
 							if err != nil {
 								return err
 							}
+							if err := selectFeeds(c, session); err != nil {
+								return err
+							}
+							if err := checkHoardFeeds(session.ec, session.hc); err != nil {
+								return err
+							}
+							defer session.sc.WaitForMirrors()
 							args := c.Args().Slice()
 							if len(args) == 0 {
 								return fmt.Errorf("no intervals provided")
 							}
 							var intervals []periodic.Interval
 							for _, arg := range args {
-								interval, err := periodic.NewInterval(arg)
+								interval, err := periodic.ParseInterval(arg)
 								if err != nil {
 									return fmt.Errorf("failed to parse interval: %w", err)
 								}
 								intervals = append(intervals, interval)
 							}
-							ctx := context.Background()
-							periodic.Run(ctx, session.ec, session.hc, session.sc, intervals)
+							// Stopping the process cancels the backlog run, which is then resumed on restart.
+							ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+							defer cancel()
+							var metrics *periodic.Metrics
+							if c.IsSet("metrics-port") {
+								metrics = periodic.NewMetrics()
+								if err := periodic.ServeMetrics(ctx, metrics, c.Int("metrics-port")); err != nil {
+									return err
+								}
+							}
+							periodic.Run(ctx, session.ec, session.hc, session.sc, intervals, c.String("state-file"), metrics)
 							return nil
 						},
 					},
+					{
+						Name:        "replay",
+						Usage:       "replay the GTFS-RT data of a processed day as if it were live (for testing)",
+						UsageText:   "etl replay YYYY-MM-DD",
+						Description: "Downloads the GTFS-RT archive of the specified day (YYYY-MM-DD) and publishes its messages at the original pace, optionally sped up.",
+						Flags: []cli.Flag{
+							&cli.Float64Flag{
+								Name:  "speed",
+								Usage: "how many times faster than real time to replay the day",
+								Value: 1,
+							},
+							&cli.DurationFlag{
+								Name:  "interval",
+								Usage: "simulated time between snapshots",
+								Value: time.Minute,
+							},
+							&cli.StringFlag{
+								Name:  "target-url",
+								Usage: "URL to POST each snapshot to",
+							},
+							&cli.IntFlag{
+								Name:  "port",
+								Usage: "port to serve the latest snapshot of each feed on, at /<feed ID>",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							session, err := newSession(c)
+							if err != nil {
+								return err
+							}
+							if c.Args().Len() != 1 {
+								return fmt.Errorf("expected exactly one argument YYYY-MM-DD")
+							}
+							day, err := metadata.ParseDay(c.Args().First())
+							if err != nil {
+								return err
+							}
+							client, err := newHttpClient(c)
+							if err != nil {
+								return err
+							}
+							return replay.Run(context.Background(), day, session.sc, replay.Options{
+								Speed:     c.Float64("speed"),
+								Interval:  c.Duration("interval"),
+								TargetUrl: c.String("target-url"),
+								Port:      c.Int("port"),
+								Client:    client,
+							})
+						},
+					},
 				},
 			},
 			{
@@ -182,59 +987,190 @@ func main() {
 						Value:       8080,
 						DefaultText: "8080",
 					},
-					&cli.StringFlag{
+					&cli.StringSliceFlag{
 						Name:     "metadata-url",
-						Usage:    "URL for the metadata",
+						Usage:    "URL for the metadata; pass multiple times to add mirrors that are tried in order",
 						Required: true,
 					},
+					&cli.DurationFlag{
+						Name:  "read-header-timeout",
+						Usage: "maximum time to read the headers of a request",
+						Value: website.DefaultTimeouts().ReadHeader,
+					},
+					&cli.DurationFlag{
+						Name:  "read-timeout",
+						Usage: "maximum time to read a request, including the body",
+						Value: website.DefaultTimeouts().Read,
+					},
+					&cli.DurationFlag{
+						Name:  "write-timeout",
+						Usage: "maximum time to write a response",
+						Value: website.DefaultTimeouts().Write,
+					},
+					&cli.DurationFlag{
+						Name:  "idle-timeout",
+						Usage: "maximum time to wait for the next request on a keep-alive connection",
+						Value: website.DefaultTimeouts().Idle,
+					},
 				},
 				Action: func(ctx *cli.Context) error {
-					website.Run(ctx.String("metadata-url"), ctx.Int("port"))
+					client, err := newHttpClient(ctx)
+					if err != nil {
+						return err
+					}
+					website.Run(ctx.StringSlice("metadata-url"), ctx.Int("port"), website.Timeouts{
+						ReadHeader: ctx.Duration("read-header-timeout"),
+						Read:       ctx.Duration("read-timeout"),
+						Write:      ctx.Duration("write-timeout"),
+						Idle:       ctx.Duration("idle-timeout"),
+					}, client)
 					return nil
 				},
 			},
 		},
 	}
-	if err := app.Run(os.Args); err != nil {
-		fmt.Println("Error:", err)
-		os.Exit(1)
-	}
 }
 
 type session struct {
-	ec *config.Config
-	hc *hconfig.Config
-	sc *storage.Client
+	ec     *config.Config
+	hc     *hconfig.Config
+	sc     *storage.Client
+	output etl.OutputFormat
 }
 
 func newSession(c *cli.Context) (*session, error) {
-	path := c.String(hoardConfig)
-	b, err := os.ReadFile(path)
+	outputFormat, err := etl.ParseOutputFormat(c.String(output))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read the Hoard config file from disk: %w", err)
+		return nil, err
+	}
+
+	client, err := newHttpClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := readConfig(client, c.String(hoardConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the Hoard config file: %w", err)
 	}
 	hc, err := hconfig.NewConfig(b)
 	if err != nil {
 		return nil, err
 	}
 
-	path = c.String(etlConfig)
-	b, err = os.ReadFile(path)
+	b, err = readConfig(client, c.String(etlConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the ETL config file: %w", err)
+	}
+	ec, err := config.Parse(b)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read the ETL config file from disk: %w", err)
+		return nil, fmt.Errorf("invalid ETL config file:\n%w", err)
+	}
+	if c.IsSet(runID) {
+		ec.ProvenanceRunID = c.String(runID)
 	}
-	var ec config.Config
-	if err := json.Unmarshal(b, &ec); err != nil {
-		return nil, fmt.Errorf("failed to parse the ETL config file: %w", err)
+	if c.IsSet(parallelFeeds) {
+		if _, err := config.ParseConcurrency(c.String(parallelFeeds)); err != nil {
+			return nil, fmt.Errorf("invalid --%s: %w", parallelFeeds, err)
+		}
+		ec.ParseConcurrency = c.String(parallelFeeds)
 	}
 
-	sc, err := storage.NewClient(&ec)
+	sc, err := storage.NewClient(ec)
 	if err != nil {
 		return nil, err
 	}
 	return &session{
-		ec: &ec,
-		hc: hc,
-		sc: sc,
+		ec:     ec,
+		hc:     hc,
+		sc:     sc,
+		output: outputFormat,
 	}, nil
 }
+
+// feedFlag returns the flag that selects the feeds a command acts on in place of DefaultFeeds.
+func feedFlag(usage string) cli.Flag {
+	return &cli.StringSliceFlag{
+		Name:        "feed",
+		Usage:       usage + " (ID or alias); may be repeated",
+		DefaultText: "DefaultFeeds in the ETL config, or all feeds",
+	}
+}
+
+// allFeedsFlag returns the flag that selects all feeds, ignoring DefaultFeeds.
+func allFeedsFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "all-feeds",
+		Usage: "act on all feeds in the ETL config, ignoring DefaultFeeds",
+	}
+}
+
+// selectFeeds replaces the default feeds in the config with the feeds selected on the command line.
+func selectFeeds(c *cli.Context, session *session) error {
+	ec := session.ec
+	if c.Bool("all-feeds") {
+		if c.IsSet("feed") {
+			return fmt.Errorf("--feed and --all-feeds can't both be used")
+		}
+		ec.DefaultFeeds = nil
+		return nil
+	}
+	if !c.IsSet("feed") {
+		return nil
+	}
+	feedIDs, err := ec.ResolveFeedSet(c.StringSlice("feed"))
+	if err != nil {
+		return fmt.Errorf("invalid --feed: %w", err)
+	}
+	ec.DefaultFeeds = feedIDs
+	return nil
+}
+
+// feedIDsForDay returns the IDs of the selected feeds that are active on the day, and fails if
+// there are none rather than processing nothing.
+func feedIDsForDay(ec *config.Config, day metadata.Day) ([]string, error) {
+	if len(ec.Feeds) == 0 {
+		return nil, fmt.Errorf("no feeds to process: the ETL config has no Feeds")
+	}
+	feedIDs := config.FeedIDsForDay(ec.ActiveFeeds(), day)
+	if len(feedIDs) == 0 {
+		return nil, fmt.Errorf("none of the selected feeds (DefaultFeeds in the ETL config, or --feed) are active on %s", day)
+	}
+	return feedIDs, nil
+}
+
+// checkHoardFeeds fails if any of the feeds that would be processed is not in the Hoard config,
+// so that the mismatch is reported before any work starts rather than part way through a run.
+//
+// Commands that read from Hoard call it once the feeds have been selected.
+func checkHoardFeeds(ec *config.Config, hc *hconfig.Config) error {
+	var hoardFeedIDs []string
+	for _, feed := range hc.Feeds {
+		hoardFeedIDs = append(hoardFeedIDs, feed.ID)
+	}
+	if missing := ec.MissingFeeds(hoardFeedIDs); len(missing) > 0 {
+		return fmt.Errorf("feed(s) not in the Hoard config: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func newHttpClient(c *cli.Context) (*http.Client, error) {
+	opts := httpclient.Options{
+		Proxy:              c.String(proxy),
+		Timeout:            c.Duration(httpTimeout),
+		InsecureSkipVerify: c.Bool(insecureSkipVerify),
+		UserAgent:          c.String(userAgent),
+	}
+	if secret := c.String(signingSecret); secret != "" {
+		opts.Signer = httpclient.NewHmacSigner(secret, c.String(signingHeader))
+	}
+	return httpclient.New(opts)
+}
+
+// readConfig reads a config file from disk or, if the location is a URL, over HTTP.
+func readConfig(client *http.Client, location string) ([]byte, error) {
+	if httpclient.IsUrl(location) {
+		return httpclient.Get(client, location)
+	}
+	return os.ReadFile(location)
+}
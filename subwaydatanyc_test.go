@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jamespfennell/subwaydata.nyc/etl"
+	"github.com/urfave/cli/v2"
+)
+
+func TestAsOfFlags(t *testing.T) {
+	app := newApp()
+	var gotFormat, gotOutputFile string
+	findCommand(t, app.Commands, "etl", "as-of").Action = func(c *cli.Context) error {
+		gotFormat = c.String(output)
+		gotOutputFile = c.String("output-file")
+		return nil
+	}
+	if err := app.Run([]string{
+		"subwaydatanyc", "etl", "--hoard-config", "hoard.yml", "--etl-config", "etl.json",
+		"as-of", "--output-file", "/tmp/x.tar.xz", "2024-01-01", "12:00",
+	}); err != nil {
+		t.Fatalf("failed to run app: %s", err)
+	}
+	if _, err := etl.ParseOutputFormat(gotFormat); err != nil {
+		t.Errorf("output format read by newSession is invalid: %s", err)
+	}
+	if gotOutputFile != "/tmp/x.tar.xz" {
+		t.Errorf("output file = %q, want /tmp/x.tar.xz", gotOutputFile)
+	}
+}
+
+// Flags of a subcommand with the same name as a flag of a parent command shadow the parent's
+// flag when it is read from the subcommand's context.
+func TestNoShadowedFlags(t *testing.T) {
+	var check func(parentNames map[string]string, commands []*cli.Command, path string)
+	check = func(parentNames map[string]string, commands []*cli.Command, path string) {
+		for _, command := range commands {
+			names := map[string]string{}
+			for name, owner := range parentNames {
+				names[name] = owner
+			}
+			commandPath := path + " " + command.Name
+			for _, flag := range command.Flags {
+				for _, name := range flag.Names() {
+					if owner, ok := parentNames[name]; ok {
+						t.Errorf("flag %s of%s shadows the flag of%s", name, commandPath, owner)
+					}
+					names[name] = commandPath
+				}
+			}
+			check(names, command.Subcommands, commandPath)
+		}
+	}
+	app := newApp()
+	names := map[string]string{}
+	for _, flag := range app.Flags {
+		for _, name := range flag.Names() {
+			names[name] = " " + app.Name
+		}
+	}
+	check(names, app.Commands, "")
+}
+
+func findCommand(t *testing.T, commands []*cli.Command, names ...string) *cli.Command {
+	for _, command := range commands {
+		if command.Name != names[0] {
+			continue
+		}
+		if len(names) == 1 {
+			return command
+		}
+		return findCommand(t, command.Subcommands, names[1:]...)
+	}
+	t.Fatalf("command %s not found", names[0])
+	return nil
+}
@@ -0,0 +1,165 @@
+package website
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+const (
+	// Maximum number of days in a single bundle.
+	maxBundleDays = 31
+	// Maximum number of bundles being built at once.
+	maxConcurrentBundleBuilds = 2
+	// Write timeout for bundle responses, which overrides the server's write timeout.
+	bundleWriteTimeout = 10 * time.Minute
+)
+
+// bundler serves tar archives containing the CSV archives of a range of days.
+//
+// Bundles are assembled deterministically (file order and tar headers depend only on the
+// metadata) and cached in memory for a short time, so that clients can resume a download
+// using HTTP Range requests. The tradeoff is memory: each bundle being built or served is held
+// in full, which is why the number of days per bundle and the number of concurrent builds are
+// capped, and the cache is bounded by size.
+type bundler struct {
+	d        *dynamicContent
+	builds   chan struct{}
+	cache    *memoryCache
+	fetchUrl func(path string) string
+}
+
+func newBundler(d *dynamicContent, cache *memoryCache) *bundler {
+	return &bundler{
+		d:        d,
+		builds:   make(chan struct{}, maxConcurrentBundleBuilds),
+		cache:    cache,
+		fetchUrl: d.dataUrl,
+	}
+}
+
+// ServeHTTP serves paths of the form /bundle/subwaydatanyc_YYYY-MM-DD_YYYY-MM-DD_csv.tar.
+func (b *bundler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/bundle/")
+	first, last, err := parseBundleName(name)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var days []metadata.ProcessedDay
+	for _, p := range b.d.getProcessedDays() {
+		if p.Day.Before(first) || last.Before(p.Day) {
+			continue
+		}
+		days = append(days, p)
+	}
+	if len(days) == 0 {
+		http.Error(rw, "no processed days in the range", http.StatusNotFound)
+		return
+	}
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].Day.Before(days[j].Day)
+	})
+	if len(days) > maxBundleDays {
+		http.Error(rw, fmt.Sprintf("bundles can contain at most %d days", maxBundleDays), http.StatusBadRequest)
+		return
+	}
+	if err := http.NewResponseController(rw).SetWriteDeadline(time.Now().Add(bundleWriteTimeout)); err != nil {
+		log.Printf("Failed to extend write deadline for bundle %s: %s", name, err)
+	}
+	bd := b.get(name, days)
+	if bd.err != nil {
+		log.Printf("Failed to build bundle %s: %s", name, bd.err)
+		http.Error(rw, "failed to build bundle", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/x-tar")
+	http.ServeContent(rw, r, name, bd.modTime, bytes.NewReader(bd.b))
+}
+
+func parseBundleName(name string) (metadata.Day, metadata.Day, error) {
+	errInvalid := fmt.Errorf("bundle name must be of the form subwaydatanyc_YYYY-MM-DD_YYYY-MM-DD_csv.tar")
+	if !strings.HasPrefix(name, "subwaydatanyc_") || !strings.HasSuffix(name, "_csv.tar") {
+		return metadata.Day{}, metadata.Day{}, errInvalid
+	}
+	pieces := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "subwaydatanyc_"), "_csv.tar"), "_")
+	if len(pieces) != 2 {
+		return metadata.Day{}, metadata.Day{}, errInvalid
+	}
+	first, err := metadata.ParseDay(pieces[0])
+	if err != nil {
+		return metadata.Day{}, metadata.Day{}, err
+	}
+	last, err := metadata.ParseDay(pieces[1])
+	if err != nil {
+		return metadata.Day{}, metadata.Day{}, err
+	}
+	return first, last, nil
+}
+
+// get returns the bundle for the days, building it if it is not in the cache.
+func (b *bundler) get(name string, days []metadata.ProcessedDay) *cacheEntry {
+	// The cache key includes the checksums so that reprocessed days invalidate the bundle.
+	var key strings.Builder
+	key.WriteString("bundle/" + name)
+	for _, p := range days {
+		key.WriteString("/" + p.Csv.Checksum)
+	}
+	return b.cache.get(key.String(), func() ([]byte, time.Time, error) {
+		b.builds <- struct{}{}
+		defer func() { <-b.builds }()
+		return b.build(days)
+	})
+}
+
+// build assembles the bundle. The archives of the days are downloaded concurrently, subject to
+// the limit on concurrent downloads shared with projections, and written in order of day.
+func (b *bundler) build(days []metadata.ProcessedDay) ([]byte, time.Time, error) {
+	contents := make([][]byte, len(days))
+	errs := make([]error, len(days))
+	var wg sync.WaitGroup
+	for i := range days {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			contents[i], errs[i] = b.d.download(b.fetchUrl(days[i].Csv.Path))
+		}()
+	}
+	wg.Wait()
+	var out bytes.Buffer
+	tw := tar.NewWriter(&out)
+	var modTime time.Time
+	for i, p := range days {
+		content, err := contents[i], errs[i]
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to fetch %s: %w", p.Csv.Path, err)
+		}
+		if modTime.Before(p.Created) {
+			modTime = p.Created
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    fmt.Sprintf("subwaydatanyc_%s_csv.tar.xz", p.Day),
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: p.Created.Truncate(time.Second),
+		}); err != nil {
+			return nil, time.Time{}, err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, time.Time{}, err
+	}
+	return out.Bytes(), modTime, nil
+}
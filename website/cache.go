@@ -0,0 +1,106 @@
+package website
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum total size of the values kept in memory by the cache.
+	maxCacheBytes = 1 << 30
+	// How long a value is kept in memory by the cache.
+	cacheTtl = 10 * time.Minute
+)
+
+// memoryCache holds values that are expensive to build, such as assembled bundles, in memory for
+// a short time. Concurrent requests for a value that is being built wait for the same build.
+//
+// The total size of the values is bounded. When a new value doesn't fit, the values that expire
+// soonest are evicted, and values larger than the bound are not kept at all.
+type memoryCache struct {
+	maxBytes int
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	size     int
+}
+
+type cacheEntry struct {
+	ready   chan struct{}
+	b       []byte
+	modTime time.Time
+	err     error
+	expires time.Time
+}
+
+func newMemoryCache(maxBytes int) *memoryCache {
+	return &memoryCache{
+		maxBytes: maxBytes,
+		entries:  map[string]*cacheEntry{},
+	}
+}
+
+// get returns the value for the key, building it if it is not in the cache. Failed builds are
+// not cached.
+func (c *memoryCache) get(key string, build func() ([]byte, time.Time, error)) *cacheEntry {
+	now := time.Now()
+	c.mu.Lock()
+	for k, e := range c.entries {
+		if e.isReady() && now.After(e.expires) {
+			c.remove(k)
+		}
+	}
+	e, ok := c.entries[key]
+	if !ok {
+		e = &cacheEntry{ready: make(chan struct{})}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+	if !ok {
+		e.b, e.modTime, e.err = build()
+		e.expires = time.Now().Add(cacheTtl)
+		c.mu.Lock()
+		if e.err != nil || len(e.b) > c.maxBytes {
+			delete(c.entries, key)
+		} else {
+			c.size += len(e.b)
+			c.evict()
+		}
+		c.mu.Unlock()
+		close(e.ready)
+	}
+	<-e.ready
+	return e
+}
+
+// evict removes the values that expire soonest until the values fit in the bound. Values being
+// built are not counted. The mutex must be held.
+func (c *memoryCache) evict() {
+	for c.size > c.maxBytes {
+		var soonestKey string
+		var soonest *cacheEntry
+		for k, e := range c.entries {
+			if e.isReady() && (soonest == nil || e.expires.Before(soonest.expires)) {
+				soonestKey, soonest = k, e
+			}
+		}
+		if soonest == nil {
+			return
+		}
+		c.remove(soonestKey)
+	}
+}
+
+// remove removes a built value. The mutex must be held.
+func (c *memoryCache) remove(key string) {
+	c.size -= len(c.entries[key].b)
+	delete(c.entries, key)
+}
+
+func (e *cacheEntry) isReady() bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
+}
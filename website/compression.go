@@ -0,0 +1,113 @@
+package website
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Text responses smaller than this are not compressed, as the saving is not worth the CPU.
+const minCompressedSize = 1024
+
+// contentEncoding is a content coding that text responses can be compressed with.
+type contentEncoding struct {
+	name      string
+	newWriter func(w io.Writer) io.WriteCloser
+}
+
+// contentEncodings is the supported content codings, in order of server preference.
+//
+// Only responses written with writeResponse are compressed. Data downloads, bundles and
+// projections are served as is, both because the archives are already compressed and so that
+// range requests keep working.
+var contentEncodings = []contentEncoding{
+	{
+		name: "br",
+		newWriter: func(w io.Writer) io.WriteCloser {
+			return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+		},
+	},
+	{
+		name: "gzip",
+		newWriter: func(w io.Writer) io.WriteCloser {
+			return gzip.NewWriter(w)
+		},
+	},
+}
+
+// negotiateEncoding returns the content coding to compress the response with, given the
+// request's Accept-Encoding header, or nil if the response should not be compressed.
+//
+// The coding with the highest quality value is chosen, with ties broken by server preference.
+func negotiateEncoding(acceptEncoding string) *contentEncoding {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.TrimSpace(key) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				parsed = 0
+			}
+			q = parsed
+		}
+		qualities[name] = q
+	}
+	var best *contentEncoding
+	var bestQ float64
+	for i := range contentEncodings {
+		q, ok := qualities[contentEncodings[i].name]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if !ok || q <= 0 {
+			continue
+		}
+		if best == nil || q > bestQ {
+			best, bestQ = &contentEncodings[i], q
+		}
+	}
+	return best
+}
+
+// writeCompressed writes s to the response with the status code, compressed if the client
+// accepts a supported content coding. It reports whether the response was written.
+func writeCompressed(w http.ResponseWriter, r *http.Request, statusCode int, s string) (bool, error) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if len(s) < minCompressedSize {
+		return false, nil
+	}
+	e := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if e == nil {
+		return false, nil
+	}
+	w.Header().Set("Content-Encoding", e.name)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(statusCode)
+	cw := e.newWriter(w)
+	if _, err := io.Copy(cw, strings.NewReader(s)); err != nil {
+		return true, err
+	}
+	return true, cw.Close()
+}
+
+func isTextContentType(contentType string) bool {
+	switch contentType {
+	case contentTypeHtml, contentTypeCss, contentTypeJson:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,75 @@
+package website
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jamespfennell/subwaydata.nyc/metadata"
+)
+
+// apiDay is a processed day in the /api/days response.
+type apiDay struct {
+	Day         metadata.Day
+	FeedIDs     []string
+	Created     time.Time
+	Preliminary bool `json:",omitempty"`
+	NeedsReview bool `json:",omitempty"`
+	// Name of the day's CSV archive under /data/.
+	Csv string
+}
+
+// serveDays serves the processed days as JSON, in order of day. The optional from and to query
+// parameters (YYYY-MM-DD, inclusive) restrict the days returned.
+func serveDays(rw http.ResponseWriter, r *http.Request, processedDays []metadata.ProcessedDay) {
+	q := r.URL.Query()
+	var from, to *metadata.Day
+	for _, p := range []struct {
+		name string
+		day  **metadata.Day
+	}{
+		{"from", &from},
+		{"to", &to},
+	} {
+		if !q.Has(p.name) {
+			continue
+		}
+		day, err := metadata.ParseDay(q.Get(p.name))
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("the %s parameter must be a day in the format YYYY-MM-DD", p.name), http.StatusBadRequest)
+			return
+		}
+		*p.day = &day
+	}
+	days := []apiDay{}
+	for _, processedDay := range processedDays {
+		if from != nil && processedDay.Day.Before(*from) {
+			continue
+		}
+		if to != nil && to.Before(processedDay.Day) {
+			continue
+		}
+		days = append(days, apiDay{
+			Day:         processedDay.Day,
+			FeedIDs:     processedDay.Feeds,
+			Created:     processedDay.Created,
+			Preliminary: processedDay.Preliminary,
+			NeedsReview: processedDay.NeedsReview,
+			Csv:         fmt.Sprintf("subwaydatanyc_%s_csv.tar.xz", processedDay.Day),
+		})
+	}
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].Day.Before(days[j].Day)
+	})
+	b, err := json.Marshal(days)
+	if err != nil {
+		log.Printf("Failed to encode days: %s", err)
+		http.Error(rw, "failed to encode days", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Cache-Control", "public, max-age=60")
+	writeResponse(rw, r, http.StatusOK, string(b), contentTypeJson)
+}
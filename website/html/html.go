@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -82,9 +83,19 @@ type dayData struct {
 	Title      string
 	CsvUrl     string
 	CsvSize    string
+	CsvTarUrl  string
+	CsvTarSize string
 	GtfsrtUrl  string
 	GtfsrtSize string
 	Updated    string
+	Partial    bool
+	FeedCsvs   []feedCsvData
+}
+
+type feedCsvData struct {
+	Name string
+	Url  string
+	Size string
 }
 
 func ExploreTheData(m *metadata.Metadata) string {
@@ -108,13 +119,38 @@ func ExploreTheData(m *metadata.Metadata) string {
 			})
 			j += 1
 		}
+		var gtfsrtUrl string
+		if !p.GtfsrtPruned {
+			gtfsrtUrl = fmt.Sprintf("%s/%s", dataBaseUrl, p.Gtfsrt.Path)
+		}
+		var csvTarUrl, csvTarSize string
+		if p.CsvUncompressed != nil {
+			csvTarUrl = fmt.Sprintf("/data/subwaydatanyc_%s_csv.tar", p.Day)
+			csvTarSize = formatBytes(p.CsvUncompressed.Size)
+		}
+		var feedCsvs []feedCsvData
+		for _, feedCsv := range p.FeedCsv {
+			name := feedCsv.FeedID
+			if feedName, ok := m.FeedNames[feedCsv.FeedID]; ok {
+				name = feedName
+			}
+			feedCsvs = append(feedCsvs, feedCsvData{
+				Name: name,
+				Url:  fmt.Sprintf("/data/subwaydatanyc_%s_%s_csv.tar.xz", p.Day, name),
+				Size: formatBytes(feedCsv.Size),
+			})
+		}
 		year.Months[j].Days = append(year.Months[j].Days, dayData{
 			Title:      p.Day.Format("January 02, 2006"),
 			CsvUrl:     fmt.Sprintf("/data/subwaydatanyc_%s_csv.tar.xz", p.Day),
 			CsvSize:    formatBytes(p.Csv.Size),
-			GtfsrtUrl:  fmt.Sprintf("%s/%s", dataBaseUrl, p.Gtfsrt.Path),
+			CsvTarUrl:  csvTarUrl,
+			CsvTarSize: csvTarSize,
+			GtfsrtUrl:  gtfsrtUrl,
 			GtfsrtSize: formatBytes(p.Gtfsrt.Size),
 			Updated:    p.Created.Format("January 02, 2006"),
+			Partial:    p.Preliminary,
+			FeedCsvs:   feedCsvs,
 		})
 	}
 	input := struct {
@@ -131,6 +167,117 @@ func ExploreTheData(m *metadata.Metadata) string {
 	return s.String()
 }
 
+const (
+	// Number of processed days listed on the recent activity page.
+	recentActivityDays = 50
+	// Number of days in the sparkline of daily trip counts.
+	sparklineDays   = 60
+	sparklineWidth  = 240
+	sparklineHeight = 30
+)
+
+type recentDay struct {
+	Processed   string
+	Day         string
+	Feeds       string
+	Trips       string
+	Preliminary bool
+	NeedsReview bool
+}
+
+// RecentActivity renders the most recently processed days, ordered by processing time, along
+// with a sparkline of the number of trips in the most recent days.
+func RecentActivity(m *metadata.Metadata) string {
+	if m == nil {
+		m = &metadata.Metadata{}
+	}
+	processedDays := append([]metadata.ProcessedDay(nil), m.ProcessedDays...)
+	sort.SliceStable(processedDays, func(i, j int) bool {
+		return processedDays[j].Created.Before(processedDays[i].Created)
+	})
+	var days []recentDay
+	for i, p := range processedDays {
+		if i == recentActivityDays {
+			break
+		}
+		var feeds []string
+		for _, feedID := range p.Feeds {
+			if name, ok := m.FeedNames[feedID]; ok {
+				feedID = name
+			}
+			feeds = append(feeds, feedID)
+		}
+		var trips string
+		if p.ExportStats != nil {
+			trips = fmt.Sprintf("%d", p.ExportStats.TripsOut)
+		}
+		days = append(days, recentDay{
+			Processed:   p.Created.In(americaNewYork).Format("January 02, 2006 at 3:04pm"),
+			Day:         p.Day.Format("January 02, 2006"),
+			Feeds:       strings.Join(feeds, ", "),
+			Trips:       trips,
+			Preliminary: p.Preliminary,
+			NeedsReview: p.NeedsReview,
+		})
+	}
+	sparkline, numSparklineDays := tripCountSparkline(m.ProcessedDays)
+	input := struct {
+		Days            []recentDay
+		Sparkline       string
+		SparklineDays   int
+		SparklineWidth  int
+		SparklineHeight int
+		StaticFiles     static.Files
+	}{
+		Days:            days,
+		Sparkline:       sparkline,
+		SparklineDays:   numSparklineDays,
+		SparklineWidth:  sparklineWidth,
+		SparklineHeight: sparklineHeight,
+		StaticFiles:     static.Get(),
+	}
+	var s strings.Builder
+	if err := t.RecentActivity.Execute(&s, input); err != nil {
+		panic(err)
+	}
+	return s.String()
+}
+
+// tripCountSparkline returns the points of an SVG polyline of the number of trips in each of the
+// most recent days, oldest first, along with the number of days. Days without export statistics
+// are omitted. The empty string is returned if there are fewer than two points.
+func tripCountSparkline(processedDays []metadata.ProcessedDay) (string, int) {
+	var withStats []metadata.ProcessedDay
+	for _, p := range processedDays {
+		if p.ExportStats != nil {
+			withStats = append(withStats, p)
+		}
+	}
+	sort.Slice(withStats, func(i, j int) bool {
+		return withStats[i].Day.Before(withStats[j].Day)
+	})
+	if len(withStats) > sparklineDays {
+		withStats = withStats[len(withStats)-sparklineDays:]
+	}
+	if len(withStats) < 2 {
+		return "", 0
+	}
+	max := 1
+	for _, p := range withStats {
+		if p.ExportStats.TripsOut > max {
+			max = p.ExportStats.TripsOut
+		}
+	}
+	var points []string
+	for i, p := range withStats {
+		x := float64(i) * sparklineWidth / float64(len(withStats)-1)
+		// Leave a pixel at the top and bottom so the line isn't clipped.
+		y := 1 + (sparklineHeight-2)*(1-float64(p.ExportStats.TripsOut)/float64(max))
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	return strings.Join(points, " "), len(withStats)
+}
+
 func ProgrammaticAccess() string {
 	return executeStaticTemplate(t.ProgrammaticAccess)
 }
@@ -186,6 +333,7 @@ type Templates struct {
 	HowItWorks         *template.Template `html:"how-it-works.html"`
 	DataSchema         *template.Template `html:"data-schema.html"`
 	PageNotFound       *template.Template `html:"404.html"`
+	RecentActivity     *template.Template `html:"recent-activity.html"`
 }
 
 var t Templates
@@ -34,6 +34,10 @@ func TestTemplates(t *testing.T) {
 			"ExploreTheData",
 			ExploreTheData,
 		},
+		{
+			"RecentActivity",
+			RecentActivity,
+		},
 		{
 			"ProgrammaticAccess",
 			func(m *metadata.Metadata) string {
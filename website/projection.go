@@ -0,0 +1,187 @@
+package website
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jamespfennell/xz"
+)
+
+// Maximum number of archives being downloaded for projections at once.
+const maxConcurrentProjections = 2
+
+// projector serves a single table of a day's CSV archive, optionally restricted to some of its
+// columns, as a plain CSV file.
+//
+// Projections require downloading and decompressing the whole archive, so the number of
+// archives downloaded at once is capped and the archives are kept in the shared cache for a
+// short time, keyed by their path, which changes whenever the day is reprocessed. The rows of
+// the table are streamed to the response as they are decompressed.
+type projector struct {
+	d        *dynamicContent
+	builds   chan struct{}
+	cache    *memoryCache
+	fetchUrl func(path string) string
+}
+
+func newProjector(d *dynamicContent, cache *memoryCache) *projector {
+	return &projector{
+		d:        d,
+		builds:   make(chan struct{}, maxConcurrentProjections),
+		cache:    cache,
+		fetchUrl: d.dataUrl,
+	}
+}
+
+// isProjection returns whether the download request asks for a projection.
+func isProjection(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Has("table") || q.Has("columns")
+}
+
+// serve serves the projection of the archive at the path described by the request's query
+// parameters: table (trips or stop_times) and columns (a comma-separated list of column names
+// of the table, in the order they should appear).
+func (p *projector) serve(rw http.ResponseWriter, r *http.Request, name, path string) {
+	if !strings.HasSuffix(name, "_csv.tar.xz") && !strings.HasSuffix(name, "_csv.tar") {
+		http.Error(rw, "only CSV archives can be projected", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	table := q.Get("table")
+	if table != "trips" && table != "stop_times" {
+		http.Error(rw, "the table parameter must be trips or stop_times", http.StatusBadRequest)
+		return
+	}
+	var columns []string
+	if q.Get("columns") != "" {
+		columns = strings.Split(q.Get("columns"), ",")
+	}
+	if err := http.NewResponseController(rw).SetWriteDeadline(time.Now().Add(bundleWriteTimeout)); err != nil {
+		log.Printf("Failed to extend write deadline for projection of %s: %s", path, err)
+	}
+	archive := p.cache.get("archive/"+path, func() ([]byte, time.Time, error) {
+		p.builds <- struct{}{}
+		defer func() { <-p.builds }()
+		b, err := p.d.download(p.fetchUrl(path))
+		return b, time.Time{}, err
+	})
+	if archive.err != nil {
+		log.Printf("Failed to fetch %s: %s", path, archive.err)
+		http.Error(rw, "failed to project archive", http.StatusInternalServerError)
+		return
+	}
+	pr, err := newProjection(archive.b, path, table, columns)
+	if err != nil {
+		var badRequest *projectionError
+		if errors.As(err, &badRequest) {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to project %s: %s", path, err)
+		http.Error(rw, "failed to project archive", http.StatusInternalServerError)
+		return
+	}
+	fileName := strings.TrimSuffix(strings.TrimSuffix(name, ".xz"), "_csv.tar") + "_" + table + ".csv"
+	rw.Header().Set("Content-Type", "text/csv")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	rw.WriteHeader(http.StatusOK)
+	if err := pr.write(rw); err != nil {
+		// The status code has already been sent, so the response is just cut short.
+		log.Printf("Failed to write projection of %s: %s", path, err)
+	}
+}
+
+// projectionError is a projection failure caused by the request, such as an unknown column.
+type projectionError struct {
+	msg string
+}
+
+func (e *projectionError) Error() string {
+	return e.msg
+}
+
+// projection reads the rows of a table of an archive and re-encodes them with only some of the
+// columns.
+type projection struct {
+	cr      *csv.Reader
+	columns []string
+	indices []int
+}
+
+// newProjection finds the table in the archive and reads its header. If columns is empty all
+// columns are kept.
+func newProjection(archive []byte, path, table string, columns []string) (*projection, error) {
+	var r io.Reader = bytes.NewReader(archive)
+	if strings.HasSuffix(path, ".xz") {
+		r = xz.NewReader(r)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("archive %s has no %s.csv", path, table)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive %s: %w", path, err)
+		}
+		if hdr.Name == table+".csv" || strings.HasSuffix(hdr.Name, "_"+table+".csv") {
+			break
+		}
+	}
+	cr := csv.NewReader(tr)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	if len(columns) == 0 {
+		columns = header
+	}
+	nameToIndex := map[string]int{}
+	for i, name := range header {
+		nameToIndex[name] = i
+	}
+	var indices []int
+	for _, column := range columns {
+		i, ok := nameToIndex[column]
+		if !ok {
+			return nil, &projectionError{fmt.Sprintf("unknown column %q (columns: %s)", column, strings.Join(header, ","))}
+		}
+		indices = append(indices, i)
+	}
+	return &projection{cr: cr, columns: columns, indices: indices}, nil
+}
+
+// write writes the header and the rows of the projection as they are read.
+func (pr *projection) write(out io.Writer) error {
+	w := csv.NewWriter(out)
+	if err := w.Write(pr.columns); err != nil {
+		return err
+	}
+	record := make([]string, len(pr.indices))
+	for {
+		row, err := pr.cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read CSV row: %w", err)
+		}
+		for j, i := range pr.indices {
+			record[j] = row[i]
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
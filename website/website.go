@@ -1,21 +1,28 @@
 package website
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"path"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/jamespfennell/subwaydata.nyc/httpclient"
 	"github.com/jamespfennell/subwaydata.nyc/metadata"
 	"github.com/jamespfennell/subwaydata.nyc/website/html"
 	"github.com/jamespfennell/subwaydata.nyc/website/static"
 )
 
+// Maximum number of data archives being downloaded from object storage at once, across all
+// bundles and projections.
+const maxConcurrentDownloads = 8
+
 const (
 	contentTypeHtml = "text/html"
 	contentTypeCss  = "text/css"
@@ -23,47 +30,108 @@ const (
 	contentTypeJson = "application/json"
 )
 
-func Run(metadataUrl string, port int) {
-	d := newDynamicContent(metadataUrl)
+// Timeouts configures the timeouts of the HTTP server.
+//
+// Data downloads are served as redirects to object storage, so a single write
+// timeout is sufficient for most handlers. Multi-day bundles are the exception
+// and extend their own write deadline.
+type Timeouts struct {
+	ReadHeader time.Duration
+	Read       time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+}
+
+// DefaultTimeouts returns the default timeouts of the HTTP server.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		ReadHeader: 5 * time.Second,
+		Read:       10 * time.Second,
+		Write:      30 * time.Second,
+		Idle:       2 * time.Minute,
+	}
+}
+
+// Run runs the website.
+//
+// The metadata is read from the first of the metadata URLs that responds successfully;
+// the remaining URLs are mirrors used when the primary is unreachable. The paths of the data
+// in the metadata are relative to the URL it was read from. The metadata and the data in
+// multi-day bundles are fetched using the provided client.
+func Run(metadataUrls []string, port int, timeouts Timeouts, client *http.Client) {
+	d := newDynamicContent(metadataUrls, client)
 	pageNotFound := html.PageNotFound()
 	http.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
-			rw.WriteHeader(http.StatusNotFound)
-			writeResponse(rw, pageNotFound, contentTypeHtml)
+			writeResponse(rw, r, http.StatusNotFound, pageNotFound, contentTypeHtml)
 			return
 		}
-		writeResponse(rw, d.getHome(), contentTypeHtml)
+		writeResponse(rw, r, http.StatusOK, d.getHome(), contentTypeHtml)
 	})
 	http.HandleFunc("/explore-the-data", func(rw http.ResponseWriter, r *http.Request) {
-		writeResponse(rw, d.getExploreTheData(), contentTypeHtml)
+		writeResponse(rw, r, http.StatusOK, d.getExploreTheData(), contentTypeHtml)
+	})
+	http.HandleFunc("/recent-activity", func(rw http.ResponseWriter, r *http.Request) {
+		writeResponse(rw, r, http.StatusOK, d.getRecentActivity(), contentTypeHtml)
 	})
 	http.HandleFunc("/metadata.json", func(rw http.ResponseWriter, r *http.Request) {
-		writeResponse(rw, d.getMetadataJson(), contentTypeJson)
+		writeResponse(rw, r, http.StatusOK, d.getMetadataJson(), contentTypeJson)
+	})
+	// The full metadata, in the same structure as the metadata file written by the ETL pipeline.
+	http.HandleFunc("/api/metadata", func(rw http.ResponseWriter, r *http.Request) {
+		metadataJson, etag := d.getMetadataJsonWithEtag()
+		rw.Header().Set("ETag", etag)
+		rw.Header().Set("Cache-Control", "public, max-age=60")
+		if match := r.Header.Get("If-None-Match"); match != "" && match == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeResponse(rw, r, http.StatusOK, metadataJson, contentTypeJson)
+	})
+	// The processed days and their feeds, optionally restricted to a range of days.
+	http.HandleFunc("/api/days", func(rw http.ResponseWriter, r *http.Request) {
+		serveDays(rw, r, d.getProcessedDays())
 	})
 	programmaticAccess := html.ProgrammaticAccess()
 	http.HandleFunc("/programmatic-access", func(rw http.ResponseWriter, r *http.Request) {
-		writeResponse(rw, programmaticAccess, contentTypeHtml)
+		writeResponse(rw, r, http.StatusOK, programmaticAccess, contentTypeHtml)
 	})
 	dataSchema := html.DataSchema()
 	http.HandleFunc("/data-schema", func(rw http.ResponseWriter, r *http.Request) {
-		writeResponse(rw, dataSchema, contentTypeHtml)
+		writeResponse(rw, r, http.StatusOK, dataSchema, contentTypeHtml)
 	})
 	howItWorks := html.HowItWorks()
 	http.HandleFunc("/how-it-works", func(rw http.ResponseWriter, r *http.Request) {
-		writeResponse(rw, howItWorks, contentTypeHtml)
+		writeResponse(rw, r, http.StatusOK, howItWorks, contentTypeHtml)
 	})
 	http.HandleFunc("/refresh-metadata", func(rw http.ResponseWriter, r *http.Request) {
 		d.update()
 	})
+	c := newMemoryCache(maxCacheBytes)
+	http.Handle("/bundle/", newBundler(d, c))
+	projector := newProjector(d, c)
 	http.HandleFunc("/data/", func(rw http.ResponseWriter, r *http.Request) {
-		path := r.URL.Path[6:]
-		path, ok := d.getDataRedirect(path)
+		name := r.URL.Path[6:]
+		path, ok := d.getDataRedirect(name)
 		if !ok {
-			rw.WriteHeader(http.StatusNotFound)
-			writeResponse(rw, pageNotFound, contentTypeHtml)
+			// Days that were deliberately deleted are distinguished from days that never existed,
+			// so that mirrors of the data know to remove their copies.
+			if deletedDay, ok := d.getDeletedDay(name); ok {
+				msg := fmt.Sprintf("The data for %s was deleted on %s", deletedDay.Day, deletedDay.Deleted.Format("2006-01-02"))
+				if deletedDay.Reason != "" {
+					msg += ": " + deletedDay.Reason
+				}
+				http.Error(rw, msg, http.StatusGone)
+				return
+			}
+			writeResponse(rw, r, http.StatusNotFound, pageNotFound, contentTypeHtml)
 			return
 		}
-		http.Redirect(rw, r, fmt.Sprintf("https://data.subwaydata.nyc/%s", path), http.StatusFound)
+		if isProjection(r) {
+			projector.serve(rw, r, name, path)
+			return
+		}
+		http.Redirect(rw, r, d.dataUrl(path), http.StatusFound)
 	})
 
 	for _, file := range static.Get().All() {
@@ -79,31 +147,51 @@ func Run(metadataUrl string, port int) {
 			panic("unknown content type in static files")
 		}
 		http.HandleFunc(file.FullPath(), func(rw http.ResponseWriter, r *http.Request) {
-			writeResponse(rw, file.Content, contentType)
+			writeResponse(rw, r, http.StatusOK, file.Content, contentType)
 		})
 	}
 
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		ReadHeaderTimeout: timeouts.ReadHeader,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+	}
 	log.Printf("Launching HTTP server on port %d\n", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	log.Fatal(server.ListenAndServe())
 }
 
 type dynamicContent struct {
-	updateMutex sync.RWMutex
-	metadataUrl string
+	updateMutex  sync.RWMutex
+	metadataUrls []string
+	client       *http.Client
+	downloads    chan struct{}
+	// Location of the metadata file that was last read. Paths in the metadata are relative to it.
+	dataBaseUrl *url.URL
 
 	home           string
 	exploreTheData string
+	recentActivity string
 	metadataJson   string
+	metadataEtag   string
 	dataRedirects  map[string]string
+	deletedDays    map[string]metadata.DeletedDay
+	processedDays  []metadata.ProcessedDay
 }
 
-func newDynamicContent(metadataUrl string) *dynamicContent {
+func newDynamicContent(metadataUrls []string, client *http.Client) *dynamicContent {
 	d := dynamicContent{
-		metadataUrl:    metadataUrl,
+		metadataUrls:   metadataUrls,
+		client:         client,
+		downloads:      make(chan struct{}, maxConcurrentDownloads),
 		home:           html.Home(nil, nil),
 		exploreTheData: html.ExploreTheData(nil),
+		recentActivity: html.RecentActivity(nil),
 		metadataJson:   "\"failed to load metadata\"",
+		metadataEtag:   `"none"`,
 		dataRedirects:  map[string]string{},
+		deletedDays:    map[string]metadata.DeletedDay{},
 	}
 	t := time.NewTicker(500 * time.Millisecond)
 	defer t.Stop()
@@ -132,36 +220,133 @@ func newDynamicContent(metadataUrl string) *dynamicContent {
 }
 
 func (d *dynamicContent) update() error {
-	res, err := http.Get(d.metadataUrl)
-	if err != nil {
-		return err
+	var b []byte
+	var m metadata.Metadata
+	var dataBaseUrl *url.URL
+	var err error
+	for i, metadataUrl := range d.metadataUrls {
+		b, m, err = d.fetchMetadata(metadataUrl)
+		if err == nil {
+			dataBaseUrl, err = url.Parse(metadataUrl)
+		}
+		if err == nil {
+			if i > 0 {
+				log.Printf("Metadata read from mirror %s", metadataUrl)
+			}
+			break
+		}
+		log.Printf("Failed to read metadata from %s: %s", metadataUrl, err)
 	}
-	defer res.Body.Close()
-	b, err := io.ReadAll(res.Body)
 	if err != nil {
 		return err
 	}
-	var m metadata.Metadata
-	if err := json.Unmarshal(b, &m); err != nil {
-		return err
-	}
 
 	now := time.Now()
 	home := html.Home(&m, &now)
 	exploreTheData := html.ExploreTheData(&m)
+	recentActivity := html.RecentActivity(&m)
 	redirects := map[string]string{}
 	for i := range m.ProcessedDays {
 		redirects[fmt.Sprintf("subwaydatanyc_%s_csv.tar.xz", m.ProcessedDays[i].Day)] = m.ProcessedDays[i].Csv.Path
+		if csvUncompressed := m.ProcessedDays[i].CsvUncompressed; csvUncompressed != nil {
+			redirects[fmt.Sprintf("subwaydatanyc_%s_csv.tar", m.ProcessedDays[i].Day)] = csvUncompressed.Path
+		}
+		for _, feedCsv := range m.ProcessedDays[i].FeedCsv {
+			redirects[fmt.Sprintf("subwaydatanyc_%s_%s_csv.tar.xz", m.ProcessedDays[i].Day, feedCsv.FeedID)] = feedCsv.Path
+			if name, ok := m.FeedNames[feedCsv.FeedID]; ok {
+				redirects[fmt.Sprintf("subwaydatanyc_%s_%s_csv.tar.xz", m.ProcessedDays[i].Day, name)] = feedCsv.Path
+			}
+		}
+	}
+	deletedDays := map[string]metadata.DeletedDay{}
+	for _, deletedDay := range m.DeletedDays {
+		names := []string{
+			fmt.Sprintf("subwaydatanyc_%s_csv.tar.xz", deletedDay.Day),
+			fmt.Sprintf("subwaydatanyc_%s_csv.tar", deletedDay.Day),
+		}
+		for _, feedID := range deletedDay.Feeds {
+			names = append(names, fmt.Sprintf("subwaydatanyc_%s_%s_csv.tar.xz", deletedDay.Day, feedID))
+			if name, ok := m.FeedNames[feedID]; ok {
+				names = append(names, fmt.Sprintf("subwaydatanyc_%s_%s_csv.tar.xz", deletedDay.Day, name))
+			}
+		}
+		for _, name := range names {
+			deletedDays[name] = deletedDay
+		}
 	}
 	d.updateMutex.Lock()
 	defer d.updateMutex.Unlock()
 	d.home = home
 	d.exploreTheData = exploreTheData
+	d.recentActivity = recentActivity
 	d.metadataJson = string(b)
+	d.metadataEtag = fmt.Sprintf(`"%x"`, sha256.Sum256(b))
 	d.dataRedirects = redirects
+	d.deletedDays = deletedDays
+	d.processedDays = m.ProcessedDays
+	d.dataBaseUrl = dataBaseUrl
 	return nil
 }
 
+// fetchMetadata fetches the metadata from the URL. If the metadata is sharded, the shards are
+// fetched from the same location and the combined metadata is returned.
+func (d *dynamicContent) fetchMetadata(metadataUrl string) ([]byte, metadata.Metadata, error) {
+	var m metadata.Metadata
+	b, err := d.fetch(metadataUrl)
+	if err != nil {
+		return nil, m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, m, err
+	}
+	if len(m.Shards) == 0 {
+		return b, m, nil
+	}
+	base, err := url.Parse(metadataUrl)
+	if err != nil {
+		return nil, m, err
+	}
+	var shards []metadata.Metadata
+	for _, name := range m.Shards {
+		shardUrl := base.ResolveReference(&url.URL{Path: name}).String()
+		shardB, err := d.fetch(shardUrl)
+		if err != nil {
+			return nil, m, fmt.Errorf("failed to read metadata shard %s: %w", shardUrl, err)
+		}
+		var shard metadata.Metadata
+		if err := json.Unmarshal(shardB, &shard); err != nil {
+			return nil, m, fmt.Errorf("failed to parse metadata shard %s: %w", shardUrl, err)
+		}
+		shards = append(shards, shard)
+	}
+	metadata.Combine(&m, shards)
+	b, err = json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, m, err
+	}
+	return b, m, nil
+}
+
+func (d *dynamicContent) fetch(url string) ([]byte, error) {
+	return httpclient.Get(d.client, url)
+}
+
+// download fetches a data archive, waiting if the maximum number of downloads are in progress.
+func (d *dynamicContent) download(url string) ([]byte, error) {
+	d.downloads <- struct{}{}
+	defer func() { <-d.downloads }()
+	return d.fetch(url)
+}
+
+// dataUrl returns the URL of the object at the path from the metadata, which is relative to the
+// location of the metadata file it was read from. Paths are only known once the metadata has
+// been read, so the location is always set.
+func (d *dynamicContent) dataUrl(path string) string {
+	d.updateMutex.RLock()
+	defer d.updateMutex.RUnlock()
+	return d.dataBaseUrl.ResolveReference(&url.URL{Path: path}).String()
+}
+
 func (d *dynamicContent) getHome() string {
 	d.updateMutex.RLock()
 	defer d.updateMutex.RUnlock()
@@ -174,12 +359,30 @@ func (d *dynamicContent) getExploreTheData() string {
 	return d.exploreTheData
 }
 
+func (d *dynamicContent) getRecentActivity() string {
+	d.updateMutex.RLock()
+	defer d.updateMutex.RUnlock()
+	return d.recentActivity
+}
+
 func (d *dynamicContent) getMetadataJson() string {
 	d.updateMutex.RLock()
 	defer d.updateMutex.RUnlock()
 	return d.metadataJson
 }
 
+func (d *dynamicContent) getMetadataJsonWithEtag() (string, string) {
+	d.updateMutex.RLock()
+	defer d.updateMutex.RUnlock()
+	return d.metadataJson, d.metadataEtag
+}
+
+func (d *dynamicContent) getProcessedDays() []metadata.ProcessedDay {
+	d.updateMutex.RLock()
+	defer d.updateMutex.RUnlock()
+	return d.processedDays
+}
+
 func (d *dynamicContent) getDataRedirect(url string) (string, bool) {
 	d.updateMutex.RLock()
 	defer d.updateMutex.RUnlock()
@@ -187,10 +390,27 @@ func (d *dynamicContent) getDataRedirect(url string) (string, bool) {
 	return s, b
 }
 
-func writeResponse(w http.ResponseWriter, s string, contentType string) {
+func (d *dynamicContent) getDeletedDay(name string) (metadata.DeletedDay, bool) {
+	d.updateMutex.RLock()
+	defer d.updateMutex.RUnlock()
+	deletedDay, ok := d.deletedDays[name]
+	return deletedDay, ok
+}
+
+// writeResponse writes s to the response with the status code. All headers are set before the
+// status code is written, so callers must not call WriteHeader themselves.
+func writeResponse(w http.ResponseWriter, r *http.Request, statusCode int, s string, contentType string) {
 	w.Header().Set("Content-Type", contentType)
+	if isTextContentType(contentType) {
+		if ok, err := writeCompressed(w, r, statusCode, s); ok {
+			if err != nil {
+				log.Printf("Failed to write compressed response: %s\n", err)
+			}
+			return
+		}
+	}
+	w.WriteHeader(statusCode)
 	if _, err := io.Copy(w, strings.NewReader(s)); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		log.Printf("Failed to write response: %s\n", err)
 	}
 }